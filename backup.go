@@ -0,0 +1,375 @@
+package nyx
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/crazyfrankie/nyxdb/internal/kv"
+	"github.com/crazyfrankie/nyxdb/internal/util"
+)
+
+const (
+	// backupMagic starts every backup, "NYXB".
+	backupMagic   uint32 = 0x4e595842
+	backupVersion uint32 = 1
+
+	// backupRecordOverhead bounds the bytes the tags and varints of a record
+	// add to its key and value. Records bigger than the largest entry the DB
+	// accepts plus this are rejected before they are read, so that a corrupt
+	// length doesn't allocate the memory of the machine.
+	backupRecordOverhead = 64
+)
+
+// The fields of a backup record. A record is encoded like a protocol buffer
+// message: each field is a varint tag, field<<3 | wire type, followed by a
+// varint or by a length prefixed byte string. Fields Load doesn't know are
+// skipped, so records can gain fields without a new backup version.
+const (
+	fieldKey       = 1 // bytes
+	fieldVersion   = 2 // varint
+	fieldValue     = 3 // bytes
+	fieldUserMeta  = 4 // varint
+	fieldExpiresAt = 5 // varint
+	fieldKind      = 6 // varint
+
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// The kinds of backup records.
+const (
+	recordSet         = 0
+	recordDelete      = 1
+	recordRangeDelete = 2 // key is the start of the range, value its end
+)
+
+// backupRecord is a key version, or a range tombstone, in a backup.
+type backupRecord struct {
+	key       []byte
+	version   uint64
+	value     []byte
+	userMeta  byte
+	expiresAt uint64
+	kind      uint64
+}
+
+// encode appends r, as a length prefixed and checksummed record, to buf:
+// len(varint) | crc32(4) | fields
+func (r *backupRecord) encode(buf []byte) []byte {
+	var payload []byte
+	payload = appendBytesField(payload, fieldKey, r.key)
+	payload = appendVarintField(payload, fieldVersion, r.version)
+	if len(r.value) > 0 {
+		payload = appendBytesField(payload, fieldValue, r.value)
+	}
+	if r.userMeta != 0 {
+		payload = appendVarintField(payload, fieldUserMeta, uint64(r.userMeta))
+	}
+	if r.expiresAt != 0 {
+		payload = appendVarintField(payload, fieldExpiresAt, r.expiresAt)
+	}
+	if r.kind != recordSet {
+		payload = appendVarintField(payload, fieldKind, r.kind)
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(payload)))
+	buf = binary.BigEndian.AppendUint32(buf, crc32.Checksum(payload, castagnoli))
+	return append(buf, payload...)
+}
+
+func appendVarintField(buf []byte, field int, v uint64) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field<<3|wireVarint))
+	return binary.AppendUvarint(buf, v)
+}
+
+func appendBytesField(buf []byte, field int, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field<<3|wireBytes))
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// decode decodes the fields of a record from payload. The key and the value
+// alias payload.
+func (r *backupRecord) decode(payload []byte) error {
+	*r = backupRecord{}
+	for len(payload) > 0 {
+		tag, n := binary.Uvarint(payload)
+		if n <= 0 {
+			return fmt.Errorf("%w: bad field tag", ErrInvalidBackup)
+		}
+		payload = payload[n:]
+		var v uint64
+		var b []byte
+		switch tag & 7 {
+		case wireVarint:
+			if v, n = binary.Uvarint(payload); n <= 0 {
+				return fmt.Errorf("%w: bad varint in field %d", ErrInvalidBackup, tag>>3)
+			}
+			payload = payload[n:]
+		case wireBytes:
+			l, n := binary.Uvarint(payload)
+			if n <= 0 || l > uint64(len(payload)-n) {
+				return fmt.Errorf("%w: bad length of field %d", ErrInvalidBackup, tag>>3)
+			}
+			b, payload = payload[n:n+int(l)], payload[n+int(l):]
+		default:
+			return fmt.Errorf("%w: unknown wire type %d", ErrInvalidBackup, tag&7)
+		}
+
+		switch tag >> 3 {
+		case fieldKey:
+			r.key = b
+		case fieldVersion:
+			r.version = v
+		case fieldValue:
+			r.value = b
+		case fieldUserMeta:
+			r.userMeta = byte(v)
+		case fieldExpiresAt:
+			r.expiresAt = v
+		case fieldKind:
+			r.kind = v
+		}
+	}
+	if len(r.key) == 0 || r.version == 0 {
+		return fmt.Errorf("%w: record without key or version", ErrInvalidBackup)
+	}
+	if r.kind > recordRangeDelete {
+		return fmt.Errorf("%w: unknown record kind %d", ErrInvalidBackup, r.kind)
+	}
+
+	return nil
+}
+
+// Backup writes to w every version of the keys newer than since, the deletes
+// and the range deletes included, as of the moment it's called. It returns the
+// version the backup is complete up to, its read timestamp, or since if that
+// is newer. Passing it as since to the next Backup writes an incremental
+// backup, that Load applies on top of the previous ones. A since of 0 backs
+// everything up.
+//
+// Once no transaction reads below a delete, compaction drops it along with
+// the versions it deletes. An incremental backup can't carry such a delete,
+// and the key would come back when the backups are loaded: Backup returns
+// ErrInvalidRequest, without writing anything, if a delete newer than since
+// was dropped. A full backup is needed then.
+//
+// The backup starts with a header, magic(4) | version(4) | since(8), followed
+// by one checksummed record per key version.
+func (d *DB) Backup(w io.Writer, since uint64) (uint64, error) {
+	if d.isClosed.Load() {
+		return 0, ErrDBClosed
+	}
+	readTs := d.orc.readTs()
+	it := d.newIterator(readTs, IteratorOptions{AllVersions: true})
+	defer func() {
+		it.Close()
+		d.orc.readMark.Done(readTs)
+	}()
+	// The deletes dropped from now on are still in the tables the iterator
+	// holds on to.
+	if dropped := d.manifest.deletesDroppedAt(); since > 0 && dropped > since {
+		return 0, fmt.Errorf("%w: compaction dropped deletes up to version %d, after %d, take a full backup",
+			ErrInvalidRequest, dropped, since)
+	}
+
+	bw := bufio.NewWriter(w)
+	var buf []byte
+	buf = binary.BigEndian.AppendUint32(buf, backupMagic)
+	buf = binary.BigEndian.AppendUint32(buf, backupVersion)
+	buf = binary.BigEndian.AppendUint64(buf, since)
+	if _, err := bw.Write(buf); err != nil {
+		return 0, err
+	}
+
+	maxVersion := since
+	write := func(r *backupRecord) error {
+		maxVersion = max(maxVersion, r.version)
+		buf = r.encode(buf[:0])
+		_, err := bw.Write(buf)
+		return err
+	}
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if item.Version() <= since {
+			continue
+		}
+		r := &backupRecord{
+			key:       item.Key(),
+			version:   item.Version(),
+			userMeta:  item.vs.UserMeta,
+			expiresAt: item.ExpiresAt(),
+		}
+		if item.IsDeleted() {
+			r.kind = recordDelete
+		} else {
+			val, err := item.readValue()
+			if err != nil {
+				return 0, fmt.Errorf("while reading value of key %q: %w", item.Key(), err)
+			}
+			r.value = val
+		}
+		if err := write(r); err != nil {
+			return 0, err
+		}
+	}
+	if err := it.Err(); err != nil {
+		// The backup would end early.
+		return 0, fmt.Errorf("while reading the tables: %w", err)
+	}
+	for _, rt := range it.tombs {
+		if rt.Version <= since {
+			continue
+		}
+		r := &backupRecord{key: rt.Start, version: rt.Version, value: rt.End, kind: recordRangeDelete}
+		if err := write(r); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	return max(maxVersion, readTs), nil
+}
+
+// Load restores a backup written by Backup. The key versions are written with
+// the versions they had in the backed up DB, in batches, so Load should run
+// while nothing else writes to the DB. Reads started after Load returns see
+// all the data.
+//
+// The versions of the backup can't interleave with those already in the DB:
+// a full backup is loaded into an empty DB, and each incremental backup on
+// top of the one it was taken after. Load returns ErrInvalidRequest, without
+// writing anything, if the DB already holds versions newer than those the
+// backup starts after.
+func (d *DB) Load(r io.Reader) error {
+	if d.isClosed.Load() {
+		return ErrDBClosed
+	}
+	br := bufio.NewReader(r)
+	var header [16]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return fmt.Errorf("%w: while reading header: %w", ErrInvalidBackup, err)
+	}
+	if binary.BigEndian.Uint32(header[0:4]) != backupMagic {
+		return fmt.Errorf("%w: bad magic", ErrInvalidBackup)
+	}
+	if version := binary.BigEndian.Uint32(header[4:8]); version != backupVersion {
+		return fmt.Errorf("%w: unsupported version %d (we support %d)", ErrInvalidBackup, version, backupVersion)
+	}
+	since := binary.BigEndian.Uint64(header[8:16])
+	d.orc.Lock()
+	last := d.orc.nextTxnTs - 1
+	d.orc.Unlock()
+	if last > since {
+		return fmt.Errorf("%w: the backup holds versions after %d, the DB already has versions up to %d",
+			ErrInvalidRequest, since, last)
+	}
+
+	var (
+		entries    []*entry
+		size       int64
+		maxVersion uint64
+	)
+	flush := func() error {
+		if len(entries) == 0 {
+			return nil
+		}
+		err := d.loadEntries(entries, maxVersion)
+		entries, size, maxVersion = nil, 0, 0
+		return err
+	}
+	for {
+		length, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: bad record length: %w", ErrInvalidBackup, err)
+		}
+		if length > uint64(d.opt.maxBatchSize+backupRecordOverhead) {
+			return fmt.Errorf("%w: record of %d bytes is too big", ErrInvalidBackup, length)
+		}
+		buf := make([]byte, 4+length)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return fmt.Errorf("%w: truncated record: %w", ErrInvalidBackup, err)
+		}
+		payload := buf[4:]
+		if crc32.Checksum(payload, castagnoli) != binary.BigEndian.Uint32(buf) {
+			return fmt.Errorf("%w: checksum mismatch", ErrInvalidBackup)
+		}
+		var rec backupRecord
+		if err := rec.decode(payload); err != nil {
+			return err
+		}
+		if rec.version <= since {
+			return fmt.Errorf("%w: record of version %d in a backup after %d", ErrInvalidBackup, rec.version, since)
+		}
+
+		v := kv.Value{UserMeta: rec.userMeta, ExpiresAt: rec.expiresAt, Value: rec.value}
+		switch rec.kind {
+		case recordDelete:
+			v.Meta = kv.BitDelete
+		case recordRangeDelete:
+			v.Meta = kv.BitRangeDelete
+		}
+		e := &entry{key: util.KeyWithTs(rec.key, rec.version), value: v}
+		if err := d.checkEntrySize(rec.key, v); err != nil {
+			return err
+		}
+		esize := d.storedSize(rec.key, v)
+		if int64(len(entries)) >= d.opt.maxBatchCount || size+esize > d.opt.maxBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		entries = append(entries, e)
+		size += esize
+		maxVersion = max(maxVersion, rec.version)
+	}
+
+	return flush()
+}
+
+// loadEntries writes entries, whose keys carry their own versions, the newest
+// of which is maxVersion. Commits from then on get newer versions.
+func (d *DB) loadEntries(entries []*entry, maxVersion uint64) error {
+	orc := d.orc
+	orc.writeChLock.Lock()
+	orc.Lock()
+	if orc.failErr != nil {
+		err := orc.failErr
+		orc.Unlock()
+		orc.writeChLock.Unlock()
+		return fmt.Errorf("cannot load backup after a failed write: %w", err)
+	}
+	if maxVersion >= orc.nextTxnTs {
+		orc.nextTxnTs = maxVersion + 1
+	}
+	// The batches of a backup aren't ordered by version. The entries are
+	// marked as the newest commit so far, so that the commit mark never goes
+	// back and reads started from now on wait until they're written.
+	mark := orc.nextTxnTs - 1
+	orc.txnMark.Begin(mark)
+	orc.Unlock()
+
+	req, err := d.sendToWriteCh(entries)
+	orc.writeChLock.Unlock()
+	if err != nil {
+		// Nothing was written.
+		orc.doneCommit(mark)
+		return fmt.Errorf("while loading backup: %w", err)
+	}
+	if err := req.Wait(); err != nil {
+		// The entries may be partly written, like those of a failed commit.
+		orc.fail(err)
+		return fmt.Errorf("while loading backup: %w", err)
+	}
+	orc.doneCommit(mark)
+
+	return nil
+}
@@ -0,0 +1,247 @@
+package nyx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crazyfrankie/nyxdb/internal/kv"
+	"github.com/crazyfrankie/nyxdb/table"
+)
+
+// dumpVersions returns all the versions of the keys in db, as key@version=value.
+func dumpVersions(t *testing.T, db *DB) []string {
+	t.Helper()
+	it, err := db.NewIterator(IteratorOptions{AllVersions: true})
+	require.NoError(t, err)
+	defer it.Close()
+
+	var versions []string
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		val, err := item.ValueCopy(nil)
+		require.NoError(t, err)
+		if item.IsDeleted() {
+			val = []byte("<deleted>")
+		}
+		versions = append(versions, fmt.Sprintf("%s@%d=%s", item.Key(), item.Version(), val))
+	}
+	return versions
+}
+
+func TestBackupLoad(t *testing.T) {
+	opts := []Option{WithMemTableSize(64 << 10), WithValueThreshold(64)}
+	db := openTestDB(t, t.TempDir(), opts...)
+	defer db.Close()
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%04d", i)) }
+	bigValue := bytes.Repeat([]byte("v"), 100)
+
+	for i := 0; i < 1000; i++ {
+		val := []byte(fmt.Sprintf("val%d", i))
+		if i%10 == 0 {
+			val = bigValue
+		}
+		require.NoError(t, db.Put(key(i), val))
+	}
+	var full bytes.Buffer
+	since, err := db.Backup(&full, 0)
+	require.NoError(t, err)
+	require.Equal(t, db.maxVersion(), since)
+
+	// The increments carry the overwrites, the deletes and the range deletes.
+	var increments []*bytes.Buffer
+	for round := 0; round < 2; round++ {
+		for i := round; i < 1000; i += 7 {
+			require.NoError(t, db.Put(key(i), []byte(fmt.Sprintf("round%d", round))))
+		}
+		require.NoError(t, db.Delete(key(500+round)))
+		require.NoError(t, db.DeleteRange(key(100*round+10), key(100*round+50)))
+
+		var inc bytes.Buffer
+		next, err := db.Backup(&inc, since)
+		require.NoError(t, err)
+		require.Greater(t, next, since)
+		since = next
+		increments = append(increments, &inc)
+	}
+	var empty bytes.Buffer
+	next, err := db.Backup(&empty, since)
+	require.NoError(t, err)
+	require.Equal(t, since, next)
+
+	restored := openTestDB(t, t.TempDir(), opts...)
+	defer restored.Close()
+	require.NoError(t, restored.Load(&full))
+	for _, inc := range increments {
+		require.NoError(t, restored.Load(inc))
+	}
+	require.NoError(t, restored.Load(&empty))
+	require.Equal(t, dumpVersions(t, db), dumpVersions(t, restored))
+
+	_, err = restored.Get(key(20))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = restored.Get(key(501))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	val, err := restored.Get(key(990))
+	require.NoError(t, err)
+	require.Equal(t, bigValue, val)
+
+	// Commits after the load get versions newer than the loaded ones.
+	require.NoError(t, restored.Update(func(txn *Txn) error {
+		require.GreaterOrEqual(t, txn.ReadTs(), since)
+		return txn.Set(key(1), []byte("after"))
+	}))
+	val, err = restored.Get(key(1))
+	require.NoError(t, err)
+	require.Equal(t, []byte("after"), val)
+}
+
+func TestLoadInvalid(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")))
+	}
+	var buf bytes.Buffer
+	_, err := db.Backup(&buf, 0)
+	require.NoError(t, err)
+	backup := buf.Bytes()
+
+	restored := openTestDB(t, t.TempDir())
+	defer restored.Close()
+	corrupt := bytes.Clone(backup)
+	corrupt[len(corrupt)-1] ^= 0xff
+	require.ErrorIs(t, restored.Load(bytes.NewReader(corrupt)), ErrInvalidBackup)
+	require.ErrorIs(t, restored.Load(bytes.NewReader(backup[:len(backup)-3])), ErrInvalidBackup)
+	require.ErrorIs(t, restored.Load(bytes.NewReader([]byte("not a backup"))), ErrInvalidBackup)
+	// A corrupt length is rejected before the record is read.
+	huge := binary.AppendUvarint(bytes.Clone(backup[:16]), 1<<30)
+	err = restored.Load(bytes.NewReader(huge))
+	require.ErrorIs(t, err, ErrInvalidBackup)
+	require.ErrorContains(t, err, "too big")
+
+	require.NoError(t, restored.Load(bytes.NewReader(backup)))
+	require.Equal(t, dumpVersions(t, db), dumpVersions(t, restored))
+}
+
+func TestLoadLargestEntry(t *testing.T) {
+	opts := []Option{WithValueThreshold(1 << 20)}
+	db := openTestDB(t, t.TempDir(), opts...)
+	defer db.Close()
+
+	// The largest value Put takes is loaded as well.
+	key := []byte("key")
+	n := sort.Search(1<<20, func(n int) bool {
+		return db.checkEntrySize(key, kv.Value{Value: make([]byte, n+1)}) != nil
+	})
+	require.NoError(t, db.Put(key, make([]byte, n)))
+	var buf bytes.Buffer
+	_, err := db.Backup(&buf, 0)
+	require.NoError(t, err)
+
+	restored := openTestDB(t, t.TempDir(), opts...)
+	defer restored.Close()
+	require.NoError(t, restored.Load(&buf))
+	val, err := restored.Get(key)
+	require.NoError(t, err)
+	require.Len(t, val, n)
+}
+
+func TestLoadRejectsOlderVersions(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	defer db.Close()
+	require.NoError(t, db.Put([]byte("key"), []byte("v1")))
+	var full bytes.Buffer
+	since, err := db.Backup(&full, 0)
+	require.NoError(t, err)
+	require.NoError(t, db.Put([]byte("key"), []byte("v2")))
+	var inc bytes.Buffer
+	_, err = db.Backup(&inc, since)
+	require.NoError(t, err)
+
+	// A DB with versions of its own only takes a backup taken after them.
+	other := openTestDB(t, t.TempDir())
+	defer other.Close()
+	require.NoError(t, other.Put([]byte("other"), []byte("value")))
+	require.ErrorIs(t, other.Load(bytes.NewReader(full.Bytes())), ErrInvalidRequest)
+	_, err = other.Get([]byte("key"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+
+	restored := openTestDB(t, t.TempDir())
+	defer restored.Close()
+	require.NoError(t, restored.Load(bytes.NewReader(full.Bytes())))
+	require.ErrorIs(t, restored.Load(bytes.NewReader(full.Bytes())), ErrInvalidRequest)
+	require.NoError(t, restored.Load(bytes.NewReader(inc.Bytes())))
+	require.ErrorIs(t, restored.Load(bytes.NewReader(inc.Bytes())), ErrInvalidRequest)
+	require.Equal(t, dumpVersions(t, db), dumpVersions(t, restored))
+}
+
+func TestIncrementalBackupAfterDroppedDeletes(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	require.NoError(t, db.Put([]byte("key"), []byte("value")))
+	var full bytes.Buffer
+	since, err := db.Backup(&full, 0)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	db = openTestDB(t, dir)
+	require.NoError(t, db.Delete([]byte("key")))
+	require.NoError(t, db.Close())
+
+	// Both level 0 tables are merged into the last level, which drops the
+	// delete together with the value.
+	db = openTestDB(t, dir)
+	require.NoError(t, db.lc.doCompact(0, compactionPriority{level: 0}))
+	require.Empty(t, dumpVersions(t, db))
+	require.NoError(t, db.Close())
+
+	// The increment couldn't carry the delete, even after a reopen.
+	db = openTestDB(t, dir)
+	defer db.Close()
+	var inc bytes.Buffer
+	_, err = db.Backup(&inc, since)
+	require.ErrorIs(t, err, ErrInvalidRequest)
+
+	// A full backup has no deleted key, and the next increment works again.
+	full.Reset()
+	since, err = db.Backup(&full, 0)
+	require.NoError(t, err)
+	require.NoError(t, db.Put([]byte("other"), []byte("value")))
+	inc.Reset()
+	_, err = db.Backup(&inc, since)
+	require.NoError(t, err)
+
+	restored := openTestDB(t, t.TempDir())
+	defer restored.Close()
+	require.NoError(t, restored.Load(&full))
+	require.NoError(t, restored.Load(&inc))
+	_, err = restored.Get([]byte("key"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	val, err := restored.Get([]byte("other"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+}
+
+func TestBackupFailsOnCorruptTable(t *testing.T) {
+	dir := t.TempDir()
+	opts := append(compactionTestOptions(), WithBaseLevelSize(16<<20))
+	db := openTestDB(t, dir, opts...)
+	var entries []testEntry
+	for i := 0; i < 500; i++ {
+		entries = append(entries, testEntry{fmt.Sprintf("key%03d", i), 1, "value"})
+	}
+	addTestTable(t, db, 1, entries...)
+	require.NoError(t, db.Close())
+
+	db = openTestDB(t, dir, opts...)
+	defer db.Close()
+	corruptFile(t, db.lc.levels[1].tables[0].Filename(), db.lc.levels[1].tables[0].Size()/3)
+	var buf bytes.Buffer
+	_, err := db.Backup(&buf, 0)
+	require.ErrorIs(t, err, table.ErrChecksumMismatch)
+}
@@ -0,0 +1,66 @@
+package nyx
+
+import (
+	"time"
+
+	"github.com/crazyfrankie/nyxdb/internal/kv"
+)
+
+// WriteBatch groups writes that are committed together, without the conflict
+// detection of a transaction. All the writes of a batch become visible
+// atomically, and they're written to the logs along with those of concurrent
+// transactions and batches.
+//
+// A batch is limited to the size of a transaction, its methods return
+// ErrTxnTooBig once it is full instead of splitting it. A WriteBatch is not
+// safe for concurrent use.
+type WriteBatch struct {
+	txn *Txn
+}
+
+// NewWriteBatch creates a new WriteBatch. Cancel or Flush must be called once
+// it's no longer needed.
+func (d *DB) NewWriteBatch() *WriteBatch {
+	txn := &Txn{
+		update:        true,
+		db:            d,
+		readTs:        d.orc.batchReadTs(),
+		conflictKeys:  make(map[uint64]struct{}),
+		pendingWrites: make(map[string]kv.Value),
+	}
+
+	return &WriteBatch{txn: txn}
+}
+
+// Set adds a key-value pair to the batch. The batch keeps a reference to the
+// key and val byte slices, they must not be modified until it is flushed.
+func (wb *WriteBatch) Set(key, val []byte) error {
+	return wb.txn.Set(key, val)
+}
+
+// SetWithTTL adds a key-value pair to the batch, which expires after ttl.
+func (wb *WriteBatch) SetWithTTL(key, val []byte, ttl time.Duration) error {
+	return wb.txn.SetWithTTL(key, val, ttl)
+}
+
+// Delete adds the deletion of key to the batch.
+func (wb *WriteBatch) Delete(key []byte) error {
+	return wb.txn.Delete(key)
+}
+
+// DeleteRange adds the deletion of all the keys in [start, end) to the batch.
+// The writes of the batch itself are not deleted by it, whatever their order.
+func (wb *WriteBatch) DeleteRange(start, end []byte) error {
+	return wb.txn.deleteRange(start, end)
+}
+
+// Flush commits the writes of the batch and waits until they are written.
+// The batch can't be used afterward.
+func (wb *WriteBatch) Flush() error {
+	return wb.txn.Commit()
+}
+
+// Cancel drops the writes of the batch, if it wasn't flushed yet.
+func (wb *WriteBatch) Cancel() {
+	wb.txn.Discard()
+}
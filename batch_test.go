@@ -0,0 +1,145 @@
+package nyx
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteBatch(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+
+	require.NoError(t, db.Put([]byte("key0"), []byte("old")))
+	wb := db.NewWriteBatch()
+	for i := 1; i < 100; i++ {
+		require.NoError(t, wb.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))))
+	}
+	require.NoError(t, wb.Delete([]byte("key0")))
+
+	// Nothing is visible before the batch is flushed.
+	val, err := db.Get([]byte("key0"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("old"), val)
+	_, err = db.Get([]byte("key1"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	require.NoError(t, wb.Flush())
+	require.ErrorIs(t, wb.Flush(), ErrDiscardedTxn)
+
+	canceled := db.NewWriteBatch()
+	require.NoError(t, canceled.Set([]byte("canceled"), []byte("value")))
+	canceled.Cancel()
+	require.ErrorIs(t, canceled.Flush(), ErrDiscardedTxn)
+	require.NoError(t, db.Close())
+
+	db = openTestDB(t, dir)
+	defer db.Close()
+	_, err = db.Get([]byte("key0"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = db.Get([]byte("canceled"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	for i := 1; i < 100; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("key%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("value%d", i), string(val))
+	}
+}
+
+func TestWriteBatchTooBig(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), WithMemTableSize(16<<10))
+	defer db.Close()
+
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	var err error
+	var n int
+	for ; err == nil; n++ {
+		err = wb.Set([]byte(fmt.Sprintf("key%04d", n)), make([]byte, 10))
+	}
+	require.ErrorIs(t, err, ErrTxnTooBig)
+	require.Less(t, int64(n), db.opt.maxBatchCount)
+
+	// The batch isn't split, what was added before still goes as a whole.
+	require.NoError(t, wb.Flush())
+	for i := 0; i < n-1; i++ {
+		_, err := db.Get([]byte(fmt.Sprintf("key%04d", i)))
+		require.NoError(t, err)
+	}
+}
+
+func TestWriteBatchAdvancesReadMark(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	defer db.Close()
+
+	// Without any read, the versions overwritten by batches can still be
+	// discarded by compaction.
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Put([]byte("key"), []byte(fmt.Sprintf("value%d", i))))
+	}
+	require.Equal(t, uint64(99), db.orc.discardAtOrBelow())
+
+	// A pending batch holds the read mark back until it's done.
+	wb := db.NewWriteBatch()
+	require.NoError(t, db.Put([]byte("key"), []byte("value")))
+	require.Equal(t, uint64(99), db.orc.discardAtOrBelow())
+	wb.Cancel()
+	require.Equal(t, uint64(100), db.orc.discardAtOrBelow())
+}
+
+func TestGroupCommit(t *testing.T) {
+	dir := t.TempDir()
+	opts := []Option{WithSyncWrites(true), WithValueThreshold(64), WithMemTableSize(64 << 10)}
+	db := openTestDB(t, dir, opts...)
+
+	const writers, n = 20, 50
+	key := func(w, i int) []byte { return []byte(fmt.Sprintf("key%02d-%02d", w, i)) }
+	value := func(w, i int) []byte { return []byte(fmt.Sprintf("%0100d", w*n+i)) }
+
+	// Hold the writer up, the requests sent meanwhile are written together.
+	db.writeLock.Lock()
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			require.NoError(t, db.Put(key(w, 0), value(w, 0)))
+		}(w)
+	}
+	time.Sleep(100 * time.Millisecond)
+	db.writeLock.Unlock()
+	wg.Wait()
+	m := db.Metrics()
+	require.Equal(t, uint64(writers), m.WriteRequests)
+	require.LessOrEqual(t, m.WriteGroups, uint64(2))
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 1; i < n; i++ {
+				if i%2 == 0 {
+					require.NoError(t, db.Put(key(w, i), value(w, i)))
+					continue
+				}
+				wb := db.NewWriteBatch()
+				require.NoError(t, wb.Set(key(w, i), value(w, i)))
+				require.NoError(t, wb.Flush())
+			}
+		}(w)
+	}
+	wg.Wait()
+	require.NoError(t, db.Close())
+
+	db = openTestDB(t, dir, opts...)
+	defer db.Close()
+	for w := 0; w < writers; w++ {
+		for i := 0; i < n; i++ {
+			val, err := db.Get(key(w, i))
+			require.NoError(t, err)
+			require.Equal(t, value(w, i), val)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package nyx
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+
+	"github.com/crazyfrankie/nyxdb/table"
+)
+
+// Checkpoint writes a consistent copy of the DB to dir, which must not exist
+// yet, that can be opened as a database of its own. The memtable is flushed
+// first, then the tables and the value log files are hard linked into dir, so
+// a checkpoint is cheap as long as dir is on the same file system. Files that
+// can't be linked are copied.
+//
+// The checkpoint holds every write that completed before Checkpoint was
+// called. Writes go on meanwhile, flushes and compactions only wait while the
+// tables are linked. An encrypted checkpoint is opened with the same
+// encryption key.
+func (d *DB) Checkpoint(dir string) error {
+	if d.isClosed.Load() {
+		return ErrDBClosed
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return fmt.Errorf("while creating checkpoint directory: %w", err)
+	}
+	if err := d.checkpoint(dir); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("while writing checkpoint to %q: %w", dir, err)
+	}
+
+	return nil
+}
+
+func (d *DB) checkpoint(dir string) error {
+	// Value log files rewritten by GC are kept until the checkpoint is done.
+	d.vlog.incrReaders()
+	defer d.vlog.decrReaders()
+
+	d.writeLock.Lock()
+	if !d.mm.empty() {
+		if err := d.retryNoRoom(d.rotateMemTable); err != nil {
+			d.writeLock.Unlock()
+			return err
+		}
+	}
+	d.lock.RLock()
+	var flushed *memTable
+	if len(d.imm) > 0 {
+		flushed = d.imm[len(d.imm)-1]
+	}
+	d.lock.RUnlock()
+	d.writeLock.Unlock()
+
+	if err := d.waitForFlush(flushed); err != nil {
+		return err
+	}
+
+	// The value log files are captured once the table set is fixed, so the
+	// tables linked only point into bytes that are copied. Flushes and GC may
+	// add tables pointing further until then.
+	d.writeLock.Lock()
+	d.manifest.appendLock.Lock()
+	fids, writeAt := d.vlog.files()
+	d.writeLock.Unlock()
+	err := d.manifest.checkpoint(dir, d.opt.Dir)
+	d.manifest.appendLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := d.vlog.checkpoint(dir, fids, writeAt); err != nil {
+		return err
+	}
+	// The registry goes last, it must hold the data keys of all the files.
+	if err := d.registry.checkpoint(dir); err != nil {
+		return err
+	}
+
+	return z.SyncDir(dir)
+}
+
+// waitForFlush waits until mt, if set, has been flushed to level 0.
+func (d *DB) waitForFlush(mt *memTable) error {
+	for mt != nil {
+		if d.isClosed.Load() {
+			return ErrDBClosed
+		}
+		d.lock.RLock()
+		pending, err := slices.Contains(d.imm, mt), d.flushErr
+		d.lock.RUnlock()
+		if err != nil {
+			return err
+		}
+		if !pending {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return nil
+}
+
+// checkpoint links the tables in tableDir listed in the manifest into dir, and
+// writes a manifest listing them there. The manifest is written anew instead
+// of being linked, as more changes are appended to it. Must be called with
+// appendLock held, which keeps flushes and compactions from dropping the
+// tables meanwhile.
+func (mf *manifestFile) checkpoint(dir, tableDir string) error {
+	for id := range mf.manifest.tables {
+		if err := linkOrCopy(table.NewFilename(id, tableDir), table.NewFilename(id, dir)); err != nil {
+			return fmt.Errorf("while linking table %d: %w", id, err)
+		}
+	}
+	m := mf.manifest.clone()
+	fp, _, err := helpRewrite(dir, &m)
+	if err != nil {
+		return err
+	}
+
+	return fp.Close()
+}
+
+// files returns the fids of the value log files in ascending order, and the
+// offset the newest of them is written up to. Must be called with
+// DB.writeLock held.
+func (vlog *valueLog) files() ([]uint32, uint32) {
+	vlog.filesLock.RLock()
+	defer vlog.filesLock.RUnlock()
+
+	fids := make([]uint32, 0, len(vlog.filesMap))
+	for fid := range vlog.filesMap {
+		fids = append(fids, fid)
+	}
+	slices.Sort(fids)
+	var writeAt uint32
+	if lf := vlog.filesMap[vlog.maxFid]; lf != nil {
+		writeAt = lf.writeAt
+	}
+
+	return fids, writeAt
+}
+
+// checkpoint links the value log files with fids into dir. The newest one is
+// still written to, so the writeAt bytes written to it are copied instead.
+func (vlog *valueLog) checkpoint(dir string, fids []uint32, writeAt uint32) error {
+	for i, fid := range fids {
+		src, dst := vlogFilePath(vlog.dirPath, fid), vlogFilePath(dir, fid)
+		var err error
+		if i < len(fids)-1 {
+			err = linkOrCopy(src, dst)
+		} else {
+			err = copyFile(src, dst, int64(writeAt))
+		}
+		if err != nil {
+			return fmt.Errorf("while linking value log file %d: %w", fid, err)
+		}
+	}
+
+	return nil
+}
+
+// checkpoint copies the registry file into dir, if there is one.
+func (kr *keyRegistry) checkpoint(dir string) error {
+	if kr == nil || kr.fp == nil {
+		return nil
+	}
+	kr.RLock()
+	defer kr.RUnlock()
+
+	return copyFile(filepath.Join(kr.dir, KeyRegistryFilename), filepath.Join(dir, KeyRegistryFilename), -1)
+}
+
+// linkOrCopy hard links src to dst, or copies it if it can't be linked, e.g.
+// as dst is on another file system.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(src, dst, -1)
+}
+
+// copyFile copies the first n bytes of src, or all of it if n is negative, to
+// a new file dst and syncs it.
+func copyFile(src, dst string, n int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if n < 0 {
+		_, err = io.Copy(out, in)
+	} else {
+		_, err = io.CopyN(out, in, n)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,86 @@
+package nyx
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpoint(t *testing.T) {
+	opts := []Option{
+		WithMemTableSize(64 << 10),
+		WithValueThreshold(64),
+		WithValueLogFileSize(1 << 20),
+		WithEncryptionKey(bytes.Repeat([]byte("k"), 32)),
+	}
+	db := openTestDB(t, t.TempDir(), opts...)
+	defer db.Close()
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+	value := func(i int) []byte { return bytes.Repeat([]byte{byte(i)}, 10+i%200) }
+
+	for i := 0; i < 5000; i++ {
+		require.NoError(t, db.Put(key(i), value(i)))
+	}
+	require.NoError(t, db.DeleteRange(key(100), key(200)))
+
+	// The source keeps writing while the checkpoint is taken.
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	var putErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 5000; !stop.Load() && putErr == nil; i++ {
+			putErr = db.Put(key(i), value(i))
+		}
+	}()
+
+	dir := filepath.Join(t.TempDir(), "checkpoint")
+	require.NoError(t, db.Checkpoint(dir))
+	require.Error(t, db.Checkpoint(dir))
+	stop.Store(true)
+	wg.Wait()
+	require.NoError(t, putErr)
+
+	cp := openTestDB(t, dir, opts...)
+	defer cp.Close()
+	for i := 0; i < 5000; i++ {
+		val, err := cp.Get(key(i))
+		if i >= 100 && i < 200 {
+			require.ErrorIs(t, err, ErrKeyNotFound)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, value(i), val)
+	}
+	// Whatever the writer got into the checkpoint reads back as well.
+	it, err := cp.NewIterator(IteratorOptions{})
+	require.NoError(t, err)
+	n := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		var i int
+		_, err := fmt.Sscanf(string(it.Item().Key()), "key%05d", &i)
+		require.NoError(t, err)
+		val, err := it.Item().ValueCopy(nil)
+		require.NoError(t, err)
+		require.Equal(t, value(i), val)
+		n++
+	}
+	require.NoError(t, it.Close())
+	require.GreaterOrEqual(t, n, 4900)
+
+	// The checkpoint and the source go their own ways.
+	require.NoError(t, cp.Put(key(0), []byte("checkpoint")))
+	require.NoError(t, db.Put(key(1), []byte("source")))
+	val, err := db.Get(key(0))
+	require.NoError(t, err)
+	require.Equal(t, value(0), val)
+	val, err = cp.Get(key(1))
+	require.NoError(t, err)
+	require.Equal(t, value(1), val)
+}
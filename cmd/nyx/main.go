@@ -0,0 +1,93 @@
+// Command nyx runs maintenance tasks on a nyx database that isn't open.
+//
+// Usage:
+//
+//	nyx rekey -dir <dir> [-value-dir <dir>] [-key-file <file>] [-new-key-file <file>]
+//
+// rekey rewrites all the tables and value log files of the database under
+// fresh data keys and verifies their checksums afterwards. The key files hold
+// the hex encoded master keys. Without -new-key-file the master key is kept,
+// without -key-file a database that isn't encrypted yet gets encrypted.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	nyx "github.com/crazyfrankie/nyxdb"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "rekey":
+		err = rekey(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "nyx %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: nyx rekey -dir <dir> [-value-dir <dir>] [-key-file <file>] [-new-key-file <file>]")
+	os.Exit(2)
+}
+
+func rekey(args []string) error {
+	fs := flag.NewFlagSet("rekey", flag.ExitOnError)
+	dir := fs.String("dir", "", "database directory")
+	valueDir := fs.String("value-dir", "", "value log directory, if not the database directory")
+	keyFile := fs.String("key-file", "", "file holding the hex encoded master key")
+	newKeyFile := fs.String("new-key-file", "", "file holding the hex encoded new master key")
+	fs.Parse(args)
+	if *dir == "" {
+		return fmt.Errorf("-dir is required")
+	}
+
+	opts := []nyx.Option{nyx.WithDir(*dir)}
+	if *valueDir != "" {
+		opts = append(opts, nyx.WithValueDir(*valueDir))
+	}
+	if *keyFile != "" {
+		key, err := readKey(*keyFile)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, nyx.WithEncryptionKey(key))
+	}
+	var newKey []byte
+	if *newKeyFile != "" {
+		var err error
+		if newKey, err = readKey(*newKeyFile); err != nil {
+			return err
+		}
+	}
+
+	if err := nyx.Rekey(newKey, opts...); err != nil {
+		return err
+	}
+	fmt.Println("rekeyed and verified", *dir)
+	return nil
+}
+
+// readKey reads the hex encoded key in the file at path.
+func readKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("key file %q: %w", path, err)
+	}
+	return key, nil
+}
@@ -1,10 +1,847 @@
 package nyx
 
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+
+	"github.com/crazyfrankie/nyxdb/internal/kv"
+	"github.com/crazyfrankie/nyxdb/internal/util"
+	"github.com/crazyfrankie/nyxdb/skl"
+	"github.com/crazyfrankie/nyxdb/table"
+)
+
+const (
+	lockFile = "LOCK"
+
+	kvWriteChCapacity = 1000
+)
+
+type closers struct {
+	writes     *z.Closer
+	memtable   *z.Closer
+	compactors *z.Closer
+}
+
 type DB struct {
+	lock      sync.RWMutex // Guards list of in-memory tables, not individual reads and writes.
+	writeLock sync.Mutex   // Serializes writes to the value log and the memtable.
+	sendLock  sync.RWMutex // Held while sending to writeCh, Close takes it to wait for senders.
+
+	dirLockGuard *directoryLockGuard
+	// nil if Dir and ValueDir are the same
+	valueDirGuard *directoryLockGuard
+
+	closers closers
+
 	mm  *memTable   // our latest in-memory table (active-written)
 	imm []*memTable // add here only AFTER pushing to flushChan.
 
+	// flushErr is set, under lock, once the flusher stops on an error. The
+	// memtables are no longer rotated, writes fail once the active one is full.
+	flushErr error
+
 	nextMemfd int // Initialized through openMemTables.
 
-	opt *option
+	opt      *option
+	registry *keyRegistry
+	manifest *manifestFile
+	lc       *levelsController
+	vlog     valueLog
+	orc      *oracle
+
+	blockCache *table.Cache // nil if BlockCacheSize is 0
+	indexCache *table.Cache // nil if IndexCacheSize is 0
+
+	writeCh   chan *request  // For the writer goroutine.
+	flushChan chan *memTable // For flushing memtables.
+
+	metrics metrics
+
+	isClosed atomic.Bool
+}
+
+// Open returns a new DB object. The directories in Dir and ValueDir are created
+// if they don't exist, and are locked for the lifetime of the DB so that no
+// other process can open the same database concurrently.
+func Open(opts ...Option) (*DB, error) {
+	opt, err := buildOption(opts...)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range []string{opt.Dir, opt.ValueDir} {
+		if err := os.MkdirAll(path, 0700); err != nil {
+			return nil, fmt.Errorf("while creating directory %q: %w", path, err)
+		}
+	}
+
+	dirLockGuard, err := acquireDirectoryLock(opt.Dir, lockFile)
+	if err != nil {
+		return nil, err
+	}
+	var valueDirLockGuard *directoryLockGuard
+	if opt.ValueDir != opt.Dir {
+		valueDirLockGuard, err = acquireDirectoryLock(opt.ValueDir, lockFile)
+		if err != nil {
+			dirLockGuard.release()
+			return nil, err
+		}
+	}
+
+	db := &DB{
+		dirLockGuard:  dirLockGuard,
+		valueDirGuard: valueDirLockGuard,
+		opt:           opt,
+		writeCh:       make(chan *request, kvWriteChCapacity),
+		flushChan:     make(chan *memTable, opt.NumMemtables),
+	}
+	if db.registry, err = openKeyRegistry(opt.Dir, opt.EncryptionKey, opt.EncryptionKeyRotationDuration); err != nil {
+		db.cleanup()
+		return nil, err
+	}
+	if err := db.initCaches(); err != nil {
+		db.cleanup()
+		return nil, err
+	}
+	manifestFile, manifest, err := openOrCreateManifestFile(opt.Dir)
+	if err != nil {
+		db.cleanup()
+		return nil, err
+	}
+	db.manifest = manifestFile
+	if db.lc, err = newLevelsController(db, &manifest); err != nil {
+		db.cleanup()
+		return nil, err
+	}
+	if err := db.vlog.open(opt, &db.metrics, db.registry); err != nil {
+		db.cleanup()
+		return nil, err
+	}
+	if err := db.openMemTables(); err != nil {
+		db.cleanup()
+		return nil, err
+	}
+	if db.mm, err = db.newMemTable(); err != nil {
+		db.cleanup()
+		return nil, err
+	}
+
+	db.orc = newOracle(db.maxVersion())
+
+	db.closers.compactors = z.NewCloser(1)
+	db.lc.startCompact(db.closers.compactors)
+
+	db.closers.writes = z.NewCloser(1)
+	go db.doWrites(db.closers.writes)
+
+	db.closers.memtable = z.NewCloser(1)
+	go db.flushMemtable(db.closers.memtable)
+	// Flush the replayed memtables to disk asap.
+	for _, mt := range db.imm {
+		db.flushChan <- mt
+	}
+
+	return db, nil
+}
+
+// initCaches creates the caches of the SSTable blocks and indexes.
+func (d *DB) initCaches() error {
+	var err error
+	if d.opt.BlockCacheSize > 0 {
+		numBlocks := d.opt.BlockCacheSize / int64(max(d.opt.BlockSize, 1))
+		if d.blockCache, err = table.NewCache(d.opt.BlockCacheSize, numBlocks); err != nil {
+			return fmt.Errorf("while creating block cache: %w", err)
+		}
+	}
+	if d.opt.IndexCacheSize > 0 {
+		// An index takes about a hundredth of its table.
+		numIndexes := 100 * d.opt.IndexCacheSize / max(d.opt.TableSize, 1)
+		if d.indexCache, err = table.NewCache(d.opt.IndexCacheSize, numIndexes); err != nil {
+			return fmt.Errorf("while creating index cache: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Close closes a DB. The active memtable and every queued immutable memtable
+// are flushed to level 0 before the directory locks are released.
+// Calling Close multiple times is a no-op.
+func (d *DB) Close() error {
+	if !d.isClosed.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	// Wait for a running value log GC, it stops at its next write.
+	d.vlog.garbageCh <- struct{}{}
+
+	// Wait for the requests being sent, later writers see isClosed. The
+	// writer goroutine writes all of them before it stops.
+	d.sendLock.Lock()
+	d.sendLock.Unlock()
+	d.closers.writes.SignalAndWait()
+
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+
+	var errs []error
+	switch {
+	case d.mm.torn:
+		// Not flushed, cleanup closes it and its WAL is replayed on the next Open.
+	case !d.mm.empty():
+		for {
+			pushedMemTable := func() bool {
+				d.lock.Lock()
+				defer d.lock.Unlock()
+				if d.flushErr != nil {
+					// Nothing is flushed anymore, the memtable stays in its WAL.
+					errs = append(errs, d.flushErr)
+					return true
+				}
+				select {
+				case d.flushChan <- d.mm:
+					d.imm = append(d.imm, d.mm) // Flusher will attempt to remove this from d.imm.
+					d.mm = nil                  // Will segfault if we try writing!
+					return true
+				default:
+					// If we fail to push, we need to unlock and wait for a short while.
+					// The flushing operation needs to update d.imm. Otherwise, we have a deadlock.
+				}
+				return false
+			}()
+			if pushedMemTable {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	default:
+		d.lock.Lock()
+		errs = append(errs, d.mm.wal.delete())
+		d.mm.DecrRef()
+		d.mm = nil
+		d.lock.Unlock()
+	}
+	close(d.flushChan)
+	d.closers.memtable.SignalAndWait()
+
+	// Compactions are stopped only now, flushes may have been waiting on them.
+	d.closers.compactors.SignalAndWait()
+
+	errs = append(errs, d.cleanup())
+
+	return errors.Join(errs...)
+}
+
+// cleanup releases every resource held by the DB and returns the first error seen.
+func (d *DB) cleanup() error {
+	var errs []error
+
+	d.lock.Lock()
+	if d.mm != nil {
+		errs = append(errs, d.mm.close())
+		d.mm = nil
+	}
+	for _, mt := range d.imm {
+		errs = append(errs, mt.close())
+	}
+	d.imm = nil
+	d.lock.Unlock()
+
+	errs = append(errs, d.vlog.close())
+	if d.lc != nil {
+		d.lc.close()
+	}
+	if d.manifest != nil {
+		errs = append(errs, d.manifest.close())
+	}
+	errs = append(errs, d.registry.close())
+	d.blockCache.Close()
+	d.indexCache.Close()
+	if d.valueDirGuard != nil {
+		errs = append(errs, d.valueDirGuard.release())
+	}
+	errs = append(errs, d.dirLockGuard.release())
+
+	return errors.Join(errs...)
+}
+
+// Put sets the value for the given key, overwriting any previous value.
+// It runs as a write batch of its own.
+func (d *DB) Put(key, value []byte) error {
+	wb := d.NewWriteBatch()
+	defer wb.Cancel()
+	if err := wb.Set(key, value); err != nil {
+		return err
+	}
+
+	return wb.Flush()
+}
+
+// SetWithTTL sets the value for the given key, which expires after ttl.
+// Once expired, the key is no longer returned by reads and is eventually
+// removed by compaction. It runs as a write batch of its own.
+func (d *DB) SetWithTTL(key, value []byte, ttl time.Duration) error {
+	wb := d.NewWriteBatch()
+	defer wb.Cancel()
+	if err := wb.SetWithTTL(key, value, ttl); err != nil {
+		return err
+	}
+
+	return wb.Flush()
+}
+
+// Delete deletes the given key. A tombstone is written so that
+// older versions of the key are shadowed until they are compacted away.
+// It runs as a write batch of its own.
+func (d *DB) Delete(key []byte) error {
+	wb := d.NewWriteBatch()
+	defer wb.Cancel()
+	if err := wb.Delete(key); err != nil {
+		return err
+	}
+
+	return wb.Flush()
+}
+
+// DeleteRange deletes all the keys in [start, end) with a single range
+// tombstone, instead of one tombstone per key. The deleted versions are
+// shadowed until compaction drops them, along with whole tables holding
+// nothing else. It runs as a write batch of its own, and like any other
+// write batch it doesn't conflict with transactions.
+func (d *DB) DeleteRange(start, end []byte) error {
+	wb := d.NewWriteBatch()
+	defer wb.Cancel()
+	if err := wb.DeleteRange(start, end); err != nil {
+		return err
+	}
+
+	return wb.Flush()
+}
+
+// Get returns a copy of the latest value for the given key.
+// It returns ErrKeyNotFound if the key doesn't exist or has been deleted.
+func (d *DB) Get(key []byte) ([]byte, error) {
+	var val []byte
+	err := d.View(func(txn *Txn) error {
+		var err error
+		val, err = txn.Get(key)
+		return err
+	})
+
+	return val, err
+}
+
+// getAt returns a copy of the newest value of key with a version not newer
+// than readTs, reading it from the value log if it was stored there.
+func (d *DB) getAt(key []byte, readTs uint64) ([]byte, error) {
+	if d.isClosed.Load() {
+		return nil, ErrDBClosed
+	}
+
+	// Value log files rewritten by GC are kept until we're done.
+	d.vlog.incrReaders()
+	defer d.vlog.decrReaders()
+
+	// Range tombstones are looked up first. Compaction drops them only
+	// together with the versions they delete, which are gone by then as well.
+	deletedBelow := d.deletedBelow(key, readTs)
+	vs, err := d.get(util.KeyWithTs(key, readTs))
+	if err != nil {
+		return nil, err
+	}
+	if vs.Meta == 0 && vs.Value == nil {
+		return nil, ErrKeyNotFound
+	}
+	if vs.IsDeletedOrExpired() || vs.Version < deletedBelow {
+		return nil, ErrKeyNotFound
+	}
+	if vs.Meta&kv.BitValuePointer > 0 {
+		var vp valuePointer
+		vp.Decode(vs.Value)
+		return d.vlog.read(vp)
+	}
+
+	return append([]byte{}, vs.Value...), nil
+}
+
+// entry is a key with its version and the value written for it.
+type entry struct {
+	key   []byte
+	value kv.Value
+}
+
+// storedSize returns the worst case memtable usage of the user key with v.
+// Values going to the value log only take the space of a pointer.
+func (d *DB) storedSize(key []byte, v kv.Value) int64 {
+	if !d.shouldWriteValueToVlog(v) {
+		return estimateSize(key, v) + 8 // 8 for the version
+	}
+	v.Value = nil
+
+	return estimateSize(key, v) + 8 + vptrSize
+}
+
+// checkEntrySize returns ErrEntryTooBig if the user key with v can't be
+// written, not even in a transaction of its own.
+func (d *DB) checkEntrySize(key []byte, v kv.Value) error {
+	if d.shouldWriteValueToVlog(v) && int64(len(v.Value)) > d.opt.ValueLogFileSize {
+		return ErrEntryTooBig
+	}
+	if d.storedSize(key, v)+finTxnSize > d.opt.maxBatchSize {
+		return ErrEntryTooBig
+	}
+
+	return nil
+}
+
+// request is a group of entries that are written together by the writer
+// goroutine, so they end up in the same memtable.
+type request struct {
+	entries []*entry
+	Err     error
+	wg      sync.WaitGroup
+}
+
+// Wait blocks until the request has been written and returns its error.
+func (req *request) Wait() error {
+	req.wg.Wait()
+	return req.Err
+}
+
+// sendToWriteCh hands entries over to the writer goroutine and returns the
+// request to wait on. Keys are internal keys. It returns ErrTxnTooBig if the
+// entries exceed the limits of a batch.
+func (d *DB) sendToWriteCh(entries []*entry) (*request, error) {
+	d.sendLock.RLock()
+	defer d.sendLock.RUnlock()
+
+	if d.isClosed.Load() {
+		return nil, ErrDBClosed
+	}
+	var size int64
+	for _, e := range entries {
+		size += d.storedSize(util.ParseKey(e.key), e.value)
+	}
+	if int64(len(entries)) > d.opt.maxBatchCount || size > d.opt.maxBatchSize {
+		return nil, ErrTxnTooBig
+	}
+
+	req := &request{entries: entries}
+	req.wg.Add(1)
+	d.writeCh <- req
+
+	return req, nil
+}
+
+// doWrites is the writer goroutine. It picks up the requests sent to writeCh
+// while the previous ones are being written, and writes them as one group, so
+// concurrent writers share a single log sync. Once lc is closed, the requests
+// left in writeCh are written before it returns.
+func (d *DB) doWrites(lc *z.Closer) {
+	defer lc.Done()
+
+	// pendingCh holds a token while a group is being written.
+	pendingCh := make(chan struct{}, 1)
+	writeRequests := func(reqs []*request) {
+		d.writeRequests(reqs)
+		<-pendingCh
+	}
+
+	reqs := make([]*request, 0, 10)
+	writeRemaining := func() {
+		for {
+			select {
+			case r := <-d.writeCh:
+				reqs = append(reqs, r)
+			default:
+				pendingCh <- struct{}{} // Wait for the running write.
+				writeRequests(reqs)
+				return
+			}
+		}
+	}
+	for {
+		var r *request
+		select {
+		case r = <-d.writeCh:
+		case <-lc.HasBeenClosed():
+			writeRemaining()
+			return
+		}
+
+	collect:
+		for {
+			reqs = append(reqs, r)
+			if len(reqs) >= 3*kvWriteChCapacity {
+				pendingCh <- struct{}{} // Blocking, enough requests are piled up.
+				break
+			}
+			select {
+			// Either start writing, or keep collecting while a write runs.
+			case r = <-d.writeCh:
+			case pendingCh <- struct{}{}:
+				break collect
+			case <-lc.HasBeenClosed():
+				writeRemaining()
+				return
+			}
+		}
+
+		go writeRequests(reqs)
+		reqs = make([]*request, 0, 10)
+	}
+}
+
+// writeRequests writes reqs, sets the error of each of them and marks them as
+// done.
+func (d *DB) writeRequests(reqs []*request) {
+	if len(reqs) == 0 {
+		return
+	}
+	d.writeLock.Lock()
+	d.writeRequestsLocked(reqs)
+	d.writeLock.Unlock()
+	d.metrics.writeRequests.Add(uint64(len(reqs)))
+	d.metrics.writeGroups.Add(1)
+
+	for _, r := range reqs {
+		r.wg.Done()
+	}
+}
+
+// writeRequestsLocked writes the entries of each request to the active
+// memtable. Values of at least ValueThreshold bytes are appended to the value
+// log first and only a pointer to them is kept in the memtable. The entries of
+// a request all go into the same memtable, it stalls while the memtable is
+// full and too many memtables are waiting to be flushed.
+// If SyncWrites is set, each log is synced once for all the requests.
+// Must be called with writeLock held.
+func (d *DB) writeRequestsLocked(reqs []*request) {
+	setErr := func(err error) {
+		for _, r := range reqs {
+			if r.Err == nil {
+				r.Err = err
+			}
+		}
+	}
+
+	for _, r := range reqs {
+		r.Err = d.writeToVlog(r.entries)
+	}
+	if d.opt.SyncWrites {
+		// The value log must be durable before the pointers to it are.
+		if err := d.vlog.sync(); err != nil {
+			setErr(err)
+		}
+	}
+	for _, r := range reqs {
+		if r.Err == nil {
+			r.Err = d.writeToMemTable(r.entries)
+		}
+	}
+	if d.opt.SyncWrites {
+		if err := d.mm.SyncWAL(); err != nil {
+			setErr(err)
+		}
+	}
+}
+
+// writeToVlog appends the values that are big enough to the value log and
+// replaces them with pointers.
+func (d *DB) writeToVlog(entries []*entry) error {
+	for _, e := range entries {
+		if !d.shouldWriteValueToVlog(e.value) {
+			continue
+		}
+		vp, err := d.vlog.write(e.key, e.value)
+		if err != nil {
+			return err
+		}
+		e.value = kv.Value{
+			Meta:      e.value.Meta | kv.BitValuePointer,
+			UserMeta:  e.value.UserMeta,
+			ExpiresAt: e.value.ExpiresAt,
+			Value:     vp.Encode(),
+		}
+	}
+
+	return nil
+}
+
+// writeToMemTable writes entries to the active memtable, rotating it first if
+// they don't all fit. If the arena of the memtable turns out to be full
+// anyway, it's rotated and the entries are written to the new one. If the
+// entries are written partly, the memtable is torn and every later write
+// fails.
+func (d *DB) writeToMemTable(entries []*entry) error {
+	if d.mm.torn {
+		return errTornMemTable
+	}
+	var size int64
+	for _, e := range entries {
+		size += estimateSize(e.key, e.value)
+	}
+	if err := d.retryNoRoom(func() error { return d.ensureRoomForWrite(size) }); err != nil {
+		return err
+	}
+
+	for i, e := range entries {
+		err := d.mm.Put(e.key, e.value)
+		if errors.Is(err, skl.ErrArenaFull) && i == 0 {
+			// Nothing was written yet, so the whole request moves to a new
+			// memtable and a transaction still ends up in a single WAL.
+			if err = d.retryNoRoom(d.rotateMemTable); err != nil {
+				return err
+			}
+			err = d.mm.Put(e.key, e.value)
+		}
+		if err != nil {
+			if i > 0 || !errors.Is(err, skl.ErrArenaFull) {
+				// Flushing the memtable would make the entries written so far
+				// visible after a reopen, without the rest of the request.
+				d.mm.torn = true
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// retryNoRoom calls fn until it doesn't return errNoRoom, giving the flusher
+// time to make room in between.
+func (d *DB) retryNoRoom(fn func() error) error {
+	for {
+		err := fn()
+		if !errors.Is(err, errNoRoom) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// shouldWriteValueToVlog reports whether v is big enough to be kept in the value log.
+// The end keys of range tombstones are always kept in the LSM tree.
+func (d *DB) shouldWriteValueToVlog(v kv.Value) bool {
+	return !v.IsDeleted() && v.Meta&kv.BitRangeDelete == 0 && int64(len(v.Value)) >= d.opt.ValueThreshold
+}
+
+// ensureRoomForWrite rotates the active memtable if size more bytes don't fit into it.
+// It returns errNoRoom if the flush queue is full. Must be called with writeLock held.
+func (d *DB) ensureRoomForWrite(size int64) error {
+	if !d.mm.isFull(size) {
+		return nil
+	}
+
+	return d.rotateMemTable()
+}
+
+// rotateMemTable queues the active memtable for flushing and replaces it with
+// a new one. It returns errNoRoom if the flush queue is full, and the error
+// the flusher stopped on if it did. Must be called with writeLock held.
+func (d *DB) rotateMemTable() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.flushErr != nil {
+		return fmt.Errorf("cannot rotate memtable: %w", d.flushErr)
+	}
+	if d.mm.torn {
+		return fmt.Errorf("cannot rotate memtable: %w", errTornMemTable)
+	}
+
+	select {
+	case d.flushChan <- d.mm:
+		if d.opt.SyncWrites {
+			// The last group written to it was only synced if it ended there.
+			if err := d.mm.SyncWAL(); err != nil {
+				return err
+			}
+		}
+		// We manage to push this task. Let's modify imm.
+		d.imm = append(d.imm, d.mm)
+		mm, err := d.newMemTable()
+		if err != nil {
+			return fmt.Errorf("cannot create new mem table: %w", err)
+		}
+		d.mm = mm
+		// New memtable is empty. We certainly have room.
+		return nil
+	default:
+		// We need to do this to unlock and allow the flusher to modify imm.
+		return errNoRoom
+	}
+}
+
+// flushMemtable flushes the immutable memtables pushed to flushChan in order,
+// until flushChan is closed, until a flushed memtable can't be dropped, or
+// until level 0 is full and can't be compacted.
+func (d *DB) flushMemtable(lc *z.Closer) {
+	defer lc.Done()
+
+	for mt := range d.flushChan {
+		for {
+			err := d.handleMemTableFlush(mt)
+			if errors.Is(err, errLevel0Stalled) {
+				// The memtables left keep their WALs, which are replayed on
+				// the next Open.
+				d.lock.Lock()
+				d.flushErr = err
+				d.lock.Unlock()
+				log.Printf("error flushing memtable to disk: %v, no more memtables are flushed", err)
+				return
+			}
+			if err != nil {
+				// Encountered error. Retry indefinitely.
+				log.Printf("error flushing memtable to disk: %v, retrying", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			break
+		}
+		if err := d.dropFlushedMemTable(mt); err != nil {
+			// The memtables left keep their WALs, which are replayed on the
+			// next Open.
+			log.Printf("error flushing memtable to disk: %v, no more memtables are flushed", err)
+			return
+		}
+	}
+}
+
+// dropFlushedMemTable removes mt from the immutable memtables once it's
+// flushed. Until then, the data is readable from both the memtable and level
+// 0, which hold the same versions. If mt isn't the oldest immutable memtable,
+// it's left in place and the error is kept in flushErr.
+func (d *DB) dropFlushedMemTable(mt *memTable) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if len(d.imm) == 0 || d.imm[0] != mt {
+		d.flushErr = fmt.Errorf("flushed memtable fid %d is not the oldest immutable memtable", mt.wal.fid)
+		return d.flushErr
+	}
+	d.imm = d.imm[1:]
+	mt.DecrRef() // Return memory.
+
+	return nil
+}
+
+// handleMemTableFlush writes mt to a new level 0 table and then deletes its WAL,
+// which is no longer needed to recover the data.
+func (d *DB) handleMemTableFlush(mt *memTable) error {
+	opts, err := d.tableOptions()
+	if err != nil {
+		return err
+	}
+	iter := mt.skl.NewUniIterator(false)
+	builder := table.NewTableBuilder(opts)
+	builder.AddAll(iter)
+	iter.Close()
+	for _, rt := range mt.rangeTombstones() {
+		builder.AddRangeTombstone(rt)
+	}
+
+	if !builder.Empty() {
+		tbl, err := d.lc.createTable(builder)
+		if err != nil {
+			return fmt.Errorf("error while creating table: %w", err)
+		}
+		if err := d.lc.addLevel0Table(tbl); err != nil {
+			tbl.DecrRef()
+			return err
+		}
+	}
+
+	return mt.wal.delete()
+}
+
+// getMemTables returns the current memtables, the active one first followed by
+// the immutable ones from newest to oldest, and a function to release them.
+func (d *DB) getMemTables() ([]*memTable, func()) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	var tables []*memTable
+
+	// Get mutable memtable.
+	if d.mm != nil {
+		tables = append(tables, d.mm)
+		d.mm.IncrRef()
+	}
+
+	// Get immutable memtables, the last one is the newest.
+	last := len(d.imm) - 1
+	for i := range d.imm {
+		tables = append(tables, d.imm[last-i])
+		d.imm[last-i].IncrRef()
+	}
+
+	return tables, func() {
+		for _, tbl := range tables {
+			tbl.DecrRef()
+		}
+	}
+}
+
+// get returns the newest value of the user key in key with a version not newer
+// than the version of key. It looks through the memtables and then the tables
+// on disk, and stops early only on an exact version match, since a version
+// rewritten by value log GC may be found in a newer source than versions
+// written after it.
+// The returned value may alias memory that is released later, so it has
+// to be copied if it's used after the next write. It fails if a table can't
+// be read.
+func (d *DB) get(key []byte) (kv.Value, error) {
+	tables, decr := d.getMemTables()
+	defer decr()
+
+	version := util.ParseTs(key)
+	var maxVs kv.Value
+	for _, mt := range tables {
+		vs := mt.get(key)
+		if vs.Meta == 0 && vs.Value == nil {
+			continue
+		}
+		if vs.Version == version {
+			return vs, nil
+		}
+		if maxVs.Version < vs.Version {
+			maxVs = vs
+		}
+	}
+
+	return d.lc.get(key, maxVs)
+}
+
+// deletedBelow returns the newest version, not newer than readTs, of the range
+// tombstones covering the user key. Versions of the key older than it are
+// deleted as of readTs.
+func (d *DB) deletedBelow(key []byte, readTs uint64) uint64 {
+	tables, decr := d.getMemTables()
+	defer decr()
+
+	var version uint64
+	for _, mt := range tables {
+		version = max(version, kv.DeletedBelow(d.opt.Comparator, mt.rangeTombstones(), key, readTs))
+	}
+
+	return max(version, d.lc.deletedBelow(key, readTs))
+}
+
+// maxVersion returns the highest version in the LSM tree.
+func (d *DB) maxVersion() uint64 {
+	version := d.lc.maxVersion()
+	for _, mt := range append([]*memTable{d.mm}, d.imm...) {
+		if mt != nil && mt.maxVersion > version {
+			version = mt.maxVersion
+		}
+	}
+
+	return version
 }
@@ -0,0 +1,513 @@
+package nyx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crazyfrankie/nyxdb/skl"
+)
+
+// openTestDB opens a DB in dir with opts. The memtables, the value log files
+// and the block cache are kept small, so that the tests opening several DBs
+// fit in memory under the race detector.
+func openTestDB(t *testing.T, dir string, opts ...Option) *DB {
+	t.Helper()
+	defaults := []Option{
+		WithDir(dir),
+		WithMemTableSize(1 << 20),
+		WithValueLogFileSize(8 << 20),
+		WithBlockCacheSize(8 << 20),
+	}
+	db, err := Open(append(defaults, opts...)...)
+	require.NoError(t, err)
+	return db
+}
+
+func TestOpenClose(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	require.FileExists(t, filepath.Join(dir, lockFile))
+	require.NoError(t, db.Close())
+	require.NoError(t, db.Close())
+	require.NoFileExists(t, filepath.Join(dir, lockFile))
+
+	// The empty memtable was removed on close instead of being flushed.
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+MemTableExt))
+	require.NoError(t, err)
+	require.Empty(t, matches)
+
+	db = openTestDB(t, dir)
+	require.Empty(t, db.imm)
+	require.Equal(t, 2, db.nextMemfd)
+	require.NoError(t, db.Close())
+}
+
+func TestOpenRequiresDir(t *testing.T) {
+	_, err := Open()
+	require.ErrorIs(t, err, ErrDirRequired)
+}
+
+func TestOpenInvalidOptions(t *testing.T) {
+	for _, opt := range []Option{
+		WithNumMemtables(0),
+		WithMemTableSize(100),
+		WithMaxLevels(1),
+		WithNumVersionsToKeep(0),
+	} {
+		_, err := Open(WithDir(t.TempDir()), opt)
+		require.Error(t, err)
+	}
+
+	// The smallest memtable still takes a write batch of one entry.
+	opt, err := buildOption(WithDir(t.TempDir()), WithMemTableSize((100*int64(skl.MaxNodeSize)+14)/15))
+	require.NoError(t, err)
+	require.Equal(t, int64(1), opt.maxBatchCount)
+}
+
+func TestOpenDirLocked(t *testing.T) {
+	dir := t.TempDir()
+	valueDir := filepath.Join(dir, "vlog")
+	db := openTestDB(t, dir, WithValueDir(valueDir))
+	_, err := os.Stat(valueDir)
+	require.NoError(t, err)
+
+	_, err = Open(WithDir(dir))
+	require.Error(t, err)
+	_, err = Open(WithDir(t.TempDir()), WithValueDir(valueDir))
+	require.Error(t, err)
+
+	require.NoError(t, db.Close())
+	db = openTestDB(t, dir, WithValueDir(valueDir))
+	require.NoError(t, db.Close())
+}
+
+func TestPutGetDelete(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+
+	_, err := db.Get([]byte("key1"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	require.ErrorIs(t, db.Put(nil, []byte("value")), ErrEmptyKey)
+
+	require.NoError(t, db.Put([]byte("key1"), []byte("value1")))
+	require.NoError(t, db.Put([]byte("key2"), []byte("value2")))
+	require.NoError(t, db.Put([]byte("key1"), []byte("value3")))
+	require.NoError(t, db.Put([]byte("empty"), nil))
+
+	val, err := db.Get([]byte("key1"))
+	require.NoError(t, err)
+	require.Equal(t, "value3", string(val))
+	val, err = db.Get([]byte("empty"))
+	require.NoError(t, err)
+	require.Empty(t, val)
+
+	require.NoError(t, db.Delete([]byte("key2")))
+	_, err = db.Get([]byte("key2"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	require.NoError(t, db.Close())
+
+	// After a reopen, the data lives in a level 0 table and the tombstone
+	// written into the memtable shadows it.
+	db = openTestDB(t, dir)
+	val, err = db.Get([]byte("key1"))
+	require.NoError(t, err)
+	require.Equal(t, "value3", string(val))
+	require.NoError(t, db.Delete([]byte("key1")))
+	_, err = db.Get([]byte("key1"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = db.Get([]byte("key2"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	require.NoError(t, db.Close())
+
+	_, err = db.Get([]byte("key1"))
+	require.ErrorIs(t, err, ErrDBClosed)
+}
+
+func TestSetWithTTL(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+
+	require.NoError(t, db.Put([]byte("key1"), []byte("value1")))
+	require.NoError(t, db.SetWithTTL([]byte("key1"), []byte("value2"), -time.Second))
+	require.NoError(t, db.SetWithTTL([]byte("key2"), []byte("value2"), time.Hour))
+	require.NoError(t, db.SetWithTTL([]byte("key3"), []byte("value3"), 2*time.Second))
+
+	check := func() {
+		_, err := db.Get([]byte("key1"))
+		require.ErrorIs(t, err, ErrKeyNotFound)
+		val, err := db.Get([]byte("key2"))
+		require.NoError(t, err)
+		require.Equal(t, "value2", string(val))
+
+		snap, err := db.Snapshot()
+		require.NoError(t, err)
+		defer snap.Release()
+		it, err := snap.NewIterator(IteratorOptions{})
+		require.NoError(t, err)
+		defer it.Close()
+		it.Rewind()
+		require.True(t, it.Valid())
+		require.Equal(t, "key2", string(it.Item().Key()))
+		require.InDelta(t, time.Now().Add(time.Hour).Unix(), int64(it.Item().ExpiresAt()), 5)
+	}
+	require.Eventually(t, func() bool {
+		_, err := db.Get([]byte("key3"))
+		return errors.Is(err, ErrKeyNotFound)
+	}, 5*time.Second, 50*time.Millisecond)
+	check()
+
+	// A transaction sees its own writes expire as well.
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		require.NoError(t, txn.SetWithTTL([]byte("key4"), []byte("value4"), -time.Second))
+		_, err := txn.Get([]byte("key4"))
+		require.ErrorIs(t, err, ErrKeyNotFound)
+		return nil
+	}))
+	require.NoError(t, db.Close())
+
+	db = openTestDB(t, dir)
+	defer db.Close()
+	check()
+}
+
+func TestMemTableFlush(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir, WithMemTableSize(16<<10), WithNumMemtables(1))
+
+	const n = 2000
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprintf("value%05d", i))))
+	}
+	for i := 0; i < n; i += 2 {
+		require.NoError(t, db.Delete([]byte(fmt.Sprintf("key%05d", i))))
+	}
+	tables, err := filepath.Glob(filepath.Join(dir, "*.sst"))
+	require.NoError(t, err)
+	require.NotEmpty(t, tables)
+
+	check := func() {
+		for i := 0; i < n; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key%05d", i)))
+			if i%2 == 0 {
+				require.ErrorIs(t, err, ErrKeyNotFound)
+				continue
+			}
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("value%05d", i), string(val))
+		}
+	}
+	check()
+	require.NoError(t, db.Close())
+
+	// Everything was flushed on close, only tables are left.
+	mems, err := filepath.Glob(filepath.Join(dir, "*"+MemTableExt))
+	require.NoError(t, err)
+	require.Empty(t, mems)
+
+	db = openTestDB(t, dir, WithMemTableSize(16<<10))
+	check()
+	require.NoError(t, db.Close())
+}
+
+func TestFlushError(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	require.NoError(t, db.Put([]byte("key"), []byte("value")))
+
+	// A flushed memtable that isn't the oldest stops the flusher instead of
+	// the process.
+	require.Error(t, db.dropFlushedMemTable(&memTable{wal: &wal{fid: 100}}))
+	db.writeLock.Lock()
+	err := db.rotateMemTable()
+	db.writeLock.Unlock()
+	require.ErrorContains(t, err, "not the oldest immutable memtable")
+	require.Error(t, db.Checkpoint(filepath.Join(t.TempDir(), "checkpoint")))
+
+	// The active memtable is left in its WAL.
+	require.Error(t, db.Close())
+	db = openTestDB(t, dir)
+	defer db.Close()
+	val, err := db.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+}
+
+func TestPutEntryTooBig(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), WithMemTableSize(16<<10))
+	require.ErrorIs(t, db.Put([]byte("key"), make([]byte, 16<<10)), ErrEntryTooBig)
+	require.NoError(t, db.Close())
+}
+
+func TestBloomFilterMetrics(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("value")))
+	}
+	require.NoError(t, db.Close())
+
+	db = openTestDB(t, dir)
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		_, err := db.Get([]byte(fmt.Sprintf("missing%03d", i)))
+		require.ErrorIs(t, err, ErrKeyNotFound)
+	}
+	_, err := db.Get([]byte("key042"))
+	require.NoError(t, err)
+
+	m := db.Metrics()
+	require.Greater(t, m.BloomHits, uint64(90))
+	require.Equal(t, uint64(101), m.BloomHits+m.BloomMisses)
+	require.Equal(t, m.BloomMisses-1, m.BloomFalsePositives)
+}
+
+func TestDeleteRange(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir, WithMemTableSize(16<<10), WithValueThreshold(64))
+
+	const n = 1000
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%04d", i)) }
+	value := func(i int) []byte { return []byte(fmt.Sprintf("value%04d", i)) }
+	big := bytes.Repeat([]byte("b"), 100)
+	for i := 0; i < n; i++ {
+		val := value(i)
+		if i%10 == 0 {
+			val = big
+		}
+		require.NoError(t, db.Put(key(i), val))
+	}
+	snap, err := db.Snapshot()
+	require.NoError(t, err)
+	defer snap.Release()
+
+	require.ErrorIs(t, db.DeleteRange(nil, key(1)), ErrEmptyKey)
+	require.ErrorIs(t, db.DeleteRange(key(2), key(1)), ErrInvalidRange)
+	require.ErrorIs(t, db.DeleteRange(key(1), key(1)), ErrInvalidRange)
+	require.NoError(t, db.DeleteRange(key(100), key(300)))
+	// Writes of the same batch survive its range deletion.
+	wb := db.NewWriteBatch()
+	require.NoError(t, wb.DeleteRange(key(500), key(700)))
+	require.NoError(t, wb.Set(key(600), []byte("again")))
+	require.NoError(t, wb.Flush())
+	require.NoError(t, db.Put(key(200), []byte("again")))
+
+	check := func(db *DB) {
+		t.Helper()
+		var want []string
+		for i := 0; i < n; i++ {
+			val, err := db.Get(key(i))
+			switch {
+			case i == 200 || i == 600:
+				require.NoError(t, err)
+				require.Equal(t, "again", string(val))
+			case i >= 100 && i < 300, i >= 500 && i < 700:
+				require.ErrorIs(t, err, ErrKeyNotFound, "key %d", i)
+				continue
+			default:
+				require.NoError(t, err)
+			}
+			want = append(want, string(key(i)))
+		}
+
+		snap, err := db.Snapshot()
+		require.NoError(t, err)
+		defer snap.Release()
+		for _, reverse := range []bool{false, true} {
+			it, err := snap.NewIterator(IteratorOptions{Reverse: reverse})
+			require.NoError(t, err)
+			it.Rewind()
+			keys, _ := collect(t, it)
+			require.NoError(t, it.Close())
+			if reverse {
+				slices.Reverse(keys)
+			}
+			require.Equal(t, want, keys)
+		}
+	}
+	check(db)
+
+	// A snapshot taken before the deletion still sees the keys.
+	val, err := snap.Get(key(151))
+	require.NoError(t, err)
+	require.Equal(t, value(151), val)
+	it, err := snap.NewIterator(IteratorOptions{})
+	require.NoError(t, err)
+	it.Rewind()
+	keys, _ := collect(t, it)
+	require.NoError(t, it.Close())
+	require.Len(t, keys, n)
+	snap.Release()
+
+	// The range tombstones are flushed along with the keys.
+	require.NoError(t, db.Close())
+	db = openTestDB(t, dir, WithMemTableSize(16<<10), WithValueThreshold(64))
+	defer db.Close()
+	check(db)
+}
+
+func TestCompression(t *testing.T) {
+	dir := t.TempDir()
+	opts := []Option{WithValueThreshold(1 << 10), WithCompression(ZSTDCompression), WithCompressValueLog(true)}
+	db := openTestDB(t, dir, opts...)
+
+	const n = 200
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	value := func(i int) []byte {
+		if i%2 == 0 {
+			return []byte(fmt.Sprintf("small%03d", i))
+		}
+		return bytes.Repeat([]byte(fmt.Sprintf("big%03d", i)), 1<<8)
+	}
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put(key(i), value(i)))
+	}
+	// Values that don't shrink are stored as they are.
+	random := make([]byte, 4<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+	require.NoError(t, db.Put([]byte("random"), random))
+	check := func() {
+		for i := 0; i < n; i++ {
+			val, err := db.Get(key(i))
+			require.NoError(t, err)
+			require.Equal(t, value(i), val)
+		}
+		val, err := db.Get([]byte("random"))
+		require.NoError(t, err)
+		require.Equal(t, random, val)
+	}
+	check()
+	require.NoError(t, db.Close())
+	m := db.Metrics()
+	require.Greater(t, m.VlogCompressionRatio(), 5.0)
+	require.Greater(t, m.TableCompressionRatio(), 1.0)
+
+	// Tables and values written with another algorithm are still read.
+	db = openTestDB(t, dir, WithValueThreshold(1<<10), WithCompression(SnappyCompression))
+	check()
+	_, err := db.vlog.createLogFile()
+	require.NoError(t, err)
+	for i := 0; i < n; i += 4 {
+		require.NoError(t, db.Put(key(i), value(i)))
+	}
+	require.NoError(t, db.rewrite(db.vlog.filesMap[1]))
+	require.NoFileExists(t, vlogFilePath(dir, 1))
+	check()
+	require.NoError(t, db.Close())
+	m = db.Metrics()
+	require.Equal(t, m.VlogRawBytes, m.VlogStoredBytes)
+
+	_, err = Open(WithDir(dir), WithCompression(CompressionType(9)))
+	require.Error(t, err)
+}
+
+func TestEncryption(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte("k"), 32)
+	opts := []Option{WithValueThreshold(1 << 10), WithEncryptionKey(key)}
+	db := openTestDB(t, dir, opts...)
+
+	const n = 100
+	k := func(i int) []byte { return []byte(fmt.Sprintf("secret-key%03d", i)) }
+	value := func(i int) []byte {
+		if i%2 == 0 {
+			return []byte(fmt.Sprintf("secret-small%03d", i))
+		}
+		return bytes.Repeat([]byte(fmt.Sprintf("secret-big%03d", i)), 1<<8)
+	}
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put(k(i), value(i)))
+	}
+	check := func(db *DB) {
+		for i := 0; i < n; i++ {
+			val, err := db.Get(k(i))
+			require.NoError(t, err)
+			require.Equal(t, value(i), val)
+		}
+	}
+	check(db)
+	requirePlaintextAbsent := func(ext string) {
+		matches, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+		require.NoError(t, err)
+		require.NotEmpty(t, matches, ext)
+		for _, path := range matches {
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			require.NotContains(t, string(data), "secret", path)
+		}
+	}
+	requirePlaintextAbsent(MemTableExt)
+	requirePlaintextAbsent(VlogFileExt)
+	require.NoError(t, db.Close())
+	requirePlaintextAbsent(".sst")
+
+	db = openTestDB(t, dir, opts...)
+	check(db)
+	require.NoError(t, db.Close())
+
+	_, err := Open(WithDir(dir), WithEncryptionKey(bytes.Repeat([]byte("x"), 32)))
+	require.ErrorIs(t, err, ErrEncryptionKeyMismatch)
+	_, err = Open(WithDir(dir))
+	require.ErrorIs(t, err, ErrEncryptionKeyMismatch)
+	_, err = Open(WithDir(dir), WithEncryptionKey([]byte("short")))
+	require.ErrorIs(t, err, ErrInvalidEncryptionKey)
+
+	// Every new file gets a new data key, the files written with the older
+	// ones stay readable.
+	db = openTestDB(t, dir, append(opts, WithEncryptionKeyRotationDuration(time.Nanosecond))...)
+	lastID := db.registry.lastID
+	for i := 0; i < n; i += 2 {
+		require.NoError(t, db.Put(k(i), value(i)))
+	}
+	require.NoError(t, db.Close())
+	db = openTestDB(t, dir, opts...)
+	require.Greater(t, db.registry.lastID, lastID)
+	check(db)
+	require.NoError(t, db.Close())
+}
+
+func TestCaches(t *testing.T) {
+	dir := t.TempDir()
+	opts := []Option{WithCompression(SnappyCompression), WithBlockSize(512), WithIndexCacheSize(1 << 20)}
+	db := openTestDB(t, dir, opts...)
+	const n = 1000
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%04d", i)) }
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put(key(i), bytes.Repeat([]byte{byte(i)}, 32)))
+	}
+	require.NoError(t, db.Close())
+
+	db = openTestDB(t, dir, opts...)
+	for pass := 0; pass < 3; pass++ {
+		for i := 0; i < n; i++ {
+			val, err := db.Get(key(i))
+			require.NoError(t, err)
+			require.Equal(t, bytes.Repeat([]byte{byte(i)}, 32), val)
+		}
+	}
+	m := db.Metrics()
+	require.NotZero(t, m.BlockCacheHits)
+	require.NotZero(t, m.BlockCacheMisses)
+	require.Greater(t, m.BlockCacheHitRatio(), 0.0)
+	require.NotZero(t, m.IndexCacheHits)
+	require.NoError(t, db.Close())
+
+	// Without caches everything is read from the tables.
+	db = openTestDB(t, dir, WithBlockCacheSize(0))
+	for i := 0; i < n; i++ {
+		_, err := db.Get(key(i))
+		require.NoError(t, err)
+	}
+	m = db.Metrics()
+	require.Zero(t, m.BlockCacheHits+m.BlockCacheMisses)
+	require.Zero(t, m.BlockCacheHitRatio())
+	require.NoError(t, db.Close())
+}
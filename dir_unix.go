@@ -0,0 +1,61 @@
+//go:build !windows
+
+package nyx
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// directoryLockGuard holds a lock on a directory and a pid file inside.
+// The pid file isn't part of the locking mechanism, it's just advisory.
+type directoryLockGuard struct {
+	// File handle on the directory, which we've flocked.
+	f *os.File
+	// The absolute path to our pid file.
+	path string
+}
+
+// acquireDirectoryLock gets a lock on the directory (using flock). It will also write
+// our pid to dirPath/pidFileName for convenience.
+func acquireDirectoryLock(dirPath string, pidFileName string) (*directoryLockGuard, error) {
+	// Convert to absolute path so that release will still work even if we do an unbalanced
+	// chdir in the meantime.
+	absPidFilePath, err := filepath.Abs(filepath.Join(dirPath, pidFileName))
+	if err != nil {
+		return nil, fmt.Errorf("cannot get absolute path for pid lock file: %w", err)
+	}
+	f, err := os.Open(dirPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open directory %q: %w", dirPath, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot acquire directory lock on %q. Another process is using this database: %w",
+			dirPath, err)
+	}
+
+	// Yes, we happily overwrite a pre-existing pid file. We're the only process using this
+	// directory.
+	if err := os.WriteFile(absPidFilePath, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0666); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot write pid file %q: %w", absPidFilePath, err)
+	}
+
+	return &directoryLockGuard{f: f, path: absPidFilePath}, nil
+}
+
+// release deletes the pid file and releases our lock on the directory.
+func (guard *directoryLockGuard) release() error {
+	// It's important that we remove the pid file first.
+	err := os.Remove(guard.path)
+	if closeErr := guard.f.Close(); err == nil {
+		err = closeErr
+	}
+	guard.path = ""
+	guard.f = nil
+
+	return err
+}
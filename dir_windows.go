@@ -0,0 +1,49 @@
+//go:build windows
+
+package nyx
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// directoryLockGuard holds a lock on the directory.
+// Windows has no flock, so the lock is an exclusively created file that
+// is removed again on release.
+type directoryLockGuard struct {
+	f    *os.File
+	path string
+}
+
+// acquireDirectoryLock acquires exclusive access to a directory.
+func acquireDirectoryLock(dirPath string, pidFileName string) (*directoryLockGuard, error) {
+	absLockFilePath, err := filepath.Abs(filepath.Join(dirPath, pidFileName))
+	if err != nil {
+		return nil, fmt.Errorf("cannot get absolute path for lock file: %w", err)
+	}
+	f, err := os.OpenFile(absLockFilePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create lock file %q. Another process is using this database: %w",
+			absLockFilePath, err)
+	}
+	if _, err := fmt.Fprintf(f, "%d\n", os.Getpid()); err != nil {
+		f.Close()
+		os.Remove(absLockFilePath)
+		return nil, fmt.Errorf("cannot write pid to lock file %q: %w", absLockFilePath, err)
+	}
+
+	return &directoryLockGuard{f: f, path: absLockFilePath}, nil
+}
+
+// release removes the directory lock.
+func (g *directoryLockGuard) release() error {
+	err := g.f.Close()
+	if rmErr := os.Remove(g.path); err == nil {
+		err = rmErr
+	}
+	g.f = nil
+	g.path = ""
+
+	return err
+}
@@ -0,0 +1,166 @@
+package nyx
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+)
+
+const discardFname = "DISCARD"
+
+// discardStats keeps track of the amount of data that could be discarded for
+// a given value log file. It is stored in a memory-mapped file of fixed size
+// slots, each holding a fid and its discard bytes, sorted by fid.
+//
+// +-----------+----------------+
+// | fid(8 B)  | discard(8 B)   |
+// +-----------+----------------+
+//
+// Fid 0 marks an empty slot, value log fids start at 1.
+type discardStats struct {
+	sync.Mutex
+	*z.MmapFile
+	nextEmptySlot int
+}
+
+// initDiscardStats opens the DISCARD file in dir, creating it if needed.
+func initDiscardStats(dir string) (*discardStats, error) {
+	fname := filepath.Join(dir, discardFname)
+	mf, err := z.OpenMmapFile(fname, os.O_CREATE|os.O_RDWR, 1<<20)
+	lf := &discardStats{MmapFile: mf}
+	if errors.Is(err, z.NewFile) {
+		lf.zeroOut()
+	} else if err != nil {
+		return nil, fmt.Errorf("while opening file %q: %w", fname, err)
+	}
+
+	for slot := 0; slot < lf.maxSlot(); slot++ {
+		if lf.get(16*slot) == 0 {
+			lf.nextEmptySlot = slot
+			break
+		}
+	}
+	sort.Sort(lf)
+
+	return lf, nil
+}
+
+func (lf *discardStats) Len() int {
+	return lf.nextEmptySlot
+}
+
+func (lf *discardStats) Less(i, j int) bool {
+	return lf.get(16*i) < lf.get(16*j)
+}
+
+func (lf *discardStats) Swap(i, j int) {
+	left := lf.Data[16*i : 16*i+16]
+	right := lf.Data[16*j : 16*j+16]
+	var tmp [16]byte
+	copy(tmp[:], left)
+	copy(left, right)
+	copy(right, tmp[:])
+}
+
+// offset is the byte offset of the slot in the file.
+func (lf *discardStats) get(offset int) uint64 {
+	return binary.BigEndian.Uint64(lf.Data[offset : offset+8])
+}
+
+func (lf *discardStats) set(offset int, val uint64) {
+	binary.BigEndian.PutUint64(lf.Data[offset:offset+8], val)
+}
+
+// zeroOut zeroes out the next empty slot, which terminates the list.
+func (lf *discardStats) zeroOut() {
+	lf.set(lf.nextEmptySlot*16, 0)
+	lf.set(lf.nextEmptySlot*16+8, 0)
+}
+
+func (lf *discardStats) maxSlot() int {
+	return len(lf.Data) / 16
+}
+
+// Update adds discard bytes to the stats of fid and returns the new total.
+// A discard of 0 only reads the current value, a negative one resets it.
+func (lf *discardStats) Update(fidu uint32, discard int64) int64 {
+	fid := uint64(fidu)
+	lf.Lock()
+	defer lf.Unlock()
+
+	idx := sort.Search(lf.nextEmptySlot, func(slot int) bool {
+		return lf.get(slot*16) >= fid
+	})
+	if idx < lf.nextEmptySlot && lf.get(idx*16) == fid {
+		off := idx*16 + 8
+		curDisc := lf.get(off)
+		if discard == 0 {
+			return int64(curDisc)
+		}
+		if discard < 0 {
+			lf.set(off, 0)
+			return 0
+		}
+		lf.set(off, curDisc+uint64(discard))
+		return int64(curDisc + uint64(discard))
+	}
+	if discard <= 0 {
+		// No need to add a new entry.
+		return 0
+	}
+
+	// Could not find the fid. Add the entry, keeping room for the empty slot
+	// that terminates the list.
+	if lf.nextEmptySlot+1 >= lf.maxSlot() {
+		if err := lf.Truncate(2 * int64(len(lf.Data))); err != nil {
+			// The stats are only a hint for value log GC, losing an update is fine.
+			return 0
+		}
+	}
+	idx = lf.nextEmptySlot
+	lf.set(idx*16, fid)
+	lf.set(idx*16+8, uint64(discard))
+
+	// Move to next slot.
+	lf.nextEmptySlot++
+	lf.zeroOut()
+
+	sort.Sort(lf)
+	return discard
+}
+
+// Iterate calls f for every fid with its discard bytes, in ascending fid order.
+func (lf *discardStats) Iterate(f func(fid, stats uint64)) {
+	lf.Lock()
+	defer lf.Unlock()
+
+	for slot := 0; slot < lf.nextEmptySlot; slot++ {
+		idx := 16 * slot
+		f(lf.get(idx), lf.get(idx+8))
+	}
+}
+
+// MaxDiscard returns the fid with the most discard bytes, among those for
+// which keep returns true.
+func (lf *discardStats) MaxDiscard(keep func(fid uint32) bool) (uint32, int64) {
+	var maxFid, maxVal uint64
+	lf.Iterate(func(fid, val uint64) {
+		if maxVal < val && keep(uint32(fid)) {
+			maxVal = val
+			maxFid = fid
+		}
+	})
+
+	return uint32(maxFid), int64(maxVal)
+}
+
+// close unmaps the file, keeping its size.
+func (lf *discardStats) close() error {
+	return lf.Close(-1)
+}
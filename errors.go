@@ -0,0 +1,66 @@
+package nyx
+
+import "errors"
+
+var (
+	// ErrDirRequired is returned by Open when no Dir was configured.
+	ErrDirRequired = errors.New("dir is required")
+
+	// ErrDBClosed is returned when an operation is performed on a closed DB.
+	ErrDBClosed = errors.New("database is closed")
+
+	// ErrKeyNotFound is returned when key isn't found, or has been deleted.
+	ErrKeyNotFound = errors.New("key not found")
+
+	// ErrEmptyKey is returned if an empty key is passed on an update function.
+	ErrEmptyKey = errors.New("key cannot be empty")
+
+	// ErrEntryTooBig is returned if a key and value can't fit into an empty memtable.
+	ErrEntryTooBig = errors.New("entry is too big to fit in a memtable")
+
+	// ErrConflict is returned when a transaction conflicts with another transaction. This can
+	// happen if the read rows had been updated concurrently by another transaction.
+	ErrConflict = errors.New("transaction conflict, please retry")
+
+	// ErrReadOnlyTxn is returned if an update function is called on a read-only transaction.
+	ErrReadOnlyTxn = errors.New("no sets or deletes are allowed in a read-only transaction")
+
+	// ErrDiscardedTxn is returned if a previously discarded transaction is re-used.
+	ErrDiscardedTxn = errors.New("this transaction has been discarded, create a new one")
+
+	// ErrTxnTooBig is returned if too many writes are fit into a single transaction.
+	ErrTxnTooBig = errors.New("txn is too big to fit into one request")
+
+	// ErrInvalidRange is returned if the start of a range doesn't come before its end.
+	ErrInvalidRange = errors.New("start of range must be before its end")
+
+	// ErrInvalidRequest is returned if the user request is invalid.
+	ErrInvalidRequest = errors.New("invalid request")
+
+	// ErrNoRewrite is returned if a call for value log GC doesn't result in a log file rewrite.
+	ErrNoRewrite = errors.New("value log GC attempt didn't result in any cleanup")
+
+	// ErrRejected is returned if a value log GC is called while another one is running.
+	ErrRejected = errors.New("value log GC request rejected")
+
+	// ErrSnapshotReleased is returned if a snapshot is used after it was released.
+	ErrSnapshotReleased = errors.New("snapshot has been released")
+
+	// ErrInvalidEncryptionKey is returned if the encryption key isn't 16, 24 or 32 bytes long.
+	ErrInvalidEncryptionKey = errors.New("invalid encryption key")
+
+	// ErrEncryptionKeyMismatch is returned by Open if the database was encrypted with another
+	// encryption key, or the encryption key is missing.
+	ErrEncryptionKeyMismatch = errors.New("encryption key mismatch")
+
+	// ErrInvalidBackup is returned by Load if the backup is corrupt, or not a backup at all.
+	ErrInvalidBackup = errors.New("invalid backup")
+
+	// errNoRoom is returned internally when the active memtable is full but
+	// too many memtables are already waiting to be flushed.
+	errNoRoom = errors.New("no room for write")
+
+	// errTornMemTable is returned internally once a request was written to
+	// the active memtable partly. Nothing is written to it anymore.
+	errTornMemTable = errors.New("memtable holds a partly written request")
+)
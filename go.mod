@@ -2,12 +2,15 @@ module github.com/crazyfrankie/nyxdb
 
 go 1.23.4
 
-require github.com/stretchr/testify v1.10.0
+require (
+	github.com/dgraph-io/ristretto/v2 v2.1.0
+	github.com/klauspost/compress v1.18.0
+	github.com/stretchr/testify v1.10.0
+)
 
 require (
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/dgraph-io/ristretto/v2 v2.1.0 // indirect
 	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
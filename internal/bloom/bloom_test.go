@@ -0,0 +1,53 @@
+package bloom
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmptyFilter(t *testing.T) {
+	require.False(t, Filter(nil).MayContainKey([]byte("key")))
+
+	f := NewFilter(nil, 10)
+	for _, key := range []string{"", "a", "key", "hello world"} {
+		require.False(t, f.MayContainKey([]byte(key)), key)
+	}
+}
+
+func TestNoFalseNegatives(t *testing.T) {
+	for _, n := range []int{1, 10, 100, 1000, 10000} {
+		keys := make([]uint32, n)
+		for i := range keys {
+			keys[i] = Hash([]byte(fmt.Sprintf("key%05d", i)))
+		}
+		f := NewFilter(keys, 10)
+		for i := 0; i < n; i++ {
+			require.True(t, f.MayContainKey([]byte(fmt.Sprintf("key%05d", i))), "n=%d i=%d", n, i)
+		}
+	}
+}
+
+func TestFalsePositiveRate(t *testing.T) {
+	const n = 10000
+	keys := make([]uint32, n)
+	for i := range keys {
+		keys[i] = Hash([]byte(fmt.Sprintf("key%05d", i)))
+	}
+	// About 1% at 10 bits per key, and 40% at 2, which only get one probe.
+	for _, tc := range []struct {
+		bitsPerKey int
+		maxRate    float64
+	}{{10, 0.02}, {2, 0.45}} {
+		f := NewFilter(keys, tc.bitsPerKey)
+		var positives int
+		for i := 0; i < n; i++ {
+			if f.MayContainKey([]byte(fmt.Sprintf("absent%05d", i))) {
+				positives++
+			}
+		}
+		rate := float64(positives) / n
+		require.Less(t, rate, tc.maxRate, "bitsPerKey=%d", tc.bitsPerKey)
+	}
+}
@@ -0,0 +1,96 @@
+// Package compress compresses the SSTable blocks and the value log entries.
+package compress
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Type is a compression algorithm. It's stored along with the data it
+// compressed, so its values must never change.
+type Type byte
+
+const (
+	// None leaves the data as it is.
+	None Type = 0
+	// Snappy compresses fast, with a modest ratio.
+	Snappy Type = 1
+	// ZSTD compresses better than Snappy, at a higher CPU cost.
+	ZSTD Type = 2
+)
+
+// ErrUnknownType is returned when data was compressed with an unknown algorithm.
+var ErrUnknownType = errors.New("unknown compression type")
+
+func (t Type) String() string {
+	switch t {
+	case None:
+		return "none"
+	case Snappy:
+		return "snappy"
+	case ZSTD:
+		return "zstd"
+	}
+	return fmt.Sprintf("compression(%d)", byte(t))
+}
+
+// Valid returns whether t is a known algorithm.
+func (t Type) Valid() bool {
+	return t <= ZSTD
+}
+
+// The zstd encoder and decoder are safe for concurrent use of EncodeAll and
+// DecodeAll, and costly to create, so they are shared.
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			panic(err) // Only fails on invalid options.
+		}
+		return enc
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+		if err != nil {
+			panic(err) // Only fails on invalid options.
+		}
+		return dec
+	})
+)
+
+// Encode appends src compressed with t to dst[:0] and returns it.
+func Encode(t Type, dst, src []byte) ([]byte, error) {
+	switch t {
+	case None:
+		return append(dst[:0], src...), nil
+	case Snappy:
+		return snappy.Encode(dst[:cap(dst)], src), nil
+	case ZSTD:
+		return zstdEncoder().EncodeAll(src, dst[:0]), nil
+	}
+	return nil, fmt.Errorf("%w: %d", ErrUnknownType, byte(t))
+}
+
+// Decode appends src decompressed with t to dst[:0] and returns it.
+func Decode(t Type, dst, src []byte) ([]byte, error) {
+	switch t {
+	case None:
+		return append(dst[:0], src...), nil
+	case Snappy:
+		n, err := snappy.DecodedLen(src)
+		if err != nil {
+			return nil, err
+		}
+		if cap(dst) < n {
+			dst = make([]byte, n)
+		}
+		return snappy.Decode(dst[:n], src)
+	case ZSTD:
+		return zstdDecoder().DecodeAll(src, dst[:0])
+	}
+	return nil, fmt.Errorf("%w: %d", ErrUnknownType, byte(t))
+}
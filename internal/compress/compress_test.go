@@ -0,0 +1,28 @@
+package compress
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTrip(t *testing.T) {
+	src := bytes.Repeat([]byte("nyxdb compresses blocks "), 100)
+	for _, typ := range []Type{None, Snappy, ZSTD} {
+		enc, err := Encode(typ, nil, src)
+		require.NoError(t, err)
+		if typ != None {
+			require.Less(t, len(enc), len(src), typ.String())
+		}
+		dec, err := Decode(typ, make([]byte, 10), enc)
+		require.NoError(t, err)
+		require.Equal(t, src, dec, typ.String())
+	}
+
+	_, err := Encode(Type(9), nil, src)
+	require.ErrorIs(t, err, ErrUnknownType)
+	_, err = Decode(Type(9), nil, src)
+	require.ErrorIs(t, err, ErrUnknownType)
+	require.False(t, Type(9).Valid())
+}
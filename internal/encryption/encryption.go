@@ -0,0 +1,92 @@
+// Package encryption encrypts the data files with AES in counter mode.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// ErrKeyNotFound is returned when a file was encrypted with a data key the
+// registry doesn't know.
+var ErrKeyNotFound = errors.New("data key not found")
+
+// DataKey encrypts the data files. Its ID is stored in the files it encrypts,
+// so that they can be decrypted after newer keys have replaced it.
+type DataKey struct {
+	ID        uint64
+	Key       []byte
+	CreatedAt int64 // Unix time in seconds
+}
+
+// Registry looks up the data keys by their IDs.
+type Registry interface {
+	DataKey(id uint64) (*DataKey, error)
+}
+
+// ValidKeySize returns whether a key of n bytes selects AES-128, AES-192 or
+// AES-256.
+func ValidKeySize(n int) bool {
+	return n == 16 || n == 24 || n == 32
+}
+
+// GenerateIV returns n random bytes.
+func GenerateIV(n int) ([]byte, error) {
+	iv := make([]byte, n)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, fmt.Errorf("while generating IV: %w", err)
+	}
+	return iv, nil
+}
+
+// NewStream returns an AES-CTR stream with key, starting at the
+// aes.BlockSize long iv.
+func NewStream(key, iv []byte) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCTR(block, iv), nil
+}
+
+// XOR writes src encrypted, or decrypted, with key and iv to dst, which must
+// be at least as long as src.
+func XOR(dst, src, key, iv []byte) error {
+	stream, err := NewStream(key, iv)
+	if err != nil {
+		return err
+	}
+	stream.XORKeyStream(dst, src)
+	return nil
+}
+
+// Encrypt appends src encrypted with key to dst, followed by the random IV it
+// was encrypted with.
+func Encrypt(dst, src, key []byte) ([]byte, error) {
+	iv, err := GenerateIV(aes.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	n := len(dst)
+	dst = append(dst, src...)
+	if err := XOR(dst[n:], src, key, iv); err != nil {
+		return nil, err
+	}
+	return append(dst, iv...), nil
+}
+
+// Decrypt returns src, as returned by Encrypt, decrypted with key into a new
+// slice.
+func Decrypt(src, key []byte) ([]byte, error) {
+	if len(src) < aes.BlockSize {
+		return nil, errors.New("encrypted data shorter than its IV")
+	}
+	data, iv := src[:len(src)-aes.BlockSize], src[len(src)-aes.BlockSize:]
+	dst := make([]byte, len(data))
+	if err := XOR(dst, data, key, iv); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
@@ -0,0 +1,31 @@
+package encryption
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), 16)
+	src := []byte("nyxdb encrypts blocks")
+
+	enc, err := Encrypt([]byte("prefix"), src, key)
+	require.NoError(t, err)
+	require.Len(t, enc, len("prefix")+len(src)+16)
+	require.NotContains(t, string(enc), string(src))
+
+	dec, err := Decrypt(enc[len("prefix"):], key)
+	require.NoError(t, err)
+	require.Equal(t, src, dec)
+
+	other, err := Decrypt(enc[len("prefix"):], bytes.Repeat([]byte("x"), 16))
+	require.NoError(t, err)
+	require.NotEqual(t, src, other)
+
+	_, err = Decrypt(enc[:10], key)
+	require.Error(t, err)
+	_, err = Encrypt(nil, src, []byte("short"))
+	require.Error(t, err)
+}
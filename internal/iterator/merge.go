@@ -0,0 +1,199 @@
+package iterator
+
+import (
+	"bytes"
+	"container/heap"
+
+	"github.com/crazyfrankie/nyxdb/internal/kv"
+	"github.com/crazyfrankie/nyxdb/internal/util"
+)
+
+// MergeIterator merges multiple iterators into one sorted stream, using a heap
+// keyed by the current key of each iterator.
+//
+// The iterators must be ordered from the newest source to the oldest, e.g.
+// the active memtable first and the tables of the last level at the end.
+// When several of them hold an equal key, only the entry of the newest one is
+// returned and the others are skipped.
+//
+// NOTE: MergeIterator owns the array of iterators and is responsible for closing them.
+type MergeIterator struct {
+	h        mergeHeap
+	all      []*mergeItem
+	reversed bool
+	curKey   []byte
+	err      error
+
+	// OnSkip, if set, is called with every older duplicate skipped by Next.
+	// Compaction uses it to account for the entries it drops.
+	OnSkip func(key []byte, v kv.Value)
+}
+
+// mergeItem is an iterator with its position in the list of sources,
+// smaller positions are newer.
+type mergeItem struct {
+	iter Iterator
+	idx  int
+}
+
+// errorer is implemented by the iterators that can fail to read their source,
+// such as table iterators. They become invalid then.
+type errorer interface {
+	Err() error
+}
+
+// checkErr keeps the error that made item invalid, if any.
+func (m *MergeIterator) checkErr(item *mergeItem) {
+	if e, ok := item.iter.(errorer); ok && m.err == nil {
+		m.err = e.Err()
+	}
+}
+
+type mergeHeap struct {
+	items    []*mergeItem
+	reversed bool
+	cmp      util.Comparator
+}
+
+func (h *mergeHeap) Len() int { return len(h.items) }
+
+func (h *mergeHeap) Less(i, j int) bool {
+	cmp := util.CompareKeys(h.cmp, h.items[i].iter.Key(), h.items[j].iter.Key())
+	if cmp == 0 {
+		// The newer source comes first.
+		return h.items[i].idx < h.items[j].idx
+	}
+	if h.reversed {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func (h *mergeHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *mergeHeap) Push(x any) { h.items = append(h.items, x.(*mergeItem)) }
+
+func (h *mergeHeap) Pop() any {
+	old := h.items
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	h.items = old[:n-1]
+	return x
+}
+
+// NewMergeIterator creates a merge iterator. All iterators must move in the
+// direction given by reversed, over keys ordered by cmp.
+func NewMergeIterator(iters []Iterator, reversed bool, cmp util.Comparator) *MergeIterator {
+	m := &MergeIterator{
+		h:        mergeHeap{reversed: reversed, cmp: cmp},
+		all:      make([]*mergeItem, len(iters)),
+		reversed: reversed,
+	}
+	for i, it := range iters {
+		m.all[i] = &mergeItem{iter: it, idx: i}
+	}
+	return m
+}
+
+// initHeap rebuilds the heap from the iterators that are still valid.
+func (m *MergeIterator) initHeap() {
+	m.h.items = m.h.items[:0]
+	m.err = nil
+	for _, item := range m.all {
+		if item.iter.Valid() {
+			m.h.items = append(m.h.items, item)
+		} else {
+			m.checkErr(item)
+		}
+	}
+	heap.Init(&m.h)
+	m.setCurrent()
+}
+
+// setCurrent remembers the key of the top iterator, it's needed to skip the
+// same key in older sources once the top iterator moves on.
+func (m *MergeIterator) setCurrent() {
+	if len(m.h.items) == 0 {
+		m.curKey = m.curKey[:0]
+		return
+	}
+	m.curKey = append(m.curKey[:0], m.h.items[0].iter.Key()...)
+}
+
+// advanceTop moves the top iterator forward and restores the heap order.
+func (m *MergeIterator) advanceTop() {
+	top := m.h.items[0]
+	top.iter.Next()
+	if top.iter.Valid() {
+		heap.Fix(&m.h, 0)
+	} else {
+		m.checkErr(top)
+		heap.Pop(&m.h)
+	}
+}
+
+// Rewind seeks to the first key, or the last one if reversed.
+func (m *MergeIterator) Rewind() {
+	for _, item := range m.all {
+		item.iter.Rewind()
+	}
+	m.initHeap()
+}
+
+// Seek brings us to element with key >= given key, or <= key if reversed.
+func (m *MergeIterator) Seek(key []byte) {
+	for _, item := range m.all {
+		item.iter.Seek(key)
+	}
+	m.initHeap()
+}
+
+// Next moves to the next distinct key. Older duplicates of the current key are skipped.
+func (m *MergeIterator) Next() {
+	if !m.Valid() {
+		return
+	}
+	m.advanceTop()
+	for m.Valid() && bytes.Equal(m.h.items[0].iter.Key(), m.curKey) {
+		if m.OnSkip != nil {
+			top := m.h.items[0].iter
+			m.OnSkip(top.Key(), top.Value())
+		}
+		m.advanceTop()
+	}
+	m.setCurrent()
+}
+
+// Valid returns whether the MergeIterator is at a valid element. It isn't
+// once one of the iterators fails.
+func (m *MergeIterator) Valid() bool {
+	return m.err == nil && len(m.h.items) > 0
+}
+
+// Err returns the error of the first iterator that failed, if any.
+func (m *MergeIterator) Err() error {
+	return m.err
+}
+
+// Key returns the key associated with the current iterator.
+func (m *MergeIterator) Key() []byte {
+	return m.h.items[0].iter.Key()
+}
+
+// Value returns the value associated with the iterator.
+func (m *MergeIterator) Value() kv.Value {
+	return m.h.items[0].iter.Value()
+}
+
+// Close implements Iterator. It closes all the underlying iterators, and
+// returns the error of the first one that failed, if any.
+func (m *MergeIterator) Close() error {
+	firstErr := m.err
+	for _, item := range m.all {
+		if err := item.iter.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,132 @@
+package iterator
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crazyfrankie/nyxdb/internal/kv"
+	"github.com/crazyfrankie/nyxdb/internal/util"
+	"github.com/crazyfrankie/nyxdb/skl"
+)
+
+func key(i int) []byte {
+	return util.KeyWithTs([]byte(fmt.Sprintf("key%03d", i)), 0)
+}
+
+// newList returns a SkipList holding key(i) for every i in keys, valued with name.
+func newList(name string, keys ...int) *skl.SkipList {
+	l := skl.NewSkipList(1<<20, nil)
+	for _, i := range keys {
+		l.Put(key(i), kv.Value{Value: []byte(name)})
+	}
+	return l
+}
+
+type entry struct {
+	key int
+	val string
+}
+
+func collect(t *testing.T, it Iterator) []entry {
+	var out []entry
+	for ; it.Valid(); it.Next() {
+		var i int
+		_, err := fmt.Sscanf(string(util.ParseKey(it.Key())), "key%03d", &i)
+		require.NoError(t, err)
+		out = append(out, entry{key: i, val: string(it.Value().Value)})
+	}
+	return out
+}
+
+func TestMergeIterator(t *testing.T) {
+	newest := newList("newest", 1, 4, 7)
+	middle := newList("middle", 2, 4, 5, 7)
+	oldest := newList("oldest", 0, 4, 5, 9)
+
+	newMerge := func(reversed bool) *MergeIterator {
+		return NewMergeIterator([]Iterator{
+			newest.NewUniIterator(reversed),
+			middle.NewUniIterator(reversed),
+			oldest.NewUniIterator(reversed),
+		}, reversed, util.BytewiseComparator)
+	}
+	expected := []entry{
+		{0, "oldest"}, {1, "newest"}, {2, "middle"}, {4, "newest"},
+		{5, "middle"}, {7, "newest"}, {9, "oldest"},
+	}
+
+	it := newMerge(false)
+	it.Rewind()
+	require.Equal(t, expected, collect(t, it))
+	it.Seek(key(3))
+	require.Equal(t, expected[3:], collect(t, it))
+	it.Seek(key(10))
+	require.False(t, it.Valid())
+	require.NoError(t, it.Close())
+
+	reversed := make([]entry, 0, len(expected))
+	for i := len(expected) - 1; i >= 0; i-- {
+		reversed = append(reversed, expected[i])
+	}
+	rit := newMerge(true)
+	rit.Rewind()
+	require.Equal(t, reversed, collect(t, rit))
+	rit.Seek(key(6))
+	require.Equal(t, reversed[2:], collect(t, rit))
+	require.NoError(t, rit.Close())
+
+	var skipped []string
+	it = newMerge(false)
+	it.OnSkip = func(key []byte, v kv.Value) {
+		skipped = append(skipped, fmt.Sprintf("%s:%s", util.ParseKey(key), v.Value))
+	}
+	it.Rewind()
+	require.Equal(t, expected, collect(t, it))
+	require.Equal(t, []string{"key004:middle", "key004:oldest", "key005:oldest", "key007:middle"}, skipped)
+	require.NoError(t, it.Close())
+}
+
+func TestMergeIteratorEmpty(t *testing.T) {
+	it := NewMergeIterator([]Iterator{newList("a").NewUniIterator(false)}, false, util.BytewiseComparator)
+	it.Rewind()
+	require.False(t, it.Valid())
+	it.Next()
+	require.False(t, it.Valid())
+	require.NoError(t, it.Close())
+
+	it = NewMergeIterator(nil, false, util.BytewiseComparator)
+	it.Rewind()
+	require.False(t, it.Valid())
+}
+
+// failingIterator fails once it moves past the entries of its skiplist.
+type failingIterator struct {
+	Iterator
+	err error
+}
+
+func (it *failingIterator) Next() {
+	it.Iterator.Next()
+	if !it.Iterator.Valid() {
+		it.err = errors.New("unreadable")
+	}
+}
+
+func (it *failingIterator) Valid() bool { return it.err == nil && it.Iterator.Valid() }
+
+func (it *failingIterator) Err() error { return it.err }
+
+func TestMergeIteratorErr(t *testing.T) {
+	failing := &failingIterator{Iterator: newList("failing", 1, 2).NewUniIterator(false)}
+	it := NewMergeIterator([]Iterator{newList("other", 0, 3, 4).NewUniIterator(false), failing}, false, util.BytewiseComparator)
+	it.Rewind()
+	require.NoError(t, it.Err())
+
+	// The keys of the other iterator aren't returned past the failure.
+	require.Equal(t, []entry{{0, "other"}, {1, "failing"}, {2, "failing"}}, collect(t, it))
+	require.EqualError(t, it.Err(), "unreadable")
+	require.EqualError(t, it.Close(), "unreadable")
+}
@@ -0,0 +1,35 @@
+package kv
+
+import "github.com/crazyfrankie/nyxdb/internal/util"
+
+// RangeTombstone deletes the versions older than Version of all the user keys
+// in [Start, End).
+type RangeTombstone struct {
+	Start   []byte
+	End     []byte
+	Version uint64
+}
+
+// Covers returns true if the user key is in the range of the tombstone, as
+// ordered by cmp.
+func (rt RangeTombstone) Covers(cmp util.Comparator, key []byte) bool {
+	return cmp.Compare(rt.Start, key) <= 0 && cmp.Compare(key, rt.End) < 0
+}
+
+// Deletes returns true if the tombstone deletes the version of the user key.
+func (rt RangeTombstone) Deletes(cmp util.Comparator, key []byte, version uint64) bool {
+	return version < rt.Version && rt.Covers(cmp, key)
+}
+
+// DeletedBelow returns the newest version, not newer than readTs, of the
+// tombstones covering the user key. The versions of the key older than it
+// are deleted as of readTs. It returns 0 if no tombstone covers the key.
+func DeletedBelow(cmp util.Comparator, tombs []RangeTombstone, key []byte, readTs uint64) uint64 {
+	var version uint64
+	for _, rt := range tombs {
+		if rt.Version <= readTs && rt.Version > version && rt.Covers(cmp, key) {
+			version = rt.Version
+		}
+	}
+	return version
+}
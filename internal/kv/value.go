@@ -1,6 +1,9 @@
 package kv
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"time"
+)
 
 // Value represents value information that can be associated with a key
 // and also contains internal Meta information.
@@ -54,3 +57,39 @@ func (v *Value) Encode(b []byte) uint32 {
 
 	return uint32(2 + size + n)
 }
+
+// Bits stored in Value.Meta. They are internal to Nyx and never exposed to users,
+// who have UserMeta for their own flags.
+const (
+	// BitDelete is set if the key has been deleted.
+	BitDelete byte = 1 << 0
+	// BitValuePointer is set if Value holds a pointer into the value log
+	// instead of the value itself.
+	BitValuePointer byte = 1 << 1
+	// BitTxn is set on the log entries written by a transaction.
+	BitTxn byte = 1 << 2
+	// BitFinTxn marks the log entry that ends the entries of a transaction.
+	BitFinTxn byte = 1 << 3
+	// BitRangeDelete marks a log entry holding a range tombstone. Its key is
+	// the start of the range and its value the end.
+	BitRangeDelete byte = 1 << 4
+	// BitCompressed is set on the value log entries whose value is
+	// compressed. The value starts with the compression type.
+	BitCompressed byte = 1 << 5
+)
+
+// IsDeleted returns true if the value is a delete tombstone.
+func (v *Value) IsDeleted() bool {
+	return v.Meta&BitDelete > 0
+}
+
+// IsExpired returns true if the value has an expiry time that has passed.
+func (v *Value) IsExpired() bool {
+	return v.ExpiresAt != 0 && v.ExpiresAt <= uint64(time.Now().Unix())
+}
+
+// IsDeletedOrExpired returns true if the value is a tombstone or has expired,
+// either way it must not be read anymore.
+func (v *Value) IsDeletedOrExpired() bool {
+	return v.IsDeleted() || v.IsExpired()
+}
@@ -0,0 +1,56 @@
+package util
+
+import "bytes"
+
+// Comparator defines the order of the user keys. Two keys that compare equal
+// must be equal byte by byte, so that they hash alike in the bloom filters.
+type Comparator interface {
+	// Compare returns -1, 0 or +1 depending on whether a is less than, equal
+	// to or greater than b.
+	Compare(a, b []byte) int
+
+	// Separator appends to dst a key k, a <= k < b, that is preferably
+	// shorter than a. It's only called with a < b, and appending a itself
+	// is always correct.
+	Separator(dst, a, b []byte) []byte
+
+	// Successor appends to dst a key k >= a that is preferably shorter than
+	// a. Appending a itself is always correct.
+	Successor(dst, a []byte) []byte
+}
+
+// BytewiseComparator orders the keys lexicographically by bytes.
+var BytewiseComparator Comparator = bytewiseComparator{}
+
+type bytewiseComparator struct{}
+
+func (bytewiseComparator) Compare(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+func (bytewiseComparator) Separator(dst, a, b []byte) []byte {
+	n := min(len(a), len(b))
+	i := 0
+	for i < n && a[i] == b[i] {
+		i++
+	}
+	// a is a prefix of b, or incrementing the first differing byte of a
+	// doesn't leave it below b.
+	if i < n && a[i] < 0xff && a[i]+1 < b[i] {
+		dst = append(dst, a[:i+1]...)
+		dst[len(dst)-1]++
+		return dst
+	}
+	return append(dst, a...)
+}
+
+func (bytewiseComparator) Successor(dst, a []byte) []byte {
+	for i, c := range a {
+		if c != 0xff {
+			dst = append(dst, a[:i+1]...)
+			dst[len(dst)-1]++
+			return dst
+		}
+	}
+	return append(dst, a...)
+}
@@ -22,13 +22,13 @@ func ParseTs(key []byte) uint64 {
 	return math.MaxUint64 - binary.BigEndian.Uint64(key[len(key)-8:])
 }
 
-// CompareKeys checks the key without timestamp and checks the timestamp if keyNoTs
-// is same.
+// CompareKeys orders the keys without timestamp by cmp, and the versions of the
+// same key by the timestamp, newest first.
 // a<timestamp> would be sorted higher than aa<timestamp> if we use bytes.compare
 // All keys should have timestamp.
-func CompareKeys(key1, key2 []byte) int {
-	if cmp := bytes.Compare(key1[:len(key1)-8], key2[:len(key2)-8]); cmp != 0 {
-		return cmp
+func CompareKeys(cmp Comparator, key1, key2 []byte) int {
+	if c := cmp.Compare(key1[:len(key1)-8], key2[:len(key2)-8]); c != 0 {
+		return c
 	}
 	return bytes.Compare(key1[len(key1)-8:], key2[len(key2)-8:])
 }
@@ -38,5 +38,13 @@ func SameKey(src, dst []byte) bool {
 	if len(src) != len(dst) {
 		return false
 	}
-	return bytes.Equal(src, dst)
+	return bytes.Equal(ParseKey(src), ParseKey(dst))
+}
+
+// ParseKey parses the actual key from the key bytes.
+func ParseKey(key []byte) []byte {
+	if key == nil {
+		return nil
+	}
+	return key[:len(key)-8]
 }
@@ -0,0 +1,34 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSameKey(t *testing.T) {
+	require.True(t, SameKey(KeyWithTs([]byte("key"), 1), KeyWithTs([]byte("key"), 2)))
+	require.False(t, SameKey(KeyWithTs([]byte("key"), 1), KeyWithTs([]byte("kez"), 1)))
+	require.False(t, SameKey(KeyWithTs([]byte("key"), 1), KeyWithTs([]byte("key0"), 1)))
+}
+
+func TestBytewiseComparator(t *testing.T) {
+	cmp := BytewiseComparator
+	for _, tc := range []struct {
+		a, b, want string
+	}{
+		{"abc", "abd", "abc"},
+		{"abc", "abz", "abd"},
+		{"ab", "abc", "ab"},
+		{"a\xff", "b", "a\xff"},
+		{"abcd", "c", "b"},
+	} {
+		got := string(cmp.Separator(nil, []byte(tc.a), []byte(tc.b)))
+		require.Equal(t, tc.want, got, "%q %q", tc.a, tc.b)
+		require.LessOrEqual(t, cmp.Compare([]byte(tc.a), []byte(got)), 0)
+		require.Negative(t, cmp.Compare([]byte(got), []byte(tc.b)))
+	}
+	require.Equal(t, "b", string(cmp.Successor(nil, []byte("abc"))))
+	require.Equal(t, "\xff\xffb", string(cmp.Successor(nil, []byte("\xff\xffabc"))))
+	require.Equal(t, "\xff\xff", string(cmp.Successor(nil, []byte("\xff\xff"))))
+}
@@ -0,0 +1,139 @@
+package util
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// WaterMark is used to keep track of the minimum un-finished index. Typically, an index k becomes
+// finished or "done" according to a WaterMark once Done(k) has been called
+//  1. as many times as Begin(k) has, AND
+//  2. a positive number of times.
+//
+// An index may also become "done" by calling SetDoneUntil at a time such that it is not
+// inter-mingled with Begin/Done calls.
+type WaterMark struct {
+	doneUntil atomic.Uint64
+	lastIndex atomic.Uint64
+
+	mu      sync.Mutex
+	pending map[uint64]int // Begin calls minus Done calls, by index.
+	indices uint64Heap     // Indices in pending, to find the lowest one.
+	waiters map[uint64][]chan struct{}
+}
+
+// NewWaterMark returns a WaterMark with nothing done yet.
+func NewWaterMark() *WaterMark {
+	return &WaterMark{
+		pending: make(map[uint64]int),
+		waiters: make(map[uint64][]chan struct{}),
+	}
+}
+
+// Begin sets the last index to the given value.
+func (w *WaterMark) Begin(index uint64) {
+	w.lastIndex.Store(index)
+	w.process(index, 1)
+}
+
+// Done sets a single index as done.
+func (w *WaterMark) Done(index uint64) {
+	w.process(index, -1)
+}
+
+// DoneUntil returns the maximum index that has the property that all indices
+// less than or equal to it are done.
+func (w *WaterMark) DoneUntil() uint64 {
+	return w.doneUntil.Load()
+}
+
+// SetDoneUntil sets the maximum index that has the property that all indices
+// less than or equal to it are done.
+func (w *WaterMark) SetDoneUntil(val uint64) {
+	w.doneUntil.Store(val)
+}
+
+// LastIndex returns the last index for which Begin has been called.
+func (w *WaterMark) LastIndex() uint64 {
+	return w.lastIndex.Load()
+}
+
+// WaitForMark waits until the given index is marked as done.
+func (w *WaterMark) WaitForMark(ctx context.Context, index uint64) error {
+	if w.DoneUntil() >= index {
+		return nil
+	}
+
+	w.mu.Lock()
+	if w.DoneUntil() >= index {
+		w.mu.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	w.waiters[index] = append(w.waiters[index], ch)
+	w.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-ch:
+		return nil
+	}
+}
+
+// process applies delta to the pending count of index, then advances
+// doneUntil past every index that is done and wakes up its waiters.
+func (w *WaterMark) process(index uint64, delta int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	prev, present := w.pending[index]
+	if !present {
+		heap.Push(&w.indices, index)
+	}
+	w.pending[index] = prev + delta
+
+	doneUntil := w.DoneUntil()
+	until := doneUntil
+	for len(w.indices) > 0 {
+		min := w.indices[0]
+		if done := w.pending[min]; done > 0 {
+			break // len(indices) will be > 0.
+		}
+		// Even if done is called multiple times causing it to become
+		// negative, we should still pop the index.
+		heap.Pop(&w.indices)
+		delete(w.pending, min)
+		until = min
+	}
+	if until <= doneUntil {
+		return
+	}
+	w.doneUntil.Store(until)
+
+	for idx, toNotify := range w.waiters {
+		if idx <= until {
+			for _, ch := range toNotify {
+				close(ch)
+			}
+			delete(w.waiters, idx)
+		}
+	}
+}
+
+// uint64Heap is a min-heap of indices.
+type uint64Heap []uint64
+
+func (u uint64Heap) Len() int            { return len(u) }
+func (u uint64Heap) Less(i, j int) bool  { return u[i] < u[j] }
+func (u uint64Heap) Swap(i, j int)       { u[i], u[j] = u[j], u[i] }
+func (u *uint64Heap) Push(x interface{}) { *u = append(*u, x.(uint64)) }
+func (u *uint64Heap) Pop() interface{} {
+	old := *u
+	n := len(old)
+	x := old[n-1]
+	*u = old[0 : n-1]
+	return x
+}
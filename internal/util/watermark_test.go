@@ -0,0 +1,55 @@
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaterMark(t *testing.T) {
+	w := NewWaterMark()
+	w.SetDoneUntil(10)
+
+	w.Begin(11)
+	w.Begin(12)
+	w.Begin(12)
+	require.Equal(t, uint64(12), w.LastIndex())
+	require.Equal(t, uint64(10), w.DoneUntil())
+
+	// 12 is done only once both of its Begin calls are matched.
+	w.Done(12)
+	require.Equal(t, uint64(10), w.DoneUntil())
+	w.Done(11)
+	require.Equal(t, uint64(11), w.DoneUntil())
+	w.Done(12)
+	require.Equal(t, uint64(12), w.DoneUntil())
+}
+
+func TestWaterMarkWait(t *testing.T) {
+	w := NewWaterMark()
+	w.SetDoneUntil(1)
+	require.NoError(t, w.WaitForMark(context.Background(), 1))
+
+	w.Begin(2)
+	w.Begin(3)
+	waited := make(chan error, 1)
+	go func() {
+		waited <- w.WaitForMark(context.Background(), 3)
+	}()
+
+	w.Done(3)
+	select {
+	case <-waited:
+		t.Fatal("WaitForMark returned before 2 was done")
+	case <-time.After(20 * time.Millisecond):
+	}
+	w.Done(2)
+	require.NoError(t, <-waited)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w.Begin(4)
+	require.ErrorIs(t, w.WaitForMark(ctx, 4), context.Canceled)
+}
@@ -0,0 +1,459 @@
+package nyx
+
+import (
+	"bytes"
+	"math"
+	"sync"
+
+	"github.com/crazyfrankie/nyxdb/internal/iterator"
+	"github.com/crazyfrankie/nyxdb/internal/kv"
+	"github.com/crazyfrankie/nyxdb/internal/util"
+	"github.com/crazyfrankie/nyxdb/table"
+)
+
+// IteratorOptions is used to set options when iterating over Nyx key-value stores.
+type IteratorOptions struct {
+	// PrefetchValues reads the values of the next PrefetchSize items in the
+	// background, so those stored in the value log are ready by the time
+	// Item.Value is called.
+	PrefetchValues bool
+	// PrefetchSize is the number of items to prefetch the values of, 100 if unset.
+	PrefetchSize int
+
+	// Reverse iterates from the biggest key to the smallest one.
+	Reverse bool
+
+	// AllVersions returns every version of a key that hasn't been discarded
+	// by compaction, tombstones included, instead of only the newest one.
+	// Versions are returned from the newest to the oldest, or the other way
+	// around if Reverse is set. Versions deleted by DeleteRange are skipped.
+	AllVersions bool
+
+	// Prefix limits iteration to the keys starting with it. Unless the keys
+	// are ordered by BytewiseComparator, it doesn't narrow the keys that are
+	// read, set the bounds as well for that.
+	Prefix []byte
+	// LowerBound limits iteration to the keys at or above it.
+	LowerBound []byte
+	// UpperBound limits iteration to the keys below it.
+	UpperBound []byte
+}
+
+const defaultPrefetchSize = 100
+
+// keyBounds limits iteration to the user keys in [lower, upper) that start
+// with prefix. A nil bound leaves that side open.
+type keyBounds struct {
+	cmp    Comparator
+	lower  []byte
+	upper  []byte
+	prefix []byte
+}
+
+// newKeyBounds returns the bounds set by opt. With the byte order, the keys
+// starting with the prefix are a range, which narrows the bounds. With any
+// other order, every key within the bounds is checked for the prefix.
+func newKeyBounds(opt IteratorOptions, cmp Comparator) keyBounds {
+	b := keyBounds{cmp: cmp, lower: opt.LowerBound, upper: opt.UpperBound, prefix: opt.Prefix}
+	if len(opt.Prefix) == 0 || cmp != BytewiseComparator {
+		return b
+	}
+	if b.lower == nil || cmp.Compare(opt.Prefix, b.lower) > 0 {
+		b.lower = opt.Prefix
+	}
+	if end := prefixEnd(opt.Prefix); end != nil && (b.upper == nil || cmp.Compare(end, b.upper) < 0) {
+		b.upper = end
+	}
+	return b
+}
+
+// prefixEnd returns the smallest key bigger than all the keys starting with
+// prefix, or nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// contains returns whether the user key is within the bounds, regardless of
+// the prefix.
+func (b keyBounds) contains(key []byte) bool {
+	return (b.lower == nil || b.cmp.Compare(key, b.lower) >= 0) &&
+		(b.upper == nil || b.cmp.Compare(key, b.upper) < 0)
+}
+
+// hasPrefix returns whether the user key starts with the prefix.
+func (b keyBounds) hasPrefix(key []byte) bool {
+	return bytes.HasPrefix(key, b.prefix)
+}
+
+// overlaps returns whether t may hold keys within the bounds.
+func (b keyBounds) overlaps(t *table.Table) bool {
+	return (b.lower == nil || b.cmp.Compare(util.ParseKey(t.Biggest()), b.lower) >= 0) &&
+		(b.upper == nil || b.cmp.Compare(util.ParseKey(t.Smallest()), b.upper) < 0)
+}
+
+// Item is returned during iteration. Both the Key() and Value() output is
+// only valid until Next() is called on the iterator.
+type Item struct {
+	key     []byte
+	version uint64
+	vs      kv.Value
+	db      *DB
+
+	// Set if the value is prefetched, wg is done once val or err are.
+	prefetched bool
+	wg         sync.WaitGroup
+	val        []byte
+	err        error
+}
+
+// Key returns the key.
+//
+// Key is only valid as long as item is valid, or transaction is valid. If you
+// need to use it outside its validity, please use KeyCopy.
+func (item *Item) Key() []byte {
+	return item.key
+}
+
+// KeyCopy returns a copy of the key of the item, writing it to dst slice.
+// If nil is passed, or capacity of dst isn't sufficient, a new slice would be
+// allocated and returned.
+func (item *Item) KeyCopy(dst []byte) []byte {
+	return append(dst[:0], item.key...)
+}
+
+// Version returns the commit timestamp of the item.
+func (item *Item) Version() uint64 {
+	return item.version
+}
+
+// IsDeleted returns true if the item is a tombstone. Only iterators with
+// AllVersions set return those.
+func (item *Item) IsDeleted() bool {
+	return item.vs.IsDeleted()
+}
+
+// IsDeletedOrExpired returns true if the item is a tombstone or has expired.
+// Only iterators with AllVersions set return those.
+func (item *Item) IsDeletedOrExpired() bool {
+	return item.vs.IsDeletedOrExpired()
+}
+
+// ExpiresAt returns a Unix time value indicating when the item will be
+// considered expired. 0 indicates that the item will never expire.
+func (item *Item) ExpiresAt() uint64 {
+	return item.vs.ExpiresAt
+}
+
+// Value retrieves the value of the item, reading it from the value log if
+// needed, and calls fn with it. The slice passed to fn is only valid within
+// fn, use ValueCopy to keep the value around.
+func (item *Item) Value(fn func(val []byte) error) error {
+	if item.prefetched {
+		item.wg.Wait()
+		if item.err != nil {
+			return item.err
+		}
+		return fn(item.val)
+	}
+
+	val, err := item.readValue()
+	if err != nil {
+		return err
+	}
+
+	return fn(val)
+}
+
+// readValue returns the value of the item, reading it from the value log if
+// it's stored there.
+func (item *Item) readValue() ([]byte, error) {
+	if item.vs.Meta&kv.BitValuePointer == 0 {
+		return item.vs.Value, nil
+	}
+
+	var vp valuePointer
+	vp.Decode(item.vs.Value)
+	return item.db.vlog.read(vp)
+}
+
+// ValueCopy returns a copy of the value of the item, writing it to dst slice.
+// If nil is passed, or capacity of dst isn't sufficient, a new slice would be
+// allocated and returned.
+func (item *Item) ValueCopy(dst []byte) ([]byte, error) {
+	err := item.Value(func(val []byte) error {
+		dst = append(dst[:0], val...)
+		return nil
+	})
+
+	return dst, err
+}
+
+// Iterator helps iterating over the KV pairs in a lexicographically sorted
+// order. For each key, only the newest version not newer than the read
+// timestamp is returned, and deleted keys are skipped, unless AllVersions is
+// set.
+type Iterator struct {
+	iitr   *iterator.MergeIterator
+	db     *DB
+	readTs uint64
+	opt    IteratorOptions
+	bounds keyBounds
+	tombs  []kv.RangeTombstone // range tombstones of the merged sources
+
+	// items holds the item at the current position, followed by the next
+	// ones if values are prefetched.
+	items    []*Item
+	prefetch sync.WaitGroup
+	release  func() // called on Close, if set
+	closed   bool
+}
+
+// NewIterator returns an iterator over the latest committed keys, as of the
+// moment it's created. Like a snapshot, it holds back compaction of the
+// versions it reads, so it must be closed once it isn't needed anymore.
+func (d *DB) NewIterator(opt IteratorOptions) (*Iterator, error) {
+	if d.isClosed.Load() {
+		return nil, ErrDBClosed
+	}
+
+	readTs := d.orc.readTs()
+	it := d.newIterator(readTs, opt)
+	it.release = func() { d.orc.readMark.Done(readTs) }
+
+	return it, nil
+}
+
+// newIterator returns an iterator over the keys as of readTs. It merges the
+// memtables and the tables that may hold keys within the bounds of opt, which
+// stay alive until the iterator is closed.
+func (d *DB) newIterator(readTs uint64, opt IteratorOptions) *Iterator {
+	tables, decr := d.getMemTables()
+	defer decr()
+
+	// Value log files rewritten by GC are kept until the iterator is closed.
+	d.vlog.incrReaders()
+
+	if opt.PrefetchValues && opt.PrefetchSize <= 0 {
+		opt.PrefetchSize = defaultPrefetchSize
+	}
+	bounds := newKeyBounds(opt, d.opt.Comparator)
+	iters := make([]iterator.Iterator, 0, len(tables)+len(d.lc.levels))
+	var tombs []kv.RangeTombstone
+	for _, mt := range tables {
+		iters = append(iters, mt.skl.NewUniIterator(opt.Reverse))
+		tombs = append(tombs, mt.rangeTombstones()...)
+	}
+	iters, tombs = d.lc.appendIterators(iters, tombs, bounds, opt.Reverse)
+
+	// Only the range tombstones visible at readTs matter.
+	visible := tombs[:0]
+	for _, rt := range tombs {
+		if rt.Version <= readTs {
+			visible = append(visible, rt)
+		}
+	}
+
+	return &Iterator{
+		iitr:   iterator.NewMergeIterator(iters, opt.Reverse, d.opt.Comparator),
+		db:     d,
+		readTs: readTs,
+		opt:    opt,
+		bounds: bounds,
+		tombs:  visible,
+	}
+}
+
+// Item returns pointer to the current key-value pair.
+// This item is only valid until it.Next() gets called.
+func (it *Iterator) Item() *Item {
+	if len(it.items) == 0 {
+		return nil
+	}
+	return it.items[0]
+}
+
+// Valid returns false when iteration is done.
+func (it *Iterator) Valid() bool {
+	return len(it.items) > 0
+}
+
+// Err returns the error of a table that couldn't be read, if any. The
+// iteration stops at it, so it should be checked once Valid returns false
+// to tell an early end from a complete one.
+func (it *Iterator) Err() error {
+	return it.iitr.Err()
+}
+
+// Rewind would rewind the iterator cursor all the way to zero-th position,
+// which would be the smallest key if iterating forward, and largest if
+// iterating backward.
+func (it *Iterator) Rewind() {
+	switch {
+	case !it.opt.Reverse && it.bounds.lower != nil:
+		it.iitr.Seek(util.KeyWithTs(it.bounds.lower, math.MaxUint64))
+	case it.opt.Reverse && it.bounds.upper != nil:
+		// Right before the newest version of the upper bound.
+		it.iitr.Seek(util.KeyWithTs(it.bounds.upper, math.MaxUint64))
+	default:
+		it.iitr.Rewind()
+	}
+	it.fill(true)
+}
+
+// Seek would seek to the provided key if present. If absent, it would seek to
+// the next smallest key greater than the provided key if iterating in the
+// forward direction. Behavior would be reversed if iterating backwards.
+func (it *Iterator) Seek(key []byte) {
+	switch {
+	case !it.opt.Reverse && it.bounds.lower != nil && it.bounds.cmp.Compare(key, it.bounds.lower) < 0,
+		it.opt.Reverse && it.bounds.upper != nil && it.bounds.cmp.Compare(key, it.bounds.upper) >= 0:
+		it.Rewind()
+		return
+	case !it.opt.Reverse:
+		it.iitr.Seek(util.KeyWithTs(key, math.MaxUint64))
+	default:
+		it.iitr.Seek(util.KeyWithTs(key, 0))
+	}
+	it.fill(true)
+}
+
+// Next would advance the iterator by one. Always check it.Valid() after a
+// Next() to ensure you have access to a valid it.Item().
+func (it *Iterator) Next() {
+	it.fill(false)
+}
+
+// fill drops the current item, or all of them if reset is set, and parses the
+// next items until as many are ready as values are prefetched for.
+func (it *Iterator) fill(reset bool) {
+	if reset {
+		clear(it.items)
+		it.items = it.items[:0]
+	} else if len(it.items) > 0 {
+		it.items[0] = nil
+		it.items = it.items[1:]
+	}
+
+	size := 1
+	if it.opt.PrefetchValues {
+		size = it.opt.PrefetchSize
+	}
+	for len(it.items) < size {
+		item := it.parseItem()
+		if item == nil {
+			return
+		}
+		if it.opt.PrefetchValues {
+			it.prefetchValue(item)
+		}
+		it.items = append(it.items, item)
+	}
+}
+
+// prefetchValue reads the value of item in the background.
+func (it *Iterator) prefetchValue(item *Item) {
+	item.prefetched = true
+	item.wg.Add(1)
+	it.prefetch.Add(1)
+	go func() {
+		defer it.prefetch.Done()
+		defer item.wg.Done()
+		val, err := item.readValue()
+		// The value may alias the memtable or the table it was read from.
+		item.val, item.err = append([]byte{}, val...), err
+	}()
+}
+
+// parseItem moves past the versions of the next user key and returns the one
+// visible at readTs, or nil once iteration is done. Forward iteration sees the
+// versions of a key from the newest to the oldest, reverse iteration the
+// other way around.
+func (it *Iterator) parseItem() *Item {
+	if it.opt.AllVersions {
+		return it.parseVersion()
+	}
+	for it.iitr.Valid() {
+		userKey := append([]byte{}, util.ParseKey(it.iitr.Key())...)
+		if !it.bounds.contains(userKey) {
+			return nil
+		}
+		var item *Item
+		for ; it.iitr.Valid(); it.iitr.Next() {
+			key := it.iitr.Key()
+			if !bytes.Equal(util.ParseKey(key), userKey) {
+				break
+			}
+			version := util.ParseTs(key)
+			if version > it.readTs || (item != nil && !it.opt.Reverse) {
+				continue
+			}
+			item = &Item{key: userKey, version: version, vs: it.iitr.Value(), db: it.db}
+		}
+		if item != nil && it.bounds.hasPrefix(userKey) && !item.vs.IsDeletedOrExpired() &&
+			!it.rangeDeleted(userKey, item.version) {
+			return item
+		}
+	}
+	return nil
+}
+
+// parseVersion returns the next version not newer than readTs, or nil once
+// iteration is done.
+func (it *Iterator) parseVersion() *Item {
+	for ; it.iitr.Valid(); it.iitr.Next() {
+		key := it.iitr.Key()
+		if !it.bounds.contains(util.ParseKey(key)) {
+			return nil
+		}
+		version := util.ParseTs(key)
+		if version > it.readTs || !it.bounds.hasPrefix(util.ParseKey(key)) ||
+			it.rangeDeleted(util.ParseKey(key), version) {
+			continue
+		}
+		item := &Item{
+			key:     append([]byte{}, util.ParseKey(key)...),
+			version: version,
+			vs:      it.iitr.Value(),
+			db:      it.db,
+		}
+		it.iitr.Next()
+		return item
+	}
+	return nil
+}
+
+// rangeDeleted returns whether the version of the user key is deleted by a
+// range tombstone.
+func (it *Iterator) rangeDeleted(key []byte, version uint64) bool {
+	if len(it.tombs) == 0 {
+		return false
+	}
+	return version < kv.DeletedBelow(it.db.opt.Comparator, it.tombs, key, it.readTs)
+}
+
+// Close would close the iterator. It is important to call this when you're
+// done with iteration. It returns the error reported by Err as well.
+func (it *Iterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	it.items = nil
+
+	// The value log files being read from must outlive the prefetches.
+	it.prefetch.Wait()
+	err := it.iitr.Close()
+	it.db.vlog.decrReaders()
+	if it.release != nil {
+		it.release()
+	}
+
+	return err
+}
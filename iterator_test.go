@@ -0,0 +1,339 @@
+package nyx
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crazyfrankie/nyxdb/table"
+)
+
+// version is a version of a key seen by an iterator with AllVersions set.
+type version struct {
+	key     string
+	value   string
+	deleted bool
+}
+
+func collectVersions(t *testing.T, it *Iterator) []version {
+	var out []version
+	var lastKey string
+	var lastVersion uint64
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		val, err := item.ValueCopy(nil)
+		require.NoError(t, err)
+		if string(item.Key()) == lastKey {
+			if it.opt.Reverse {
+				require.Greater(t, item.Version(), lastVersion)
+			} else {
+				require.Less(t, item.Version(), lastVersion)
+			}
+		}
+		lastKey, lastVersion = string(item.Key()), item.Version()
+		out = append(out, version{key: lastKey, value: string(val), deleted: item.IsDeleted()})
+	}
+	return out
+}
+
+func TestIteratorAllVersions(t *testing.T) {
+	dir := t.TempDir()
+	opts := []Option{WithNumLevelZeroTables(2), WithNumVersionsToKeep(3)}
+	key := func(i int) string { return fmt.Sprintf("key%d", i) }
+	value := func(i, round int) string { return fmt.Sprintf("value%d-%d", i, round) }
+	put := func(db *DB, i, round int) {
+		require.NoError(t, db.Put([]byte(key(i)), []byte(value(i, round))))
+	}
+
+	const n = 5
+	db := openTestDB(t, dir, opts...)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < n; i++ {
+			put(db, i, round)
+		}
+	}
+	require.NoError(t, db.Close())
+
+	// Both level 0 tables are compacted together on the next open.
+	db = openTestDB(t, dir, opts...)
+	for round := 3; round < 5; round++ {
+		for i := 0; i < n; i++ {
+			put(db, i, round)
+		}
+	}
+	require.NoError(t, db.Delete([]byte(key(0))))
+	require.NoError(t, db.Delete([]byte(key(1))))
+	put(db, 1, 5)
+	require.NoError(t, db.Close())
+
+	db = openTestDB(t, dir, opts...)
+	defer db.Close()
+	waitForCompaction(t, db)
+	require.Empty(t, levelLayout(db)[0])
+
+	var want []version
+	want = append(want, version{key: key(1), value: value(1, 5)}, version{key: key(1), deleted: true})
+	for i := 2; i < n; i++ {
+		for round := 4; round > 1; round-- {
+			want = append(want, version{key: key(i), value: value(i, round)})
+		}
+	}
+
+	snap, err := db.Snapshot()
+	require.NoError(t, err)
+	defer snap.Release()
+	it, err := snap.NewIterator(IteratorOptions{AllVersions: true})
+	require.NoError(t, err)
+	require.Equal(t, want, collectVersions(t, it))
+	require.NoError(t, it.Close())
+
+	it, err = snap.NewIterator(IteratorOptions{AllVersions: true, Reverse: true})
+	require.NoError(t, err)
+	got := collectVersions(t, it)
+	require.NoError(t, it.Close())
+	for i, j := 0, len(got)-1; i < j; i, j = i+1, j-1 {
+		got[i], got[j] = got[j], got[i]
+	}
+	require.Equal(t, want, got)
+
+	// Without AllVersions only the latest live versions are returned.
+	it, err = snap.NewIterator(IteratorOptions{})
+	require.NoError(t, err)
+	defer it.Close()
+	it.Rewind()
+	keys, vals := collect(t, it)
+	require.Equal(t, []string{key(1), key(2), key(3), key(4)}, keys)
+	require.Equal(t, []string{value(1, 5), value(2, 4), value(3, 4), value(4, 4)}, vals)
+}
+
+func TestIteratorBounds(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), WithValueThreshold(64))
+	defer db.Close()
+
+	keys := []string{"a", "a/1", "a/2", "a/3", "a\xff", "a\xff\xff/1", "b", "b/1", "c"}
+	for _, k := range keys {
+		require.NoError(t, db.Put([]byte(k), []byte("value-"+k)))
+	}
+	require.NoError(t, db.Delete([]byte("a/2")))
+
+	scan := func(opt IteratorOptions) (fwd, rev []string) {
+		it, err := db.NewIterator(opt)
+		require.NoError(t, err)
+		it.Rewind()
+		fwd, _ = collect(t, it)
+		require.NoError(t, it.Close())
+
+		opt.Reverse = true
+		it, err = db.NewIterator(opt)
+		require.NoError(t, err)
+		it.Rewind()
+		rev, _ = collect(t, it)
+		require.NoError(t, it.Close())
+		slices.Reverse(rev)
+		return fwd, rev
+	}
+	for _, tc := range []struct {
+		opt  IteratorOptions
+		want []string
+	}{
+		{IteratorOptions{}, []string{"a", "a/1", "a/3", "a\xff", "a\xff\xff/1", "b", "b/1", "c"}},
+		{IteratorOptions{Prefix: []byte("a/")}, []string{"a/1", "a/3"}},
+		{IteratorOptions{Prefix: []byte("a\xff")}, []string{"a\xff", "a\xff\xff/1"}},
+		{IteratorOptions{Prefix: []byte("a\xff\xff")}, []string{"a\xff\xff/1"}},
+		{IteratorOptions{Prefix: []byte("d")}, nil},
+		{IteratorOptions{LowerBound: []byte("a/3"), UpperBound: []byte("b/1")}, []string{"a/3", "a\xff", "a\xff\xff/1", "b"}},
+		{IteratorOptions{LowerBound: []byte("b")}, []string{"b", "b/1", "c"}},
+		{IteratorOptions{UpperBound: []byte("a/3")}, []string{"a", "a/1"}},
+		{IteratorOptions{Prefix: []byte("a"), LowerBound: []byte("a/2"), UpperBound: []byte("b")}, []string{"a/3", "a\xff", "a\xff\xff/1"}},
+		{IteratorOptions{Prefix: []byte("b"), UpperBound: []byte("a")}, nil},
+	} {
+		fwd, rev := scan(tc.opt)
+		require.Equal(t, tc.want, fwd, "%+v", tc.opt)
+		require.Equal(t, tc.want, rev, "%+v", tc.opt)
+	}
+
+	// Seeking outside the bounds lands on their edge.
+	it, err := db.NewIterator(IteratorOptions{Prefix: []byte("a/")})
+	require.NoError(t, err)
+	it.Seek([]byte("a"))
+	got, _ := collect(t, it)
+	require.Equal(t, []string{"a/1", "a/3"}, got)
+	it.Seek([]byte("a/2"))
+	got, _ = collect(t, it)
+	require.Equal(t, []string{"a/3"}, got)
+	it.Seek([]byte("b"))
+	require.False(t, it.Valid())
+	require.NoError(t, it.Close())
+
+	it, err = db.NewIterator(IteratorOptions{Prefix: []byte("a/"), Reverse: true})
+	require.NoError(t, err)
+	it.Seek([]byte("z"))
+	got, _ = collect(t, it)
+	require.Equal(t, []string{"a/3", "a/1"}, got)
+	it.Seek([]byte("a/2"))
+	got, _ = collect(t, it)
+	require.Equal(t, []string{"a/1"}, got)
+	require.NoError(t, it.Close())
+}
+
+func TestIteratorPrefetchValues(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), WithValueThreshold(64))
+	defer db.Close()
+
+	const n = 500
+	value := func(i int) []byte { return bytes.Repeat([]byte{byte(i)}, 10+i%2*100) }
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%03d", i)), value(i)))
+	}
+
+	for _, reverse := range []bool{false, true} {
+		it, err := db.NewIterator(IteratorOptions{PrefetchValues: true, PrefetchSize: 10, Reverse: reverse})
+		require.NoError(t, err)
+		var count int
+		for it.Rewind(); it.Valid(); it.Next() {
+			i := count
+			if reverse {
+				i = n - 1 - count
+			}
+			require.Equal(t, fmt.Sprintf("key%03d", i), string(it.Item().Key()))
+			val, err := it.Item().ValueCopy(nil)
+			require.NoError(t, err)
+			require.Equal(t, value(i), val)
+			count++
+		}
+		require.Equal(t, n, count)
+		// Closing in the middle waits for the prefetches still running.
+		it.Seek([]byte("key100"))
+		require.True(t, it.Valid())
+		require.NoError(t, it.Close())
+	}
+}
+
+func TestIteratorSkipsTables(t *testing.T) {
+	dir := t.TempDir()
+	opts := []Option{WithNumLevelZeroTables(10)}
+	for _, prefix := range []string{"a/", "b/", "c/"} {
+		db := openTestDB(t, dir, opts...)
+		for i := 0; i < 10; i++ {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("%s%d", prefix, i)), []byte("value")))
+		}
+		require.NoError(t, db.Close())
+	}
+
+	db := openTestDB(t, dir, opts...)
+	defer db.Close()
+	require.Len(t, levelLayout(db)[0], 3)
+
+	for _, tc := range []struct {
+		opt  IteratorOptions
+		want int
+	}{
+		{IteratorOptions{}, 3},
+		{IteratorOptions{Prefix: []byte("b/")}, 1},
+		{IteratorOptions{Prefix: []byte("d/")}, 0},
+		{IteratorOptions{LowerBound: []byte("b/5")}, 2},
+		{IteratorOptions{UpperBound: []byte("b/")}, 1},
+	} {
+		iters, _ := db.lc.appendIterators(nil, nil, newKeyBounds(tc.opt, db.opt.Comparator), false)
+		require.Len(t, iters, tc.want, "%+v", tc.opt)
+		for _, it := range iters {
+			require.NoError(t, it.Close())
+		}
+	}
+
+	it, err := db.NewIterator(IteratorOptions{Prefix: []byte("b/")})
+	require.NoError(t, err)
+	it.Rewind()
+	keys, _ := collect(t, it)
+	require.Len(t, keys, 10)
+
+	// The iterator holds back compaction of the versions it reads.
+	require.NoError(t, db.Put([]byte("b/0"), []byte("again")))
+	_, err = db.Get([]byte("b/0"))
+	require.NoError(t, err)
+	require.LessOrEqual(t, db.orc.discardAtOrBelow(), it.readTs)
+	require.NoError(t, it.Close())
+	require.Greater(t, db.orc.discardAtOrBelow(), it.readTs)
+}
+
+// reverseComparator orders the keys by bytes, backwards.
+type reverseComparator struct{}
+
+func (reverseComparator) Compare(a, b []byte) int           { return bytes.Compare(b, a) }
+func (reverseComparator) Separator(dst, a, _ []byte) []byte { return append(dst, a...) }
+func (reverseComparator) Successor(dst, a []byte) []byte    { return append(dst, a...) }
+
+func TestIteratorComparator(t *testing.T) {
+	dir := t.TempDir()
+	opts := []Option{WithComparator(reverseComparator{}), WithMemTableSize(16 << 10)}
+	db := openTestDB(t, dir, opts...)
+
+	const n = 1000
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%04d", i)) }
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put(key(i), []byte("value")))
+	}
+	// The range is given in the order of the comparator.
+	require.ErrorIs(t, db.DeleteRange(key(10), key(20)), ErrInvalidRange)
+	require.NoError(t, db.DeleteRange(key(20), key(10)))
+	require.NoError(t, db.Close())
+
+	db = openTestDB(t, dir, opts...)
+	defer db.Close()
+	it, err := db.NewIterator(IteratorOptions{})
+	require.NoError(t, err)
+	it.Rewind()
+	keys, _ := collect(t, it)
+	require.NoError(t, it.Close())
+
+	var want []string
+	for i := n - 1; i >= 0; i-- {
+		if i <= 10 || i > 20 {
+			want = append(want, string(key(i)))
+		}
+	}
+	require.Equal(t, want, keys)
+
+	_, err = db.Get(key(15))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = db.Get(key(10))
+	require.NoError(t, err)
+
+	it, err = db.NewIterator(IteratorOptions{Prefix: []byte("key09"), LowerBound: []byte("key0950")})
+	require.NoError(t, err)
+	it.Rewind()
+	keys, _ = collect(t, it)
+	require.NoError(t, it.Close())
+	require.Len(t, keys, 51)
+	require.Equal(t, "key0950", keys[0])
+}
+
+func TestIteratorErr(t *testing.T) {
+	dir := t.TempDir()
+	opts := append(compactionTestOptions(), WithBaseLevelSize(16<<20))
+	db := openTestDB(t, dir, opts...)
+	var entries []testEntry
+	for i := 0; i < 500; i++ {
+		entries = append(entries, testEntry{fmt.Sprintf("key%03d", i), 1, "value"})
+	}
+	addTestTable(t, db, 1, entries...)
+	require.NoError(t, db.Close())
+
+	db = openTestDB(t, dir, opts...)
+	defer db.Close()
+	corruptFile(t, db.lc.levels[1].tables[0].Filename(), db.lc.levels[1].tables[0].Size()/3)
+
+	// The scan ends at the corrupt block, which tells it from a complete one.
+	it, err := db.NewIterator(IteratorOptions{})
+	require.NoError(t, err)
+	var n int
+	for it.Rewind(); it.Valid(); it.Next() {
+		n++
+	}
+	require.Less(t, n, len(entries))
+	require.ErrorIs(t, it.Err(), table.ErrChecksumMismatch)
+	require.ErrorIs(t, it.Close(), table.ErrChecksumMismatch)
+}
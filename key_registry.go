@@ -0,0 +1,356 @@
+package nyx
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+
+	"github.com/crazyfrankie/nyxdb/internal/encryption"
+)
+
+const (
+	// KeyRegistryFilename is the filename of the key registry.
+	KeyRegistryFilename        = "KEYREGISTRY"
+	keyRegistryRewriteFilename = "KEYREGISTRY-REWRITE"
+
+	// keyRegistryMagic is written at the start of the key registry, "NYXK".
+	keyRegistryMagic   uint32 = 0x4e59584b
+	keyRegistryVersion uint32 = 1
+
+	// keyRegistryHeaderSize is the size of the header of the key registry.
+	// +----------+------------+--------+------------+
+	// | magic(4) | version(4) | iv(16) | sanity(16) |
+	// +----------+------------+--------+------------+
+	keyRegistryHeaderSize = 8 + aes.BlockSize + len(sanityText)
+)
+
+// sanityText is stored in the key registry encrypted with the master key, to
+// tell whether the registry is opened with the right one.
+const sanityText = "nyx key registry"
+
+// keyRegistry holds the data keys the files are encrypted with. The data keys
+// are stored in the KEYREGISTRY file, encrypted with the master key given in
+// the options. A new data key replaces the latest one once it's older than
+// EncryptionKeyRotationDuration, the older ones are kept to read the files
+// they encrypted.
+//
+// Without a master key there is no registry file and no data key, nothing is
+// encrypted.
+type keyRegistry struct {
+	sync.RWMutex
+	fp        *os.File
+	dir       string
+	masterKey []byte
+	rotation  time.Duration
+	dataKeys  map[uint64]*encryption.DataKey
+	lastID    uint64
+}
+
+// openKeyRegistry opens the key registry in dir, or creates it if it doesn't
+// exist and masterKey is set. It returns ErrEncryptionKeyMismatch if the
+// registry was written with another master key.
+func openKeyRegistry(dir string, masterKey []byte, rotation time.Duration) (*keyRegistry, error) {
+	kr := &keyRegistry{
+		dir:       dir,
+		masterKey: masterKey,
+		rotation:  rotation,
+		dataKeys:  make(map[uint64]*encryption.DataKey),
+	}
+	path := filepath.Join(dir, KeyRegistryFilename)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		if masterKey == nil {
+			return kr, nil
+		}
+		return kr, kr.rewrite(masterKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if masterKey == nil {
+		return nil, fmt.Errorf("key registry %q exists, but no encryption key is set: %w",
+			path, ErrEncryptionKeyMismatch)
+	}
+
+	end, err := kr.replay(data)
+	if err != nil {
+		return nil, err
+	}
+	if kr.fp, err = os.OpenFile(path, os.O_RDWR, 0); err != nil {
+		return nil, err
+	}
+	// Drop a half-written data key at the end.
+	if err := kr.fp.Truncate(int64(end)); err != nil {
+		kr.fp.Close()
+		return nil, err
+	}
+	if _, err := kr.fp.Seek(int64(end), 0); err != nil {
+		kr.fp.Close()
+		return nil, err
+	}
+
+	return kr, nil
+}
+
+// replay decodes the key registry file data and returns the offset just past
+// the last complete data key.
+func (kr *keyRegistry) replay(data []byte) (int, error) {
+	if len(data) < keyRegistryHeaderSize || binary.BigEndian.Uint32(data[0:4]) != keyRegistryMagic {
+		return 0, errors.New("key registry has bad magic")
+	}
+	if version := binary.BigEndian.Uint32(data[4:8]); version != keyRegistryVersion {
+		return 0, fmt.Errorf("key registry has unsupported version: %d (we support %d)",
+			version, keyRegistryVersion)
+	}
+	iv := data[8 : 8+aes.BlockSize]
+	sanity := make([]byte, len(sanityText))
+	if err := encryption.XOR(sanity, data[8+aes.BlockSize:keyRegistryHeaderSize], kr.masterKey, iv); err != nil {
+		return 0, err
+	}
+	if string(sanity) != sanityText {
+		return 0, ErrEncryptionKeyMismatch
+	}
+
+	offset := keyRegistryHeaderSize
+	for len(data)-offset >= 8 {
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		if length > len(data)-offset-8 {
+			break
+		}
+		buf := data[offset+8 : offset+8+length]
+		if crc32.Checksum(buf, castagnoli) != binary.BigEndian.Uint32(data[offset+4:]) {
+			// A torn write at the end of the file, stop here.
+			break
+		}
+		dk, err := kr.decodeDataKey(buf)
+		if err != nil {
+			return 0, err
+		}
+		kr.dataKeys[dk.ID] = dk
+		kr.lastID = max(kr.lastID, dk.ID)
+		offset += 8 + length
+	}
+
+	return offset, nil
+}
+
+// encodeDataKey encodes dk with its key encrypted with the master key as:
+// keyID(8) | createdAt(8) | iv(16) | key
+func (kr *keyRegistry) encodeDataKey(dk *encryption.DataKey, masterKey []byte) ([]byte, error) {
+	iv, err := encryption.GenerateIV(aes.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 16, 16+len(iv)+len(dk.Key))
+	binary.BigEndian.PutUint64(buf[0:8], dk.ID)
+	binary.BigEndian.PutUint64(buf[8:16], uint64(dk.CreatedAt))
+	buf = append(buf, iv...)
+	buf = append(buf, dk.Key...)
+	if err := encryption.XOR(buf[16+len(iv):], dk.Key, masterKey, iv); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (kr *keyRegistry) decodeDataKey(buf []byte) (*encryption.DataKey, error) {
+	if len(buf) < 16+aes.BlockSize {
+		return nil, errors.New("key registry holds a truncated data key")
+	}
+	dk := &encryption.DataKey{
+		ID:        binary.BigEndian.Uint64(buf[0:8]),
+		CreatedAt: int64(binary.BigEndian.Uint64(buf[8:16])),
+		Key:       make([]byte, len(buf)-16-aes.BlockSize),
+	}
+	iv := buf[16 : 16+aes.BlockSize]
+	if err := encryption.XOR(dk.Key, buf[16+aes.BlockSize:], kr.masterKey, iv); err != nil {
+		return nil, err
+	}
+	return dk, nil
+}
+
+// rewrite writes all the data keys, encrypted with masterKey, to a new
+// registry file and atomically renames it over the old one. The registry uses
+// masterKey from then on. Must be called with the lock held, or before the
+// registry is shared.
+func (kr *keyRegistry) rewrite(masterKey []byte) error {
+	iv, err := encryption.GenerateIV(aes.BlockSize)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, keyRegistryHeaderSize)
+	binary.BigEndian.PutUint32(buf[0:4], keyRegistryMagic)
+	binary.BigEndian.PutUint32(buf[4:8], keyRegistryVersion)
+	copy(buf[8:], iv)
+	if err := encryption.XOR(buf[8+aes.BlockSize:], []byte(sanityText), masterKey, iv); err != nil {
+		return err
+	}
+	for id := uint64(1); id <= kr.lastID; id++ {
+		dk, ok := kr.dataKeys[id]
+		if !ok {
+			continue
+		}
+		rec, err := kr.encodeDataKey(dk, masterKey)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, encodeRecord(rec)...)
+	}
+
+	rewritePath := filepath.Join(kr.dir, keyRegistryRewriteFilename)
+	fp, err := os.OpenFile(rewritePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(buf); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	// In Windows the files should be closed before doing a Rename.
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	if kr.fp != nil {
+		if err := kr.fp.Close(); err != nil {
+			return err
+		}
+		kr.fp = nil
+	}
+	path := filepath.Join(kr.dir, KeyRegistryFilename)
+	if err := os.Rename(rewritePath, path); err != nil {
+		return err
+	}
+	if kr.fp, err = os.OpenFile(path, os.O_RDWR, 0); err != nil {
+		return err
+	}
+	if _, err := kr.fp.Seek(0, 2); err != nil {
+		return err
+	}
+	kr.masterKey = masterKey
+
+	return z.SyncDir(kr.dir)
+}
+
+// DataKey returns the data key with id.
+func (kr *keyRegistry) DataKey(id uint64) (*encryption.DataKey, error) {
+	if kr == nil {
+		return nil, fmt.Errorf("data key %d: %w", id, encryption.ErrKeyNotFound)
+	}
+	kr.RLock()
+	defer kr.RUnlock()
+
+	dk, ok := kr.dataKeys[id]
+	if !ok {
+		return nil, fmt.Errorf("data key %d: %w", id, encryption.ErrKeyNotFound)
+	}
+	return dk, nil
+}
+
+// latestDataKey returns the data key new files are encrypted with, or nil if
+// encryption is disabled. A new data key is generated once the latest one is
+// older than the rotation duration.
+func (kr *keyRegistry) latestDataKey() (*encryption.DataKey, error) {
+	if kr == nil {
+		return nil, nil
+	}
+	valid := func(dk *encryption.DataKey) bool {
+		return dk != nil && time.Since(time.Unix(dk.CreatedAt, 0)) < kr.rotation
+	}
+
+	// The master key is replaced by rotateMasterKey, though never with nil.
+	kr.RLock()
+	encrypted, dk := kr.masterKey != nil, kr.dataKeys[kr.lastID]
+	kr.RUnlock()
+	if !encrypted {
+		return nil, nil
+	}
+	if valid(dk) {
+		return dk, nil
+	}
+
+	kr.Lock()
+	defer kr.Unlock()
+	if dk := kr.dataKeys[kr.lastID]; valid(dk) {
+		return dk, nil
+	}
+	return kr.newDataKey()
+}
+
+// newDataKey generates a data key as long as the master key, and appends it
+// to the registry file. Must be called with the lock held.
+func (kr *keyRegistry) newDataKey() (*encryption.DataKey, error) {
+	key, err := encryption.GenerateIV(len(kr.masterKey))
+	if err != nil {
+		return nil, err
+	}
+	dk := &encryption.DataKey{ID: kr.lastID + 1, Key: key, CreatedAt: time.Now().Unix()}
+	rec, err := kr.encodeDataKey(dk, kr.masterKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := kr.fp.Write(encodeRecord(rec)); err != nil {
+		return nil, fmt.Errorf("while writing data key: %w", err)
+	}
+	if err := kr.fp.Sync(); err != nil {
+		return nil, fmt.Errorf("while syncing key registry: %w", err)
+	}
+	kr.dataKeys[dk.ID] = dk
+	kr.lastID = dk.ID
+
+	return dk, nil
+}
+
+// rotateMasterKey re-encrypts the data keys with masterKey.
+func (kr *keyRegistry) rotateMasterKey(masterKey []byte) error {
+	kr.Lock()
+	defer kr.Unlock()
+
+	if kr.masterKey == nil {
+		return fmt.Errorf("%w: the database isn't encrypted", ErrInvalidRequest)
+	}
+	return kr.rewrite(masterKey)
+}
+
+func (kr *keyRegistry) close() error {
+	if kr == nil || kr.fp == nil {
+		return nil
+	}
+	return kr.fp.Close()
+}
+
+// RotateMasterKey re-encrypts the data keys in the key registry with newKey,
+// which has to be passed to WithEncryptionKey from the next Open on. The data
+// files are left as they are, they're encrypted with the data keys. Use Rekey
+// to re-encrypt them under new data keys offline.
+//
+// It returns ErrInvalidRequest if the DB isn't encrypted.
+func (d *DB) RotateMasterKey(newKey []byte) error {
+	if d.isClosed.Load() {
+		return ErrDBClosed
+	}
+	if !encryption.ValidKeySize(len(newKey)) {
+		return fmt.Errorf("%w: must be 16, 24 or 32 bytes, got %d", ErrInvalidEncryptionKey, len(newKey))
+	}
+	if err := d.registry.rotateMasterKey(newKey); err != nil {
+		return fmt.Errorf("while rotating master key: %w", err)
+	}
+
+	return nil
+}
+
+// isEncrypted reports whether the file header of a log file names a data key.
+func isEncrypted(header []byte) bool {
+	return !bytes.Equal(header[:8], make([]byte, 8))
+}
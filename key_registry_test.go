@@ -0,0 +1,65 @@
+package nyx
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotateMasterKey(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, newKey := bytes.Repeat([]byte("o"), 16), bytes.Repeat([]byte("n"), 16)
+	db := openTestDB(t, dir, WithEncryptionKey(oldKey))
+	require.NoError(t, db.Put([]byte("key"), []byte("value")))
+	require.ErrorIs(t, db.RotateMasterKey([]byte("short")), ErrInvalidEncryptionKey)
+	require.NoError(t, db.RotateMasterKey(newKey))
+	// Data keys generated after the rotation are stored with the new key.
+	db.registry.Lock()
+	_, err := db.registry.newDataKey()
+	db.registry.Unlock()
+	require.NoError(t, err)
+	require.NoError(t, db.Put([]byte("key2"), []byte("value2")))
+	require.NoError(t, db.Close())
+	require.ErrorIs(t, db.RotateMasterKey(newKey), ErrDBClosed)
+
+	_, err = Open(WithDir(dir), WithEncryptionKey(oldKey))
+	require.ErrorIs(t, err, ErrEncryptionKeyMismatch)
+	db = openTestDB(t, dir, WithEncryptionKey(newKey))
+	require.Len(t, db.registry.dataKeys, 2)
+	for k, v := range map[string]string{"key": "value", "key2": "value2"} {
+		val, err := db.Get([]byte(k))
+		require.NoError(t, err)
+		require.Equal(t, v, string(val))
+	}
+	require.NoError(t, db.Close())
+
+	db = openTestDB(t, t.TempDir())
+	require.ErrorIs(t, db.RotateMasterKey(newKey), ErrInvalidRequest)
+	require.NoError(t, db.Close())
+}
+
+func TestRotateMasterKeyConcurrentWrites(t *testing.T) {
+	oldKey, newKey := bytes.Repeat([]byte("o"), 16), bytes.Repeat([]byte("n"), 16)
+	db := openTestDB(t, t.TempDir(), WithEncryptionKey(oldKey), WithEncryptionKeyRotationDuration(time.Nanosecond))
+	defer db.Close()
+
+	// Every new file asks for the latest data key while the master key is
+	// being replaced.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			require.NoError(t, db.RotateMasterKey([][]byte{newKey, oldKey}[i%2]))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		dk, err := db.registry.latestDataKey()
+		require.NoError(t, err)
+		require.NotNil(t, dk)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,322 @@
+package nyx
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/crazyfrankie/nyxdb/internal/iterator"
+	"github.com/crazyfrankie/nyxdb/internal/kv"
+	"github.com/crazyfrankie/nyxdb/internal/util"
+	"github.com/crazyfrankie/nyxdb/table"
+)
+
+type levelHandler struct {
+	// Guards tables, totalSize.
+	sync.RWMutex
+
+	// For level >= 1, tables are sorted by key ranges, which do not overlap.
+	// For level 0, tables are sorted by time.
+	// For level 0, newest table are at the back. Compact the oldest one first, which is at the front.
+	tables    []*table.Table
+	totalSize int64
+
+	// The following are initialized once and const.
+	level int
+	db    *DB
+}
+
+func newLevelHandler(db *DB, level int) *levelHandler {
+	return &levelHandler{
+		level: level,
+		db:    db,
+	}
+}
+
+// initTables replaces s.tables with given tables. This is done during loading.
+func (s *levelHandler) initTables(tables []*table.Table) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.tables = tables
+	s.totalSize = 0
+	for _, t := range tables {
+		s.totalSize += t.Size()
+	}
+
+	if s.level == 0 {
+		// Key range will overlap. Just sort by fileID in ascending order
+		// because newer tables are at the end of level 0.
+		sort.Slice(s.tables, func(i, j int) bool {
+			return s.tables[i].ID() < s.tables[j].ID()
+		})
+	} else {
+		// Sort tables by keys.
+		sort.Slice(s.tables, func(i, j int) bool {
+			return util.CompareKeys(s.db.opt.Comparator, s.tables[i].Smallest(), s.tables[j].Smallest()) < 0
+		})
+	}
+}
+
+// addTable appends t to level 0, as its newest table.
+func (s *levelHandler) addTable(t *table.Table) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.tables = append(s.tables, t)
+	s.totalSize += t.Size()
+}
+
+// deleteTables remove tables idx0, ..., idx1-1.
+func (s *levelHandler) deleteTables(toDel []*table.Table) {
+	s.Lock()
+	defer s.Unlock()
+
+	toDelMap := make(map[uint64]struct{})
+	for _, t := range toDel {
+		toDelMap[t.ID()] = struct{}{}
+	}
+
+	// Make a copy as iterators might be keeping a slice of tables.
+	var newTables []*table.Table
+	for _, t := range s.tables {
+		if _, found := toDelMap[t.ID()]; !found {
+			newTables = append(newTables, t)
+			continue
+		}
+		s.totalSize -= t.Size()
+	}
+	s.tables = newTables
+}
+
+// replaceTables will replace tables[left:right] with newTables. Note this EXCLUDES tables[right].
+// You must call decr() to delete the old tables _after_ writing the update to the manifest.
+func (s *levelHandler) replaceTables(toDel, toAdd []*table.Table) {
+	// Need to re-search the range of tables in this level to be replaced as other goroutines might
+	// be changing it as well.  (They can't touch our tables, but if they add/remove other tables,
+	// the indices get shifted around.)
+	s.Lock() // We s.Unlock() below.
+	defer s.Unlock()
+
+	toDelMap := make(map[uint64]struct{})
+	for _, t := range toDel {
+		toDelMap[t.ID()] = struct{}{}
+	}
+	var newTables []*table.Table
+	for _, t := range s.tables {
+		if _, found := toDelMap[t.ID()]; !found {
+			newTables = append(newTables, t)
+			continue
+		}
+		s.totalSize -= t.Size()
+	}
+
+	// Increase totalSize first.
+	for _, t := range toAdd {
+		s.totalSize += t.Size()
+		newTables = append(newTables, t)
+	}
+
+	// Assign tables.
+	s.tables = newTables
+	sort.Slice(s.tables, func(i, j int) bool {
+		return util.CompareKeys(s.db.opt.Comparator, s.tables[i].Smallest(), s.tables[j].Smallest()) < 0
+	})
+}
+
+func (s *levelHandler) numTables() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.tables)
+}
+
+func (s *levelHandler) getTotalSize() int64 {
+	s.RLock()
+	defer s.RUnlock()
+	return s.totalSize
+}
+
+// getTableForKey acquires a read-lock to access s.tables. It returns a list of tableHandlers
+// that may hold key, newest first, and a function to release them.
+func (s *levelHandler) getTableForKey(key []byte) ([]*table.Table, func()) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.level == 0 {
+		// For level 0, we need to check every table. Remember to make a copy as s.tables may change
+		// once we exit this function, and we don't want to lock s.tables while seeking in tables.
+		// CAUTION: Reverse the tables.
+		out := make([]*table.Table, 0, len(s.tables))
+		for i := len(s.tables) - 1; i >= 0; i-- {
+			out = append(out, s.tables[i])
+			s.tables[i].IncrRef()
+		}
+		return out, func() {
+			for _, t := range out {
+				t.DecrRef()
+			}
+		}
+	}
+	// For level >= 1, we can do a binary search as key range does not overlap.
+	idx := sort.Search(len(s.tables), func(i int) bool {
+		return util.CompareKeys(s.db.opt.Comparator, s.tables[i].Biggest(), key) >= 0
+	})
+	if idx >= len(s.tables) {
+		// Given key is strictly > than every element we have.
+		return nil, func() {}
+	}
+	tbl := s.tables[idx]
+	tbl.IncrRef()
+	return []*table.Table{tbl}, func() { tbl.DecrRef() }
+}
+
+// get returns the newest version of the user key in key that is not newer than
+// the version of key. The tables of level 0 are all searched, as a version
+// rewritten by value log GC may be in a newer table than later versions.
+// It fails if a table can't be read, rather than miss the versions there.
+func (s *levelHandler) get(key []byte) (kv.Value, bool, error) {
+	tables, decr := s.getTableForKey(key)
+	defer decr()
+
+	hash := bloomHash(key)
+	var maxVs kv.Value
+	var found bool
+	for _, t := range tables {
+		if s.db.lc.skipTable(t, hash) {
+			continue
+		}
+		it := t.NewIterator(false)
+		it.Seek(key)
+		if err := it.Err(); err != nil {
+			it.Close()
+			return kv.Value{}, false, fmt.Errorf("while reading table %d: %w", t.ID(), err)
+		}
+		if !it.Valid() || !bytes.Equal(util.ParseKey(key), util.ParseKey(it.Key())) {
+			// No version of the key at or below its version is there. Versions
+			// newer than it are counted as well, rather than seeking again.
+			if t.HasBloomFilter() {
+				s.db.metrics.bloomFalsePositives.Add(1)
+			}
+			it.Close()
+			continue
+		}
+		if version := util.ParseTs(it.Key()); !found || version > maxVs.Version {
+			vs := it.Value()
+			// The value aliases the table file, which may go away once released.
+			vs.Value = append([]byte{}, vs.Value...)
+			vs.Version = version
+			maxVs, found = vs, true
+		}
+		it.Close()
+	}
+
+	return maxVs, found, nil
+}
+
+// appendIterators appends iterators over the tables of the level that may hold
+// keys within bounds to iters, and their range tombstones to tombs. The tables
+// of level 0 are appended newest first. The range tombstones stay valid until
+// the iterators are closed.
+func (s *levelHandler) appendIterators(iters []iterator.Iterator, tombs []kv.RangeTombstone,
+	bounds keyBounds, reversed bool) ([]iterator.Iterator, []kv.RangeTombstone) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var tables []*table.Table
+	for _, t := range s.tables {
+		if bounds.overlaps(t) {
+			tables = append(tables, t)
+			tombs = append(tombs, t.RangeTombstones()...)
+		}
+	}
+	if s.level == 0 {
+		for i := len(tables) - 1; i >= 0; i-- {
+			iters = append(iters, tables[i].NewIterator(reversed))
+		}
+		return iters, tombs
+	}
+	if len(tables) == 0 {
+		return iters, tombs
+	}
+	return append(iters, table.NewConcatIterator(tables, reversed)), tombs
+}
+
+// deletedBelow returns the newest version, not newer than readTs, of the range
+// tombstones in the level covering the user key.
+func (s *levelHandler) deletedBelow(key []byte, readTs uint64) uint64 {
+	s.RLock()
+	defer s.RUnlock()
+
+	cmp := s.db.opt.Comparator
+	tables := s.tables
+	if s.level > 0 {
+		// The range of a table covers its range tombstones. The ranges of two
+		// tables may share a user key, where one ends and the other starts.
+		idx := sort.Search(len(tables), func(i int) bool {
+			return cmp.Compare(util.ParseKey(tables[i].Biggest()), key) >= 0
+		})
+		tables = tables[idx:]
+	}
+	var version uint64
+	for _, t := range tables {
+		if s.level > 0 && cmp.Compare(util.ParseKey(t.Smallest()), key) > 0 {
+			break
+		}
+		version = max(version, kv.DeletedBelow(cmp, t.RangeTombstones(), key, readTs))
+	}
+	return version
+}
+
+// overlappingTables returns the tables that intersect with key range [left, right].
+// s.tables must be sorted by key, so it may not be called on level 0.
+func (s *levelHandler) overlappingTables(kr keyRange) []*table.Table {
+	s.RLock()
+	defer s.RUnlock()
+
+	var out []*table.Table
+	for _, t := range s.tables {
+		if kr.overlapsWith(s.db.opt.Comparator, getKeyRange(s.db.opt.Comparator, t)) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// keyRange is an inclusive range of user keys.
+type keyRange struct {
+	left  []byte
+	right []byte
+}
+
+// getKeyRange returns the smallest range covering all given tables.
+func getKeyRange(cmp Comparator, tables ...*table.Table) keyRange {
+	if len(tables) == 0 {
+		return keyRange{}
+	}
+	smallest := tables[0].Smallest()
+	biggest := tables[0].Biggest()
+	for _, t := range tables[1:] {
+		if util.CompareKeys(cmp, t.Smallest(), smallest) < 0 {
+			smallest = t.Smallest()
+		}
+		if util.CompareKeys(cmp, t.Biggest(), biggest) > 0 {
+			biggest = t.Biggest()
+		}
+	}
+	// Versions of a user key may be spread across tables, cover them all.
+	return keyRange{
+		left:  util.ParseKey(smallest),
+		right: util.ParseKey(biggest),
+	}
+}
+
+func (r keyRange) overlapsWith(cmp Comparator, dst keyRange) bool {
+	if cmp.Compare(r.left, dst.right) > 0 {
+		return false
+	}
+	if cmp.Compare(r.right, dst.left) < 0 {
+		return false
+	}
+	return true
+}
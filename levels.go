@@ -0,0 +1,768 @@
+package nyx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+
+	"github.com/crazyfrankie/nyxdb/internal/bloom"
+	"github.com/crazyfrankie/nyxdb/internal/iterator"
+	"github.com/crazyfrankie/nyxdb/internal/kv"
+	"github.com/crazyfrankie/nyxdb/internal/util"
+	"github.com/crazyfrankie/nyxdb/table"
+)
+
+type levelsController struct {
+	nextFileID atomic.Uint64
+
+	// The following are initialized once and const.
+	levels []*levelHandler
+	db     *DB
+
+	// cstatus tracks the levels with a running compaction.
+	cstatus compactStatus
+
+	// level0Err is the error of the last compaction of level 0, nil once one
+	// succeeds. Guarded by level0ErrMu.
+	level0ErrMu sync.Mutex
+	level0Err   error
+}
+
+// compactStatus makes sure a level takes part in at most one compaction at a time.
+type compactStatus struct {
+	sync.Mutex
+	busy []bool
+}
+
+// tryLock marks thisLevel and nextLevel as compacting, it fails if either is already busy.
+func (cs *compactStatus) tryLock(thisLevel, nextLevel int) bool {
+	cs.Lock()
+	defer cs.Unlock()
+	if cs.busy[thisLevel] || cs.busy[nextLevel] {
+		return false
+	}
+	cs.busy[thisLevel], cs.busy[nextLevel] = true, true
+	return true
+}
+
+func (cs *compactStatus) unlock(thisLevel, nextLevel int) {
+	cs.Lock()
+	defer cs.Unlock()
+	cs.busy[thisLevel], cs.busy[nextLevel] = false, false
+}
+
+// newLevelsController opens every table recorded in the manifest at its level.
+// Table files that the manifest doesn't know about are leftovers of an interrupted
+// flush or compaction and are removed.
+func newLevelsController(db *DB, mf *manifest) (*levelsController, error) {
+	s := &levelsController{
+		db:     db,
+		levels: make([]*levelHandler, db.opt.MaxLevels),
+	}
+	s.cstatus.busy = make([]bool, db.opt.MaxLevels)
+	for i := 0; i < db.opt.MaxLevels; i++ {
+		s.levels[i] = newLevelHandler(db, i)
+	}
+	if err := revertToManifest(db.opt.Dir, mf, getIDMap(db.opt.Dir)); err != nil {
+		return nil, err
+	}
+
+	opts, err := db.tableOptions()
+	if err != nil {
+		return nil, err
+	}
+	var maxFileID uint64
+	tables := make([][]*table.Table, db.opt.MaxLevels)
+	for fileID, tf := range mf.tables {
+		if int(tf.level) >= db.opt.MaxLevels {
+			closeAllTables(tables)
+			return nil, fmt.Errorf("table %d is at level %d, but MaxLevels is %d",
+				fileID, tf.level, db.opt.MaxLevels)
+		}
+		t, err := table.OpenTable(table.NewFilename(fileID, db.opt.Dir), opts)
+		if err != nil {
+			closeAllTables(tables)
+			return nil, fmt.Errorf("opening table: %d: %w", fileID, err)
+		}
+		tables[tf.level] = append(tables[tf.level], t)
+		if fileID > maxFileID {
+			maxFileID = fileID
+		}
+	}
+	s.nextFileID.Store(maxFileID + 1)
+	for i, tbls := range tables {
+		s.levels[i].initTables(tbls)
+	}
+
+	return s, nil
+}
+
+// getIDMap returns the ids of the table files in dir.
+func getIDMap(dir string) map[uint64]struct{} {
+	fileInfos, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	idMap := make(map[uint64]struct{})
+	for _, info := range fileInfos {
+		if info.IsDir() {
+			continue
+		}
+		fileID, ok := table.ParseFileID(info.Name())
+		if !ok {
+			continue
+		}
+		idMap[fileID] = struct{}{}
+	}
+	return idMap
+}
+
+// revertToManifest checks that all necessary table files exist and removes all table files not
+// referenced by the manifest. idMap is a set of table file id's that were read from the directory
+// listing.
+func revertToManifest(dir string, mf *manifest, idMap map[uint64]struct{}) error {
+	// 1. Check all files in manifest exist.
+	for id := range mf.tables {
+		if _, ok := idMap[id]; !ok {
+			return fmt.Errorf("file does not exist for table %d", id)
+		}
+	}
+
+	// 2. Delete files that shouldn't exist.
+	for id := range idMap {
+		if _, ok := mf.tables[id]; !ok {
+			if err := os.Remove(table.NewFilename(id, dir)); err != nil {
+				return fmt.Errorf("while removing table %d: %w", id, err)
+			}
+		}
+	}
+
+	// 3. Delete half written tables.
+	tmps, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		return err
+	}
+	for _, tmp := range tmps {
+		if !strings.HasSuffix(tmp, ".sst.tmp") {
+			continue
+		}
+		if err := os.Remove(tmp); err != nil {
+			return fmt.Errorf("while removing %q: %w", tmp, err)
+		}
+	}
+
+	return nil
+}
+
+func closeAllTables(tables [][]*table.Table) {
+	for _, tableSlice := range tables {
+		for _, table := range tableSlice {
+			table.Close()
+		}
+	}
+}
+
+// reserveFileID returns a new unique table id.
+func (s *levelsController) reserveFileID() uint64 {
+	return s.nextFileID.Add(1) - 1
+}
+
+// createTable writes builder to a new table file, and counts its data blocks
+// in the compression metrics.
+func (s *levelsController) createTable(builder *table.Builder) (*table.Table, error) {
+	t, err := table.CreateTable(table.NewFilename(s.reserveFileID(), s.db.opt.Dir), builder)
+	if err != nil {
+		return nil, err
+	}
+	raw, stored := builder.BlockBytes()
+	s.db.metrics.tableRawBytes.Add(uint64(raw))
+	s.db.metrics.tableStoredBytes.Add(uint64(stored))
+	return t, nil
+}
+
+// startCompact starts NumCompactors compaction workers.
+func (s *levelsController) startCompact(lc *z.Closer) {
+	n := s.db.opt.NumCompactors
+	lc.AddRunning(n - 1)
+	for i := 0; i < n; i++ {
+		go s.runCompactor(i, lc)
+	}
+}
+
+func (s *levelsController) runCompactor(id int, lc *z.Closer) {
+	defer lc.Done()
+
+	randomDelay := time.NewTimer(time.Duration(rand.Int31n(1000)) * time.Millisecond)
+	select {
+	case <-randomDelay.C:
+	case <-lc.HasBeenClosed():
+		randomDelay.Stop()
+		return
+	}
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	var backoff time.Duration
+	for {
+		select {
+		// Can add a done channel or other stuff.
+		case <-ticker.C:
+		case <-lc.HasBeenClosed():
+			return
+		}
+		if !s.runCompactions(id) {
+			backoff = 0
+			continue
+		}
+		// A failed compaction most likely fails again right away, wait longer
+		// after each failure in a row.
+		backoff = min(max(2*backoff, time.Second), maxCompactionBackoff)
+		select {
+		case <-time.After(backoff):
+		case <-lc.HasBeenClosed():
+			return
+		}
+	}
+}
+
+// maxCompactionBackoff is the longest a compactor waits after a failed compaction.
+const maxCompactionBackoff = time.Minute
+
+// runCompactions runs the compaction of the first level, by priority, that
+// can be compacted. It reports whether a compaction failed.
+func (s *levelsController) runCompactions(id int) (failed bool) {
+	for _, p := range s.pickCompactLevels() {
+		err := s.doCompact(id, p)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errFillTables) {
+			log.Printf("[Compactor: %d] error while running compaction: %v", id, err)
+			failed = true
+		}
+	}
+	return failed
+}
+
+// compactionPriority is the score of a level, compaction is due once it reaches 1.
+type compactionPriority struct {
+	level int
+	score float64
+}
+
+// levelTargetSize returns the size level should be kept below.
+func (s *levelsController) levelTargetSize(level int) int64 {
+	size := s.db.opt.BaseLevelSize
+	for i := 1; i < level; i++ {
+		size *= int64(s.db.opt.LevelSizeMultiplier)
+	}
+	return size
+}
+
+// pickCompactLevels scores every level and returns the ones that need compaction,
+// highest score first. The last level is never compacted.
+func (s *levelsController) pickCompactLevels() (prios []compactionPriority) {
+	// Level 0 is scored by the number of tables, as each of them has to be
+	// checked on a read.
+	prios = append(prios, compactionPriority{
+		level: 0,
+		score: float64(s.levels[0].numTables()) / float64(s.db.opt.NumLevelZeroTables),
+	})
+	for i := 1; i < len(s.levels)-1; i++ {
+		prios = append(prios, compactionPriority{
+			level: i,
+			score: float64(s.levels[i].getTotalSize()) / float64(s.levelTargetSize(i)),
+		})
+	}
+
+	out := prios[:0]
+	for _, p := range prios {
+		if p.score >= 1.0 {
+			out = append(out, p)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].score > out[j].score
+	})
+	return out
+}
+
+var (
+	errFillTables = errors.New("unable to fill tables")
+
+	// errLevel0Stalled is returned by addLevel0Table when level 0 is full and
+	// its last compaction failed.
+	errLevel0Stalled = errors.New("level 0 is full and can't be compacted")
+)
+
+// compactDef describes a single compaction.
+type compactDef struct {
+	thisLevel *levelHandler
+	nextLevel *levelHandler
+
+	top []*table.Table
+	bot []*table.Table
+
+	thisRange keyRange
+
+	// discards counts the value log bytes whose pointers were dropped, by fid.
+	discards map[uint32]int64
+	// tombs are the range tombstones of the top and bot tables.
+	tombs []kv.RangeTombstone
+	// deletesDroppedAt is the newest version of the deletes and range
+	// deletes dropped by the compaction.
+	deletesDroppedAt uint64
+}
+
+// doCompact picks tables from level p.level and merges them into the next level.
+func (s *levelsController) doCompact(id int, p compactionPriority) error {
+	l := p.level
+	if !s.cstatus.tryLock(l, l+1) {
+		return errFillTables
+	}
+	defer s.cstatus.unlock(l, l+1)
+
+	cd := compactDef{
+		thisLevel: s.levels[l],
+		nextLevel: s.levels[l+1],
+	}
+	if !s.fillTables(&cd) {
+		return errFillTables
+	}
+
+	err := s.runCompactDef(&cd)
+	if err != nil {
+		err = fmt.Errorf("[Compactor: %d] compaction of level %d failed: %w", id, l, err)
+	}
+	if l == 0 {
+		s.level0ErrMu.Lock()
+		s.level0Err = err
+		s.level0ErrMu.Unlock()
+	}
+	return err
+}
+
+// fillTables picks the top tables of a compaction and the tables of the next level
+// overlapping with them.
+func (s *levelsController) fillTables(cd *compactDef) bool {
+	cd.thisLevel.RLock()
+	if len(cd.thisLevel.tables) == 0 {
+		cd.thisLevel.RUnlock()
+		return false
+	}
+	if cd.thisLevel.level == 0 {
+		// Level 0 tables overlap each other, they are all compacted together.
+		cd.top = make([]*table.Table, len(cd.thisLevel.tables))
+		copy(cd.top, cd.thisLevel.tables)
+	} else {
+		// Pick the table holding the oldest data, it's the one that has gone
+		// the longest without being compacted.
+		oldest := cd.thisLevel.tables[0]
+		for _, t := range cd.thisLevel.tables[1:] {
+			if t.MaxVersion() < oldest.MaxVersion() {
+				oldest = t
+			}
+		}
+		cd.top = []*table.Table{oldest}
+	}
+	cd.thisLevel.RUnlock()
+
+	cd.thisRange = getKeyRange(s.db.opt.Comparator, cd.top...)
+	cd.bot = cd.nextLevel.overlappingTables(cd.thisRange)
+	return true
+}
+
+// runCompactDef merges the tables of cd, records the result in the manifest and
+// then swaps the tables in the level handlers.
+func (s *levelsController) runCompactDef(cd *compactDef) error {
+	var newTables []*table.Table
+	if cd.thisLevel.level > 0 && len(cd.bot) == 0 {
+		// Nothing to merge with, the table can simply move down.
+		newTables = cd.top
+	} else {
+		var err error
+		if newTables, err = s.compactBuildTables(cd); err != nil {
+			return err
+		}
+	}
+	moved := len(cd.bot) == 0 && cd.thisLevel.level > 0
+
+	changes := make([]manifestChange, 0, len(newTables)+len(cd.top)+len(cd.bot))
+	for _, t := range cd.top {
+		changes = append(changes, newDeleteChange(t.ID()))
+	}
+	for _, t := range cd.bot {
+		changes = append(changes, newDeleteChange(t.ID()))
+	}
+	for _, t := range newTables {
+		changes = append(changes, newCreateChange(t.ID(), cd.nextLevel.level))
+	}
+	if cd.deletesDroppedAt > 0 {
+		changes = append(changes, newDropDeletesChange(cd.deletesDroppedAt))
+	}
+	if err := s.db.manifest.addChanges(changes); err != nil {
+		if !moved {
+			for _, t := range newTables {
+				t.DecrRef()
+			}
+		}
+		return fmt.Errorf("while adding changes to the manifest: %w", err)
+	}
+
+	// The manifest already lists the new tables, so a crash from here on
+	// keeps them. They go into the next level before the old ones leave this
+	// one: readers search the levels from the top down, so meanwhile they
+	// find the keys twice rather than not at all.
+	cd.nextLevel.replaceTables(cd.bot, newTables)
+	cd.thisLevel.deleteTables(cd.top)
+	s.db.vlog.updateDiscardStats(cd.discards)
+
+	if !moved {
+		// The old tables are no longer part of the LSM tree, drop them once the
+		// last reader lets go.
+		for _, t := range cd.top {
+			t.DecrRef()
+		}
+		for _, t := range cd.bot {
+			t.DecrRef()
+		}
+	}
+	return nil
+}
+
+// compactBuildTables merges the top and bot tables of cd into new tables of
+// about TableSize bytes each.
+func (s *levelsController) compactBuildTables(cd *compactDef) ([]*table.Table, error) {
+	// Versions at or below discardTs are not read by any running transaction
+	// except through the newest of them. Only NumVersionsToKeep of them are
+	// kept, and none older than a tombstone or an expired version. Those can
+	// be dropped as well if they're the newest of them and no level below may
+	// hold the keys they shadow. The same goes for range tombstones, which
+	// delete the versions they cover once no transaction reads below them.
+	discardTs := s.db.orc.discardAtOrBelow()
+	// The bot tables may reach past the top ones, their keys count as well.
+	allRange := getKeyRange(s.db.opt.Comparator, append(slices.Clone(cd.top), cd.bot...)...)
+	dropTombstones := !s.overlapsBelow(cd.nextLevel.level, allRange)
+
+	for _, t := range cd.top {
+		cd.tombs = append(cd.tombs, t.RangeTombstones()...)
+	}
+	for _, t := range cd.bot {
+		cd.tombs = append(cd.tombs, t.RangeTombstones()...)
+	}
+	var keepTombs []kv.RangeTombstone
+	for _, rt := range cd.tombs {
+		if rt.Version > discardTs || s.overlapsBelow(cd.nextLevel.level, keyRange{left: rt.Start, right: rt.End}) {
+			keepTombs = append(keepTombs, rt)
+			continue
+		}
+		cd.deletesDroppedAt = max(cd.deletesDroppedAt, rt.Version)
+	}
+	top, bot := cd.liveTables(cd.top, discardTs), cd.liveTables(cd.bot, discardTs)
+	opts, err := s.db.tableOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	// Sources are ordered from the newest to the oldest, so that the merge
+	// iterator keeps the newest of two equal keys.
+	var iters []iterator.Iterator
+	if cd.thisLevel.level == 0 {
+		for i := len(top) - 1; i >= 0; i-- {
+			iters = append(iters, top[i].NewIterator(false))
+		}
+	} else {
+		iters = append(iters, table.NewConcatIterator(top, false))
+	}
+	iters = append(iters, table.NewConcatIterator(bot, false))
+	it := iterator.NewMergeIterator(iters, false, s.db.opt.Comparator)
+	defer it.Close()
+
+	cd.discards = make(map[uint32]int64)
+	it.OnSkip = func(_ []byte, vs kv.Value) {
+		cd.addDiscard(vs)
+	}
+
+	var newTables []*table.Table
+	var builder *table.Builder
+	var lastKey, curKey, lower []byte
+	var skip bool
+	var numVersions int
+	var deletedBelow uint64
+	// finish completes the table being built, with the kept range tombstones
+	// clipped to [lower, upper), so that the tables don't overlap. A nil
+	// upper is unbounded.
+	finish := func(upper []byte) error {
+		for _, rt := range keepTombs {
+			if rt, ok := clipRangeTombstone(s.db.opt.Comparator, rt, lower, upper); ok {
+				if builder == nil {
+					builder = table.NewTableBuilder(opts)
+				}
+				builder.AddRangeTombstone(rt)
+			}
+		}
+		lower = upper
+		if builder == nil || builder.Empty() {
+			return nil
+		}
+		t, err := s.createTable(builder)
+		if err != nil {
+			return err
+		}
+		newTables = append(newTables, t)
+		builder = nil
+		return nil
+	}
+	for it.Rewind(); it.Valid(); it.Next() {
+		key := it.Key()
+		vs := it.Value()
+		if !bytes.Equal(util.ParseKey(key), curKey) {
+			curKey = append(curKey[:0], util.ParseKey(key)...)
+			skip = false
+			numVersions = 0
+			deletedBelow = kv.DeletedBelow(s.db.opt.Comparator, cd.tombs, curKey, discardTs)
+		}
+		if skip || util.ParseTs(key) < deletedBelow {
+			// Older versions are deleted by the same range tombstone.
+			skip = true
+			cd.addDiscard(vs)
+			continue
+		}
+		if util.ParseTs(key) <= discardTs {
+			numVersions++
+			if vs.IsDeletedOrExpired() || numVersions == s.db.opt.NumVersionsToKeep {
+				// This is the last version to keep, the older ones go.
+				skip = true
+			}
+			if vs.IsDeletedOrExpired() && numVersions == 1 && dropTombstones {
+				if vs.IsDeleted() {
+					cd.deletesDroppedAt = max(cd.deletesDroppedAt, util.ParseTs(key))
+				}
+				cd.addDiscard(vs)
+				continue
+			}
+		}
+		// Only split tables between user keys, so that all versions of a key
+		// stay in the same table.
+		if builder != nil && builder.EstimatedSize() >= uint32(s.db.opt.TableSize) &&
+			!util.SameKey(key, lastKey) {
+			if err := finish(append([]byte{}, util.ParseKey(key)...)); err != nil {
+				decrTables(newTables)
+				return nil, err
+			}
+		}
+		if builder == nil {
+			builder = table.NewTableBuilder(opts)
+		}
+		builder.Add(key, vs)
+		lastKey = append(lastKey[:0], key...)
+	}
+	if err := it.Err(); err != nil {
+		// A table that can't be read would otherwise look like it ends there,
+		// and the rest of its keys would be lost along with it.
+		decrTables(newTables)
+		return nil, fmt.Errorf("while reading tables of compaction: %w", err)
+	}
+	if err := finish(nil); err != nil {
+		decrTables(newTables)
+		return nil, err
+	}
+
+	return newTables, nil
+}
+
+// liveTables returns the tables that hold a version not deleted by a range
+// tombstone of the compaction as of discardTs. The others are dropped without
+// being read, so their value log pointers are not counted as discarded.
+func (cd *compactDef) liveTables(tables []*table.Table, discardTs uint64) []*table.Table {
+	var live []*table.Table
+	for _, t := range tables {
+		if cd.deletedTable(t, discardTs) {
+			cd.thisLevel.db.metrics.rangeDeletedTables.Add(1)
+			continue
+		}
+		live = append(live, t)
+	}
+	return live
+}
+
+// deletedTable returns whether all the versions in t are deleted by a single
+// range tombstone of the compaction as of discardTs. Tables with range
+// tombstones of their own are always read.
+func (cd *compactDef) deletedTable(t *table.Table, discardTs uint64) bool {
+	if t.KeyCount() == 0 || len(t.RangeTombstones()) > 0 {
+		return false
+	}
+	cmp := cd.thisLevel.db.opt.Comparator
+	smallest, biggest := util.ParseKey(t.Smallest()), util.ParseKey(t.Biggest())
+	for _, rt := range cd.tombs {
+		if rt.Version <= discardTs && t.MaxVersion() < rt.Version && rt.Covers(cmp, smallest) && rt.Covers(cmp, biggest) {
+			return true
+		}
+	}
+	return false
+}
+
+// clipRangeTombstone returns the part of rt in [lower, upper), where nil
+// bounds are unbounded, and whether there is any.
+func clipRangeTombstone(cmp Comparator, rt kv.RangeTombstone, lower, upper []byte) (kv.RangeTombstone, bool) {
+	if lower != nil && cmp.Compare(rt.Start, lower) < 0 {
+		rt.Start = lower
+	}
+	if upper != nil && cmp.Compare(rt.End, upper) > 0 {
+		rt.End = upper
+	}
+	return rt, cmp.Compare(rt.Start, rt.End) < 0
+}
+
+// addDiscard records that the entry with vs is dropped by the compaction.
+func (cd *compactDef) addDiscard(vs kv.Value) {
+	if vs.Meta&kv.BitValuePointer == 0 {
+		return
+	}
+	var vp valuePointer
+	vp.Decode(vs.Value)
+	cd.discards[vp.Fid] += int64(vp.Len)
+}
+
+// overlapsBelow returns whether any level below level holds keys in kr.
+func (s *levelsController) overlapsBelow(level int, kr keyRange) bool {
+	for _, lh := range s.levels[level+1:] {
+		if len(lh.overlappingTables(kr)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// decrTables drops the tables of a failed compaction, deleting their files.
+func decrTables(tables []*table.Table) {
+	for _, t := range tables {
+		t.DecrRef()
+	}
+}
+
+// addLevel0Table records a freshly flushed table in the manifest and adds it
+// as the newest table of level 0. It stalls while level 0 has too many tables,
+// giving compaction a chance to catch up, and fails with errLevel0Stalled
+// once the compaction of level 0 fails.
+func (s *levelsController) addLevel0Table(t *table.Table) error {
+	for s.levels[0].numTables() >= s.db.opt.NumLevelZeroTablesStall {
+		s.level0ErrMu.Lock()
+		err := s.level0Err
+		s.level0ErrMu.Unlock()
+		if err != nil {
+			return fmt.Errorf("%w: %w", errLevel0Stalled, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := s.db.manifest.addChanges([]manifestChange{newCreateChange(t.ID(), 0)}); err != nil {
+		return err
+	}
+	s.levels[0].addTable(t)
+
+	return nil
+}
+
+// get searches the levels from the top down for the newest version of the user
+// key in key that is not newer than the version of key, starting from maxVs
+// found in the memtables. It stops early on an exact version match.
+func (s *levelsController) get(key []byte, maxVs kv.Value) (kv.Value, error) {
+	version := util.ParseTs(key)
+	for _, h := range s.levels {
+		vs, ok, err := h.get(key)
+		if err != nil {
+			return kv.Value{}, err
+		}
+		if !ok {
+			continue
+		}
+		if vs.Version == version {
+			return vs, nil
+		}
+		if maxVs.Version < vs.Version {
+			maxVs = vs
+		}
+	}
+	return maxVs, nil
+}
+
+// appendIterators appends iterators over the tables that may hold keys within
+// bounds to iters, from the newest level 0 table to the last level, and their
+// range tombstones to tombs.
+func (s *levelsController) appendIterators(iters []iterator.Iterator, tombs []kv.RangeTombstone,
+	bounds keyBounds, reversed bool) ([]iterator.Iterator, []kv.RangeTombstone) {
+	for _, h := range s.levels {
+		iters, tombs = h.appendIterators(iters, tombs, bounds, reversed)
+	}
+	return iters, tombs
+}
+
+// deletedBelow returns the newest version, not newer than readTs, of the range
+// tombstones in the tables covering the user key. The levels are searched from
+// the top down, so a tombstone moved down by a concurrent compaction is found.
+func (s *levelsController) deletedBelow(key []byte, readTs uint64) uint64 {
+	var version uint64
+	for _, h := range s.levels {
+		version = max(version, h.deletedBelow(key, readTs))
+	}
+	return version
+}
+
+// maxVersion returns the highest version held by any table.
+func (s *levelsController) maxVersion() uint64 {
+	var version uint64
+	for _, l := range s.levels {
+		l.RLock()
+		for _, t := range l.tables {
+			if t.MaxVersion() > version {
+				version = t.MaxVersion()
+			}
+		}
+		l.RUnlock()
+	}
+	return version
+}
+
+// bloomHash returns the bloom filter hash of the user key in key.
+func bloomHash(key []byte) uint32 {
+	return bloom.Hash(util.ParseKey(key))
+}
+
+// skipTable consults the bloom filter of t and records the outcome.
+func (s *levelsController) skipTable(t *table.Table, hash uint32) bool {
+	if !t.HasBloomFilter() {
+		return false
+	}
+	if t.DoesNotHave(hash) {
+		s.db.metrics.bloomHits.Add(1)
+		return true
+	}
+	s.db.metrics.bloomMisses.Add(1)
+	return false
+}
+
+// close releases all tables.
+func (s *levelsController) close() {
+	for _, l := range s.levels {
+		l.Lock()
+		for _, t := range l.tables {
+			t.Close()
+		}
+		l.tables = nil
+		l.Unlock()
+	}
+}
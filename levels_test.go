@@ -0,0 +1,366 @@
+package nyx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crazyfrankie/nyxdb/internal/kv"
+	"github.com/crazyfrankie/nyxdb/internal/util"
+	"github.com/crazyfrankie/nyxdb/table"
+)
+
+func compactionTestOptions() []Option {
+	return []Option{
+		WithMemTableSize(16 << 10),
+		WithNumLevelZeroTables(2),
+		WithBaseLevelSize(64 << 10),
+		WithLevelSizeMultiplier(4),
+		WithTableSize(16 << 10),
+		WithBlockSize(1 << 10),
+	}
+}
+
+// levelLayout returns the table ids of every level.
+func levelLayout(db *DB) [][]uint64 {
+	layout := make([][]uint64, len(db.lc.levels))
+	for i, l := range db.lc.levels {
+		l.RLock()
+		for _, t := range l.tables {
+			layout[i] = append(layout[i], t.ID())
+		}
+		l.RUnlock()
+	}
+	return layout
+}
+
+// waitForCompaction waits until no level needs to be compacted anymore.
+func waitForCompaction(t *testing.T, db *DB) {
+	require.Eventually(t, func() bool {
+		return len(db.lc.pickCompactLevels()) == 0
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+// testEntry is a version of a key, deleted if it has no value.
+type testEntry struct {
+	key     string
+	version uint64
+	value   string
+}
+
+// addTestTable writes entries, ordered by key and then from the newest
+// version, to a new table at level.
+func addTestTable(t *testing.T, db *DB, level int, entries ...testEntry) {
+	opts, err := db.tableOptions()
+	require.NoError(t, err)
+	builder := table.NewTableBuilder(opts)
+	for _, e := range entries {
+		v := kv.Value{Value: []byte(e.value)}
+		if e.value == "" {
+			v.Meta = kv.BitDelete
+		}
+		builder.Add(util.KeyWithTs([]byte(e.key), e.version), v)
+	}
+	tbl, err := db.lc.createTable(builder)
+	require.NoError(t, err)
+	require.NoError(t, db.manifest.addChanges([]manifestChange{newCreateChange(tbl.ID(), level)}))
+	db.lc.levels[level].replaceTables(nil, []*table.Table{tbl})
+}
+
+func TestCompaction(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir, compactionTestOptions()...)
+
+	const n = 5000
+	for round := 0; round < 3; round++ {
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprintf("key%05d", i))
+			require.NoError(t, db.Put(key, []byte(fmt.Sprintf("value%05d-%d", i, round))))
+		}
+	}
+	for i := 0; i < n; i += 3 {
+		require.NoError(t, db.Delete([]byte(fmt.Sprintf("key%05d", i))))
+	}
+	waitForCompaction(t, db)
+
+	var lower int
+	for _, l := range db.lc.levels[1:] {
+		lower += l.numTables()
+	}
+	require.Greater(t, lower, 0)
+
+	check := func() {
+		for i := 0; i < n; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key%05d", i)))
+			if i%3 == 0 {
+				require.ErrorIs(t, err, ErrKeyNotFound)
+				continue
+			}
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("value%05d-2", i), string(val))
+		}
+	}
+	check()
+
+	// Level > 0 tables never overlap.
+	for _, l := range db.lc.levels[1:] {
+		l.RLock()
+		for i := 1; i < len(l.tables); i++ {
+			prev, cur := getKeyRange(BytewiseComparator, l.tables[i-1]), getKeyRange(BytewiseComparator, l.tables[i])
+			require.False(t, prev.overlapsWith(BytewiseComparator, cur))
+		}
+		l.RUnlock()
+	}
+	require.NoError(t, db.Close())
+
+	// The manifest restores the exact layout, and the flush on close only
+	// added to level 0.
+	db = openTestDB(t, dir, append(compactionTestOptions(), WithNumLevelZeroTables(100))...)
+	layout := levelLayout(db)
+	check()
+	require.NoError(t, db.Close())
+
+	db = openTestDB(t, dir, append(compactionTestOptions(), WithNumLevelZeroTables(100))...)
+	require.Equal(t, layout, levelLayout(db))
+	require.NoError(t, db.Close())
+}
+
+func TestCompactionRangeDelete(t *testing.T) {
+	// Everything stays in level 1, so the range tombstone meets the tables it
+	// covers on its first compaction.
+	db := openTestDB(t, t.TempDir(), append(compactionTestOptions(), WithBaseLevelSize(16<<20))...)
+	defer db.Close()
+
+	const n = 3000
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put(key(i), []byte(fmt.Sprintf("value%05d", i))))
+	}
+	waitForCompaction(t, db)
+	require.Greater(t, len(levelLayout(db)[1]), 3)
+
+	require.NoError(t, db.DeleteRange(key(500), key(2500)))
+	// Reads let compaction discard what was deleted before them.
+	_, err := db.Get(key(0))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		for i := 0; i < 200; i++ {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("other%05d", i)), []byte("value")))
+		}
+		return db.Metrics().RangeDeletedTables > 0
+	}, 10*time.Second, 10*time.Millisecond)
+	waitForCompaction(t, db)
+
+	for i := 0; i < n; i++ {
+		val, err := db.Get(key(i))
+		if i >= 500 && i < 2500 {
+			require.ErrorIs(t, err, ErrKeyNotFound)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("value%05d", i), string(val))
+	}
+
+	// Level > 0 tables never overlap, even where range tombstones are split
+	// between them. Nothing lies below level 1, so the range tombstone was
+	// dropped along with the keys it deleted.
+	for _, l := range db.lc.levels[1:] {
+		l.RLock()
+		for i, tbl := range l.tables {
+			require.Empty(t, tbl.RangeTombstones())
+			if i > 0 {
+				require.Negative(t, util.CompareKeys(BytewiseComparator, l.tables[i-1].Biggest(), tbl.Smallest()))
+			}
+		}
+		l.RUnlock()
+	}
+}
+
+func TestCompactionKeepsTombstonesOverBot(t *testing.T) {
+	dir := t.TempDir()
+	opts := append(compactionTestOptions(), WithBaseLevelSize(16<<20))
+	db := openTestDB(t, dir, opts...)
+	addTestTable(t, db, 3, testEntry{"z", 1, "old"})
+	addTestTable(t, db, 2, testEntry{"a", 3, "a"}, testEntry{"z", 5, ""})
+	addTestTable(t, db, 1, testEntry{"a", 10, "a"})
+	require.NoError(t, db.Close())
+
+	// Reopened, no transaction reads below the versions in the tables.
+	db = openTestDB(t, dir, opts...)
+	defer db.Close()
+	require.NoError(t, db.lc.doCompact(0, compactionPriority{level: 1}))
+	require.Empty(t, levelLayout(db)[1])
+
+	// The tombstone of z only lies in the bot table, but still shadows level 3.
+	_, err := db.Get([]byte("z"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	val, err := db.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, "a", string(val))
+}
+
+// corruptFile overwrites a few bytes of the file at path at offset, in place,
+// so that the memory maps of the file see them.
+func corruptFile(t *testing.T, path string, offset int64) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, offset)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func TestCompactionAbortsOnCorruptTable(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), append(compactionTestOptions(), WithBaseLevelSize(16<<20))...)
+	defer db.Close()
+	var entries []testEntry
+	for i := 0; i < 500; i++ {
+		entries = append(entries, testEntry{fmt.Sprintf("key%03d", i), 2, fmt.Sprintf("value%03d", i)})
+	}
+	addTestTable(t, db, 2, testEntry{"key000", 1, "old"})
+	addTestTable(t, db, 1, entries...)
+
+	// Corrupt a block in the middle of the level 1 table.
+	path := db.lc.levels[1].tables[0].Filename()
+	corruptFile(t, path, db.lc.levels[1].tables[0].Size()/3)
+
+	// The compaction fails instead of leaving out the rest of the table.
+	layout := levelLayout(db)
+	require.ErrorIs(t, db.lc.doCompact(0, compactionPriority{level: 1}), table.ErrChecksumMismatch)
+	require.Equal(t, layout, levelLayout(db))
+	require.FileExists(t, path)
+	require.Len(t, db.manifest.manifest.tables, 2)
+}
+
+func TestFlushFailsOnFailingCompaction(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), append(compactionTestOptions(), WithNumLevelZeroTablesStall(2))...)
+	var entries []testEntry
+	for i := 0; i < 500; i++ {
+		entries = append(entries, testEntry{fmt.Sprintf("key%03d", i), 1, "value"})
+	}
+	addTestTable(t, db, 0, entries...)
+	corruptFile(t, db.lc.levels[0].tables[0].Filename(), db.lc.levels[0].tables[0].Size()/3)
+	addTestTable(t, db, 0, testEntry{"key000", 2, "new"})
+
+	// The flush waiting for level 0 to shrink fails with the compaction, and
+	// the writes once the memtables can't be rotated anymore.
+	var err error
+	for i := 0; err == nil; i++ {
+		err = db.Put([]byte(fmt.Sprintf("put%05d", i)), make([]byte, 100))
+	}
+	require.ErrorIs(t, err, errLevel0Stalled)
+	require.ErrorIs(t, err, table.ErrChecksumMismatch)
+	require.ErrorIs(t, db.Close(), errLevel0Stalled)
+}
+
+func TestGetFailsOnCorruptTable(t *testing.T) {
+	dir := t.TempDir()
+	opts := append(compactionTestOptions(), WithBaseLevelSize(16<<20))
+	db := openTestDB(t, dir, opts...)
+	addTestTable(t, db, 2, testEntry{"k", 1, "old"})
+	addTestTable(t, db, 1, testEntry{"k", 2, "new"})
+	require.NoError(t, db.Close())
+
+	// Reopened, the versions in the tables are read.
+	db = openTestDB(t, dir, opts...)
+	defer db.Close()
+	corruptFile(t, db.lc.levels[1].tables[0].Filename(), 0)
+
+	// The older version in level 2 isn't returned instead.
+	_, err := db.Get([]byte("k"))
+	require.ErrorIs(t, err, table.ErrChecksumMismatch)
+	require.Zero(t, db.metrics.bloomFalsePositives.Load())
+}
+
+func TestOrphanTablesRemoved(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	require.NoError(t, db.Put([]byte("key"), []byte("value")))
+	require.NoError(t, db.Close())
+
+	orphan := filepath.Join(dir, "099999.sst")
+	require.NoError(t, os.WriteFile(orphan, []byte("garbage"), 0666))
+	db = openTestDB(t, dir)
+	require.NoFileExists(t, orphan)
+	val, err := db.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, "value", string(val))
+	require.NoError(t, db.Close())
+}
+
+func TestManifestReplay(t *testing.T) {
+	dir := t.TempDir()
+	mf, m, err := helpOpenOrCreateManifestFile(dir, 5)
+	require.NoError(t, err)
+	require.Empty(t, m.tables)
+
+	require.NoError(t, mf.addChanges([]manifestChange{newCreateChange(1, 0), newCreateChange(2, 0)}))
+	require.NoError(t, mf.addChanges([]manifestChange{
+		newDeleteChange(1), newDeleteChange(2), newCreateChange(3, 1),
+	}))
+	require.Error(t, mf.addChanges([]manifestChange{newDeleteChange(42)}))
+	require.NoError(t, mf.close())
+
+	// A torn record at the end is dropped.
+	path := filepath.Join(dir, ManifestFilename)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.Write(encodeRecord(encodeChangeSet([]manifestChange{newCreateChange(4, 0)}))[:10])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	mf, m, err = helpOpenOrCreateManifestFile(dir, 5)
+	require.NoError(t, err)
+	require.Len(t, m.tables, 1)
+	require.EqualValues(t, 1, m.tables[3].level)
+
+	// Enough deletions rewrite the manifest down to the live tables.
+	for id := uint64(10); id < 30; id++ {
+		require.NoError(t, mf.addChanges([]manifestChange{newCreateChange(id, 2)}))
+		require.NoError(t, mf.addChanges([]manifestChange{newDeleteChange(id)}))
+	}
+	require.NoError(t, mf.close())
+
+	mf, m, err = helpOpenOrCreateManifestFile(dir, 5)
+	require.NoError(t, err)
+	require.Len(t, m.tables, 1)
+	require.Less(t, m.deletions, 20)
+	require.NoError(t, mf.close())
+}
+
+func TestManifestCorruption(t *testing.T) {
+	dir := t.TempDir()
+	mf, _, err := helpOpenOrCreateManifestFile(dir, 5)
+	require.NoError(t, err)
+	require.NoError(t, mf.addChanges([]manifestChange{newCreateChange(1, 0)}))
+	require.NoError(t, mf.addChanges([]manifestChange{newCreateChange(2, 0)}))
+	require.NoError(t, mf.close())
+	path := filepath.Join(dir, ManifestFilename)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	// A bad checksum in a complete record isn't taken for a torn write.
+	corrupt := bytes.Clone(data)
+	corrupt[8+8] ^= 0x01
+	require.NoError(t, os.WriteFile(path, corrupt, 0666))
+	_, _, err = helpOpenOrCreateManifestFile(dir, 5)
+	require.ErrorIs(t, err, errManifestCorrupt)
+
+	// A length past the end of the file is, and nothing that big is read.
+	huge := binary.BigEndian.AppendUint32(bytes.Clone(data), math.MaxUint32)
+	huge = binary.BigEndian.AppendUint32(huge, 0)
+	require.NoError(t, os.WriteFile(path, huge, 0666))
+	mf, m, err := helpOpenOrCreateManifestFile(dir, 5)
+	require.NoError(t, err)
+	require.Len(t, m.tables, 2)
+	require.NoError(t, mf.close())
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), info.Size())
+}
@@ -0,0 +1,468 @@
+package nyx
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+)
+
+const (
+	// ManifestFilename is the filename for the manifest file.
+	ManifestFilename                  = "MANIFEST"
+	manifestRewriteFilename           = "MANIFEST-REWRITE"
+	manifestDeletionsRewriteThreshold = 10000
+	manifestDeletionsRatio            = 10
+
+	// manifestMagic is written at the start of the manifest file, "NYXM".
+	manifestMagic   uint32 = 0x4e59584d
+	manifestVersion uint32 = 1
+)
+
+var (
+	errBadMagic = errors.New("manifest has bad magic")
+
+	// errManifestCorrupt is returned when a change in the manifest doesn't match
+	// the tables it knows about.
+	errManifestCorrupt = errors.New("manifest is corrupt")
+)
+
+// manifest represents the contents of the MANIFEST file in a Nyx store.
+//
+// The MANIFEST file describes the startup state of the db -- all LSM files and what level they're
+// at.
+//
+// It consists of a sequence of change sets, each of them a group of table
+// creations and deletions that are applied atomically.
+type manifest struct {
+	levels []levelManifest
+	tables map[uint64]tableManifest
+
+	// Contains total number of creation and deletion changes in the manifest -- used to compute
+	// whether it'd be useful to rewrite the manifest.
+	creations int
+	deletions int
+
+	// deletesDroppedAt is the newest version of the deletes and range deletes
+	// that compaction dropped. An incremental backup taken since an older
+	// version can't carry them anymore.
+	deletesDroppedAt uint64
+}
+
+func createManifest() manifest {
+	levels := make([]levelManifest, 0)
+	return manifest{
+		levels: levels,
+		tables: make(map[uint64]tableManifest),
+	}
+}
+
+// levelManifest contains information about LSM tree levels
+// in the MANIFEST file.
+type levelManifest struct {
+	tables map[uint64]struct{} // Set of table id's
+}
+
+// tableManifest contains information about a specific table
+// in the LSM tree.
+type tableManifest struct {
+	level uint8
+}
+
+// manifestFile holds the file pointer (and other info) about the manifest file, which is a log
+// file we append to.
+type manifestFile struct {
+	fp        *os.File
+	directory string
+
+	// The manifest rewrite threshold, exposed for testing.
+	deletionsRewriteThreshold int
+
+	// Guards appends, which includes access to the manifest field.
+	appendLock sync.Mutex
+
+	// Used to track the current state of the manifest, used when rewriting.
+	manifest manifest
+}
+
+type manifestOp uint8
+
+const (
+	manifestCreate manifestOp = iota
+	manifestDelete
+	manifestDropDeletes
+)
+
+// manifestChange is a single table creation or deletion, or the drop of the
+// deletes up to a version, which is held in id.
+type manifestChange struct {
+	op    manifestOp
+	id    uint64
+	level uint32
+}
+
+func newCreateChange(id uint64, level int) manifestChange {
+	return manifestChange{op: manifestCreate, id: id, level: uint32(level)}
+}
+
+func newDeleteChange(id uint64) manifestChange {
+	return manifestChange{op: manifestDelete, id: id}
+}
+
+func newDropDeletesChange(version uint64) manifestChange {
+	return manifestChange{op: manifestDropDeletes, id: version}
+}
+
+// encodeChangeSet encodes changes as:
+// numChanges(varint) | per change: op(1) id(varint) level(varint)
+func encodeChangeSet(changes []manifestChange) []byte {
+	var buf []byte
+	buf = binary.AppendUvarint(buf, uint64(len(changes)))
+	for _, c := range changes {
+		buf = append(buf, byte(c.op))
+		buf = binary.AppendUvarint(buf, c.id)
+		buf = binary.AppendUvarint(buf, uint64(c.level))
+	}
+	return buf
+}
+
+func decodeChangeSet(buf []byte) ([]manifestChange, error) {
+	n, sz := binary.Uvarint(buf)
+	if sz <= 0 {
+		return nil, errManifestCorrupt
+	}
+	buf = buf[sz:]
+	changes := make([]manifestChange, 0, n)
+	for i := uint64(0); i < n; i++ {
+		if len(buf) == 0 {
+			return nil, errManifestCorrupt
+		}
+		c := manifestChange{op: manifestOp(buf[0])}
+		buf = buf[1:]
+		if c.id, sz = binary.Uvarint(buf); sz <= 0 {
+			return nil, errManifestCorrupt
+		}
+		buf = buf[sz:]
+		level, sz := binary.Uvarint(buf)
+		if sz <= 0 {
+			return nil, errManifestCorrupt
+		}
+		buf = buf[sz:]
+		c.level = uint32(level)
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// openOrCreateManifestFile opens a Nyx manifest file if it exists, or creates one if
+// doesn't exists.
+func openOrCreateManifestFile(dir string) (*manifestFile, manifest, error) {
+	return helpOpenOrCreateManifestFile(dir, manifestDeletionsRewriteThreshold)
+}
+
+func helpOpenOrCreateManifestFile(dir string, deletionsThreshold int) (*manifestFile, manifest, error) {
+	path := filepath.Join(dir, ManifestFilename)
+	fp, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, manifest{}, err
+		}
+		m := createManifest()
+		fp, netCreations, err := helpRewrite(dir, &m)
+		if err != nil {
+			return nil, manifest{}, err
+		}
+		if netCreations != 0 {
+			panic("netCreations must be zero for a new manifest")
+		}
+		mf := &manifestFile{
+			fp:                        fp,
+			directory:                 dir,
+			manifest:                  m.clone(),
+			deletionsRewriteThreshold: deletionsThreshold,
+		}
+		return mf, m, nil
+	}
+
+	manifest, truncOffset, err := replayManifestFile(fp)
+	if err != nil {
+		fp.Close()
+		return nil, manifest, err
+	}
+
+	// Truncate file so we don't have a half-written entry at the end.
+	if err := fp.Truncate(truncOffset); err != nil {
+		fp.Close()
+		return nil, manifest, err
+	}
+	if _, err = fp.Seek(0, io.SeekEnd); err != nil {
+		fp.Close()
+		return nil, manifest, err
+	}
+
+	mf := &manifestFile{
+		fp:                        fp,
+		directory:                 dir,
+		manifest:                  manifest.clone(),
+		deletionsRewriteThreshold: deletionsThreshold,
+	}
+	return mf, manifest, nil
+}
+
+// deletesDroppedAt returns the newest version of the deletes dropped by
+// compaction.
+func (mf *manifestFile) deletesDroppedAt() uint64 {
+	if mf == nil {
+		return 0
+	}
+	mf.appendLock.Lock()
+	defer mf.appendLock.Unlock()
+	return mf.manifest.deletesDroppedAt
+}
+
+func (mf *manifestFile) close() error {
+	return mf.fp.Close()
+}
+
+// addChanges writes a batch of changes, atomically, to the file. By "atomically" that means when
+// we replay the MANIFEST file, we'll either replay all the changes or none of them. (The truth of
+// this depends on the filesystem -- some might append garbage data if a system crash happens at
+// the wrong time.)
+func (mf *manifestFile) addChanges(changes []manifestChange) error {
+	if mf == nil {
+		return nil
+	}
+	buf := encodeChangeSet(changes)
+
+	// Maybe we could use O_APPEND instead (on certain file systems)
+	mf.appendLock.Lock()
+	defer mf.appendLock.Unlock()
+	if err := applyChangeSet(&mf.manifest, changes); err != nil {
+		return err
+	}
+	// Rewrite manifest if it'd shrink by 1/10 and it's big enough to care
+	if mf.manifest.deletions > mf.deletionsRewriteThreshold &&
+		mf.manifest.deletions > manifestDeletionsRatio*(mf.manifest.creations-mf.manifest.deletions) {
+		if err := mf.rewrite(); err != nil {
+			return err
+		}
+	} else {
+		if _, err := mf.fp.Write(encodeRecord(buf)); err != nil {
+			return err
+		}
+	}
+
+	return mf.fp.Sync()
+}
+
+// encodeRecord frames a change set as len(4) | crc32(4) | changeSet.
+func encodeRecord(changeBuf []byte) []byte {
+	var lenCrcBuf [8]byte
+	binary.BigEndian.PutUint32(lenCrcBuf[0:4], uint32(len(changeBuf)))
+	binary.BigEndian.PutUint32(lenCrcBuf[4:8], crc32.Checksum(changeBuf, castagnoli))
+	return append(lenCrcBuf[:], changeBuf...)
+}
+
+// Must be called while appendLock is held.
+func (mf *manifestFile) rewrite() error {
+	// In Windows the files should be closed before doing a Rename.
+	if err := mf.fp.Close(); err != nil {
+		return err
+	}
+	fp, netCreations, err := helpRewrite(mf.directory, &mf.manifest)
+	if err != nil {
+		return err
+	}
+	mf.fp = fp
+	mf.manifest.creations = netCreations
+	mf.manifest.deletions = 0
+
+	return nil
+}
+
+// helpRewrite writes a new manifest holding only the creations of m to a temporary
+// file and atomically renames it over the old one.
+func helpRewrite(dir string, m *manifest) (*os.File, int, error) {
+	rewritePath := filepath.Join(dir, manifestRewriteFilename)
+	// We explicitly sync.
+	fp, err := os.OpenFile(rewritePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint32(buf[0:4], manifestMagic)
+	binary.BigEndian.PutUint32(buf[4:8], manifestVersion)
+
+	netCreations := len(m.tables)
+	changes := m.asChanges()
+	if len(changes) > 0 {
+		buf = append(buf, encodeRecord(encodeChangeSet(changes))...)
+	}
+	if _, err := fp.Write(buf); err != nil {
+		fp.Close()
+		return nil, 0, err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return nil, 0, err
+	}
+
+	// In Windows the files should be closed before doing a Rename.
+	if err = fp.Close(); err != nil {
+		return nil, 0, err
+	}
+	manifestPath := filepath.Join(dir, ManifestFilename)
+	if err := os.Rename(rewritePath, manifestPath); err != nil {
+		return nil, 0, err
+	}
+	fp, err = os.OpenFile(manifestPath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := fp.Seek(0, io.SeekEnd); err != nil {
+		fp.Close()
+		return nil, 0, err
+	}
+	if err := z.SyncDir(dir); err != nil {
+		fp.Close()
+		return nil, 0, err
+	}
+
+	return fp, netCreations, nil
+}
+
+// replayManifestFile reads the manifest file and constructs the manifest it describes.
+// Also, returns the last offset after a completely read manifest entry -- the file must be
+// truncated at that point before further appends are made (if there is a partial entry after
+// that). In normal conditions, truncOffset is the file size.
+//
+// Only a record cut short by the end of the file is taken for a torn write. A
+// complete record failing its checksum is corruption, dropping it along with
+// the records after it would lose the tables they created.
+func replayManifestFile(fp *os.File) (manifest, int64, error) {
+	info, err := fp.Stat()
+	if err != nil {
+		return manifest{}, 0, err
+	}
+	r := bufio.NewReader(fp)
+
+	var magicBuf [8]byte
+	if _, err := io.ReadFull(r, magicBuf[:]); err != nil {
+		return manifest{}, 0, errBadMagic
+	}
+	if binary.BigEndian.Uint32(magicBuf[0:4]) != manifestMagic {
+		return manifest{}, 0, errBadMagic
+	}
+	if version := binary.BigEndian.Uint32(magicBuf[4:8]); version != manifestVersion {
+		return manifest{}, 0, fmt.Errorf("manifest has unsupported version: %d (we support %d)",
+			version, manifestVersion)
+	}
+
+	build := createManifest()
+	offset := int64(8)
+	for {
+		var lenCrcBuf [8]byte
+		if _, err := io.ReadFull(r, lenCrcBuf[:]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return manifest{}, 0, err
+		}
+		length := binary.BigEndian.Uint32(lenCrcBuf[0:4])
+		if int64(length) > info.Size()-offset-8 {
+			// A torn write at the end of the file, stop here.
+			break
+		}
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return manifest{}, 0, err
+		}
+		if crc32.Checksum(buf, castagnoli) != binary.BigEndian.Uint32(lenCrcBuf[4:8]) {
+			return manifest{}, 0, fmt.Errorf("MANIFEST record at offset %d has a bad checksum: %w",
+				offset, errManifestCorrupt)
+		}
+
+		changes, err := decodeChangeSet(buf)
+		if err != nil {
+			return manifest{}, 0, err
+		}
+		if err := applyChangeSet(&build, changes); err != nil {
+			return manifest{}, 0, err
+		}
+		offset += int64(8 + length)
+	}
+
+	return build, offset, nil
+}
+
+func applyManifestChange(build *manifest, tc manifestChange) error {
+	switch tc.op {
+	case manifestCreate:
+		if _, ok := build.tables[tc.id]; ok {
+			return fmt.Errorf("MANIFEST invalid, table %d exists: %w", tc.id, errManifestCorrupt)
+		}
+		build.tables[tc.id] = tableManifest{level: uint8(tc.level)}
+		for len(build.levels) <= int(tc.level) {
+			build.levels = append(build.levels, levelManifest{make(map[uint64]struct{})})
+		}
+		build.levels[tc.level].tables[tc.id] = struct{}{}
+		build.creations++
+	case manifestDelete:
+		tm, ok := build.tables[tc.id]
+		if !ok {
+			return fmt.Errorf("MANIFEST removes non-existing table %d: %w", tc.id, errManifestCorrupt)
+		}
+		delete(build.levels[tm.level].tables, tc.id)
+		delete(build.tables, tc.id)
+		build.deletions++
+	case manifestDropDeletes:
+		build.deletesDroppedAt = max(build.deletesDroppedAt, tc.id)
+	default:
+		return fmt.Errorf("MANIFEST file has invalid manifestChange op: %w", errManifestCorrupt)
+	}
+	return nil
+}
+
+// This is not a "recoverable" error -- opening the KV store fails because the MANIFEST file is
+// just plain broken.
+func applyChangeSet(build *manifest, changes []manifestChange) error {
+	for _, change := range changes {
+		if err := applyManifestChange(build, change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *manifest) clone() manifest {
+	changes := m.asChanges()
+	ret := createManifest()
+	if err := applyChangeSet(&ret, changes); err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+// asChanges returns a sequence of changes that could be used to recreate the Manifest in its
+// present state.
+func (m *manifest) asChanges() []manifestChange {
+	changes := make([]manifestChange, 0, len(m.tables)+1)
+	for id, tm := range m.tables {
+		changes = append(changes, newCreateChange(id, int(tm.level)))
+	}
+	if m.deletesDroppedAt > 0 {
+		changes = append(changes, newDropDeletesChange(m.deletesDroppedAt))
+	}
+	return changes
+}
@@ -2,50 +2,154 @@ package nyx
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 
 	"github.com/dgraph-io/ristretto/v2/z"
 
+	"github.com/crazyfrankie/nyxdb/internal/encryption"
+	"github.com/crazyfrankie/nyxdb/internal/kv"
+	"github.com/crazyfrankie/nyxdb/internal/util"
 	"github.com/crazyfrankie/nyxdb/skl"
 )
 
 const (
 	MemTableExt = ".mem"
+
+	// maxHeaderSize is the worst case size of an encoded entry header:
+	// meta(1) + userMeta(1) + klen(5) + vlen(5) + expiresAt(10).
+	maxHeaderSize = 22
+	// crcSize is the size of the checksum that follows each entry.
+	crcSize = crc32.Size
+)
+
+var (
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+	// errTruncate is returned when an entry in a log file is torn or corrupt,
+	// everything from its offset on has to be discarded.
+	errTruncate = errors.New("do truncate")
 )
 
 type memTable struct {
-	skl *skl.SkipList
-	wal *wal
-	opt *option
-	buf *bytes.Buffer // cache data to reduce frequent disk writing by WAL
+	skl        *skl.SkipList
+	wal        *wal
+	opt        *option
+	buf        *bytes.Buffer // cache data to reduce frequent disk writing by WAL
+	maxVersion uint64        // highest version written, only updated by the writer
+	// torn is set by the writer once a request was only written partly. The
+	// memtable takes no more writes and is never flushed: its WAL is replayed
+	// on the next Open, which drops a transaction cut short.
+	torn bool
+
+	// Range tombstones are kept out of the SkipList. Guarded by rangeMu,
+	// they're only ever appended to.
+	rangeMu    sync.RWMutex
+	tombstones []kv.RangeTombstone
 }
 
+// openMemTables opens all the existing memtable files in Dir in ascending fid order.
+// They are older than anything written from now on, so they all become immutable.
 func (d *DB) openMemTables() error {
+	files, err := os.ReadDir(d.opt.Dir)
+	if err != nil {
+		return fmt.Errorf("unable to open mem dir %q: %w", d.opt.Dir, err)
+	}
+
+	var fids []int
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), MemTableExt) {
+			continue
+		}
+		fsz := len(file.Name())
+		fid, err := strconv.ParseInt(file.Name()[:fsz-len(MemTableExt)], 10, 64)
+		if err != nil {
+			return fmt.Errorf("unable to parse mem file %q: %w", file.Name(), err)
+		}
+		fids = append(fids, int(fid))
+	}
+
+	// Sort in ascending order.
+	sort.Ints(fids)
+	for _, fid := range fids {
+		mt, err := d.openMemTable(fid, os.O_RDWR)
+		if err != nil {
+			return fmt.Errorf("while opening fid %d: %w", fid, err)
+		}
+		if mt.empty() {
+			// Nothing to flush, remove it right away.
+			if err := mt.wal.delete(); err != nil {
+				return fmt.Errorf("while deleting empty fid %d: %w", fid, err)
+			}
+			mt.DecrRef()
+			continue
+		}
+		d.imm = append(d.imm, mt)
+	}
+	if len(fids) != 0 {
+		d.nextMemfd = fids[len(fids)-1]
+	}
+	d.nextMemfd++
+
 	return nil
 }
 
+// newMemTable creates the memtable with the next free fid.
+func (d *DB) newMemTable() (*memTable, error) {
+	mt, err := d.openMemTable(d.nextMemfd, os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		return nil, err
+	}
+	d.nextMemfd++
+
+	return mt, nil
+}
+
+// openMemTable opens the memtable with fid and replays its WAL. The WAL may
+// have been written with a bigger MemTableSize than the current one, so the
+// arena is grown until everything in it fits.
 func (d *DB) openMemTable(fid, flags int) (*memTable, error) {
 	filepath := d.memTablePath(fid)
-	skl := skl.NewSkipList(d.arenaSize())
 	mt := &memTable{
-		skl: skl,
 		opt: d.opt,
 		buf: &bytes.Buffer{},
 	}
 	mt.wal = &wal{
-		path:    filepath,
-		fid:     uint32(fid),
-		writeAt: vlogHeaderSize,
-		opt:     d.opt,
+		path:     filepath,
+		fid:      uint32(fid),
+		writeAt:  vlogHeaderSize,
+		opt:      d.opt,
+		registry: d.registry,
+	}
+	if err := mt.wal.open(filepath, flags, 2*int(d.opt.MemTableSize)); err != nil {
+		return nil, err
+	}
+	for arenaSize := d.arenaSize(); ; arenaSize *= 2 {
+		mt.skl = skl.NewSkipList(arenaSize, d.opt.Comparator)
+		mt.maxVersion, mt.tombstones = 0, nil
+		err := mt.UpdateSkipList()
+		if err == nil {
+			return mt, nil
+		}
+		mt.DecrRef()
+		if !errors.Is(err, skl.ErrArenaFull) {
+			mt.wal.close()
+			return nil, fmt.Errorf("while updating skiplist: %w", err)
+		}
 	}
-	// TODO
-	return mt, nil
 }
 
 func (d *DB) memTablePath(fid int) string {
-	return fmt.Sprintf("%05d%s", fid, MemTableExt)
+	return filepath.Join(d.opt.Dir, fmt.Sprintf("%05d%s", fid, MemTableExt))
 }
 
 // arenaSize returns default arena size
@@ -53,6 +157,153 @@ func (d *DB) arenaSize() int64 {
 	return d.opt.MemTableSize + d.opt.maxBatchSize + d.opt.maxBatchCount*int64(skl.MaxNodeSize)
 }
 
+// estimateSize returns the worst case arena usage of key and v.
+func estimateSize(key []byte, v kv.Value) int64 {
+	return int64(skl.MaxNodeSize + len(key) + int(v.EncodedSize()) + 8) // 8 for alignment
+}
+
+// isFull reports whether adding entries of size bytes could overflow the
+// memtable, or the arena backing it.
+func (mt *memTable) isFull(size int64) bool {
+	return mt.skl.MemorySize()+size > mt.opt.MemTableSize || size > mt.skl.Available()
+}
+
+// IncrRef takes a reference to the memtable's SkipList.
+func (mt *memTable) IncrRef() {
+	mt.skl.IncrRef()
+}
+
+// DecrRef drops a reference to the memtable's SkipList.
+func (mt *memTable) DecrRef() {
+	mt.skl.DecrRef()
+}
+
+// Put writes the entry to the WAL first and then inserts it into the SkipList.
+// The WAL isn't synced, the writer syncs it once for a whole group of writes.
+// It returns skl.ErrArenaFull, without writing anything, if the entry may not
+// fit into the SkipList.
+func (mt *memTable) Put(key []byte, v kv.Value) error {
+	if !mt.skl.CanFit(key, v) {
+		return skl.ErrArenaFull
+	}
+	if err := mt.wal.writeEntry(mt.buf, key, v); err != nil {
+		return fmt.Errorf("cannot write entry to WAL file: %w", err)
+	}
+
+	return mt.apply(key, v)
+}
+
+// apply inserts a log entry into the SkipList, or into the range tombstones.
+// The entry ending a transaction only exists in the log, the transaction bits
+// of the others are dropped.
+func (mt *memTable) apply(key []byte, v kv.Value) error {
+	if v.Meta&kv.BitFinTxn > 0 {
+		return nil
+	}
+	v.Meta &^= kv.BitTxn
+	if v.Meta&kv.BitRangeDelete > 0 {
+		mt.rangeMu.Lock()
+		mt.tombstones = append(mt.tombstones, kv.RangeTombstone{
+			Start:   append([]byte{}, util.ParseKey(key)...),
+			End:     append([]byte{}, v.Value...),
+			Version: util.ParseTs(key),
+		})
+		mt.rangeMu.Unlock()
+	} else if err := mt.skl.TryPut(key, v); err != nil {
+		return err
+	}
+	if ts := util.ParseTs(key); ts > mt.maxVersion {
+		mt.maxVersion = ts
+	}
+
+	return nil
+}
+
+// rangeTombstones returns the range tombstones written to the memtable.
+func (mt *memTable) rangeTombstones() []kv.RangeTombstone {
+	mt.rangeMu.RLock()
+	defer mt.rangeMu.RUnlock()
+	return mt.tombstones
+}
+
+// empty returns whether nothing was written to the memtable.
+func (mt *memTable) empty() bool {
+	return mt.skl.Empty() && len(mt.rangeTombstones()) == 0
+}
+
+// get returns the newest version of the user key in key that is not newer than
+// the version of key. The returned value aliases the SkipList arena.
+func (mt *memTable) get(key []byte) kv.Value {
+	return mt.skl.Get(util.ParseKey(key), util.ParseTs(key))
+}
+
+// SyncWAL flushes the written part of the WAL to disk.
+func (mt *memTable) SyncWAL() error {
+	return mt.wal.sync()
+}
+
+// UpdateSkipList replays the WAL into the SkipList. Replay stops at the
+// first torn or corrupt entry, and the file is truncated there so that
+// new writes continue from the last good entry. The entries of a
+// transaction are only applied once the entry ending it has been read,
+// a transaction cut short is dropped as a whole.
+func (mt *memTable) UpdateSkipList() error {
+	type txnEntry struct {
+		key []byte
+		v   kv.Value
+	}
+	var (
+		txnEntries []txnEntry
+		txnTs      uint64
+		validEnd   = uint32(vlogHeaderSize)
+	)
+	_, err := mt.wal.iterate(func(key []byte, v kv.Value, vp valuePointer) error {
+		switch {
+		case v.Meta&kv.BitTxn > 0:
+			ts := util.ParseTs(key)
+			if len(txnEntries) > 0 && ts != txnTs {
+				// Entries of two transactions interleaved, this can't be a valid log.
+				return errTruncate
+			}
+			txnTs = ts
+			txnEntries = append(txnEntries, txnEntry{key: key, v: v})
+			return nil
+		case v.Meta&kv.BitFinTxn > 0:
+			if util.ParseTs(key) != txnTs {
+				return errTruncate
+			}
+			for _, e := range txnEntries {
+				if err := mt.apply(e.key, e.v); err != nil {
+					return err
+				}
+			}
+			txnEntries = txnEntries[:0]
+		default:
+			if len(txnEntries) > 0 {
+				return errTruncate
+			}
+			if err := mt.apply(key, v); err != nil {
+				return err
+			}
+		}
+		validEnd = vp.Offset + vp.Len
+		return nil
+	})
+	if err != nil && !errors.Is(err, errTruncate) {
+		return fmt.Errorf("while iterating wal %q: %w", mt.wal.path, err)
+	}
+
+	return mt.wal.truncate(validEnd)
+}
+
+// close syncs the WAL to disk and releases the memtable.
+func (mt *memTable) close() error {
+	err := mt.wal.close()
+	mt.DecrRef()
+
+	return err
+}
+
 type wal struct {
 	mmapFile *z.MmapFile // improve IO performance with mmap
 	path     string
@@ -60,5 +311,338 @@ type wal struct {
 	fid      uint32
 	size     atomic.Uint32 // current file size
 	writeAt  uint32        // write offset
+	fsize    int           // size the file is mapped at while it is written
 	opt      *option
+
+	registry *keyRegistry
+	dataKey  *encryption.DataKey // nil if the file isn't encrypted
+	baseIV   []byte
+	// sealed is set once an encrypted file is truncated below where it may
+	// have been written. The keystream of an entry only depends on its
+	// offset, so the offsets of the entries discarded aren't written again.
+	sealed bool
+}
+
+// open maps the file at path, creating it with fsize bytes if it doesn't exist yet.
+// A newly created file gets its header written right away. An existing file is
+// written from its end, which truncate moves back to the last valid entry.
+func (w *wal) open(path string, flags int, fsize int) error {
+	mf, ferr := z.OpenMmapFile(path, flags, fsize)
+	w.mmapFile = mf
+	w.fsize = fsize
+	if errors.Is(ferr, z.NewFile) {
+		if err := w.bootstrap(); err != nil {
+			os.Remove(path)
+			return err
+		}
+		w.size.Store(uint32(len(w.mmapFile.Data)))
+		return nil
+	} else if ferr != nil {
+		return fmt.Errorf("while opening file %q: %w", path, ferr)
+	}
+	w.size.Store(uint32(len(w.mmapFile.Data)))
+	w.writeAt = w.size.Load()
+	if err := w.readHeader(); err != nil {
+		w.mmapFile.Close(-1)
+		return fmt.Errorf("while reading header of file %q: %w", path, err)
+	}
+
+	return nil
+}
+
+// bootstrap writes the file header of a new log file. The entries are
+// encrypted with the latest data key, if encryption is enabled.
+//
+// +----------------+------------------+
+// | keyID(8 bytes) |  baseIV(12 bytes)|
+// +----------------+------------------+
+func (w *wal) bootstrap() error {
+	var header [vlogHeaderSize]byte
+	dk, err := w.registry.latestDataKey()
+	if err != nil {
+		return err
+	}
+	if dk != nil {
+		iv, err := encryption.GenerateIV(vlogHeaderSize - 8)
+		if err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint64(header[:8], dk.ID)
+		copy(header[8:], iv)
+		w.dataKey, w.baseIV = dk, iv
+	}
+	copy(w.mmapFile.Data, header[:])
+	w.writeAt = vlogHeaderSize
+
+	return nil
+}
+
+// readHeader loads the data key named by the header of an existing log file.
+func (w *wal) readHeader() error {
+	if len(w.mmapFile.Data) < vlogHeaderSize {
+		// Nothing was ever written to it.
+		return nil
+	}
+	header := w.mmapFile.Data[:vlogHeaderSize]
+	if !isEncrypted(header) {
+		return nil
+	}
+	dk, err := w.registry.DataKey(binary.BigEndian.Uint64(header[:8]))
+	if err != nil {
+		return err
+	}
+	w.dataKey, w.baseIV = dk, append([]byte{}, header[8:]...)
+
+	return nil
+}
+
+// entryIV returns the IV of the entry at offset. The offset sits in the middle,
+// so that the counter incremented over a long entry never runs into the IV of
+// the next one.
+func (w *wal) entryIV(offset uint32) []byte {
+	iv := make([]byte, 16)
+	copy(iv[0:4], w.baseIV[0:4])
+	binary.BigEndian.PutUint32(iv[4:8], offset)
+	copy(iv[8:16], w.baseIV[4:12])
+	return iv
+}
+
+// decrypt returns key and v of the entry at offset decrypted into a new
+// buffer, or as they are if the file isn't encrypted.
+func (w *wal) decrypt(key []byte, v kv.Value, offset uint32) ([]byte, kv.Value, error) {
+	if w.dataKey == nil {
+		return key, v, nil
+	}
+	stream, err := encryption.NewStream(w.dataKey.Key, w.entryIV(offset))
+	if err != nil {
+		return nil, kv.Value{}, err
+	}
+	buf := make([]byte, len(key)+len(v.Value))
+	stream.XORKeyStream(buf[:len(key)], key)
+	stream.XORKeyStream(buf[len(key):], v.Value)
+	v.Value = buf[len(key):]
+
+	return buf[:len(key)], v, nil
+}
+
+// header is the header of an entry in a log file.
+//
+// +---------+-------------+--------------+--------------+-------------------+
+// | meta(1) | userMeta(1) | klen(varint) | vlen(varint) | expiresAt(varint) |
+// +---------+-------------+--------------+--------------+-------------------+
+type header struct {
+	klen      uint32
+	vlen      uint32
+	expiresAt uint64
+	meta      byte
+	userMeta  byte
+}
+
+// Encode encodes the header into out and returns the number of bytes written.
+// out must be at least maxHeaderSize long.
+func (h header) Encode(out []byte) int {
+	out[0], out[1] = h.meta, h.userMeta
+	index := 2
+	index += binary.PutUvarint(out[index:], uint64(h.klen))
+	index += binary.PutUvarint(out[index:], uint64(h.vlen))
+	index += binary.PutUvarint(out[index:], h.expiresAt)
+
+	return index
+}
+
+// Decode decodes the header from buf and returns the number of bytes read.
+// It returns errTruncate if buf does not hold a complete header.
+func (h *header) Decode(buf []byte) (int, error) {
+	if len(buf) < 2 {
+		return 0, errTruncate
+	}
+	h.meta, h.userMeta = buf[0], buf[1]
+	index := 2
+	klen, n := binary.Uvarint(buf[index:])
+	if n <= 0 {
+		return 0, errTruncate
+	}
+	index += n
+	vlen, n := binary.Uvarint(buf[index:])
+	if n <= 0 {
+		return 0, errTruncate
+	}
+	index += n
+	h.expiresAt, n = binary.Uvarint(buf[index:])
+	if n <= 0 {
+		return 0, errTruncate
+	}
+	h.klen, h.vlen = uint32(klen), uint32(vlen)
+
+	return index + n, nil
+}
+
+// encodeEntry encodes key and v into the empty buf as the log entry at offset:
+// header | key | value | crc32. The key and the value are encrypted if the
+// file is, the checksum covers what is written. It returns the number of bytes
+// written.
+func (w *wal) encodeEntry(buf *bytes.Buffer, key []byte, v kv.Value, offset uint32) (int, error) {
+	h := header{
+		klen:      uint32(len(key)),
+		vlen:      uint32(len(v.Value)),
+		expiresAt: v.ExpiresAt,
+		meta:      v.Meta,
+		userMeta:  v.UserMeta,
+	}
+	var headerEnc [maxHeaderSize]byte
+	sz := h.Encode(headerEnc[:])
+	buf.Write(headerEnc[:sz])
+	buf.Write(key)
+	buf.Write(v.Value)
+	if w.dataKey != nil {
+		if err := encryption.XOR(buf.Bytes()[sz:], buf.Bytes()[sz:], w.dataKey.Key, w.entryIV(offset)); err != nil {
+			return 0, err
+		}
+	}
+
+	var crcBuf [crcSize]byte
+	binary.BigEndian.PutUint32(crcBuf[:], crc32.Checksum(buf.Bytes(), castagnoli))
+	buf.Write(crcBuf[:])
+
+	return sz + len(key) + len(v.Value) + crcSize, nil
+}
+
+// decodeEntry decodes the log entry at the start of buf. The returned key and value
+// alias buf. errTruncate is returned if the entry is incomplete or its checksum
+// doesn't match.
+func decodeEntry(buf []byte) (key []byte, v kv.Value, n int, err error) {
+	var h header
+	hlen, err := h.Decode(buf)
+	if err != nil {
+		return nil, kv.Value{}, 0, err
+	}
+	if h.klen == 0 {
+		// Zeroed region, we have reached the end of the written data.
+		return nil, kv.Value{}, 0, errTruncate
+	}
+	end := uint64(hlen) + uint64(h.klen) + uint64(h.vlen)
+	if end+crcSize > uint64(len(buf)) {
+		return nil, kv.Value{}, 0, errTruncate
+	}
+	if crc32.Checksum(buf[:end], castagnoli) != binary.BigEndian.Uint32(buf[end:]) {
+		return nil, kv.Value{}, 0, errTruncate
+	}
+	key = buf[hlen : hlen+int(h.klen)]
+	v = kv.Value{
+		Meta:      h.meta,
+		UserMeta:  h.userMeta,
+		ExpiresAt: h.expiresAt,
+		Value:     buf[hlen+int(h.klen) : end],
+	}
+
+	return key, v, int(end) + crcSize, nil
+}
+
+// writeEntry appends key and v to the log file, growing it when it is full.
+// Only one goroutine may write to the file at a time.
+func (w *wal) writeEntry(buf *bytes.Buffer, key []byte, v kv.Value) error {
+	if w.sealed {
+		return fmt.Errorf("cannot write to %q, it was truncated", w.path)
+	}
+	buf.Reset()
+	plen, err := w.encodeEntry(buf, key, v, w.writeAt)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if end := int(w.writeAt) + plen; end > len(w.mmapFile.Data) {
+		grow := 2 * len(w.mmapFile.Data)
+		if grow < end {
+			grow = end
+		}
+		if err := w.mmapFile.Truncate(int64(grow)); err != nil {
+			return fmt.Errorf("while growing wal %q: %w", w.path, err)
+		}
+		w.size.Store(uint32(grow))
+	}
+	copy(w.mmapFile.Data[w.writeAt:], buf.Bytes())
+	w.writeAt += uint32(plen)
+
+	return nil
+}
+
+// iterate calls fn for every valid entry in the log file, in write order, along
+// with the position of the entry. The key and value are decrypted if the file is
+// encrypted. It returns the offset just past the last valid entry.
+func (w *wal) iterate(fn func(key []byte, v kv.Value, vp valuePointer) error) (uint32, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	offset := uint32(vlogHeaderSize)
+	data := w.mmapFile.Data
+	for int(offset) < len(data) {
+		key, v, n, err := decodeEntry(data[offset:])
+		if errors.Is(err, errTruncate) {
+			break
+		}
+		if key, v, err = w.decrypt(key, v, offset); err != nil {
+			return 0, err
+		}
+		if err := fn(key, v, valuePointer{Fid: w.fid, Len: uint32(n), Offset: offset}); err != nil {
+			return 0, err
+		}
+		offset += uint32(n)
+	}
+
+	return offset, nil
+}
+
+// truncate discards everything after end. The file keeps its mapped size, the tail
+// is zeroed so that a later replay stops at end. An encrypted file is sealed if
+// it was written past end.
+func (w *wal) truncate(end uint32) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.dataKey != nil && end < w.writeAt {
+		w.sealed = true
+	}
+
+	// Only the existing part of the file can hold stale data, anything the
+	// file is extended by below reads as zeroes.
+	z.ZeroOut(w.mmapFile.Data, int(end), len(w.mmapFile.Data))
+	if len(w.mmapFile.Data) < w.fsize {
+		// The file was shrunk to its written size on close, map the full size again.
+		if err := w.mmapFile.Truncate(int64(w.fsize)); err != nil {
+			return fmt.Errorf("while truncating wal %q: %w", w.path, err)
+		}
+		w.size.Store(uint32(w.fsize))
+	}
+	w.writeAt = end
+
+	return nil
+}
+
+// sync msyncs the written part of the file. A deleted file has nothing to sync.
+func (w *wal) sync() error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.mmapFile.Data == nil {
+		return nil
+	}
+	return z.Msync(w.mmapFile.Data[:w.writeAt])
+}
+
+// close unmaps the file and truncates it to the written portion.
+func (w *wal) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.mmapFile.Close(int64(w.writeAt))
+}
+
+// delete unmaps and removes the file.
+func (w *wal) delete() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.mmapFile.Delete()
 }
@@ -0,0 +1,198 @@
+package nyx
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crazyfrankie/nyxdb/internal/kv"
+	"github.com/crazyfrankie/nyxdb/internal/util"
+	"github.com/crazyfrankie/nyxdb/skl"
+)
+
+// newMemTableTestDB returns a DB that is only good for opening memtables,
+// nothing is flushed behind the test's back.
+func newMemTableTestDB(t *testing.T) *DB {
+	opt, err := buildOption(WithDir(t.TempDir()), WithMemTableSize(1<<20))
+	require.NoError(t, err)
+	return &DB{opt: opt}
+}
+
+func TestMemTableReplay(t *testing.T) {
+	db := newMemTableTestDB(t)
+	mt, err := db.openMemTable(1, os.O_CREATE|os.O_RDWR)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		key := util.KeyWithTs([]byte(fmt.Sprintf("key%03d", i)), 0)
+		v := kv.Value{Value: []byte(fmt.Sprintf("val%03d", i)), Meta: 1, UserMeta: 2, ExpiresAt: uint64(i)}
+		require.NoError(t, mt.Put(key, v))
+	}
+	require.NoError(t, mt.close())
+
+	mt, err = db.openMemTable(1, os.O_RDWR)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		v := mt.skl.Get([]byte(fmt.Sprintf("key%03d", i)), 0)
+		require.Equal(t, fmt.Sprintf("val%03d", i), string(v.Value))
+		require.EqualValues(t, 1, v.Meta)
+		require.EqualValues(t, 2, v.UserMeta)
+		require.EqualValues(t, i, v.ExpiresAt)
+	}
+	require.NoError(t, mt.close())
+}
+
+func TestMemTableReplayTruncatesCorruptTail(t *testing.T) {
+	db := newMemTableTestDB(t)
+	mt, err := db.openMemTable(1, os.O_CREATE|os.O_RDWR)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		key := util.KeyWithTs([]byte(fmt.Sprintf("key%d", i)), 0)
+		require.NoError(t, mt.Put(key, kv.Value{Value: []byte("value")}))
+	}
+	path := mt.wal.path
+	require.NoError(t, mt.close())
+
+	// Flip the last byte of the checksum of the final entry.
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0666))
+
+	mt, err = db.openMemTable(1, os.O_RDWR)
+	require.NoError(t, err)
+	require.Equal(t, "value", string(mt.skl.Get([]byte("key8"), 0).Value))
+	require.Nil(t, mt.skl.Get([]byte("key9"), 0).Value)
+
+	// The torn entry is gone and new writes continue from the last good one.
+	require.Less(t, mt.wal.writeAt, uint32(len(data)))
+	require.NoError(t, mt.Put(util.KeyWithTs([]byte("key9"), 0), kv.Value{Value: []byte("again")}))
+	require.NoError(t, mt.close())
+}
+
+func TestWALGrow(t *testing.T) {
+	opt := &option{MemTableSize: 64}
+	w := &wal{writeAt: vlogHeaderSize, opt: opt}
+	path := filepath.Join(t.TempDir(), "00001"+MemTableExt)
+	require.NoError(t, w.open(path, os.O_CREATE|os.O_RDWR, 128))
+
+	buf := &bytes.Buffer{}
+	for i := 0; i < 50; i++ {
+		key := util.KeyWithTs([]byte(fmt.Sprintf("key%02d", i)), 0)
+		require.NoError(t, w.writeEntry(buf, key, kv.Value{Value: bytes.Repeat([]byte{'x'}, 32)}))
+	}
+	require.Greater(t, int(w.size.Load()), 128)
+
+	var count int
+	end, err := w.iterate(func(key []byte, v kv.Value, _ valuePointer) error {
+		require.Equal(t, fmt.Sprintf("key%02d", count), string(key[:len(key)-8]))
+		count++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 50, count)
+	require.Equal(t, w.writeAt, end)
+	require.NoError(t, w.close())
+}
+
+func TestWALSyncAfterDelete(t *testing.T) {
+	db := newMemTableTestDB(t)
+	mt, err := db.openMemTable(1, os.O_CREATE|os.O_RDWR)
+	require.NoError(t, err)
+	require.NoError(t, mt.Put(util.KeyWithTs([]byte("key"), 1), kv.Value{Value: []byte("value")}))
+	require.NoError(t, mt.wal.delete())
+
+	// A flushed memtable may still be synced by value log GC.
+	require.NoError(t, mt.SyncWAL())
+	mt.DecrRef()
+}
+
+func TestMemTableReplayDropsPartialTxn(t *testing.T) {
+	db := newMemTableTestDB(t)
+	mt, err := db.openMemTable(1, os.O_CREATE|os.O_RDWR)
+	require.NoError(t, err)
+	putTxn := func(ts uint64, fin bool, keys ...string) {
+		for _, k := range keys {
+			require.NoError(t, mt.Put(util.KeyWithTs([]byte(k), ts), kv.Value{Meta: kv.BitTxn, Value: []byte(k)}))
+		}
+		if fin {
+			require.NoError(t, mt.Put(util.KeyWithTs(txnKey, ts), kv.Value{Meta: kv.BitFinTxn}))
+		}
+	}
+	putTxn(1, true, "a", "b")
+	require.NoError(t, mt.Put(util.KeyWithTs([]byte("c"), 1), kv.Value{Value: []byte("c")}))
+	end := mt.wal.writeAt
+	putTxn(2, false, "d", "e")
+	require.NoError(t, mt.close())
+
+	mt, err = db.openMemTable(1, os.O_RDWR)
+	require.NoError(t, err)
+	defer mt.close()
+	for _, k := range []string{"a", "b", "c"} {
+		v := mt.get(util.KeyWithTs([]byte(k), 1))
+		require.Equal(t, k, string(v.Value))
+		require.Zero(t, v.Meta&kv.BitTxn)
+	}
+	require.Nil(t, mt.get(util.KeyWithTs([]byte("d"), 2)).Value)
+	require.Nil(t, mt.get(util.KeyWithTs(txnKey, 1)).Value)
+	require.Equal(t, uint64(1), mt.maxVersion)
+	require.Equal(t, end, mt.wal.writeAt)
+}
+
+func TestMemTableArenaFull(t *testing.T) {
+	db := newMemTableTestDB(t)
+	mt, err := db.openMemTable(1, os.O_CREATE|os.O_RDWR)
+	require.NoError(t, err)
+
+	var n int
+	val := kv.Value{Value: bytes.Repeat([]byte("v"), 1000)}
+	for {
+		key := util.KeyWithTs([]byte(fmt.Sprintf("key%05d", n)), 1)
+		writeAt := mt.wal.writeAt
+		err := mt.Put(key, val)
+		if err != nil {
+			// Nothing was written to the WAL either.
+			require.ErrorIs(t, err, skl.ErrArenaFull)
+			require.Equal(t, writeAt, mt.wal.writeAt)
+			break
+		}
+		n++
+	}
+	require.Greater(t, int64(n)*int64(len(val.Value)), db.opt.MemTableSize)
+	require.NoError(t, mt.close())
+
+	// A smaller memtable size doesn't stop the WAL from being replayed.
+	opt, err := buildOption(WithDir(db.opt.Dir), WithMemTableSize(64<<10))
+	require.NoError(t, err)
+	db = &DB{opt: opt}
+	mt, err = db.openMemTable(1, os.O_RDWR)
+	require.NoError(t, err)
+	defer mt.close()
+	for i := 0; i < n; i++ {
+		v := mt.skl.Get([]byte(fmt.Sprintf("key%05d", i)), 1)
+		require.Equal(t, val.Value, v.Value)
+	}
+	require.EqualValues(t, 1, mt.maxVersion)
+}
+
+func TestMemTableReplayRangeTombstones(t *testing.T) {
+	db := newMemTableTestDB(t)
+	mt, err := db.openMemTable(1, os.O_CREATE|os.O_RDWR)
+	require.NoError(t, err)
+	require.NoError(t, mt.Put(util.KeyWithTs([]byte("a"), 1), kv.Value{Value: []byte("value")}))
+	require.NoError(t, mt.Put(util.KeyWithTs([]byte("a"), 2), kv.Value{Meta: kv.BitRangeDelete | kv.BitTxn, Value: []byte("c")}))
+	require.NoError(t, mt.Put(util.KeyWithTs(txnKey, 2), kv.Value{Meta: kv.BitFinTxn}))
+	require.NoError(t, mt.close())
+
+	mt, err = db.openMemTable(1, os.O_RDWR)
+	require.NoError(t, err)
+	defer mt.close()
+	want := []kv.RangeTombstone{{Start: []byte("a"), End: []byte("c"), Version: 2}}
+	require.Equal(t, want, mt.rangeTombstones())
+	require.EqualValues(t, 2, mt.maxVersion)
+	// The range tombstone is kept out of the SkipList.
+	require.EqualValues(t, 1, mt.get(util.KeyWithTs([]byte("a"), 2)).Version)
+}
@@ -0,0 +1,119 @@
+package nyx
+
+import "sync/atomic"
+
+// metrics holds the counters updated by the DB internals.
+type metrics struct {
+	bloomHits           atomic.Uint64
+	bloomMisses         atomic.Uint64
+	bloomFalsePositives atomic.Uint64
+	writeRequests       atomic.Uint64
+	writeGroups         atomic.Uint64
+	rangeDeletedTables  atomic.Uint64
+	tableRawBytes       atomic.Uint64
+	tableStoredBytes    atomic.Uint64
+	vlogRawBytes        atomic.Uint64
+	vlogStoredBytes     atomic.Uint64
+}
+
+// Metrics is a point-in-time snapshot of the DB counters.
+type Metrics struct {
+	// BloomHits is the number of table lookups skipped because the bloom filter
+	// ruled the key out.
+	BloomHits uint64
+	// BloomMisses is the number of table lookups the bloom filter let through.
+	BloomMisses uint64
+	// BloomFalsePositives is the part of BloomMisses where the table didn't hold
+	// a version of the key at or below the one looked up.
+	BloomFalsePositives uint64
+	// WriteRequests is the number of transactions and batches written.
+	WriteRequests uint64
+	// WriteGroups is the number of groups the requests were written in, each
+	// of them with a single log sync if SyncWrites is set.
+	WriteGroups uint64
+	// RangeDeletedTables is the number of tables dropped by compaction without
+	// being read, as a range tombstone deleted everything in them.
+	RangeDeletedTables uint64
+	// TableRawBytes is the size of the SSTable data blocks written, before
+	// compression.
+	TableRawBytes uint64
+	// TableStoredBytes is the size of the same blocks as stored on disk.
+	TableStoredBytes uint64
+	// VlogRawBytes is the size of the values written to the value log, before
+	// compression.
+	VlogRawBytes uint64
+	// VlogStoredBytes is the size of the same values as stored on disk.
+	VlogStoredBytes uint64
+	// BlockCacheHits is the number of SSTable blocks found in the block cache.
+	BlockCacheHits uint64
+	// BlockCacheMisses is the number of SSTable blocks looked up in the block
+	// cache and read from the table.
+	BlockCacheMisses uint64
+	// BlockCacheEvictions is the number of blocks evicted from the block cache.
+	BlockCacheEvictions uint64
+	// IndexCacheHits is the number of SSTable indexes found in the index cache.
+	IndexCacheHits uint64
+	// IndexCacheMisses is the number of SSTable indexes looked up in the index
+	// cache and read again from the table.
+	IndexCacheMisses uint64
+	// IndexCacheEvictions is the number of indexes evicted from the index cache.
+	IndexCacheEvictions uint64
+}
+
+// TableCompressionRatio returns how many times smaller compression made the
+// SSTable data blocks, 1 if nothing was written.
+func (m Metrics) TableCompressionRatio() float64 {
+	return compressionRatio(m.TableRawBytes, m.TableStoredBytes)
+}
+
+// VlogCompressionRatio returns how many times smaller compression made the
+// values in the value log, 1 if nothing was written.
+func (m Metrics) VlogCompressionRatio() float64 {
+	return compressionRatio(m.VlogRawBytes, m.VlogStoredBytes)
+}
+
+// BlockCacheHitRatio returns the part of the block cache lookups that found
+// the block, 0 if there were none.
+func (m Metrics) BlockCacheHitRatio() float64 {
+	return hitRatio(m.BlockCacheHits, m.BlockCacheMisses)
+}
+
+// IndexCacheHitRatio returns the part of the index cache lookups that found
+// the index, 0 if there were none.
+func (m Metrics) IndexCacheHitRatio() float64 {
+	return hitRatio(m.IndexCacheHits, m.IndexCacheMisses)
+}
+
+func hitRatio(hits, misses uint64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+func compressionRatio(raw, stored uint64) float64 {
+	if stored == 0 {
+		return 1
+	}
+	return float64(raw) / float64(stored)
+}
+
+// Metrics returns a snapshot of the DB counters. The cache counters are reset
+// when the DB is closed.
+func (d *DB) Metrics() Metrics {
+	m := Metrics{
+		BloomHits:           d.metrics.bloomHits.Load(),
+		BloomMisses:         d.metrics.bloomMisses.Load(),
+		BloomFalsePositives: d.metrics.bloomFalsePositives.Load(),
+		WriteRequests:       d.metrics.writeRequests.Load(),
+		WriteGroups:         d.metrics.writeGroups.Load(),
+		RangeDeletedTables:  d.metrics.rangeDeletedTables.Load(),
+		TableRawBytes:       d.metrics.tableRawBytes.Load(),
+		TableStoredBytes:    d.metrics.tableStoredBytes.Load(),
+		VlogRawBytes:        d.metrics.vlogRawBytes.Load(),
+		VlogStoredBytes:     d.metrics.vlogStoredBytes.Load(),
+	}
+	m.BlockCacheHits, m.BlockCacheMisses, m.BlockCacheEvictions = d.blockCache.Metrics()
+	m.IndexCacheHits, m.IndexCacheMisses, m.IndexCacheEvictions = d.indexCache.Metrics()
+	return m
+}
@@ -1,20 +1,87 @@
 package nyx
 
+import (
+	"fmt"
+	"time"
+
+	"github.com/crazyfrankie/nyxdb/internal/compress"
+	"github.com/crazyfrankie/nyxdb/internal/encryption"
+	"github.com/crazyfrankie/nyxdb/internal/util"
+	"github.com/crazyfrankie/nyxdb/skl"
+	"github.com/crazyfrankie/nyxdb/table"
+)
+
 type option struct {
-	Dir            string // Database home directory (holds SSTable)
-	ValueDir       string // Directory for large values
-	MemTableSize   int64  // MemTable size threshold (Flush if exceeded)
-	SyncWrites     bool   // Whether each write is immediately flushed to disk
-	ValueThreshold int64  // Threshold value, above which the value is written to ValueDir instead of Dir.
-	maxBatchCount  int64  // max entries in batch
-	maxBatchSize   int64  // max batch size in bytes
+	Dir              string          // Database home directory (holds SSTable)
+	ValueDir         string          // Directory for large values
+	MemTableSize     int64           // MemTable size threshold (Flush if exceeded)
+	SyncWrites       bool            // Whether each write is immediately flushed to disk
+	ValueThreshold   int64           // Threshold value, above which the value is written to ValueDir instead of Dir.
+	ValueLogFileSize int64           // Size at which a value log file is rotated.
+	NumMemtables     int             // Maximum number of memtables waiting to be flushed before writes stall.
+	BlockSize        int             // Size of each data block inside an SSTable.
+	BloomBitsPerKey  int             // Bloom filter bits per key in each SSTable, 0 disables the filter.
+	BlockCacheSize   int64           // Bytes of decrypted or decompressed SSTable blocks kept in memory.
+	IndexCacheSize   int64           // Bytes of SSTable indexes and bloom filters kept in memory, 0 keeps them all.
+	Comparator       Comparator      // Order of the keys.
+	Compression      CompressionType // Algorithm the SSTable blocks are compressed with.
+	CompressValueLog bool            // Whether the value log entries are compressed as well.
+
+	EncryptionKey                 []byte        // Master key the data keys are encrypted with, nil disables encryption.
+	EncryptionKeyRotationDuration time.Duration // Age at which a new data key replaces the latest one.
+
+	MaxLevels               int   // Number of levels in the LSM tree.
+	NumLevelZeroTables      int   // Number of level 0 tables that triggers a compaction.
+	NumLevelZeroTablesStall int   // Number of level 0 tables at which flushes, and so writes, stall.
+	BaseLevelSize           int64 // Target size of level 1.
+	LevelSizeMultiplier     int   // Ratio between the target sizes of two consecutive levels.
+	TableSize               int64 // Target size of the tables written by compactions.
+	NumCompactors           int   // Number of concurrent compaction workers.
+	NumVersionsToKeep       int   // Number of versions of a key kept by compaction.
+	maxBatchCount           int64 // max entries in batch, derived from MemTableSize
+	maxBatchSize            int64 // max batch size in bytes, derived from MemTableSize
 }
 type Option func(*option)
 
+// Comparator defines the order of the keys. See WithComparator.
+type Comparator = util.Comparator
+
+// BytewiseComparator orders the keys lexicographically by bytes.
+var BytewiseComparator = util.BytewiseComparator
+
+// CompressionType is a compression algorithm. See WithCompression.
+type CompressionType = compress.Type
+
+const (
+	// NoCompression leaves the data uncompressed.
+	NoCompression = compress.None
+	// SnappyCompression compresses fast, with a modest ratio.
+	SnappyCompression = compress.Snappy
+	// ZSTDCompression compresses better than Snappy, at a higher CPU cost.
+	ZSTDCompression = compress.ZSTD
+)
+
 var defaultMemTableOpt = &option{
-	MemTableSize:   64 << 20, // 64 MB
-	SyncWrites:     false,
-	ValueThreshold: 1 << 20, // 1 MB
+	MemTableSize:     64 << 20, // 64 MB
+	SyncWrites:       false,
+	ValueThreshold:   1 << 20,   // 1 MB
+	ValueLogFileSize: 1<<30 - 1, // 1 GB
+	NumMemtables:     5,
+	BlockSize:        4 << 10, // 4 KB
+	BloomBitsPerKey:  10,
+	BlockCacheSize:   256 << 20, // 256 MB
+	Comparator:       BytewiseComparator,
+
+	EncryptionKeyRotationDuration: 10 * 24 * time.Hour, // 10 days
+
+	MaxLevels:               7,
+	NumLevelZeroTables:      5,
+	NumLevelZeroTablesStall: 15,
+	BaseLevelSize:           10 << 20, // 10 MB
+	LevelSizeMultiplier:     10,
+	TableSize:               2 << 20, // 2 MB
+	NumCompactors:           4,
+	NumVersionsToKeep:       1,
 }
 
 // WithSyncWrites returns a new Options value with SyncWrites set to the given value.
@@ -22,7 +89,7 @@ var defaultMemTableOpt = &option{
 // Nyx does all writes via mmap. So, all writes can survive process crashes or k8s environments
 // with SyncWrites set to false.
 //
-// When set to true, Badger would call an additional msync after writes to flush mmap buffer over to
+// When set to true, Nyx calls an additional msync after writes to flush the mmap buffers over to
 // disk to survive hard reboots. Most users of Nyx should not need to do this.
 //
 // The default value of SyncWrites is false.
@@ -36,7 +103,7 @@ func WithSyncWrites(val bool) Option {
 //
 // Dir is the path of the directory where key data will be stored in.
 // If it doesn't exist, Nyx will try to create it for you.
-// This is set automatically to be the path given to `DefaultOptions`.
+// Dir is required, Open fails with ErrDirRequired if it is not set.
 func WithDir(path string) Option {
 	return func(opt *option) {
 		opt.Dir = path
@@ -47,13 +114,252 @@ func WithDir(path string) Option {
 //
 // ValueDir is the path of the directory where value data will be stored in.
 // If it doesn't exist, Nyx will try to create it for you.
-// This is set automatically to be the path given to `DefaultOptions`.
+// If it is left empty, it is set automatically to be the same as Dir.
 func WithValueDir(path string) Option {
 	return func(opt *option) {
 		opt.ValueDir = path
 	}
 }
 
+// WithMemTableSize returns a new Options value with MemTableSize set to the given value.
+//
+// MemTableSize sets the maximum size in bytes for memtable. Once the active memtable
+// grows beyond it, it is turned into an immutable memtable and flushed to disk.
+//
+// The default value of MemTableSize is 64 MB.
+func WithMemTableSize(val int64) Option {
+	return func(opt *option) {
+		opt.MemTableSize = val
+	}
+}
+
+// WithNumMemtables returns a new Options value with NumMemtables set to the given value.
+//
+// NumMemtables sets the maximum number of immutable memtables that can be queued up for
+// flushing. Once the limit is reached, writes stall until a memtable has been flushed.
+//
+// The default value of NumMemtables is 5.
+func WithNumMemtables(val int) Option {
+	return func(opt *option) {
+		opt.NumMemtables = val
+	}
+}
+
+// WithBlockSize returns a new Options value with BlockSize set to the given value.
+//
+// BlockSize sets the size of any block in SSTable. SSTable is divided into multiple blocks
+// internally. Each block is prefix compressed and indexed separately.
+//
+// The default value of BlockSize is 4 KB.
+func WithBlockSize(val int) Option {
+	return func(opt *option) {
+		opt.BlockSize = val
+	}
+}
+
+// WithComparator returns a new Options value with Comparator set to the given value.
+//
+// Comparator defines the order of the keys in the memtables, the SSTables and the iterators,
+// and the range of a DeleteRange. Keys that compare equal must be equal byte by byte. A DB
+// must always be opened with the same Comparator.
+//
+// The default value of Comparator is BytewiseComparator.
+func WithComparator(val Comparator) Option {
+	return func(opt *option) {
+		opt.Comparator = val
+	}
+}
+
+// WithCompression returns a new Options value with Compression set to the given value.
+//
+// Compression sets the algorithm each SSTable block is compressed with. A block that doesn't
+// shrink by at least an eighth is stored uncompressed. The algorithm is recorded in every
+// block, so tables written with different settings can be read side by side, and the setting
+// can be changed between two opens of the DB.
+//
+// The default value of Compression is NoCompression.
+func WithCompression(val CompressionType) Option {
+	return func(opt *option) {
+		opt.Compression = val
+	}
+}
+
+// WithCompressValueLog returns a new Options value with CompressValueLog set to the given value.
+//
+// CompressValueLog makes the values written to the value log compressed with the algorithm
+// set by WithCompression, one entry at a time. It's worth it unless the big values are
+// already compressed, like most media files.
+//
+// The default value of CompressValueLog is false.
+func WithCompressValueLog(val bool) Option {
+	return func(opt *option) {
+		opt.CompressValueLog = val
+	}
+}
+
+// WithEncryptionKey returns a new Options value with EncryptionKey set to the given value.
+//
+// EncryptionKey is the master key, 16, 24 or 32 bytes long to select AES-128, AES-192 or
+// AES-256. The WAL, the value log and the SSTables are encrypted with data keys, which are
+// stored in the KEYREGISTRY file encrypted with the master key. A database created with an
+// EncryptionKey can only be opened with the same key, Open returns ErrEncryptionKeyMismatch
+// otherwise. Files written before encryption was enabled stay readable.
+//
+// The default value of EncryptionKey is nil, nothing is encrypted.
+func WithEncryptionKey(val []byte) Option {
+	return func(opt *option) {
+		opt.EncryptionKey = val
+	}
+}
+
+// WithEncryptionKeyRotationDuration returns a new Options value with
+// EncryptionKeyRotationDuration set to the given value.
+//
+// EncryptionKeyRotationDuration is the age at which a new data key is generated for the files
+// written from then on. The older data keys are kept to read the files they encrypted.
+//
+// The default value of EncryptionKeyRotationDuration is 10 days.
+func WithEncryptionKeyRotationDuration(val time.Duration) Option {
+	return func(opt *option) {
+		opt.EncryptionKeyRotationDuration = val
+	}
+}
+
+// WithBlockCacheSize returns a new Options value with BlockCacheSize set to the given value.
+//
+// BlockCacheSize is the size of the cache of SSTable blocks that had to be decrypted or
+// decompressed, so that hot reads don't decode them again. Plain blocks are read straight
+// from the memory mapped tables and aren't cached. Setting it to 0 disables the cache.
+//
+// The default value of BlockCacheSize is 256 MB.
+func WithBlockCacheSize(val int64) Option {
+	return func(opt *option) {
+		opt.BlockCacheSize = val
+	}
+}
+
+// WithIndexCacheSize returns a new Options value with IndexCacheSize set to the given value.
+//
+// IndexCacheSize bounds the memory taken by the indexes and the bloom filters of the SSTables.
+// The ones evicted from the cache are read, and decrypted, again from the tables when needed.
+// Setting it to 0 keeps them all in memory for as long as the tables are open.
+//
+// The default value of IndexCacheSize is 0.
+func WithIndexCacheSize(val int64) Option {
+	return func(opt *option) {
+		opt.IndexCacheSize = val
+	}
+}
+
+// WithBloomBitsPerKey returns a new Options value with BloomBitsPerKey set to the given value.
+//
+// Every SSTable carries a bloom filter over its user keys, which lets point lookups skip
+// tables that can't contain the key. BloomBitsPerKey trades filter size for accuracy,
+// 10 bits per key give a false positive rate of about 1%. Setting it to 0 disables the filters.
+//
+// The default value of BloomBitsPerKey is 10.
+func WithBloomBitsPerKey(val int) Option {
+	return func(opt *option) {
+		opt.BloomBitsPerKey = val
+	}
+}
+
+// WithMaxLevels returns a new Options value with MaxLevels set to the given value.
+//
+// MaxLevels sets the maximum number of levels of compaction allowed in the LSM.
+//
+// The default value of MaxLevels is 7.
+func WithMaxLevels(val int) Option {
+	return func(opt *option) {
+		opt.MaxLevels = val
+	}
+}
+
+// WithNumLevelZeroTables returns a new Options value with NumLevelZeroTables set to the given
+// value.
+//
+// NumLevelZeroTables sets the maximum number of Level 0 tables before compaction starts.
+//
+// The default value of NumLevelZeroTables is 5.
+func WithNumLevelZeroTables(val int) Option {
+	return func(opt *option) {
+		opt.NumLevelZeroTables = val
+	}
+}
+
+// WithNumLevelZeroTablesStall returns a new Options value with NumLevelZeroTablesStall set to
+// the given value.
+//
+// NumLevelZeroTablesStall sets the number of Level 0 tables that once reached causes the DB to
+// stall until compaction succeeds.
+//
+// The default value of NumLevelZeroTablesStall is 15.
+func WithNumLevelZeroTablesStall(val int) Option {
+	return func(opt *option) {
+		opt.NumLevelZeroTablesStall = val
+	}
+}
+
+// WithBaseLevelSize returns a new Options value with BaseLevelSize set to the given value.
+//
+// BaseLevelSize sets the maximum size target for level 1. Every following level may grow
+// LevelSizeMultiplier times bigger than the one before it.
+//
+// The default value of BaseLevelSize is 10 MB.
+func WithBaseLevelSize(val int64) Option {
+	return func(opt *option) {
+		opt.BaseLevelSize = val
+	}
+}
+
+// WithLevelSizeMultiplier returns a new Options value with LevelSizeMultiplier set to the given
+// value.
+//
+// LevelSizeMultiplier sets the ratio between the maximum sizes of contiguous levels in the LSM.
+// Once a level grows to be larger than this ratio allowed, the compaction process will be
+// triggered.
+//
+// The default value of LevelSizeMultiplier is 10.
+func WithLevelSizeMultiplier(val int) Option {
+	return func(opt *option) {
+		opt.LevelSizeMultiplier = val
+	}
+}
+
+// WithTableSize returns a new Options value with TableSize set to the given value.
+//
+// TableSize sets the target size of the tables written by compaction.
+//
+// The default value of TableSize is 2 MB.
+func WithTableSize(val int64) Option {
+	return func(opt *option) {
+		opt.TableSize = val
+	}
+}
+
+// WithNumCompactors sets the number of compaction workers to run concurrently.
+//
+// The default value of NumCompactors is 4.
+func WithNumCompactors(val int) Option {
+	return func(opt *option) {
+		opt.NumCompactors = val
+	}
+}
+
+// WithNumVersionsToKeep returns a new Options value with NumVersionsToKeep set to the given value.
+//
+// NumVersionsToKeep sets how many versions to keep per key at most. Versions
+// that are still readable by a running transaction or snapshot are kept anyway,
+// the limit applies to the older ones. A deletion ends the history of a key,
+// the versions before it are discarded.
+//
+// The default value of NumVersionsToKeep is 1.
+func WithNumVersionsToKeep(val int) Option {
+	return func(opt *option) {
+		opt.NumVersionsToKeep = val
+	}
+}
+
 // WithValueThreshold returns a new Options value with ValueThreshold set to the given value.
 //
 // ValueThreshold sets the threshold used to decide whether a value is stored directly in the LSM
@@ -65,3 +371,102 @@ func WithValueThreshold(val int64) Option {
 		opt.ValueThreshold = val
 	}
 }
+
+// WithValueLogFileSize returns a new Options value with ValueLogFileSize set to the given value.
+//
+// ValueLogFileSize sets the maximum size of a single value log file. Once a file
+// grows past it, values are appended to a new file.
+//
+// The default value of ValueLogFileSize is 1 GB.
+func WithValueLogFileSize(val int64) Option {
+	return func(opt *option) {
+		opt.ValueLogFileSize = val
+	}
+}
+
+// buildOption applies opts on top of the default options and fills
+// in the derived fields.
+func buildOption(opts ...Option) (*option, error) {
+	opt := *defaultMemTableOpt
+	for _, o := range opts {
+		o(&opt)
+	}
+	if opt.Dir == "" {
+		return nil, ErrDirRequired
+	}
+	if opt.ValueDir == "" {
+		opt.ValueDir = opt.Dir
+	}
+	if opt.NumMemtables < 1 {
+		return nil, fmt.Errorf("NumMemtables must be at least 1, got %d", opt.NumMemtables)
+	}
+	if opt.MaxLevels < 2 {
+		return nil, fmt.Errorf("MaxLevels must be at least 2, got %d", opt.MaxLevels)
+	}
+	if opt.ValueLogFileSize < 1<<20 || opt.ValueLogFileSize >= 1<<31 {
+		return nil, fmt.Errorf("ValueLogFileSize must be in range [1MB, 2GB), got %d", opt.ValueLogFileSize)
+	}
+	if opt.NumCompactors < 1 {
+		return nil, fmt.Errorf("NumCompactors must be at least 1, got %d", opt.NumCompactors)
+	}
+	if opt.Comparator == nil {
+		return nil, fmt.Errorf("Comparator must not be nil")
+	}
+	if !opt.Compression.Valid() {
+		return nil, fmt.Errorf("unknown Compression %s", opt.Compression)
+	}
+	if len(opt.EncryptionKey) > 0 && !encryption.ValidKeySize(len(opt.EncryptionKey)) {
+		return nil, fmt.Errorf("%w: must be 16, 24 or 32 bytes, got %d",
+			ErrInvalidEncryptionKey, len(opt.EncryptionKey))
+	}
+	if len(opt.EncryptionKey) == 0 {
+		opt.EncryptionKey = nil
+	}
+	if opt.EncryptionKeyRotationDuration <= 0 {
+		return nil, fmt.Errorf("EncryptionKeyRotationDuration must be positive, got %s",
+			opt.EncryptionKeyRotationDuration)
+	}
+	if opt.BlockCacheSize < 0 || opt.IndexCacheSize < 0 {
+		return nil, fmt.Errorf("cache sizes must not be negative, got %d and %d",
+			opt.BlockCacheSize, opt.IndexCacheSize)
+	}
+	if opt.NumVersionsToKeep < 1 {
+		return nil, fmt.Errorf("NumVersionsToKeep must be at least 1, got %d", opt.NumVersionsToKeep)
+	}
+
+	// A transaction or write batch takes up to 15% of a memtable, so that it
+	// always fits into an empty one.
+	opt.maxBatchSize = (15 * opt.MemTableSize) / 100
+	opt.maxBatchCount = opt.maxBatchSize / int64(skl.MaxNodeSize)
+	if opt.maxBatchCount < 1 {
+		return nil, fmt.Errorf("MemTableSize must be at least %d, got %d",
+			(100*int64(skl.MaxNodeSize)+14)/15, opt.MemTableSize)
+	}
+
+	return &opt, nil
+}
+
+// tableOptions returns the options used to build and open tables.
+func (opt *option) tableOptions() table.Options {
+	return table.Options{
+		BlockSize:       opt.BlockSize,
+		BloomBitsPerKey: opt.BloomBitsPerKey,
+		Comparator:      opt.Comparator,
+		Compression:     opt.Compression,
+	}
+}
+
+// tableOptions returns the options used to build and open tables, new tables
+// are encrypted with the latest data key. The tables share the caches of d.
+func (d *DB) tableOptions() (table.Options, error) {
+	opts := d.opt.tableOptions()
+	dk, err := d.registry.latestDataKey()
+	if err != nil {
+		return table.Options{}, err
+	}
+	opts.DataKey = dk
+	opts.KeyRegistry = d.registry
+	opts.BlockCache = d.blockCache
+	opts.IndexCache = d.indexCache
+	return opts, nil
+}
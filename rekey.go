@@ -0,0 +1,213 @@
+package nyx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+
+	"github.com/crazyfrankie/nyxdb/internal/encryption"
+	"github.com/crazyfrankie/nyxdb/internal/kv"
+	"github.com/crazyfrankie/nyxdb/table"
+)
+
+// Rekey re-encrypts a database that isn't open: every table and value log
+// file is rewritten under a fresh data key, and the data keys that encrypted
+// them before are dropped from the key registry. If newKey isn't nil, it
+// replaces the master key, and has to be passed to WithEncryptionKey from
+// then on. A database that isn't encrypted yet gets encrypted with newKey.
+//
+// opts are the options the database is opened with. The database is opened
+// and closed first, so that everything in the WAL ends up in tables. The
+// checksums of all the files are verified once they're rewritten.
+func Rekey(newKey []byte, opts ...Option) error {
+	opt, err := buildOption(opts...)
+	if err != nil {
+		return err
+	}
+	if newKey != nil && !encryption.ValidKeySize(len(newKey)) {
+		return fmt.Errorf("%w: must be 16, 24 or 32 bytes, got %d", ErrInvalidEncryptionKey, len(newKey))
+	}
+	if opt.EncryptionKey == nil && newKey == nil {
+		return fmt.Errorf("%w: the database isn't encrypted and no new key is given", ErrInvalidEncryptionKey)
+	}
+
+	db, err := Open(opts...)
+	if err != nil {
+		return err
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+
+	dirLockGuard, err := acquireDirectoryLock(opt.Dir, lockFile)
+	if err != nil {
+		return err
+	}
+	defer dirLockGuard.release()
+	if opt.ValueDir != opt.Dir {
+		valueDirLockGuard, err := acquireDirectoryLock(opt.ValueDir, lockFile)
+		if err != nil {
+			return err
+		}
+		defer valueDirLockGuard.release()
+	}
+
+	kr, err := openKeyRegistry(opt.Dir, opt.EncryptionKey, opt.EncryptionKeyRotationDuration)
+	if err != nil {
+		return err
+	}
+	defer kr.close()
+	if newKey != nil {
+		if err := kr.rewrite(newKey); err != nil {
+			return fmt.Errorf("while rotating master key: %w", err)
+		}
+	}
+	kr.Lock()
+	dk, err := kr.newDataKey()
+	kr.Unlock()
+	if err != nil {
+		return err
+	}
+
+	mf, manifest, err := openOrCreateManifestFile(opt.Dir)
+	if err != nil {
+		return err
+	}
+	if err := mf.close(); err != nil {
+		return err
+	}
+	tableOpts := opt.tableOptions()
+	tableOpts.DataKey = dk
+	tableOpts.KeyRegistry = kr
+	for id := range manifest.tables {
+		if err := rekeyTable(table.NewFilename(id, opt.Dir), tableOpts); err != nil {
+			return fmt.Errorf("while rekeying table %d: %w", id, err)
+		}
+	}
+
+	vlog := &valueLog{dirPath: opt.ValueDir, opt: opt, registry: kr}
+	fids, err := vlogFids(vlog.dirPath)
+	if err != nil {
+		return err
+	}
+	for _, fid := range fids {
+		if err := vlog.rekeyLogFile(fid); err != nil {
+			return fmt.Errorf("while rekeying value log file %d: %w", fid, err)
+		}
+	}
+
+	// The files are verified with the fresh data key only, no file may still
+	// need an older one.
+	kr.Lock()
+	kr.dataKeys = map[uint64]*encryption.DataKey{dk.ID: dk}
+	kr.Unlock()
+	tableOpts.DataKey = nil
+	for id := range manifest.tables {
+		if err := verifyTable(table.NewFilename(id, opt.Dir), tableOpts); err != nil {
+			return fmt.Errorf("while verifying table %d: %w", id, err)
+		}
+	}
+	for _, fid := range fids {
+		if err := vlog.verifyLogFile(fid); err != nil {
+			return fmt.Errorf("while verifying value log file %d: %w", fid, err)
+		}
+	}
+
+	kr.Lock()
+	defer kr.Unlock()
+	return kr.rewrite(kr.masterKey)
+}
+
+// rekeyTable rewrites the table at path with the data key in opts.
+func rekeyTable(path string, opts table.Options) error {
+	t, err := table.OpenTable(path, opts)
+	if err != nil {
+		return err
+	}
+	builder := table.NewTableBuilder(opts)
+	it := t.NewIterator(false)
+	builder.AddAll(it)
+	for _, rt := range t.RangeTombstones() {
+		builder.AddRangeTombstone(rt)
+	}
+	err = it.Err()
+	it.Close()
+	// The old table is replaced under its name.
+	if err := errors.Join(err, t.Close()); err != nil {
+		return err
+	}
+
+	t, err = table.CreateTable(path, builder)
+	if err != nil {
+		return err
+	}
+	return t.Close()
+}
+
+// verifyTable opens the table at path and verifies all its checksums.
+func verifyTable(path string, opts table.Options) error {
+	t, err := table.OpenTable(path, opts)
+	if err != nil {
+		return err
+	}
+	return errors.Join(t.VerifyChecksum(), t.Close())
+}
+
+// rekeyLogFile rewrites the value log file with fid under the latest data key
+// of the registry. The entries keep their offsets, so the value pointers to
+// them stay valid.
+func (vlog *valueLog) rekeyLogFile(fid uint32) error {
+	lf, err := vlog.openLogFile(fid, os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	tmp := lf.path + ".rekey"
+	nf := &wal{
+		path:     tmp,
+		fid:      fid,
+		writeAt:  vlogHeaderSize,
+		opt:      vlog.opt,
+		registry: vlog.registry,
+	}
+	if err := nf.open(tmp, os.O_CREATE|os.O_RDWR|os.O_TRUNC, int(lf.writeAt)); err != nil {
+		lf.close()
+		return err
+	}
+	var buf bytes.Buffer
+	_, err = lf.iterate(func(key []byte, v kv.Value, vp valuePointer) error {
+		if nf.writeAt != vp.Offset {
+			return fmt.Errorf("entry at offset %d would move to %d", vp.Offset, nf.writeAt)
+		}
+		return nf.writeEntry(&buf, key, v)
+	})
+	if err == nil && nf.writeAt != lf.writeAt {
+		err = fmt.Errorf("rewritten file ends at %d instead of %d", nf.writeAt, lf.writeAt)
+	}
+	if err := errors.Join(err, nf.close(), lf.close()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, lf.path); err != nil {
+		return err
+	}
+
+	return z.SyncDir(vlog.dirPath)
+}
+
+// verifyLogFile verifies the checksums of all the entries in the value log
+// file with fid.
+func (vlog *valueLog) verifyLogFile(fid uint32) error {
+	lf, err := vlog.openLogFile(fid, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	end, err := lf.iterate(func([]byte, kv.Value, valuePointer) error { return nil })
+	if err == nil && end != lf.writeAt {
+		err = fmt.Errorf("checksum mismatch at offset %d", end)
+	}
+
+	return errors.Join(err, lf.mmapFile.Close(-1))
+}
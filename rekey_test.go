@@ -0,0 +1,72 @@
+package nyx
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRekey(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, newKey := bytes.Repeat([]byte("o"), 32), bytes.Repeat([]byte("n"), 32)
+
+	const n = 100
+	key := func(i int) []byte { return []byte(fmt.Sprintf("secret-key%03d", i)) }
+	value := func(i int) []byte {
+		if i%2 == 0 {
+			return []byte(fmt.Sprintf("secret-small%03d", i))
+		}
+		return bytes.Repeat([]byte(fmt.Sprintf("secret-big%03d", i)), 1<<8)
+	}
+	check := func(db *DB) {
+		for i := 0; i < n; i++ {
+			val, err := db.Get(key(i))
+			require.NoError(t, err)
+			require.Equal(t, value(i), val)
+		}
+	}
+	requireEncrypted := func() {
+		for _, pattern := range []string{"*.sst", "*" + VlogFileExt} {
+			matches, err := filepath.Glob(filepath.Join(dir, pattern))
+			require.NoError(t, err)
+			require.NotEmpty(t, matches, pattern)
+			for _, path := range matches {
+				data, err := os.ReadFile(path)
+				require.NoError(t, err)
+				require.NotContains(t, string(data), "secret", path)
+			}
+		}
+	}
+
+	// A database that isn't encrypted needs a new key.
+	db := openTestDB(t, dir, WithValueThreshold(1<<10))
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put(key(i), value(i)))
+	}
+	require.NoError(t, db.Close())
+	require.ErrorIs(t, Rekey(nil, WithDir(dir)), ErrInvalidEncryptionKey)
+
+	require.NoError(t, Rekey(oldKey, WithDir(dir)))
+	requireEncrypted()
+	db = openTestDB(t, dir, WithEncryptionKey(oldKey))
+	require.Len(t, db.registry.dataKeys, 1)
+	lastID := db.registry.lastID
+	check(db)
+	require.NoError(t, db.Close())
+
+	require.NoError(t, Rekey(newKey, WithDir(dir), WithEncryptionKey(oldKey)))
+	requireEncrypted()
+	_, err := Open(WithDir(dir), WithEncryptionKey(oldKey))
+	require.ErrorIs(t, err, ErrEncryptionKeyMismatch)
+	db = openTestDB(t, dir, WithEncryptionKey(newKey))
+	// Only the fresh data key is left, the files encrypted with the older
+	// ones have all been rewritten.
+	require.Len(t, db.registry.dataKeys, 1)
+	require.Greater(t, db.registry.lastID, lastID)
+	check(db)
+	require.NoError(t, db.Close())
+}
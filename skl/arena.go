@@ -1,7 +1,7 @@
 package skl
 
 import (
-	"log"
+	"errors"
 	"sync/atomic"
 	"unsafe"
 
@@ -18,6 +18,17 @@ const (
 	nodeAlign = int(unsafe.Sizeof(uint64(0))) - 1
 )
 
+var (
+	// ErrArenaFull is returned when the arena has no room left for a new node,
+	// key or value. The SkipList stays usable, it just can't take more writes.
+	ErrArenaFull = errors.New("arena is full")
+
+	// ErrCorrupt is returned when a write finds the SkipList in a state it
+	// can never be in. The key may have been inserted partly, nothing should
+	// be written to the SkipList anymore.
+	ErrCorrupt = errors.New("skiplist is corrupt")
+)
+
 type Arena struct {
 	cnt atomic.Uint32
 	buf []byte
@@ -26,6 +37,10 @@ type Arena struct {
 func newArena(maxSize int64) *Arena {
 	// Badger design here, reserving index 0 to prevent data from being stored at offset 0.
 	// "Don't store data at position 0 in order to reserve offset=0 as a kind of nil pointer."
+	// The arena always has room for the head node.
+	if minSize := int64(1 + MaxNodeSize + nodeAlign); maxSize < minSize {
+		maxSize = minSize
+	}
 	ar := &Arena{buf: make([]byte, maxSize)}
 	ar.cnt.Store(1)
 
@@ -36,51 +51,63 @@ func (a *Arena) size() int64 {
 	return int64(a.cnt.Load())
 }
 
-// putNode assigns a node in the arena.
+// allocate reserves total bytes and returns the offset right after them. It
+// returns ErrArenaFull without reserving anything if they don't fit, with
+// slack more bytes left in the buffer after them.
+func (a *Arena) allocate(total, slack uint32) (uint32, error) {
+	for {
+		cnt := a.cnt.Load()
+		n := cnt + total
+		if int64(n)+int64(slack) > int64(len(a.buf)) || n < cnt {
+			return 0, ErrArenaFull
+		}
+		if a.cnt.CompareAndSwap(cnt, n) {
+			return n, nil
+		}
+	}
+}
+
+// putNode assigns a node of the given height in the arena, followed by key and
+// val, with a single allocation: either all of them fit or nothing is used.
 // Nodes are aligned to pointer-sized boundary alignments.
-// The offset of the node is returned.
-func (a *Arena) putNode(height int) uint32 {
+// The offsets of the node, the key and the value are returned.
+func (a *Arena) putNode(height int, key []byte, val kv.Value) (uint32, uint32, uint32, error) {
 	// Calculate the amount that won't be used and truncate it,
 	// since height must be less than maxHeight.
 	unusedSize := (maxHeight - height) * offsetSize
-	total := uint32(MaxNodeSize - unusedSize + nodeAlign)
-	n := a.cnt.Add(total)
-	if int(n) > len(a.buf) {
-		log.Fatalf("Arena is too small, toWrite:%d, newTotal:%d, limit:%d", total, n, len(a.buf))
+	nodeSize := uint32(MaxNodeSize - unusedSize + nodeAlign)
+	total := nodeSize + uint32(len(key)) + val.EncodedSize()
+	// The node is accessed as a whole, the unused part of its tower must
+	// still lie within the buffer.
+	n, err := a.allocate(total, uint32(unusedSize))
+	if err != nil {
+		return 0, 0, 0, err
 	}
+	start := n - total
 	// returns the offset after alignment.
-	offset := (n - total + uint32(nodeAlign)) &^ uint32(nodeAlign)
+	nodeOffset := (start + uint32(nodeAlign)) &^ uint32(nodeAlign)
+	keyOffset := start + nodeSize
+	copy(a.buf[keyOffset:], key)
+	valOffset := keyOffset + uint32(len(key))
+	val.Encode(a.buf[valOffset:])
 
-	return offset
-}
-
-func (a *Arena) putKey(key []byte) uint32 {
-	total := uint32(len(key))
-	n := a.cnt.Add(total)
-	if int(n) > len(a.buf) {
-		log.Fatalf("Arena is too small, toWrite:%d, newTotal:%d, limit:%d", total, n, len(a.buf))
-	}
-	offset := n - total
-	copy(a.buf[offset:n], key)
-
-	return offset
+	return nodeOffset, keyOffset, valOffset, nil
 }
 
 // Put will *copy* val into arena. To make better use of this, reuse your input
 // val buffer. Returns an offset into buf. User is responsible for remembering
 // size of val. We could also store this size inside arena but the encoding and
 // decoding will incur some overhead.
-func (a *Arena) putVal(val kv.Value) uint32 {
+func (a *Arena) putVal(val kv.Value) (uint32, error) {
 	total := val.EncodedSize()
-	n := a.cnt.Add(total)
-
-	if int(n) > len(a.buf) {
-		log.Fatalf("Arena is too small, toWrite:%d, newTotal:%d, limit:%d", total, n, len(a.buf))
+	n, err := a.allocate(total, 0)
+	if err != nil {
+		return 0, err
 	}
 	offset := n - total
 	val.Encode(a.buf[offset:])
 
-	return offset
+	return offset, nil
 }
 
 // getNode returns a pointer to the node located at offset. If the offset is zero,
@@ -1,7 +1,7 @@
 package skl
 
 import (
-	"log"
+	"fmt"
 	"math/rand"
 	"sync/atomic"
 	"unsafe"
@@ -42,6 +42,7 @@ type SkipList struct {
 	height atomic.Int32
 	ref    atomic.Int32
 	arena  *Arena
+	cmp    util.Comparator // orders the keys without timestamp
 }
 
 // IncrRef increases the refcount
@@ -74,21 +75,30 @@ func decodeValue(value uint64) (valOffset uint32, valSize uint32) {
 	return
 }
 
-func newNode(a *Arena, key []byte, val kv.Value, height int) *node {
-	// The base level is already allocated in the node struct.
-	offset := a.putNode(height)
+func newNode(a *Arena, key []byte, val kv.Value, height int) (*node, error) {
+	offset, keyOffset, valOffset, err := a.putNode(height, key, val)
+	if err != nil {
+		return nil, err
+	}
 	n := a.getNode(offset)
-	n.keyOffset = a.putKey(key)
+	n.keyOffset = keyOffset
 	n.keySize = uint16(len(key))
 	n.height = uint16(height)
-	n.value.Store(encodeValue(a.putVal(val), val.EncodedSize()))
-	return n
+	n.value.Store(encodeValue(valOffset, val.EncodedSize()))
+	return n, nil
 }
 
-func NewSkipList(arenaSize int64) *SkipList {
+// NewSkipList returns a SkipList whose nodes, keys and values are allocated
+// from an arena of arenaSize bytes. Keys are ordered by cmp, and then by
+// version, newest first. A nil cmp orders them by bytes.
+func NewSkipList(arenaSize int64, cmp util.Comparator) *SkipList {
+	if cmp == nil {
+		cmp = util.BytewiseComparator
+	}
 	arena := newArena(arenaSize)
-	head := newNode(arena, nil, kv.Value{}, maxHeight)
-	skl := &SkipList{head: head, arena: arena}
+	// The arena always has room for the head.
+	head, _ := newNode(arena, nil, kv.Value{}, maxHeight)
+	skl := &SkipList{head: head, arena: arena, cmp: cmp}
 	skl.height.Store(1)
 	skl.ref.Add(1)
 	return skl
@@ -101,10 +111,14 @@ func (n *node) getValue() (uint32, uint32) {
 }
 
 // setValue stores the given val in the node and arena.
-func (n *node) setValue(a *Arena, val kv.Value) {
-	valueOffset := a.putVal(val)
+func (n *node) setValue(a *Arena, val kv.Value) error {
+	valueOffset, err := a.putVal(val)
+	if err != nil {
+		return err
+	}
 	value := encodeValue(valueOffset, val.EncodedSize())
 	n.value.Store(value)
+	return nil
 }
 
 // getNextOffset returns the offset of the node with the given height in the next array.
@@ -154,7 +168,7 @@ func (s *SkipList) findNear(key []byte, less bool, allowEqual bool) (*node, bool
 		}
 
 		nextKey := next.key(s.arena)
-		cmp := util.CompareKeys(key, nextKey)
+		cmp := util.CompareKeys(s.cmp, key, nextKey)
 		if cmp > 0 {
 			// curr.key < next.key < key. We can continue to move right.
 			curr = next
@@ -215,22 +229,24 @@ func (s *SkipList) findLast() *node {
 	}
 }
 
-// Get gets the value associated with the key.
-// It returns a valid value if it finds equal or earlier version of the same key.
-func (s *SkipList) Get(key []byte) kv.Value {
-	n, _ := s.findNear(key, false, true) // findGreaterOrEqual
+// Get returns the newest version of key, a key without timestamp, that is not
+// newer than readTs, with its Version set. It returns an empty value if there
+// is none. The returned value aliases the arena.
+func (s *SkipList) Get(key []byte, readTs uint64) kv.Value {
+	seek := util.KeyWithTs(key, readTs)
+	n, _ := s.findNear(seek, false, true) // findGreaterOrEqual
 	if n == nil {
 		return kv.Value{}
 	}
 
-	nextKey := s.arena.getKey(n.keyOffset, n.keySize)
-	if !util.SameKey(key, nextKey) {
+	nextKey := n.key(s.arena)
+	if !util.SameKey(seek, nextKey) {
 		return kv.Value{}
 	}
 
 	valOffset, valSize := n.getValue()
 	vs := s.arena.getVal(valOffset, valSize)
-	vs.Version = util.ParseTs(key)
+	vs.Version = util.ParseTs(nextKey)
 
 	return vs
 }
@@ -244,7 +260,7 @@ func (s *SkipList) findSpliceForLevel(key []byte, before *node, level int) (*nod
 			return before, next
 		}
 		nextKey := next.key(s.arena)
-		cmp := util.CompareKeys(key, nextKey)
+		cmp := util.CompareKeys(s.cmp, key, nextKey)
 		if cmp == 0 {
 			// Equal case
 			// just update val
@@ -260,8 +276,30 @@ func (s *SkipList) findSpliceForLevel(key []byte, before *node, level int) (*nod
 	}
 }
 
-// Put inserts the key-value pair.
+// Available returns the number of bytes left in the arena.
+func (s *SkipList) Available() int64 {
+	return int64(len(s.arena.buf)) - s.arena.size()
+}
+
+// CanFit returns whether a new node for key and val is sure to fit into the
+// arena, even at the maximum height.
+func (s *SkipList) CanFit(key []byte, val kv.Value) bool {
+	return int64(MaxNodeSize+nodeAlign+len(key))+int64(val.EncodedSize()) <= s.Available()
+}
+
+// Put inserts the key-value pair. It panics if the arena is full, TryPut
+// reports that as an error instead.
 func (s *SkipList) Put(key []byte, val kv.Value) {
+	if err := s.TryPut(key, val); err != nil {
+		panic(err)
+	}
+}
+
+// TryPut inserts the key-value pair. It returns ErrArenaFull, leaving the
+// SkipList unchanged, if the arena has no room left for them. It returns
+// ErrCorrupt if the SkipList is found broken, in which case the key may be
+// inserted partly and the SkipList must not be written to anymore.
+func (s *SkipList) TryPut(key []byte, val kv.Value) error {
 	currHeight := s.getHeight()
 	var prev [maxHeight + 1]*node
 	var next [maxHeight + 1]*node
@@ -271,13 +309,15 @@ func (s *SkipList) Put(key []byte, val kv.Value) {
 	for i := int(currHeight) - 1; i >= 0; i-- {
 		prev[i], next[i] = s.findSpliceForLevel(key, prev[i+1], i)
 		if prev[i] == next[i] {
-			prev[i].setValue(s.arena, val)
-			return
+			return prev[i].setValue(s.arena, val)
 		}
 	}
 
 	height := s.RandomLevel()
-	newNode := newNode(s.arena, key, val, height)
+	newNode, err := newNode(s.arena, key, val, height)
+	if err != nil {
+		return err
+	}
 
 	// Try to increase height through CAS
 	currHeight = s.getHeight()
@@ -294,7 +334,7 @@ func (s *SkipList) Put(key []byte, val kv.Value) {
 		for {
 			if prev[i] == nil {
 				if i <= 1 {
-					log.Fatalf("Invalid level: %d. This cannot happen in base level.", i)
+					return fmt.Errorf("%w: invalid level %d, this cannot happen in base level", ErrCorrupt, i)
 				}
 				// We haven't computed prev, next for this level because height exceeds old currHeight.
 				// For these levels, we expect the lists to be sparse, so we can just search from head.
@@ -304,7 +344,7 @@ func (s *SkipList) Put(key []byte, val kv.Value) {
 				// This doesn't usually happen, but if prev[i] == next[i],
 				// there's a problem with the jump table structure (e.g. multiple threads inserting the same key at the same time).
 				if prev[i] == next[i] {
-					log.Fatalf("prev[i] and next[i] are equal at level %d, which should never happen.", i)
+					return fmt.Errorf("%w: prev and next are equal at level %d, which should never happen", ErrCorrupt, i)
 				}
 			}
 			nextOffset := s.arena.getNodeOffset(next[i])
@@ -318,13 +358,14 @@ func (s *SkipList) Put(key []byte, val kv.Value) {
 			prev[i], next[i] = s.findSpliceForLevel(key, prev[i], i)
 			if prev[i] == next[i] {
 				if i != 0 {
-					log.Fatalf("Equality can happen only on base level, but found on level %d.", i)
+					return fmt.Errorf("%w: equality can happen only on base level, but found on level %d", ErrCorrupt, i)
 				}
-				prev[i].setValue(s.arena, val)
-				return
+				return prev[i].setValue(s.arena, val)
 			}
 		}
 	}
+
+	return nil
 }
 
 // RandomLevel generates a random number of levels
@@ -336,6 +377,11 @@ func (s *SkipList) RandomLevel() int {
 	return level
 }
 
+// Empty returns if the SkipList is empty.
+func (s *SkipList) Empty() bool {
+	return s.findLast() == nil
+}
+
 // MemorySize returns the size of the SkipList in terms of how much memory is used within its internal arena.
 func (s *SkipList) MemorySize() int64 {
 	return s.arena.size()
@@ -378,18 +424,18 @@ func (i *Iterator) ValueUint64() uint64 {
 	return i.n.value.Load()
 }
 
-// Next moves to the next position.
+// Next moves to the next position. It's a no-op if the iterator is not valid.
 func (i *Iterator) Next() {
 	if !i.Valid() {
-		log.Fatalf("the current node is nil, can't move to next node")
+		return
 	}
 	i.n = i.list.getNext(i.n, 0)
 }
 
-// Prev moves to the previous position
+// Prev moves to the previous position. It's a no-op if the iterator is not valid.
 func (i *Iterator) Prev() {
 	if !i.Valid() {
-		log.Fatalf("the current node is nil, can't move to prev node")
+		return
 	}
 	i.n, _ = i.list.findNear(i.Key(), true, false)
 }
@@ -29,7 +29,7 @@ func length(s *SkipList) int {
 }
 
 func TestBasicWay(t *testing.T) {
-	l := NewSkipList(arenaSize)
+	l := NewSkipList(arenaSize, nil)
 	val1 := newValue(42)
 	val2 := newValue(52)
 	val3 := newValue(62)
@@ -42,30 +42,30 @@ func TestBasicWay(t *testing.T) {
 	l.Put(util.KeyWithTs([]byte("key2"), 2), kv.Value{Value: val2, Meta: 56, UserMeta: 0})
 	l.Put(util.KeyWithTs([]byte("key3"), 0), kv.Value{Value: val3, Meta: 57, UserMeta: 0})
 
-	v := l.Get(util.KeyWithTs([]byte("key"), 0))
+	v := l.Get([]byte("key"), 0)
 	require.True(t, v.Value == nil)
 
-	v = l.Get(util.KeyWithTs([]byte("key1"), 0))
+	v = l.Get([]byte("key1"), 0)
 	require.True(t, v.Value != nil)
 	require.EqualValues(t, "00042", string(v.Value))
 	require.EqualValues(t, 55, v.Meta)
 
-	v = l.Get(util.KeyWithTs([]byte("key2"), 0))
+	v = l.Get([]byte("key2"), 0)
 	require.True(t, v.Value == nil)
 
-	v = l.Get(util.KeyWithTs([]byte("key3"), 0))
+	v = l.Get([]byte("key3"), 0)
 	require.True(t, v.Value != nil)
 	require.EqualValues(t, "00062", string(v.Value))
 	require.EqualValues(t, 57, v.Meta)
 
 	l.Put(util.KeyWithTs([]byte("key3"), 1), kv.Value{Value: val4, Meta: 12, UserMeta: 0})
-	v = l.Get(util.KeyWithTs([]byte("key3"), 1))
+	v = l.Get([]byte("key3"), 1)
 	require.True(t, v.Value != nil)
 	require.EqualValues(t, "00072", string(v.Value))
 	require.EqualValues(t, 12, v.Meta)
 
 	l.Put(util.KeyWithTs([]byte("key4"), 1), kv.Value{Value: val5, Meta: 60, UserMeta: 0})
-	v = l.Get(util.KeyWithTs([]byte("key4"), 1))
+	v = l.Get([]byte("key4"), 1)
 	require.NotNil(t, v.Value)
 	require.EqualValues(t, val5, v.Value)
 	require.EqualValues(t, 60, v.Meta)
@@ -73,7 +73,7 @@ func TestBasicWay(t *testing.T) {
 
 func TestConcurrentBasic(t *testing.T) {
 	const n = 1000
-	l := NewSkipList(arenaSize)
+	l := NewSkipList(arenaSize, nil)
 	var wg sync.WaitGroup
 	key := func(i int) []byte {
 		return util.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0)
@@ -92,7 +92,7 @@ func TestConcurrentBasic(t *testing.T) {
 		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
-			v := l.Get(key(i))
+			v := l.Get(util.ParseKey(key(i)), 0)
 			require.True(t, v.Value != nil)
 			require.EqualValues(t, newValue(i), v.Value)
 		}(i)
@@ -100,3 +100,115 @@ func TestConcurrentBasic(t *testing.T) {
 	wg.Wait()
 	require.EqualValues(t, n, length(l))
 }
+
+func TestArenaFull(t *testing.T) {
+	l := NewSkipList(4<<10, nil)
+	val := kv.Value{Value: newValue(1)}
+
+	var n int
+	for {
+		key := util.KeyWithTs([]byte(fmt.Sprintf("key%05d", n)), 0)
+		canFit := l.CanFit(key, val)
+		err := l.TryPut(key, val)
+		if err != nil {
+			require.ErrorIs(t, err, ErrArenaFull)
+			require.False(t, canFit)
+			break
+		}
+		n++
+	}
+	require.Greater(t, n, 0)
+	require.Equal(t, n, length(l))
+
+	// A failed write doesn't use up the arena, smaller ones may still fit.
+	size := l.MemorySize()
+	require.ErrorIs(t, l.TryPut(util.KeyWithTs([]byte("big"), 0), kv.Value{Value: make([]byte, 4<<10)}), ErrArenaFull)
+	require.Equal(t, size, l.MemorySize())
+	require.Panics(t, func() { l.Put(util.KeyWithTs([]byte("big"), 0), kv.Value{Value: make([]byte, 4<<10)}) })
+
+	for i := 0; i < n; i++ {
+		v := l.Get([]byte(fmt.Sprintf("key%05d", i)), 0)
+		require.EqualValues(t, newValue(1), v.Value)
+	}
+
+	// Nor does one whose node would fit, but not its value.
+	l = NewSkipList(4<<10, nil)
+	size = l.MemorySize()
+	require.Greater(t, l.Available(), int64(MaxNodeSize+nodeAlign))
+	require.ErrorIs(t, l.TryPut(util.KeyWithTs([]byte("big"), 0), kv.Value{Value: make([]byte, 4<<10)}), ErrArenaFull)
+	require.Equal(t, size, l.MemorySize())
+	require.True(t, l.Empty())
+}
+
+func TestIteratorInvalid(t *testing.T) {
+	l := NewSkipList(arenaSize, nil)
+	l.Put(util.KeyWithTs([]byte("key"), 0), kv.Value{Value: newValue(1)})
+
+	it := l.NewIterator()
+	defer it.Close()
+	require.False(t, it.Valid())
+	it.Next()
+	require.False(t, it.Valid())
+	it.Prev()
+	require.False(t, it.Valid())
+
+	it.SeekToFirst()
+	require.True(t, it.Valid())
+	it.Next()
+	require.False(t, it.Valid())
+	it.Next()
+	require.False(t, it.Valid())
+}
+
+func TestGetVersions(t *testing.T) {
+	l := NewSkipList(arenaSize, nil)
+	for _, version := range []uint64{3, 5, 9} {
+		l.Put(util.KeyWithTs([]byte("key"), version), kv.Value{Value: newValue(int(version))})
+	}
+	l.Put(util.KeyWithTs([]byte("key0"), 1), kv.Value{Value: newValue(1)})
+
+	for _, tc := range []struct {
+		readTs, version uint64
+	}{
+		{2, 0}, {3, 3}, {4, 3}, {5, 5}, {8, 5}, {9, 9}, {100, 9},
+	} {
+		v := l.Get([]byte("key"), tc.readTs)
+		require.Equal(t, tc.version, v.Version, "readTs %d", tc.readTs)
+		if tc.version == 0 {
+			require.Nil(t, v.Value)
+			continue
+		}
+		require.EqualValues(t, newValue(int(tc.version)), v.Value)
+	}
+	// A longer key with the same prefix is another key.
+	require.Nil(t, l.Get([]byte("ke"), 100).Value)
+	require.EqualValues(t, 1, l.Get([]byte("key0"), 100).Version)
+}
+
+// reverseComparator orders the keys by bytes, backwards.
+type reverseComparator struct{}
+
+func (reverseComparator) Compare(a, b []byte) int           { return util.BytewiseComparator.Compare(b, a) }
+func (reverseComparator) Separator(dst, a, _ []byte) []byte { return append(dst, a...) }
+func (reverseComparator) Successor(dst, a []byte) []byte    { return append(dst, a...) }
+
+func TestComparator(t *testing.T) {
+	l := NewSkipList(arenaSize, reverseComparator{})
+	for _, k := range []string{"b", "a", "ab", "c"} {
+		l.Put(util.KeyWithTs([]byte(k), 1), kv.Value{Value: []byte(k)})
+	}
+	l.Put(util.KeyWithTs([]byte("b"), 2), kv.Value{Value: []byte("b2")})
+
+	it := l.NewIterator()
+	defer it.Close()
+	var got []string
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		got = append(got, fmt.Sprintf("%s@%d", util.ParseKey(it.Key()), util.ParseTs(it.Key())))
+	}
+	require.Equal(t, []string{"c@1", "b@2", "b@1", "ab@1", "a@1"}, got)
+
+	it.Seek(util.KeyWithTs([]byte("bb"), 1))
+	require.Equal(t, []byte("b2"), it.Value().Value)
+	require.EqualValues(t, "b2", l.Get([]byte("b"), 5).Value)
+	require.EqualValues(t, "b", l.Get([]byte("b"), 1).Value)
+}
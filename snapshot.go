@@ -0,0 +1,66 @@
+package nyx
+
+import "sync/atomic"
+
+// Snapshot is a read-only, consistent view of the DB as of the moment it was
+// taken. Writes committed afterward are not visible through it, and the
+// versions it reads are not discarded by compaction until it is released.
+//
+// A Snapshot is safe for concurrent use, unlike Txn.
+type Snapshot struct {
+	db       *DB
+	readTs   uint64
+	released atomic.Bool
+}
+
+// Snapshot pins the current read timestamp and returns a view of the DB at it.
+// It's absolutely essential to call Release once the snapshot isn't needed
+// anymore, otherwise compaction keeps every version written after it.
+func (d *DB) Snapshot() (*Snapshot, error) {
+	if d.isClosed.Load() {
+		return nil, ErrDBClosed
+	}
+
+	return &Snapshot{db: d, readTs: d.orc.readTs()}, nil
+}
+
+// ReadTs returns the read timestamp pinned by the snapshot.
+func (s *Snapshot) ReadTs() uint64 {
+	return s.readTs
+}
+
+// Get returns a copy of the value of key as of the snapshot.
+// It returns ErrKeyNotFound if the key didn't exist or was deleted by then.
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	if s.released.Load() {
+		return nil, ErrSnapshotReleased
+	}
+
+	return s.db.getAt(key, s.readTs)
+}
+
+// NewIterator returns an iterator over the keys as of the snapshot. The
+// iterator must be closed, and it should be closed before the snapshot is
+// released.
+func (s *Snapshot) NewIterator(opt IteratorOptions) (*Iterator, error) {
+	if s.released.Load() {
+		return nil, ErrSnapshotReleased
+	}
+	if s.db.isClosed.Load() {
+		return nil, ErrDBClosed
+	}
+
+	return s.db.newIterator(s.readTs, opt), nil
+}
+
+// Release unpins the read timestamp of the snapshot, which allows compaction
+// to discard the versions only it could read. Calling Release multiple times
+// is a no-op.
+func (s *Snapshot) Release() {
+	if s.released.CompareAndSwap(false, true) {
+		s.db.orc.readMark.Done(s.readTs)
+	}
+}
@@ -0,0 +1,144 @@
+package nyx
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// collect returns the keys and values seen by it from its current position.
+func collect(t *testing.T, it *Iterator) (keys, vals []string) {
+	for ; it.Valid(); it.Next() {
+		val, err := it.Item().ValueCopy(nil)
+		require.NoError(t, err)
+		keys = append(keys, string(it.Item().Key()))
+		vals = append(vals, string(val))
+	}
+	return keys, vals
+}
+
+func TestSnapshotIterator(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), WithValueThreshold(64))
+	defer db.Close()
+
+	big := string(bytes.Repeat([]byte("b"), 100))
+	require.NoError(t, db.Put([]byte("a"), []byte("a1")))
+	require.NoError(t, db.Put([]byte("b"), []byte(big)))
+	require.NoError(t, db.Put([]byte("c"), []byte("c1")))
+	require.NoError(t, db.Put([]byte("d"), []byte("d1")))
+	snap, err := db.Snapshot()
+	require.NoError(t, err)
+	defer snap.Release()
+
+	require.NoError(t, db.Put([]byte("a"), []byte("a2")))
+	require.NoError(t, db.Delete([]byte("c")))
+	require.NoError(t, db.Put([]byte("e"), []byte("e1")))
+
+	val, err := snap.Get([]byte("c"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("c1"), val)
+	_, err = snap.Get([]byte("e"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+
+	it, err := snap.NewIterator(IteratorOptions{})
+	require.NoError(t, err)
+	it.Rewind()
+	keys, vals := collect(t, it)
+	require.Equal(t, []string{"a", "b", "c", "d"}, keys)
+	require.Equal(t, []string{"a1", big, "c1", "d1"}, vals)
+	it.Seek([]byte("bb"))
+	keys, _ = collect(t, it)
+	require.Equal(t, []string{"c", "d"}, keys)
+	require.NoError(t, it.Close())
+
+	it, err = snap.NewIterator(IteratorOptions{Reverse: true})
+	require.NoError(t, err)
+	it.Rewind()
+	keys, vals = collect(t, it)
+	require.Equal(t, []string{"d", "c", "b", "a"}, keys)
+	require.Equal(t, []string{"d1", "c1", big, "a1"}, vals)
+	it.Seek([]byte("c"))
+	keys, _ = collect(t, it)
+	require.Equal(t, []string{"c", "b", "a"}, keys)
+	require.NoError(t, it.Close())
+
+	// A newer snapshot sees the later writes.
+	latest, err := db.Snapshot()
+	require.NoError(t, err)
+	defer latest.Release()
+	require.Greater(t, latest.ReadTs(), snap.ReadTs())
+	it, err = latest.NewIterator(IteratorOptions{})
+	require.NoError(t, err)
+	defer it.Close()
+	it.Rewind()
+	keys, vals = collect(t, it)
+	require.Equal(t, []string{"a", "b", "d", "e"}, keys)
+	require.Equal(t, []string{"a2", big, "d1", "e1"}, vals)
+}
+
+func TestSnapshotSurvivesCompaction(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), compactionTestOptions()...)
+	defer db.Close()
+
+	const n = 2000
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+	value := func(i, round int) []byte { return []byte(fmt.Sprintf("value%05d-%d", i, round)) }
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put(key(i), value(i, 0)))
+	}
+	snap, err := db.Snapshot()
+	require.NoError(t, err)
+
+	for round := 1; round <= 3; round++ {
+		for i := 0; i < n; i++ {
+			require.NoError(t, db.Put(key(i), value(i, round)))
+		}
+	}
+	for i := 0; i < n; i += 3 {
+		require.NoError(t, db.Delete(key(i)))
+	}
+	waitForCompaction(t, db)
+	require.NotEmpty(t, levelLayout(db)[1], "nothing was compacted")
+	require.LessOrEqual(t, db.orc.discardAtOrBelow(), snap.ReadTs())
+
+	for i := 0; i < n; i++ {
+		val, err := snap.Get(key(i))
+		require.NoError(t, err)
+		require.Equal(t, value(i, 0), val)
+
+		val, err = db.Get(key(i))
+		if i%3 == 0 {
+			require.ErrorIs(t, err, ErrKeyNotFound)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, value(i, 3), val)
+	}
+	for _, reverse := range []bool{false, true} {
+		it, err := snap.NewIterator(IteratorOptions{Reverse: reverse})
+		require.NoError(t, err)
+		it.Rewind()
+		keys, vals := collect(t, it)
+		require.NoError(t, it.Close())
+		require.Len(t, keys, n)
+		for j := range keys {
+			i := j
+			if reverse {
+				i = n - 1 - j
+			}
+			require.Equal(t, string(key(i)), keys[j])
+			require.Equal(t, string(value(i, 0)), vals[j])
+		}
+	}
+
+	// Releasing the snapshot lets compaction discard what only it could see.
+	snap.Release()
+	snap.Release()
+	require.Greater(t, db.orc.discardAtOrBelow(), snap.ReadTs())
+	_, err = snap.Get(key(1))
+	require.ErrorIs(t, err, ErrSnapshotReleased)
+	_, err = snap.NewIterator(IteratorOptions{})
+	require.ErrorIs(t, err, ErrSnapshotReleased)
+}
@@ -0,0 +1,302 @@
+package table
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sort"
+
+	"github.com/crazyfrankie/nyxdb/internal/compress"
+	"github.com/crazyfrankie/nyxdb/internal/encryption"
+	"github.com/crazyfrankie/nyxdb/internal/kv"
+	"github.com/crazyfrankie/nyxdb/internal/util"
+)
+
+const (
+	// restartInterval is the number of entries between two restart points.
+	restartInterval = 16
+
+	// blockTrailerSize is the size of the compression type and the checksum
+	// stored after every data block.
+	blockTrailerSize = 5
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// blockBuilder builds a single data block.
+//
+// Keys are prefix compressed against the previous key, except at restart
+// points, which store the full key so that a block can be binary searched.
+//
+// +------------------------------------------------------------------+
+// | shared(varint) | unshared(varint) | vlen(varint) | key | value   | ... entries
+// +------------------------------------------------------------------+
+// | restart[0](4) | ... | restart[n-1](4) | n(4)                      |
+// +------------------------------------------------------------------+
+//
+// The block is then stored, possibly compressed and then encrypted, followed
+// by a trailer:
+// +------------------+---------------------+-------------+
+// | block (n bytes)  | compressionType(1)  | checksum(4) |
+// +------------------+---------------------+-------------+
+// The checksum covers the stored block and the compression type. An
+// encrypted block ends with the IV it was encrypted with. Blocks of version 1
+// tables are never compressed and have no compression type.
+type blockBuilder struct {
+	buf      bytes.Buffer
+	restarts []uint32
+	counter  int // entries since the last restart point
+	lastKey  []byte
+	valBuf   []byte
+}
+
+func (bb *blockBuilder) reset() {
+	bb.buf.Reset()
+	bb.restarts = bb.restarts[:0]
+	bb.counter = 0
+	bb.lastKey = bb.lastKey[:0]
+}
+
+func (bb *blockBuilder) empty() bool {
+	return bb.buf.Len() == 0
+}
+
+// estimatedSize returns the size of the block if it was finished now.
+func (bb *blockBuilder) estimatedSize() int {
+	return bb.buf.Len() + 4*(len(bb.restarts)+1) + blockTrailerSize
+}
+
+func (bb *blockBuilder) add(key []byte, v kv.Value) {
+	shared := 0
+	if bb.counter < restartInterval {
+		shared = sharedPrefixLen(bb.lastKey, key)
+	} else {
+		bb.counter = 0
+	}
+	if bb.counter == 0 {
+		bb.restarts = append(bb.restarts, uint32(bb.buf.Len()))
+		shared = 0
+	}
+
+	if sz := int(v.EncodedSize()); cap(bb.valBuf) < sz {
+		bb.valBuf = make([]byte, sz)
+	}
+	val := bb.valBuf[:v.Encode(bb.valBuf[:cap(bb.valBuf)])]
+
+	var tmp [3 * binary.MaxVarintLen32]byte
+	n := binary.PutUvarint(tmp[:], uint64(shared))
+	n += binary.PutUvarint(tmp[n:], uint64(len(key)-shared))
+	n += binary.PutUvarint(tmp[n:], uint64(len(val)))
+	bb.buf.Write(tmp[:n])
+	bb.buf.Write(key[shared:])
+	bb.buf.Write(val)
+
+	bb.lastKey = append(bb.lastKey[:0], key...)
+	bb.counter++
+}
+
+// finish appends the restart points and returns the uncompressed block data,
+// without the trailer. The returned slice is only valid until the next reset.
+func (bb *blockBuilder) finish() []byte {
+	var tmp [4]byte
+	for _, r := range bb.restarts {
+		binary.BigEndian.PutUint32(tmp[:], r)
+		bb.buf.Write(tmp[:])
+	}
+	binary.BigEndian.PutUint32(tmp[:], uint32(len(bb.restarts)))
+	bb.buf.Write(tmp[:])
+
+	return bb.buf.Bytes()
+}
+
+// appendBlockTrailer appends the compression type and the checksum of the
+// stored block data to buf.
+func appendBlockTrailer(buf []byte, data []byte, typ compress.Type) []byte {
+	crc := crc32.Update(crc32.Checksum(data, castagnoli), castagnoli, []byte{byte(typ)})
+	buf = append(buf, byte(typ))
+	return binary.BigEndian.AppendUint32(buf, crc)
+}
+
+func sharedPrefixLen(a, b []byte) int {
+	n := min(len(a), len(b))
+	i := 0
+	for i < n && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// block is a decoded data block, data aliases the table file unless the block
+// was encrypted or compressed.
+type block struct {
+	data     []byte // the entries
+	restarts []byte // numRestarts * 4 bytes
+}
+
+func (b *block) numRestarts() int {
+	return len(b.restarts) / 4
+}
+
+func (b *block) restart(i int) int {
+	return int(binary.BigEndian.Uint32(b.restarts[i*4:]))
+}
+
+// decodeBlock verifies the checksum of raw, a block stored in a table of the
+// given format version, decrypts it with key if it's not nil, decompresses
+// it and splits it into entries and restarts. Plain blocks alias raw.
+func decodeBlock(raw []byte, version uint32, key []byte) (*block, error) {
+	trailerSize := 4
+	if version >= 2 {
+		trailerSize = blockTrailerSize
+	}
+	if len(raw) < trailerSize {
+		return nil, ErrChecksumMismatch
+	}
+	body := raw[:len(raw)-4]
+	if crc32.Checksum(body, castagnoli) != binary.BigEndian.Uint32(raw[len(body):]) {
+		return nil, ErrChecksumMismatch
+	}
+	if version >= 2 {
+		typ := compress.Type(body[len(body)-1])
+		body = body[:len(body)-1]
+		if key != nil {
+			var err error
+			if body, err = encryption.Decrypt(body, key); err != nil {
+				return nil, fmt.Errorf("while decrypting block: %w", err)
+			}
+		}
+		if typ != compress.None {
+			var err error
+			if body, err = compress.Decode(typ, nil, body); err != nil {
+				return nil, fmt.Errorf("while decompressing %s block: %w", typ, err)
+			}
+		}
+	}
+	if len(body) < 4 {
+		return nil, ErrChecksumMismatch
+	}
+	n := int(binary.BigEndian.Uint32(body[len(body)-4:]))
+	restartsStart := len(body) - 4 - 4*n
+	if n == 0 || restartsStart < 0 {
+		return nil, ErrChecksumMismatch
+	}
+
+	return &block{
+		data:     body[:restartsStart],
+		restarts: body[restartsStart : len(body)-4],
+	}, nil
+}
+
+// blockIterator iterates over the entries of a single block.
+type blockIterator struct {
+	b   *block
+	cmp util.Comparator
+
+	offset     int // offset of the current entry, -1 if invalid
+	nextOffset int // offset of the entry after the current one
+	key        []byte
+	val        []byte
+}
+
+func (bi *blockIterator) reset(b *block) {
+	bi.b = b
+	bi.offset = -1
+	bi.key = bi.key[:0]
+	bi.val = nil
+}
+
+func (bi *blockIterator) valid() bool {
+	return bi.offset >= 0
+}
+
+// parseEntry decodes the entry at off, whose predecessor must be the current key,
+// unless off is a restart point.
+func (bi *blockIterator) parseEntry(off int) bool {
+	data := bi.b.data
+	if off >= len(data) {
+		bi.offset = -1
+		return false
+	}
+	p := off
+	shared, n := binary.Uvarint(data[p:])
+	p += n
+	unshared, n := binary.Uvarint(data[p:])
+	p += n
+	vlen, n := binary.Uvarint(data[p:])
+	p += n
+
+	bi.key = append(bi.key[:shared], data[p:p+int(unshared)]...)
+	p += int(unshared)
+	bi.val = data[p : p+int(vlen)]
+	bi.offset = off
+	bi.nextOffset = p + int(vlen)
+
+	return true
+}
+
+func (bi *blockIterator) seekToRestart(i int) {
+	bi.key = bi.key[:0]
+	bi.parseEntry(bi.b.restart(i))
+}
+
+func (bi *blockIterator) seekToFirst() {
+	bi.seekToRestart(0)
+}
+
+func (bi *blockIterator) seekToLast() {
+	bi.seekToRestart(bi.b.numRestarts() - 1)
+	for bi.nextOffset < len(bi.b.data) {
+		bi.parseEntry(bi.nextOffset)
+	}
+}
+
+func (bi *blockIterator) next() {
+	if !bi.valid() {
+		return
+	}
+	bi.parseEntry(bi.nextOffset)
+}
+
+// prev moves to the previous entry by scanning forward from the closest
+// restart point before the current entry.
+func (bi *blockIterator) prev() {
+	if !bi.valid() {
+		return
+	}
+	target := bi.offset
+	r := sort.Search(bi.b.numRestarts(), func(i int) bool {
+		return bi.b.restart(i) >= target
+	}) - 1
+	if r < 0 {
+		// Already at the first entry.
+		bi.offset = -1
+		return
+	}
+	bi.seekToRestart(r)
+	for bi.nextOffset < target {
+		bi.parseEntry(bi.nextOffset)
+	}
+}
+
+// seek moves to the first entry with a key >= key.
+func (bi *blockIterator) seek(key []byte) {
+	// Find the last restart point with a key < key, then scan forward from there.
+	r := sort.Search(bi.b.numRestarts(), func(i int) bool {
+		bi.seekToRestart(i)
+		return util.CompareKeys(bi.cmp, bi.key, key) >= 0
+	}) - 1
+	if r < 0 {
+		r = 0
+	}
+	bi.seekToRestart(r)
+	for bi.valid() && util.CompareKeys(bi.cmp, bi.key, key) < 0 {
+		bi.next()
+	}
+}
+
+func (bi *blockIterator) value() kv.Value {
+	var v kv.Value
+	v.Decode(bi.val)
+	return v
+}
@@ -0,0 +1,373 @@
+package table
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+
+	"github.com/crazyfrankie/nyxdb/internal/bloom"
+	"github.com/crazyfrankie/nyxdb/internal/compress"
+	"github.com/crazyfrankie/nyxdb/internal/encryption"
+	"github.com/crazyfrankie/nyxdb/internal/iterator"
+	"github.com/crazyfrankie/nyxdb/internal/kv"
+	"github.com/crazyfrankie/nyxdb/internal/util"
+)
+
+const (
+	// magic is the last 8 bytes of every table file, "nyxdbsst".
+	magic uint64 = 0x6e79786462737374
+	// version of the table format. Version 2 added the compression type to
+	// the data blocks, version 3 the data key id to the footer.
+	version uint32 = 3
+
+	// footerSize is the size of the fixed footer at the end of a table file.
+	// +-----------+-----------------+---------------+------------+----------+
+	// | keyID(8)  | indexOffset(8)  | indexLen(4)   | version(4) | magic(8) |
+	// +-----------+-----------------+---------------+------------+----------+
+	// Tables before version 3 have no keyID.
+	footerSize = 32
+
+	defaultBlockSize = 4 << 10 // 4 KB
+)
+
+// Options contains configurable options for Table/Builder.
+type Options struct {
+	// BlockSize is the size of each block inside SSTable in bytes.
+	BlockSize int
+
+	// BloomBitsPerKey is the number of bloom filter bits spent on each key,
+	// zero disables the filter.
+	BloomBitsPerKey int
+
+	// Comparator orders the keys without timestamp, nil orders them by bytes.
+	// A table must be opened with the comparator it was built with.
+	Comparator util.Comparator
+
+	// Compression is the algorithm the data blocks are compressed with. It's
+	// stored in each block, so it doesn't need to match when opening a table.
+	Compression compress.Type
+
+	// DataKey encrypts the data blocks, the range tombstones and the index of
+	// the tables being built. nil leaves them unencrypted.
+	DataKey *encryption.DataKey
+
+	// KeyRegistry looks up the data key an encrypted table was built with
+	// when it's opened.
+	KeyRegistry encryption.Registry
+
+	// BlockCache keeps the data blocks that were decrypted or decompressed,
+	// nil reads them from the file every time.
+	BlockCache *Cache
+
+	// IndexCache keeps the indexes and the bloom filters of the tables, which
+	// are otherwise held in memory as long as the tables are open.
+	IndexCache *Cache
+}
+
+// withDefaults fills in the zero fields of opts.
+func (opts Options) withDefaults() Options {
+	if opts.BlockSize <= 0 {
+		opts.BlockSize = defaultBlockSize
+	}
+	if opts.Comparator == nil {
+		opts.Comparator = util.BytewiseComparator
+	}
+	return opts
+}
+
+// blockHandle locates a data block in the table file. key is a separator that
+// is not smaller than the last key of the block, and smaller than the first
+// key of the next one.
+type blockHandle struct {
+	key    []byte
+	offset uint32
+	size   uint32
+}
+
+// Builder is used in building a table. Keys must be added in sorted order.
+//
+// A table file consists of:
+// +-------------+-----+-------------+--------------+------------------+-------+--------+
+// | data block0 | ... | data blockN | bloom filter | range tombstones | index | footer |
+// +-------------+-----+-------------+--------------+------------------+-------+--------+
+type Builder struct {
+	opts Options
+
+	buf         bytes.Buffer // the table file contents written so far
+	block       blockBuilder // the data block being built
+	compressBuf []byte
+
+	rawBlockBytes    int // size of the data blocks before compression
+	storedBlockBytes int // size of the data blocks as written
+	err              error
+
+	index      []blockHandle
+	keyHashes  []uint32 // hashes of the user keys, for the bloom filter
+	smallest   []byte
+	biggest    []byte
+	maxVersion uint64
+	keyCount   uint32
+	tombstones []kv.RangeTombstone
+}
+
+// NewTableBuilder returns a new, empty Builder.
+func NewTableBuilder(opts Options) *Builder {
+	return &Builder{opts: opts.withDefaults()}
+}
+
+// Add appends a key-value pair to the table.
+func (b *Builder) Add(key []byte, v kv.Value) {
+	if b.keyCount == 0 {
+		b.smallest = append(b.smallest[:0], key...)
+	}
+	// Versions of the same user key are adjacent, hash each user key only once.
+	if b.keyCount == 0 || !util.SameKey(b.biggest, key) {
+		b.keyHashes = append(b.keyHashes, bloom.Hash(util.ParseKey(key)))
+	}
+	if b.block.empty() && len(b.index) > 0 {
+		// The first key of a block bounds the index key of the previous one.
+		last := &b.index[len(b.index)-1]
+		last.key = b.indexKey(last.key, key)
+	}
+	b.biggest = append(b.biggest[:0], key...)
+	if version := util.ParseTs(key); version > b.maxVersion {
+		b.maxVersion = version
+	}
+
+	b.block.add(key, v)
+	b.keyCount++
+	if b.block.estimatedSize() >= b.opts.BlockSize {
+		b.finishBlock()
+	}
+}
+
+// AddRangeTombstone adds a range tombstone to the table. Range tombstones are
+// kept apart from the keys, so they can be added in any order. The range of
+// the table is extended to cover them.
+func (b *Builder) AddRangeTombstone(rt kv.RangeTombstone) {
+	b.tombstones = append(b.tombstones, kv.RangeTombstone{
+		Start:   append([]byte{}, rt.Start...),
+		End:     append([]byte{}, rt.End...),
+		Version: rt.Version,
+	})
+}
+
+// AddAll adds every entry of a sorted iterator to the table.
+func (b *Builder) AddAll(iter iterator.Iterator) {
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		b.Add(iter.Key(), iter.Value())
+	}
+}
+
+// finishBlock writes the current data block to buf and records it in the index.
+// The block is stored uncompressed if compression doesn't save at least an
+// eighth of it, and is encrypted after compression.
+func (b *Builder) finishBlock() {
+	if b.block.empty() {
+		return
+	}
+	lastKey := append([]byte{}, b.block.lastKey...)
+	data := b.block.finish()
+	b.rawBlockBytes += len(data)
+
+	typ := compress.None
+	if b.opts.Compression != compress.None {
+		compressed, err := compress.Encode(b.opts.Compression, b.compressBuf, data)
+		if err == nil && len(compressed) < len(data)-len(data)/8 {
+			typ, data = b.opts.Compression, compressed
+		}
+		b.compressBuf = compressed
+	}
+	if data = b.encrypt(data); data == nil {
+		b.block.reset()
+		return
+	}
+	b.storedBlockBytes += len(data)
+
+	offset := b.buf.Len()
+	b.buf.Write(data)
+	b.buf.Write(appendBlockTrailer(nil, data, typ))
+	b.index = append(b.index, blockHandle{
+		key:    lastKey,
+		offset: uint32(offset),
+		size:   uint32(b.buf.Len() - offset),
+	})
+	b.block.reset()
+}
+
+// indexKey returns a key k, last <= k < next, that is preferably shorter than
+// last. If next is nil, k only needs to be >= last.
+func (b *Builder) indexKey(last, next []byte) []byte {
+	cmp := b.opts.Comparator
+	user := util.ParseKey(last)
+	var short []byte
+	switch {
+	case next == nil:
+		short = cmp.Successor(nil, user)
+	case cmp.Compare(user, util.ParseKey(next)) < 0:
+		short = cmp.Separator(nil, user, util.ParseKey(next))
+	default:
+		// The versions of a key continue in the next block.
+		return last
+	}
+	if len(short) < len(user) && cmp.Compare(user, short) < 0 {
+		// Every version of short comes after last.
+		return util.KeyWithTs(short, math.MaxUint64)
+	}
+	return last
+}
+
+// Empty returns whether it's empty.
+func (b *Builder) Empty() bool {
+	return b.keyCount == 0 && len(b.tombstones) == 0
+}
+
+// encrypt returns data encrypted with the data key, followed by its IV, or
+// data itself if there is no key. It returns nil once encryption failed.
+func (b *Builder) encrypt(data []byte) []byte {
+	if b.err != nil {
+		return nil
+	}
+	if b.opts.DataKey == nil {
+		return data
+	}
+	out, err := encryption.Encrypt(nil, data, b.opts.DataKey.Key)
+	if err != nil {
+		b.err = fmt.Errorf("while encrypting table: %w", err)
+		return nil
+	}
+	return out
+}
+
+// BlockBytes returns the total size of the data blocks added so far, before and
+// after compression.
+func (b *Builder) BlockBytes() (raw, stored int) {
+	return b.rawBlockBytes, b.storedBlockBytes
+}
+
+// EstimatedSize returns the approximate size of the table file if it was finished now.
+func (b *Builder) EstimatedSize() uint32 {
+	size := b.buf.Len() + b.block.estimatedSize() + footerSize
+	for _, h := range b.index {
+		size += len(h.key) + 2*binary.MaxVarintLen32
+	}
+	for _, rt := range b.tombstones {
+		size += len(rt.Start) + len(rt.End) + 3*binary.MaxVarintLen64
+	}
+	return uint32(size)
+}
+
+// Finish writes the last block, the bloom filter, the range tombstones, the
+// index and the footer, and returns the table data.
+func (b *Builder) Finish() ([]byte, error) {
+	b.finishBlock()
+	if len(b.index) > 0 {
+		last := &b.index[len(b.index)-1]
+		last.key = b.indexKey(last.key, nil)
+	}
+
+	bloomOffset, bloomLen := b.buf.Len(), 0
+	if b.opts.BloomBitsPerKey > 0 && len(b.keyHashes) > 0 {
+		filter := bloom.NewFilter(b.keyHashes, b.opts.BloomBitsPerKey)
+		filter = binary.BigEndian.AppendUint32(filter, crc32.Checksum(filter, castagnoli))
+		b.buf.Write(filter)
+		bloomLen = len(filter)
+	}
+
+	rangeDelOffset, rangeDelLen := b.buf.Len(), 0
+	if len(b.tombstones) > 0 {
+		block := b.encodeRangeTombstones()
+		b.buf.Write(block)
+		rangeDelLen = len(block)
+	}
+
+	indexOffset := b.buf.Len()
+	index := b.encodeIndex(bloomOffset, bloomLen, rangeDelOffset, rangeDelLen)
+	b.buf.Write(index)
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	var footer [footerSize]byte
+	if b.opts.DataKey != nil {
+		binary.BigEndian.PutUint64(footer[0:], b.opts.DataKey.ID)
+	}
+	binary.BigEndian.PutUint64(footer[8:], uint64(indexOffset))
+	binary.BigEndian.PutUint32(footer[16:], uint32(len(index)))
+	binary.BigEndian.PutUint32(footer[20:], version)
+	binary.BigEndian.PutUint64(footer[24:], magic)
+	b.buf.Write(footer[:])
+
+	return b.buf.Bytes(), nil
+}
+
+// encodeIndex encodes the block index together with the table properties. In
+// an encrypted table, everything before the checksum is encrypted.
+//
+// +--------------------+----------------------------------------------------+
+// | numBlocks(varint)  | per block: klen(varint) key offset(varint) size(varint) |
+// +--------------------+----------------------------------------------------+
+// | smallest(len+key) | biggest(len+key) | maxVersion(varint) | keyCount(varint) |
+// +-------------------------------------------------------------------------------+
+// | bloomOffset(varint) | bloomLen(varint) | rangeDelOffset(varint) | rangeDelLen(varint) | checksum(4) |
+// +----------------------------------------------------------------------------------------------------+
+func (b *Builder) encodeIndex(bloomOffset, bloomLen, rangeDelOffset, rangeDelLen int) []byte {
+	var buf []byte
+	buf = binary.AppendUvarint(buf, uint64(len(b.index)))
+	for _, h := range b.index {
+		buf = appendBytes(buf, h.key)
+		buf = binary.AppendUvarint(buf, uint64(h.offset))
+		buf = binary.AppendUvarint(buf, uint64(h.size))
+	}
+	buf = appendBytes(buf, b.smallest)
+	buf = appendBytes(buf, b.biggest)
+	buf = binary.AppendUvarint(buf, b.maxVersion)
+	buf = binary.AppendUvarint(buf, uint64(b.keyCount))
+	buf = binary.AppendUvarint(buf, uint64(bloomOffset))
+	buf = binary.AppendUvarint(buf, uint64(bloomLen))
+	buf = binary.AppendUvarint(buf, uint64(rangeDelOffset))
+	buf = binary.AppendUvarint(buf, uint64(rangeDelLen))
+	buf = b.encrypt(buf)
+
+	return binary.BigEndian.AppendUint32(buf, crc32.Checksum(buf, castagnoli))
+}
+
+// encodeRangeTombstones encodes the range tombstones of the table. It also
+// extends the range and the max version of the table to cover them. A
+// tombstone ends right before the first version of its end key. In an
+// encrypted table, everything before the checksum is encrypted.
+//
+// +------------------+---------------------------------------------------------------+-------------+
+// | count(varint)    | per tombstone: start(len+key) end(len+key) version(varint)    | checksum(4) |
+// +------------------+---------------------------------------------------------------+-------------+
+func (b *Builder) encodeRangeTombstones() []byte {
+	var buf []byte
+	buf = binary.AppendUvarint(buf, uint64(len(b.tombstones)))
+	for _, rt := range b.tombstones {
+		buf = appendBytes(buf, rt.Start)
+		buf = appendBytes(buf, rt.End)
+		buf = binary.AppendUvarint(buf, rt.Version)
+
+		start := util.KeyWithTs(rt.Start, math.MaxUint64)
+		if len(b.smallest) == 0 || util.CompareKeys(b.opts.Comparator, start, b.smallest) < 0 {
+			b.smallest = start
+		}
+		end := util.KeyWithTs(rt.End, math.MaxUint64)
+		if len(b.biggest) == 0 || util.CompareKeys(b.opts.Comparator, end, b.biggest) > 0 {
+			b.biggest = end
+		}
+		if rt.Version > b.maxVersion {
+			b.maxVersion = rt.Version
+		}
+	}
+	buf = b.encrypt(buf)
+
+	return binary.BigEndian.AppendUint32(buf, crc32.Checksum(buf, castagnoli))
+}
+
+func appendBytes(buf, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
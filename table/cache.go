@@ -0,0 +1,64 @@
+package table
+
+import (
+	"github.com/dgraph-io/ristretto/v2"
+)
+
+// Cache holds decoded data blocks, or table indexes, shared by the tables
+// opened with it. A nil *Cache caches nothing.
+type Cache struct {
+	c *ristretto.Cache[uint64, any]
+}
+
+// NewCache returns a cache holding up to maxCost bytes, which is expected to
+// fit about numItems items.
+func NewCache(maxCost, numItems int64) (*Cache, error) {
+	c, err := ristretto.NewCache(&ristretto.Config[uint64, any]{
+		// The admission policy tracks the frequency of ten times as many
+		// keys as the cache holds.
+		NumCounters: max(10*numItems, 1000),
+		MaxCost:     maxCost,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Cache{c: c}, nil
+}
+
+func (c *Cache) get(key uint64) (any, bool) {
+	if c == nil {
+		return nil, false
+	}
+	return c.c.Get(key)
+}
+
+func (c *Cache) set(key uint64, v any, cost int64) {
+	if c != nil {
+		c.c.Set(key, v, cost)
+	}
+}
+
+func (c *Cache) del(key uint64) {
+	if c != nil {
+		c.c.Del(key)
+	}
+}
+
+// Metrics returns the number of lookups that found their item, of those that
+// didn't, and of the items evicted to make room for others.
+func (c *Cache) Metrics() (hits, misses, evictions uint64) {
+	if c == nil {
+		return 0, 0, 0
+	}
+	m := c.c.Metrics
+	return m.Hits(), m.Misses(), m.KeysEvicted()
+}
+
+// Close stops the goroutines of the cache and drops everything in it.
+func (c *Cache) Close() {
+	if c != nil {
+		c.c.Close()
+	}
+}
@@ -0,0 +1,338 @@
+package table
+
+import (
+	"sort"
+
+	"github.com/crazyfrankie/nyxdb/internal/kv"
+	"github.com/crazyfrankie/nyxdb/internal/util"
+)
+
+// Iterator is an iterator for a Table. It implements iterator.Iterator
+// and moves in reverse key order if reversed is set.
+type Iterator struct {
+	t        *Table
+	index    *tableIndex // loaded by the first Rewind or Seek
+	bpos     int         // index of the current block
+	bi       blockIterator
+	reversed bool
+	err      error
+}
+
+// NewIterator returns a new iterator of the Table. You must close the iterator.
+func (t *Table) NewIterator(reversed bool) *Iterator {
+	t.IncrRef() // Important.
+	it := &Iterator{t: t, reversed: reversed}
+	it.bi.cmp = t.opts.Comparator
+	it.bi.offset = -1
+	return it
+}
+
+// Close closes the iterator (and it must be called).
+func (it *Iterator) Close() error {
+	return it.t.DecrRef()
+}
+
+// Err returns the error that made the iterator invalid, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Valid returns true iff the iterator is positioned at an entry.
+func (it *Iterator) Valid() bool {
+	return it.err == nil && it.bi.valid()
+}
+
+// Key returns the key of the current entry. It is only valid until the iterator moves.
+func (it *Iterator) Key() []byte {
+	return it.bi.key
+}
+
+// Value returns the value of the current entry. It aliases the table file.
+func (it *Iterator) Value() kv.Value {
+	return it.bi.value()
+}
+
+// loadBlock positions bi on the bpos-th block, it returns false past either end.
+func (it *Iterator) loadBlock(bpos int) bool {
+	if bpos < 0 || bpos >= len(it.index.blocks) {
+		it.bi.offset = -1
+		return false
+	}
+	b, err := it.t.block(it.index.blocks[bpos])
+	if err != nil {
+		it.err = err
+		it.bi.offset = -1
+		return false
+	}
+	it.bpos = bpos
+	it.bi.reset(b)
+	return true
+}
+
+// loadIndex gets the index of the table, it returns false if it can't be read.
+func (it *Iterator) loadIndex() bool {
+	if it.index == nil {
+		idx, err := it.t.getIndex()
+		if err != nil {
+			it.err = err
+			it.bi.offset = -1
+			return false
+		}
+		it.index = idx
+	}
+	return true
+}
+
+func (it *Iterator) seekToFirst() {
+	if it.loadBlock(0) {
+		it.bi.seekToFirst()
+	}
+}
+
+func (it *Iterator) seekToLast() {
+	if it.loadBlock(len(it.index.blocks) - 1) {
+		it.bi.seekToLast()
+	}
+}
+
+// seek moves to the first entry with a key >= key.
+func (it *Iterator) seek(key []byte) {
+	// Every key in block i is <= index[i].key, so the first block whose
+	// index key is >= key holds the answer. As the index key may be past the
+	// last key of the block, it may also be the first key of the next one.
+	idx := sort.Search(len(it.index.blocks), func(i int) bool {
+		return util.CompareKeys(it.t.opts.Comparator, it.index.blocks[i].key, key) >= 0
+	})
+	if !it.loadBlock(idx) {
+		return
+	}
+	it.bi.seek(key)
+	if !it.bi.valid() && it.loadBlock(idx+1) {
+		it.bi.seekToFirst()
+	}
+}
+
+// seekForPrev moves to the last entry with a key <= key.
+func (it *Iterator) seekForPrev(key []byte) {
+	it.seek(key)
+	if it.err != nil {
+		return
+	}
+	if !it.bi.valid() {
+		it.seekToLast()
+		return
+	}
+	if util.CompareKeys(it.t.opts.Comparator, it.bi.key, key) != 0 {
+		it.prev()
+	}
+}
+
+func (it *Iterator) next() {
+	it.bi.next()
+	if !it.bi.valid() && it.loadBlock(it.bpos+1) {
+		it.bi.seekToFirst()
+	}
+}
+
+func (it *Iterator) prev() {
+	it.bi.prev()
+	if !it.bi.valid() && it.loadBlock(it.bpos-1) {
+		it.bi.seekToLast()
+	}
+}
+
+// Rewind moves to the first entry, or the last one if the iterator is reversed.
+func (it *Iterator) Rewind() {
+	it.err = nil
+	if !it.loadIndex() {
+		return
+	}
+	if !it.reversed {
+		it.seekToFirst()
+	} else {
+		it.seekToLast()
+	}
+}
+
+// Seek moves to the first entry with a key >= key, or the last entry with a key <= key
+// if the iterator is reversed.
+func (it *Iterator) Seek(key []byte) {
+	it.err = nil
+	if !it.loadIndex() {
+		return
+	}
+	if !it.reversed {
+		it.seek(key)
+	} else {
+		it.seekForPrev(key)
+	}
+}
+
+// Next moves to the next entry in iteration order.
+func (it *Iterator) Next() {
+	if !it.Valid() {
+		return
+	}
+	if !it.reversed {
+		it.next()
+	} else {
+		it.prev()
+	}
+}
+
+// ConcatIterator concatenates the sequences defined by several iterators.  (It only works with
+// TableIterators, probably just because it's faster to not be so generic.)
+type ConcatIterator struct {
+	idx      int // Which iterator is active now.
+	cur      *Iterator
+	iters    []*Iterator // Corresponds to tables.
+	tables   []*Table    // Disregarding reversed, this is in ascending order.
+	reversed bool
+}
+
+// NewConcatIterator creates a new concatenated iterator over tables, which must be
+// sorted by key and must not overlap.
+func NewConcatIterator(tbls []*Table, reversed bool) *ConcatIterator {
+	iters := make([]*Iterator, len(tbls))
+	for i := 0; i < len(tbls); i++ {
+		// Increment the reference count. Since, we're not creating the iterator right now.
+		// Here, We'll hold the reference of the tables, till the lifecycle of the iterator.
+		tbls[i].IncrRef()
+
+		// Save cycles by not initializing the iterators until needed.
+		// iters[i] = tbls[i].NewIterator(reversed)
+	}
+	return &ConcatIterator{
+		reversed: reversed,
+		iters:    iters,
+		tables:   tbls,
+		idx:      -1, // Not really necessary because s.it.Valid()=false, but good to have.
+	}
+}
+
+func (s *ConcatIterator) setIdx(idx int) {
+	s.idx = idx
+	if idx < 0 || idx >= len(s.iters) {
+		s.cur = nil
+		return
+	}
+	if s.iters[idx] == nil {
+		s.iters[idx] = s.tables[idx].NewIterator(s.reversed)
+	}
+	s.cur = s.iters[idx]
+}
+
+// Rewind implements Iterator.
+func (s *ConcatIterator) Rewind() {
+	if len(s.iters) == 0 {
+		return
+	}
+	if !s.reversed {
+		s.setIdx(0)
+	} else {
+		s.setIdx(len(s.iters) - 1)
+	}
+	s.cur.Rewind()
+	s.skipExhausted()
+}
+
+// Valid implements iterator.Iterator.
+func (s *ConcatIterator) Valid() bool {
+	return s.cur != nil && s.cur.Valid()
+}
+
+// Err returns the error that made the current table iterator invalid, if any.
+func (s *ConcatIterator) Err() error {
+	if s.cur == nil {
+		return nil
+	}
+	return s.cur.Err()
+}
+
+// Key implements iterator.Iterator.
+func (s *ConcatIterator) Key() []byte {
+	return s.cur.Key()
+}
+
+// Value implements iterator.Iterator.
+func (s *ConcatIterator) Value() kv.Value {
+	return s.cur.Value()
+}
+
+// Seek brings us to element >= key if reversed is false. Otherwise, <= key.
+func (s *ConcatIterator) Seek(key []byte) {
+	var idx int
+	if !s.reversed {
+		idx = sort.Search(len(s.tables), func(i int) bool {
+			return util.CompareKeys(s.tables[i].opts.Comparator, s.tables[i].Biggest(), key) >= 0
+		})
+	} else {
+		n := len(s.tables)
+		idx = n - 1 - sort.Search(n, func(i int) bool {
+			return util.CompareKeys(s.tables[n-1-i].opts.Comparator, s.tables[n-1-i].Smallest(), key) <= 0
+		})
+	}
+	if idx >= len(s.tables) || idx < 0 {
+		s.setIdx(-1)
+		return
+	}
+	// For reversed=false, we know s.tables[i-1].Biggest() < key. Thus, the
+	// previous table cannot possibly contain key.
+	s.setIdx(idx)
+	s.cur.Seek(key)
+	// The range of a table may extend past its keys to cover its range
+	// tombstones, the answer is in the following table then.
+	s.skipExhausted()
+}
+
+// Next advances our concat iterator.
+func (s *ConcatIterator) Next() {
+	if s.cur == nil {
+		return
+	}
+	s.cur.Next()
+	s.skipExhausted()
+}
+
+// skipExhausted moves on to the first entry of the following tables if the
+// current one has no entries left. It stops at a table that can't be read,
+// whose error is then returned by Err.
+func (s *ConcatIterator) skipExhausted() {
+	if s.cur.Valid() || s.cur.Err() != nil {
+		// Nothing to do. Just stay with the current table.
+		return
+	}
+	for { // In case there are empty tables.
+		if !s.reversed {
+			s.setIdx(s.idx + 1)
+		} else {
+			s.setIdx(s.idx - 1)
+		}
+		if s.cur == nil {
+			// End of list. Valid will become false.
+			return
+		}
+		s.cur.Rewind()
+		if s.cur.Valid() || s.cur.Err() != nil {
+			break
+		}
+	}
+}
+
+// Close implements iterator.Iterator.
+func (s *ConcatIterator) Close() error {
+	var firstErr error
+	for i, t := range s.tables {
+		// DeReference the tables while closing the iterator.
+		if err := t.DecrRef(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if s.iters[i] == nil {
+			continue
+		}
+		if err := s.iters[i].Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,486 @@
+package table
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+
+	"github.com/crazyfrankie/nyxdb/internal/bloom"
+	"github.com/crazyfrankie/nyxdb/internal/compress"
+	"github.com/crazyfrankie/nyxdb/internal/encryption"
+	"github.com/crazyfrankie/nyxdb/internal/kv"
+)
+
+const fileSuffix = ".sst"
+
+var (
+	// ErrChecksumMismatch is returned when the data of a table doesn't match its checksum.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+
+	// ErrInvalidTable is returned when a file is not a table or was written by an
+	// unknown version of the table format.
+	ErrInvalidTable = errors.New("invalid table")
+)
+
+// Table represents a loaded table file.
+type Table struct {
+	mmap *z.MmapFile // Memory mapped file.
+	id   uint64
+	path string
+	size int64
+	opts Options
+	ref  atomic.Int32 // For file garbage collection.
+
+	version     uint32 // of the table format
+	dataKey     []byte // nil if the table isn't encrypted
+	indexOffset uint64
+	indexLen    uint64
+	index       *tableIndex // nil if it's kept in the IndexCache
+	hasBloom    bool
+	smallest    []byte // Smallest keys (with timestamps).
+	biggest     []byte // Biggest keys (with timestamps).
+	maxVersion  uint64
+	keyCount    uint32
+	tombstones  []kv.RangeTombstone
+}
+
+// tableIndex holds the block handles and the bloom filter of a table. They
+// are kept in the IndexCache if there's one, and read again from the table
+// file once evicted.
+type tableIndex struct {
+	blocks []blockHandle
+	bloom  bloom.Filter // nil if the table was built without a filter
+}
+
+// cost returns about how much memory idx takes.
+func (idx *tableIndex) cost() int64 {
+	n := len(idx.bloom)
+	for _, h := range idx.blocks {
+		n += len(h.key) + 32
+	}
+	return int64(n)
+}
+
+// IDToFilename does the inverse of ParseFileID.
+func IDToFilename(id uint64) string {
+	return fmt.Sprintf("%06d", id) + fileSuffix
+}
+
+// NewFilename should be named TableFilepath -- it combines the dir with the ID to make a table
+// filepath.
+func NewFilename(id uint64, dir string) string {
+	return filepath.Join(dir, IDToFilename(id))
+}
+
+// ParseFileID reads the file id out of a filename.
+func ParseFileID(name string) (uint64, bool) {
+	name = filepath.Base(name)
+	if !strings.HasSuffix(name, fileSuffix) {
+		return 0, false
+	}
+	name = strings.TrimSuffix(name, fileSuffix)
+	id, err := strconv.ParseUint(name, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return id, true
+}
+
+// CreateTable writes the data of builder to a new table file and opens it.
+// The data is written to a temporary file first and renamed into place,
+// so a crash never leaves a partial table behind under its final name.
+func CreateTable(path string, builder *Builder) (*Table, error) {
+	data, err := builder.Finish()
+	if err != nil {
+		return nil, err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("while creating table %q: %w", tmp, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("while writing table %q: %w", tmp, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("while syncing table %q: %w", tmp, err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, fmt.Errorf("while renaming table %q: %w", tmp, err)
+	}
+	if err := z.SyncDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+
+	return OpenTable(path, builder.opts)
+}
+
+// OpenTable maps the table file at path and loads its index.
+// The returned table holds one reference.
+func OpenTable(path string, opts Options) (*Table, error) {
+	id, ok := ParseFileID(path)
+	if !ok {
+		return nil, fmt.Errorf("invalid table file name %q: %w", path, ErrInvalidTable)
+	}
+	mf, err := z.OpenMmapFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("while opening table %q: %w", path, err)
+	}
+
+	t := &Table{
+		mmap: mf,
+		id:   id,
+		path: path,
+		size: int64(len(mf.Data)),
+		opts: opts.withDefaults(),
+	}
+	t.ref.Store(1)
+	if err := t.readIndex(); err != nil {
+		mf.Close(-1)
+		return nil, fmt.Errorf("table %q: %w", path, err)
+	}
+
+	return t, nil
+}
+
+// readIndex decodes the footer and the index block.
+func (t *Table) readIndex() error {
+	data := t.mmap.Data
+	// The version and the magic end the footer in every version.
+	if len(data) < 12 || binary.BigEndian.Uint64(data[len(data)-8:]) != magic {
+		return ErrInvalidTable
+	}
+	t.version = binary.BigEndian.Uint32(data[len(data)-12:])
+	size := footerSize
+	if t.version < 3 {
+		size -= 8 // no keyID
+	}
+	if t.version < 1 || t.version > version || len(data) < size {
+		return ErrInvalidTable
+	}
+	footer := data[len(data)-size:]
+	var keyID uint64
+	if t.version >= 3 {
+		keyID, footer = binary.BigEndian.Uint64(footer), footer[8:]
+	}
+	t.indexOffset = binary.BigEndian.Uint64(footer[0:])
+	t.indexLen = uint64(binary.BigEndian.Uint32(footer[8:]))
+	if t.indexLen < 4 || t.indexOffset+t.indexLen > uint64(len(data)-size) {
+		return ErrInvalidTable
+	}
+	if keyID != 0 {
+		dk, err := t.lookupDataKey(keyID)
+		if err != nil {
+			return err
+		}
+		t.dataKey = dk.Key
+	}
+
+	ib, err := t.decodeIndex()
+	if err != nil {
+		return err
+	}
+	t.smallest, t.biggest = ib.smallest, ib.biggest
+	t.maxVersion, t.keyCount = ib.maxVersion, ib.keyCount
+	t.hasBloom = ib.bloom != nil
+	if t.opts.IndexCache != nil {
+		t.opts.IndexCache.set(t.id, &ib.tableIndex, ib.cost())
+	} else {
+		t.index = &ib.tableIndex
+	}
+
+	if ib.rangeDelLen > 0 {
+		if ib.rangeDelLen < 4 || ib.rangeDelOffset+ib.rangeDelLen > t.indexOffset {
+			return ErrInvalidTable
+		}
+		block := data[ib.rangeDelOffset : ib.rangeDelOffset+ib.rangeDelLen-4]
+		if crc32.Checksum(block, castagnoli) != binary.BigEndian.Uint32(data[ib.rangeDelOffset+ib.rangeDelLen-4:]) {
+			return ErrChecksumMismatch
+		}
+		block, err := t.decrypt(block)
+		if err != nil {
+			return err
+		}
+		r := indexReader{buf: block}
+		count := r.uvarint()
+		for i := uint64(0); i < count && r.err == nil; i++ {
+			t.tombstones = append(t.tombstones, kv.RangeTombstone{
+				Start:   r.bytes(),
+				End:     r.bytes(),
+				Version: r.uvarint(),
+			})
+		}
+		if r.err != nil {
+			return r.err
+		}
+	}
+
+	return nil
+}
+
+// indexBlock is the decoded index block of a table.
+type indexBlock struct {
+	tableIndex
+	smallest       []byte
+	biggest        []byte
+	maxVersion     uint64
+	keyCount       uint32
+	rangeDelOffset uint64
+	rangeDelLen    uint64
+}
+
+// decodeIndex verifies, decrypts and decodes the index block, and loads the
+// bloom filter it points to.
+func (t *Table) decodeIndex() (*indexBlock, error) {
+	data := t.mmap.Data
+	index := data[t.indexOffset : t.indexOffset+t.indexLen]
+	body := index[:len(index)-4]
+	if crc32.Checksum(body, castagnoli) != binary.BigEndian.Uint32(index[len(body):]) {
+		return nil, ErrChecksumMismatch
+	}
+	body, err := t.decrypt(body)
+	if err != nil {
+		return nil, err
+	}
+
+	var ib indexBlock
+	r := indexReader{buf: body}
+	numBlocks := r.uvarint()
+	for i := uint64(0); i < numBlocks && r.err == nil; i++ {
+		ib.blocks = append(ib.blocks, blockHandle{
+			key:    r.bytes(),
+			offset: uint32(r.uvarint()),
+			size:   uint32(r.uvarint()),
+		})
+	}
+	ib.smallest = r.bytes()
+	ib.biggest = r.bytes()
+	ib.maxVersion = r.uvarint()
+	ib.keyCount = uint32(r.uvarint())
+	bloomOffset, bloomLen := r.uvarint(), r.uvarint()
+	if len(r.buf) > 0 {
+		// Tables written before range tombstones existed end here.
+		ib.rangeDelOffset, ib.rangeDelLen = r.uvarint(), r.uvarint()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if bloomLen > 0 {
+		if bloomLen < 4 || bloomOffset+bloomLen > t.indexOffset {
+			return nil, ErrInvalidTable
+		}
+		filter := data[bloomOffset : bloomOffset+bloomLen-4]
+		if crc32.Checksum(filter, castagnoli) != binary.BigEndian.Uint32(data[bloomOffset+bloomLen-4:]) {
+			return nil, ErrChecksumMismatch
+		}
+		ib.bloom = filter
+	}
+
+	return &ib, nil
+}
+
+// getIndex returns the block handles and the bloom filter of the table, read
+// again from the file if they were evicted from the IndexCache.
+func (t *Table) getIndex() (*tableIndex, error) {
+	if t.index != nil {
+		return t.index, nil
+	}
+	if v, ok := t.opts.IndexCache.get(t.id); ok {
+		return v.(*tableIndex), nil
+	}
+	ib, err := t.decodeIndex()
+	if err != nil {
+		return nil, fmt.Errorf("index of table %q: %w", t.path, err)
+	}
+	t.opts.IndexCache.set(t.id, &ib.tableIndex, ib.cost())
+	return &ib.tableIndex, nil
+}
+
+// lookupDataKey returns the data key with id. A table that was just built
+// finds it in its options.
+func (t *Table) lookupDataKey(id uint64) (*encryption.DataKey, error) {
+	if dk := t.opts.DataKey; dk != nil && dk.ID == id {
+		return dk, nil
+	}
+	if t.opts.KeyRegistry == nil {
+		return nil, fmt.Errorf("encrypted with data key %d: %w", id, encryption.ErrKeyNotFound)
+	}
+	return t.opts.KeyRegistry.DataKey(id)
+}
+
+// decrypt returns data decrypted with the data key of the table, or data
+// itself if the table isn't encrypted.
+func (t *Table) decrypt(data []byte) ([]byte, error) {
+	if t.dataKey == nil {
+		return data, nil
+	}
+	out, err := encryption.Decrypt(data, t.dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("while decrypting: %w", err)
+	}
+	return out, nil
+}
+
+// indexReader decodes the fields of an index block, remembering the first error.
+type indexReader struct {
+	buf []byte
+	err error
+}
+
+func (r *indexReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = ErrInvalidTable
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *indexReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.buf)) {
+		r.err = ErrInvalidTable
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+// block returns the data block h points to, with its checksum verified.
+// Blocks that have to be decrypted or decompressed are kept in the BlockCache,
+// plain blocks alias the table file and are as fast to read from there.
+func (t *Table) block(h blockHandle) (*block, error) {
+	if uint64(h.offset)+uint64(h.size) > uint64(len(t.mmap.Data)) || h.size < blockTrailerSize {
+		return nil, ErrInvalidTable
+	}
+	raw := t.mmap.Data[h.offset : h.offset+h.size]
+	cached := t.dataKey != nil || (t.version >= 2 && compress.Type(raw[len(raw)-blockTrailerSize]) != compress.None)
+	// Table IDs fit into 32 bits long before they run out.
+	key := t.id<<32 | uint64(h.offset)
+	if cached {
+		if v, ok := t.opts.BlockCache.get(key); ok {
+			return v.(*block), nil
+		}
+	}
+	b, err := decodeBlock(raw, t.version, t.dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("block at offset %d of table %q: %w", h.offset, t.path, err)
+	}
+	if cached {
+		t.opts.BlockCache.set(key, b, int64(len(b.data)+len(b.restarts)))
+	}
+	return b, nil
+}
+
+// VerifyChecksum verifies the checksums of all the data blocks of the table.
+// Those of the index, the bloom filter and the range tombstones are verified
+// when the table is opened.
+func (t *Table) VerifyChecksum() error {
+	idx, err := t.getIndex()
+	if err != nil {
+		return err
+	}
+	for _, h := range idx.blocks {
+		if uint64(h.offset)+uint64(h.size) > uint64(len(t.mmap.Data)) {
+			return ErrInvalidTable
+		}
+		if _, err := decodeBlock(t.mmap.Data[h.offset:h.offset+h.size], t.version, t.dataKey); err != nil {
+			return fmt.Errorf("block at offset %d of table %q: %w", h.offset, t.path, err)
+		}
+	}
+	return nil
+}
+
+// DoesNotHave returns true if and only if the table does not have the key hash.
+// It does a bloom filter lookup.
+func (t *Table) DoesNotHave(hash uint32) bool {
+	if !t.hasBloom {
+		return false
+	}
+	idx, err := t.getIndex()
+	if err != nil {
+		// The table has to be read to find out.
+		return false
+	}
+	return !idx.bloom.MayContain(hash)
+}
+
+// HasBloomFilter returns true if the table has a bloom filter.
+func (t *Table) HasBloomFilter() bool {
+	return t.hasBloom
+}
+
+// ID returns the id of the table.
+func (t *Table) ID() uint64 { return t.id }
+
+// Filename returns the path of the table file.
+func (t *Table) Filename() string { return t.path }
+
+// Size is its file size in bytes.
+func (t *Table) Size() int64 { return t.size }
+
+// Smallest is its smallest key, or nil if there are none.
+func (t *Table) Smallest() []byte { return t.smallest }
+
+// Biggest is its biggest key, or nil if there are none.
+func (t *Table) Biggest() []byte { return t.biggest }
+
+// MaxVersion returns the maximum version across all keys stored in this table.
+func (t *Table) MaxVersion() uint64 { return t.maxVersion }
+
+// KeyCount is the number of keys in the table.
+func (t *Table) KeyCount() uint32 { return t.keyCount }
+
+// RangeTombstones returns the range tombstones stored in the table. They may
+// alias the table file, and are only valid while a reference to the table is held.
+func (t *Table) RangeTombstones() []kv.RangeTombstone { return t.tombstones }
+
+// IncrRef increments the refcount (having to do with whether the file should be deleted)
+func (t *Table) IncrRef() {
+	t.ref.Add(1)
+}
+
+// DecrRef decrements the refcount and possibly deletes the table.
+// Tables are only dereferenced to zero once they've been dropped from the LSM tree,
+// so the file is removed along with the mapping. It is only unlinked, not
+// truncated, as it may be hard linked into a checkpoint.
+func (t *Table) DecrRef() error {
+	newRef := t.ref.Add(-1)
+	if newRef == 0 {
+		t.opts.IndexCache.del(t.id)
+		if err := t.mmap.Close(-1); err != nil {
+			return err
+		}
+		return os.Remove(t.path)
+	}
+	return nil
+}
+
+// Close unmaps the table file without deleting it.
+func (t *Table) Close() error {
+	t.opts.IndexCache.del(t.id)
+	return t.mmap.Close(-1)
+}
@@ -0,0 +1,401 @@
+package table
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crazyfrankie/nyxdb/internal/bloom"
+	"github.com/crazyfrankie/nyxdb/internal/compress"
+	"github.com/crazyfrankie/nyxdb/internal/encryption"
+	"github.com/crazyfrankie/nyxdb/internal/kv"
+	"github.com/crazyfrankie/nyxdb/internal/util"
+	"github.com/crazyfrankie/nyxdb/skl"
+)
+
+func key(prefix string, i int) []byte {
+	return util.KeyWithTs([]byte(fmt.Sprintf("%s%04d", prefix, i)), uint64(i))
+}
+
+// buildTable creates a table with n keys "key0000".."key<n-1>" with 10 byte values.
+func buildTable(t *testing.T, n int, opts Options) *Table {
+	b := NewTableBuilder(opts)
+	for i := 0; i < n; i++ {
+		b.Add(key("key", i), kv.Value{Value: []byte(fmt.Sprintf("value%05d", i)), Meta: 'A', UserMeta: 0})
+	}
+	tbl, err := CreateTable(NewFilename(1, t.TempDir()), b)
+	require.NoError(t, err)
+	t.Cleanup(func() { tbl.Close() })
+	return tbl
+}
+
+func TestTableProperties(t *testing.T) {
+	tbl := buildTable(t, 10000, Options{BlockSize: 1024})
+	require.EqualValues(t, 1, tbl.ID())
+	require.Equal(t, key("key", 0), tbl.Smallest())
+	require.Equal(t, key("key", 9999), tbl.Biggest())
+	require.EqualValues(t, 9999, tbl.MaxVersion())
+	require.EqualValues(t, 10000, tbl.KeyCount())
+	require.Greater(t, len(tbl.index.blocks), 1)
+
+	reopened, err := OpenTable(tbl.Filename(), Options{})
+	require.NoError(t, err)
+	require.Equal(t, tbl.Biggest(), reopened.Biggest())
+	require.NoError(t, reopened.Close())
+}
+
+func TestTableIterate(t *testing.T) {
+	const n = 10000
+	tbl := buildTable(t, n, Options{BlockSize: 1024})
+
+	it := tbl.NewIterator(false)
+	defer it.Close()
+	count := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		require.Equal(t, key("key", count), it.Key())
+		v := it.Value()
+		require.Equal(t, fmt.Sprintf("value%05d", count), string(v.Value))
+		require.EqualValues(t, 'A', v.Meta)
+		count++
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, n, count)
+
+	rit := tbl.NewIterator(true)
+	defer rit.Close()
+	for rit.Rewind(); rit.Valid(); rit.Next() {
+		count--
+		require.Equal(t, key("key", count), rit.Key())
+	}
+	require.Zero(t, count)
+}
+
+func TestTableSeek(t *testing.T) {
+	tbl := buildTable(t, 1000, Options{BlockSize: 512})
+
+	it := tbl.NewIterator(false)
+	defer it.Close()
+	rit := tbl.NewIterator(true)
+	defer rit.Close()
+
+	// Exact matches.
+	for i := 0; i < 1000; i += 7 {
+		it.Seek(key("key", i))
+		require.True(t, it.Valid())
+		require.Equal(t, key("key", i), it.Key())
+		rit.Seek(key("key", i))
+		require.True(t, rit.Valid())
+		require.Equal(t, key("key", i), rit.Key())
+	}
+
+	// "key0010a" sorts between key0010 and key0011.
+	it.Seek(util.KeyWithTs([]byte("key0010a"), 0))
+	require.Equal(t, key("key", 11), it.Key())
+	rit.Seek(util.KeyWithTs([]byte("key0010a"), 0))
+	require.Equal(t, key("key", 10), rit.Key())
+
+	// Before the first and after the last key.
+	it.Seek(util.KeyWithTs([]byte("a"), 0))
+	require.Equal(t, key("key", 0), it.Key())
+	it.Seek(util.KeyWithTs([]byte("z"), 0))
+	require.False(t, it.Valid())
+	rit.Seek(util.KeyWithTs([]byte("a"), 0))
+	require.False(t, rit.Valid())
+	rit.Seek(util.KeyWithTs([]byte("z"), 0))
+	require.Equal(t, key("key", 999), rit.Key())
+}
+
+func TestTableFromSkipList(t *testing.T) {
+	l := skl.NewSkipList(1<<20, nil)
+	for i := 999; i >= 0; i-- {
+		l.Put(key("key", i), kv.Value{Value: []byte("v")})
+	}
+	iter := l.NewUniIterator(false)
+	b := NewTableBuilder(Options{})
+	b.AddAll(iter)
+	require.NoError(t, iter.Close())
+
+	tbl, err := CreateTable(NewFilename(2, t.TempDir()), b)
+	require.NoError(t, err)
+	defer tbl.Close()
+	require.EqualValues(t, 1000, tbl.KeyCount())
+	require.Equal(t, key("key", 0), tbl.Smallest())
+}
+
+func TestTableCorruption(t *testing.T) {
+	tbl := buildTable(t, 1000, Options{BlockSize: 512})
+	path := tbl.Filename()
+	require.NoError(t, tbl.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[10] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0666))
+
+	tbl, err = OpenTable(path, Options{})
+	require.NoError(t, err)
+	defer tbl.Close()
+	require.ErrorIs(t, tbl.VerifyChecksum(), ErrChecksumMismatch)
+	it := tbl.NewIterator(false)
+	defer it.Close()
+	it.Rewind()
+	require.False(t, it.Valid())
+	require.ErrorIs(t, it.Err(), ErrChecksumMismatch)
+
+	// A concat iterator stops at the table instead of skipping it.
+	cit := NewConcatIterator([]*Table{tbl, buildTable(t, 10, Options{})}, false)
+	defer cit.Close()
+	cit.Rewind()
+	require.False(t, cit.Valid())
+	require.ErrorIs(t, cit.Err(), ErrChecksumMismatch)
+
+	_, err = OpenTable(filepath.Join(t.TempDir(), "garbage.sst"), Options{})
+	require.Error(t, err)
+}
+
+func TestTableCompression(t *testing.T) {
+	for _, typ := range []compress.Type{compress.None, compress.Snappy, compress.ZSTD} {
+		t.Run(typ.String(), func(t *testing.T) {
+			b := NewTableBuilder(Options{BlockSize: 1024, Compression: typ})
+			for i := 0; i < 1000; i++ {
+				b.Add(key("key", i), kv.Value{Value: []byte(fmt.Sprintf("value%05d", i))})
+			}
+			raw, stored := b.BlockBytes()
+			tbl, err := CreateTable(NewFilename(1, t.TempDir()), b)
+			require.NoError(t, err)
+			defer tbl.Close()
+			if typ == compress.None {
+				require.Equal(t, raw, stored)
+			} else {
+				require.Less(t, stored, raw)
+			}
+
+			// The compression is read from the blocks, not from the options.
+			reopened, err := OpenTable(tbl.Filename(), Options{})
+			require.NoError(t, err)
+			defer reopened.Close()
+			it := reopened.NewIterator(false)
+			defer it.Close()
+			count := 0
+			for it.Rewind(); it.Valid(); it.Next() {
+				require.Equal(t, key("key", count), it.Key())
+				require.Equal(t, fmt.Sprintf("value%05d", count), string(it.Value().Value))
+				count++
+			}
+			require.NoError(t, it.Err())
+			require.Equal(t, 1000, count)
+			it.Seek(key("key", 500))
+			require.Equal(t, key("key", 500), it.Key())
+		})
+	}
+}
+
+func TestDecodeBlockVersion1(t *testing.T) {
+	var bb blockBuilder
+	bb.add(key("key", 1), kv.Value{Value: []byte("value")})
+	raw := bb.finish()
+	raw = binary.BigEndian.AppendUint32(raw, crc32.Checksum(raw, castagnoli))
+
+	blk, err := decodeBlock(raw, 1, nil)
+	require.NoError(t, err)
+	bi := blockIterator{cmp: util.BytewiseComparator}
+	bi.reset(blk)
+	bi.seekToFirst()
+	require.Equal(t, key("key", 1), bi.key)
+
+	raw[0] ^= 0xff
+	_, err = decodeBlock(raw, 1, nil)
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+}
+
+// registry holds the data keys of the tests.
+type registry map[uint64]*encryption.DataKey
+
+func (r registry) DataKey(id uint64) (*encryption.DataKey, error) {
+	if dk, ok := r[id]; ok {
+		return dk, nil
+	}
+	return nil, encryption.ErrKeyNotFound
+}
+
+func TestTableEncryption(t *testing.T) {
+	dk := &encryption.DataKey{ID: 7, Key: bytes.Repeat([]byte{0x42}, 32)}
+	b := NewTableBuilder(Options{BlockSize: 512, Compression: compress.Snappy, DataKey: dk})
+	for i := 0; i < 1000; i++ {
+		b.Add(key("key", i), kv.Value{Value: []byte(fmt.Sprintf("value%05d", i))})
+	}
+	b.AddRangeTombstone(kv.RangeTombstone{Start: []byte("key0100"), End: []byte("key0200"), Version: 2000})
+	tbl, err := CreateTable(NewFilename(1, t.TempDir()), b)
+	require.NoError(t, err)
+	require.NoError(t, tbl.Close())
+
+	// Neither the keys nor the values are readable from the file.
+	data, err := os.ReadFile(tbl.Filename())
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "key0")
+	require.NotContains(t, string(data), "value0")
+
+	_, err = OpenTable(tbl.Filename(), Options{})
+	require.ErrorIs(t, err, encryption.ErrKeyNotFound)
+	_, err = OpenTable(tbl.Filename(), Options{KeyRegistry: registry{}})
+	require.ErrorIs(t, err, encryption.ErrKeyNotFound)
+
+	tbl, err = OpenTable(tbl.Filename(), Options{KeyRegistry: registry{dk.ID: dk}})
+	require.NoError(t, err)
+	defer tbl.Close()
+	require.Equal(t, key("key", 0), tbl.Smallest())
+	require.Equal(t, []kv.RangeTombstone{{Start: []byte("key0100"), End: []byte("key0200"), Version: 2000}}, tbl.RangeTombstones())
+	it := tbl.NewIterator(false)
+	defer it.Close()
+	count := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		require.Equal(t, key("key", count), it.Key())
+		require.Equal(t, fmt.Sprintf("value%05d", count), string(it.Value().Value))
+		count++
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, 1000, count)
+}
+
+func TestTableCache(t *testing.T) {
+	blockCache, err := NewCache(1<<20, 100)
+	require.NoError(t, err)
+	defer blockCache.Close()
+	// Too small to hold the index, which is read again on every use.
+	indexCache, err := NewCache(1, 1)
+	require.NoError(t, err)
+	defer indexCache.Close()
+
+	opts := Options{BlockSize: 512, Compression: compress.Snappy, BloomBitsPerKey: 10,
+		BlockCache: blockCache, IndexCache: indexCache}
+	tbl := buildTable(t, 1000, opts)
+	require.Nil(t, tbl.index)
+	require.True(t, tbl.HasBloomFilter())
+	require.False(t, tbl.DoesNotHave(bloom.Hash(util.ParseKey(key("key", 1)))))
+
+	iterate := func() {
+		it := tbl.NewIterator(false)
+		defer it.Close()
+		count := 0
+		for it.Rewind(); it.Valid(); it.Next() {
+			require.Equal(t, key("key", count), it.Key())
+			count++
+		}
+		require.NoError(t, it.Err())
+		require.Equal(t, 1000, count)
+	}
+	iterate()
+	blockCache.c.Wait()
+	hits, misses, _ := blockCache.Metrics()
+	require.Zero(t, hits)
+	iterate()
+	hits, _, _ = blockCache.Metrics()
+	require.Equal(t, misses, hits)
+	_, misses, _ = indexCache.Metrics()
+	require.NotZero(t, misses)
+
+	// Plain blocks aren't cached, they alias the table file.
+	plainCache, err := NewCache(1<<20, 100)
+	require.NoError(t, err)
+	defer plainCache.Close()
+	tbl = buildTable(t, 100, Options{BlockCache: plainCache})
+	it := tbl.NewIterator(false)
+	defer it.Close()
+	it.Rewind()
+	require.True(t, it.Valid())
+	plainCache.c.Wait()
+	it.Rewind()
+	require.True(t, it.Valid())
+	hits, _, _ = plainCache.Metrics()
+	require.Zero(t, hits)
+}
+
+func TestTableBloomFilter(t *testing.T) {
+	tbl := buildTable(t, 1000, Options{BloomBitsPerKey: 10})
+	require.True(t, tbl.HasBloomFilter())
+	for i := 0; i < 1000; i++ {
+		require.False(t, tbl.DoesNotHave(bloom.Hash(util.ParseKey(key("key", i)))))
+	}
+	var falsePositives int
+	for i := 0; i < 1000; i++ {
+		if !tbl.DoesNotHave(bloom.Hash(util.ParseKey(key("other", i)))) {
+			falsePositives++
+		}
+	}
+	require.Less(t, falsePositives, 50)
+
+	tbl = buildTable(t, 10, Options{})
+	require.False(t, tbl.HasBloomFilter())
+	require.False(t, tbl.DoesNotHave(bloom.Hash([]byte("missing"))))
+}
+
+func TestTableRangeTombstones(t *testing.T) {
+	dir := t.TempDir()
+	b := NewTableBuilder(Options{})
+	for i := 0; i < 100; i++ {
+		b.Add(key("key", i), kv.Value{Value: []byte("v")})
+	}
+	want := []kv.RangeTombstone{
+		{Start: []byte("key0050"), End: []byte("key0200"), Version: 300},
+		{Start: []byte("a"), End: []byte("b"), Version: 5},
+	}
+	for _, rt := range want {
+		b.AddRangeTombstone(rt)
+	}
+	first, err := CreateTable(NewFilename(1, dir), b)
+	require.NoError(t, err)
+	defer first.Close()
+
+	reopened, err := OpenTable(first.Filename(), Options{})
+	require.NoError(t, err)
+	defer reopened.Close()
+	require.Equal(t, want, reopened.RangeTombstones())
+	require.Equal(t, util.KeyWithTs([]byte("a"), math.MaxUint64), reopened.Smallest())
+	require.Equal(t, util.KeyWithTs([]byte("key0200"), math.MaxUint64), reopened.Biggest())
+	require.EqualValues(t, 300, reopened.MaxVersion())
+	require.EqualValues(t, 100, reopened.KeyCount())
+
+	// A table may only hold range tombstones.
+	b = NewTableBuilder(Options{})
+	require.True(t, b.Empty())
+	b.AddRangeTombstone(kv.RangeTombstone{Start: []byte("key0300"), End: []byte("key0400"), Version: 400})
+	require.False(t, b.Empty())
+	second, err := CreateTable(NewFilename(2, dir), b)
+	require.NoError(t, err)
+	defer second.Close()
+	require.Zero(t, second.KeyCount())
+
+	b = NewTableBuilder(Options{})
+	b.Add(key("key", 500), kv.Value{Value: []byte("v")})
+	third, err := CreateTable(NewFilename(3, dir), b)
+	require.NoError(t, err)
+	defer third.Close()
+
+	// Concatenation skips past the parts of the ranges without keys.
+	it := NewConcatIterator([]*Table{first, second, third}, false)
+	it.Seek(util.KeyWithTs([]byte("key0150"), 0))
+	require.True(t, it.Valid())
+	require.Equal(t, key("key", 500), it.Key())
+	it.Seek(key("key", 99))
+	require.Equal(t, key("key", 99), it.Key())
+	it.Next()
+	require.Equal(t, key("key", 500), it.Key())
+	require.NoError(t, it.Close())
+
+	it = NewConcatIterator([]*Table{second, third}, false)
+	it.Rewind()
+	require.Equal(t, key("key", 500), it.Key())
+	require.NoError(t, it.Close())
+
+	rit := NewConcatIterator([]*Table{first, second, third}, true)
+	rit.Seek(util.KeyWithTs([]byte("key0350"), 0))
+	require.Equal(t, key("key", 99), rit.Key())
+	require.NoError(t, rit.Close())
+}
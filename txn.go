@@ -0,0 +1,542 @@
+package nyx
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+
+	"github.com/crazyfrankie/nyxdb/internal/kv"
+	"github.com/crazyfrankie/nyxdb/internal/util"
+)
+
+var (
+	// txnKey is the key of the log entry that ends the entries of a transaction.
+	txnKey = []byte("!nyx!txn")
+
+	// finTxnSize is the memtable space taken by the entry ending a transaction.
+	finTxnSize = estimateSize(util.KeyWithTs(txnKey, 0),
+		kv.Value{Meta: kv.BitFinTxn, Value: []byte(strconv.FormatUint(math.MaxUint64, 10))})
+)
+
+// oracle hands out the read and commit timestamps of transactions and
+// detects the conflicts between them.
+type oracle struct {
+	sync.Mutex // For nextTxnTs and committedTxns.
+
+	// writeChLock lock is for ensuring that transactions are written in the
+	// same order as their commit timestamps.
+	writeChLock sync.Mutex
+
+	nextTxnTs uint64
+
+	// Used to block NewTransaction, so all previous commits are visible to a new read.
+	txnMark *util.WaterMark
+
+	// Tracks the read timestamps of the running transactions, used to
+	// determine which versions can be permanently discarded during compaction.
+	readMark *util.WaterMark
+
+	// committedTxns contains all committed writes (contains fingerprints
+	// of keys written and their latest commit counter).
+	committedTxns []committedTxn
+	lastCleanupTs uint64
+
+	// failErr is set, under lock, once a commit fails after its writes were
+	// sent. They may be partly in the memtable, so its timestamp is never
+	// marked done: reads see the commits up to the commit mark from then on,
+	// and no commit gets a timestamp anymore.
+	failErr error
+	// failCtx is canceled along with failErr being set, to wake up the reads
+	// waiting for the commit mark.
+	failCtx    context.Context
+	cancelWait context.CancelFunc
+}
+
+type committedTxn struct {
+	ts uint64
+	// ConflictKeys Keeps track of the entries written at timestamp ts.
+	conflictKeys map[uint64]struct{}
+}
+
+// newOracle returns an oracle whose first commit comes after maxVersion.
+func newOracle(maxVersion uint64) *oracle {
+	orc := &oracle{
+		nextTxnTs: maxVersion + 1,
+		txnMark:   util.NewWaterMark(),
+		readMark:  util.NewWaterMark(),
+	}
+	orc.txnMark.SetDoneUntil(maxVersion)
+	orc.readMark.SetDoneUntil(maxVersion)
+	orc.failCtx, orc.cancelWait = context.WithCancel(context.Background())
+
+	return orc
+}
+
+// readTs returns the timestamp of a new transaction. It waits until every
+// commit up to it has been written, so they are all visible to the reads.
+func (o *oracle) readTs() uint64 {
+	o.Lock()
+	readTs := o.lastReadTs()
+	o.readMark.Begin(readTs)
+	o.Unlock()
+
+	// Wait for all txns which have no conflicts, have been assigned a commit
+	// timestamp and are going through the write to the LSM tree.
+	if err := o.txnMark.WaitForMark(o.failCtx, readTs); err != nil {
+		// A commit failed meanwhile, the one waited for may never be done.
+		o.Lock()
+		if doneTs := o.lastReadTs(); doneTs < readTs {
+			o.readMark.Begin(doneTs)
+			o.readMark.Done(readTs)
+			readTs = doneTs
+		}
+		o.Unlock()
+	}
+
+	return readTs
+}
+
+// lastReadTs returns the timestamp of the last commit, or of the last one
+// fully written if a commit failed. Must be called with o locked.
+func (o *oracle) lastReadTs() uint64 {
+	if o.failErr != nil {
+		return min(o.nextTxnTs-1, o.txnMark.DoneUntil())
+	}
+	return o.nextTxnTs - 1
+}
+
+// batchReadTs returns the timestamp of a new write batch. The batch doesn't
+// read, so unlike readTs it doesn't wait for the commits in flight. It's only
+// registered on the read mark, so that the read mark moves along as batches
+// are committed, and compaction can drop the versions they overwrite.
+func (o *oracle) batchReadTs() uint64 {
+	o.Lock()
+	defer o.Unlock()
+	readTs := o.lastReadTs()
+	o.readMark.Begin(readTs)
+
+	return readTs
+}
+
+// doneRead marks the reads of txn as finished, once.
+func (o *oracle) doneRead(txn *Txn) {
+	if !txn.doneRead {
+		txn.doneRead = true
+		o.readMark.Done(txn.readTs)
+	}
+}
+
+// discardAtOrBelow returns the timestamp at and below which no running
+// transaction reads anymore. It never passes the commit mark, which reads
+// fall back to once a commit failed.
+func (o *oracle) discardAtOrBelow() uint64 {
+	return min(o.readMark.DoneUntil(), o.txnMark.DoneUntil())
+}
+
+// hasConflict must be called while having a lock.
+func (o *oracle) hasConflict(txn *Txn) bool {
+	if len(txn.reads) == 0 {
+		return false
+	}
+	for _, committedTxn := range o.committedTxns {
+		// If the committedTxn.ts is less than txn.readTs that implies that the
+		// committedTxn finished before the current transaction started.
+		// We don't need to check for conflict in that case.
+		// This change assumes linearizability. Lack of linearizability could
+		// cause the read ts of a new txn to be lower than the commit ts of
+		// a txn before it (@mrjn).
+		if committedTxn.ts <= txn.readTs {
+			continue
+		}
+
+		for _, ro := range txn.reads {
+			if _, has := committedTxn.conflictKeys[ro]; has {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// newCommitTs returns the commit timestamp of txn. It returns ErrConflict if
+// txn conflicts with a transaction committed after it started, and fails once
+// a commit failed.
+func (o *oracle) newCommitTs(txn *Txn) (uint64, error) {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.failErr != nil {
+		return 0, fmt.Errorf("cannot commit after a failed write: %w", o.failErr)
+	}
+	if o.hasConflict(txn) {
+		return 0, ErrConflict
+	}
+
+	o.doneRead(txn)
+	o.cleanupCommittedTransactions()
+
+	ts := o.nextTxnTs
+	o.nextTxnTs++
+	o.txnMark.Begin(ts)
+
+	o.committedTxns = append(o.committedTxns, committedTxn{
+		ts:           ts,
+		conflictKeys: txn.conflictKeys,
+	})
+
+	return ts, nil
+}
+
+// doneCommit marks the commit at cts as written.
+func (o *oracle) doneCommit(cts uint64) {
+	o.txnMark.Done(cts)
+}
+
+// fail records that a commit failed after its writes were sent. Its
+// timestamp is left pending on the commit mark, so that none of its writes
+// are read.
+func (o *oracle) fail(err error) {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.failErr == nil {
+		o.failErr = err
+		o.cancelWait()
+	}
+}
+
+// cleanupCommittedTransactions drops the committed transactions that no
+// running transaction can conflict with. Must be called with o locked.
+func (o *oracle) cleanupCommittedTransactions() {
+	maxReadTs := o.readMark.DoneUntil()
+	if maxReadTs <= o.lastCleanupTs {
+		return
+	}
+	o.lastCleanupTs = maxReadTs
+
+	tmp := o.committedTxns[:0]
+	for _, txn := range o.committedTxns {
+		if txn.ts <= maxReadTs {
+			continue
+		}
+		tmp = append(tmp, txn)
+	}
+	o.committedTxns = tmp
+}
+
+// Txn represents a Nyx transaction. All reads of a transaction see the
+// database as of the moment it started, and its writes become visible to
+// others atomically when it commits.
+//
+// A Txn is not safe for concurrent use.
+type Txn struct {
+	readTs   uint64
+	commitTs uint64
+	size     int64
+	count    int64
+
+	reads        []uint64 // contains fingerprints of keys read.
+	conflictKeys map[uint64]struct{}
+
+	pendingWrites map[string]kv.Value // cache stores any writes done by txn.
+	rangeDeletes  []kv.RangeTombstone // versioned at commit
+
+	db        *DB
+	update    bool // update is used to conditionally keep track of reads.
+	discarded bool
+	doneRead  bool
+}
+
+// NewTransaction creates a new transaction. Nyx supports concurrent execution
+// of transactions, providing serializable snapshot isolation, avoiding write
+// skews. Nyx achieves this by tracking the keys read and at Commit time,
+// ensuring that these read keys weren't concurrently modified by another
+// transaction.
+//
+// For read-only transactions, set update to false. In this mode, we don't
+// track the rows read for any changes. Thus, any long running iterations
+// done in this mode wouldn't pay this overhead.
+//
+// Running transactions concurrently is OK. However, a transaction itself
+// isn't thread safe, and should only be run serially. It doesn't matter
+// if a transaction is created by one goroutine and passed down to other,
+// as long as the Txn APIs are called serially.
+//
+// When you create a new transaction, it is absolutely essential to call
+// Discard(). This should be done irrespective of what the update param is set
+// to. Commit API internally runs Discard, but running it twice wouldn't cause
+// any issues.
+func (d *DB) NewTransaction(update bool) *Txn {
+	txn := &Txn{
+		update: update,
+		db:     d,
+		readTs: d.orc.readTs(),
+	}
+	if update {
+		txn.conflictKeys = make(map[uint64]struct{})
+		txn.pendingWrites = make(map[string]kv.Value)
+	}
+
+	return txn
+}
+
+// View executes a function creating and managing a read-only transaction for
+// the user. Error returned by the function is relayed by the View method.
+func (d *DB) View(fn func(txn *Txn) error) error {
+	if d.isClosed.Load() {
+		return ErrDBClosed
+	}
+	txn := d.NewTransaction(false)
+	defer txn.Discard()
+
+	return fn(txn)
+}
+
+// Update executes a function, creating and managing a read-write transaction
+// for the user. Error returned by the function is relayed by the Update method.
+// Update returns ErrConflict if the keys read by fn were changed by another
+// transaction in the meantime, in which case it's safe to retry.
+func (d *DB) Update(fn func(txn *Txn) error) error {
+	if d.isClosed.Load() {
+		return ErrDBClosed
+	}
+	txn := d.NewTransaction(true)
+	defer txn.Discard()
+
+	if err := fn(txn); err != nil {
+		return err
+	}
+
+	return txn.Commit()
+}
+
+// ReadTs returns the read timestamp of the transaction.
+func (txn *Txn) ReadTs() uint64 {
+	return txn.readTs
+}
+
+// CommitTs returns the commit timestamp of the transaction, it is zero until
+// the transaction has committed some writes.
+func (txn *Txn) CommitTs() uint64 {
+	return txn.commitTs
+}
+
+// Get looks for key and returns a copy of its value. The writes of the
+// transaction itself are seen first.
+// It returns ErrKeyNotFound if the key doesn't exist or has been deleted.
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	if txn.discarded {
+		return nil, ErrDiscardedTxn
+	}
+
+	if txn.update {
+		if v, has := txn.pendingWrites[string(key)]; has {
+			if v.IsDeletedOrExpired() {
+				return nil, ErrKeyNotFound
+			}
+			return append([]byte{}, v.Value...), nil
+		}
+		// Only track reads if this is update txn. No need to track read if txn
+		// serviced it internally.
+		txn.addReadKey(key)
+	}
+
+	return txn.db.getAt(key, txn.readTs)
+}
+
+func (txn *Txn) addReadKey(key []byte) {
+	fp := z.MemHash(key)
+	txn.reads = append(txn.reads, fp)
+}
+
+// Set adds a key-value pair to the database. The current transaction keeps a
+// reference to the key and val byte slices, they must not be modified until
+// the transaction is committed or discarded.
+func (txn *Txn) Set(key, val []byte) error {
+	return txn.modify(key, kv.Value{Value: val})
+}
+
+// SetWithTTL adds a key-value pair to the database, which expires after ttl.
+// Once expired, the key is treated as deleted. The same rules as for Set apply
+// to the key and val byte slices.
+func (txn *Txn) SetWithTTL(key, val []byte, ttl time.Duration) error {
+	expiresAt := uint64(time.Now().Add(ttl).Unix())
+	return txn.modify(key, kv.Value{Value: val, ExpiresAt: expiresAt})
+}
+
+// Delete deletes a key. A tombstone is written at the commit timestamp, so
+// that older versions of the key are shadowed until they are compacted away.
+func (txn *Txn) Delete(key []byte) error {
+	return txn.modify(key, kv.Value{Meta: kv.BitDelete})
+}
+
+func (txn *Txn) modify(key []byte, v kv.Value) error {
+	switch {
+	case !txn.update:
+		return ErrReadOnlyTxn
+	case txn.discarded:
+		return ErrDiscardedTxn
+	case len(key) == 0:
+		return ErrEmptyKey
+	}
+	if err := txn.db.checkEntrySize(key, v); err != nil {
+		return err
+	}
+
+	// All the writes of a transaction are sent as one batch, together with
+	// the entry that ends the transaction.
+	count := txn.count + 1
+	size := txn.size + txn.db.storedSize(key, v)
+	if old, has := txn.pendingWrites[string(key)]; has {
+		count--
+		size -= txn.db.storedSize(key, old)
+	}
+	if count+1 > txn.db.opt.maxBatchCount || size+finTxnSize > txn.db.opt.maxBatchSize {
+		return ErrTxnTooBig
+	}
+	txn.count, txn.size = count, size
+
+	fp := z.MemHash(key)
+	txn.conflictKeys[fp] = struct{}{}
+	txn.pendingWrites[string(key)] = v
+
+	return nil
+}
+
+// deleteRange deletes the keys in [start, end) as of the commit timestamp.
+// The writes of the transaction itself are not deleted by it, and its reads
+// don't see it. Only write batches, which don't read, use it.
+func (txn *Txn) deleteRange(start, end []byte) error {
+	switch {
+	case !txn.update:
+		return ErrReadOnlyTxn
+	case txn.discarded:
+		return ErrDiscardedTxn
+	case len(start) == 0:
+		return ErrEmptyKey
+	case txn.db.opt.Comparator.Compare(start, end) >= 0:
+		return ErrInvalidRange
+	}
+	v := kv.Value{Meta: kv.BitRangeDelete, Value: end}
+	if err := txn.db.checkEntrySize(start, v); err != nil {
+		return err
+	}
+
+	count := txn.count + 1
+	size := txn.size + txn.db.storedSize(start, v)
+	if count+1 > txn.db.opt.maxBatchCount || size+finTxnSize > txn.db.opt.maxBatchSize {
+		return ErrTxnTooBig
+	}
+	txn.count, txn.size = count, size
+	txn.rangeDeletes = append(txn.rangeDeletes, kv.RangeTombstone{Start: start, End: end})
+
+	return nil
+}
+
+// Commit commits the transaction, following these steps:
+//
+// 1. If there are no writes, return immediately.
+//
+// 2. Check if read rows were updated since txn started. If so, return ErrConflict.
+//
+// 3. If no conflict, generate a commit timestamp and update written rows' commit ts.
+//
+// 4. Send the entries of the transaction, ended by an entry marking the
+// transaction as complete, to the writer goroutine and wait until they're
+// written to the value log and the memtable.
+//
+// If error is nil, the transaction is successfully committed. ErrConflict and errors returned
+// before the entries are sent leave the LSM tree untouched. Once the entries were sent, an error
+// means they may be written partly: they're never read, and are dropped on the next Open. The DB
+// refuses every later commit then, until it's closed and opened again.
+func (txn *Txn) Commit() error {
+	if txn.discarded {
+		return ErrDiscardedTxn
+	}
+	defer txn.Discard()
+
+	if len(txn.pendingWrites) == 0 && len(txn.rangeDeletes) == 0 {
+		return nil // Nothing to do.
+	}
+
+	return txn.commitAndSend()
+}
+
+func (txn *Txn) commitAndSend() error {
+	orc := txn.db.orc
+	// Ensure that the order in which we get the commit timestamp is the same as
+	// the order in which we push these updates to the write channel. So, we
+	// acquire a writeChLock before getting a commit timestamp, and only release
+	// it after pushing the entries to it.
+	orc.writeChLock.Lock()
+	commitTs, err := orc.newCommitTs(txn)
+	if err != nil {
+		orc.writeChLock.Unlock()
+		return err
+	}
+	txn.commitTs = commitTs
+
+	// Write the keys in order, the log entries of a transaction are replayed
+	// as a whole anyway.
+	keys := make([]string, 0, len(txn.pendingWrites))
+	for k := range txn.pendingWrites {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	entries := make([]*entry, 0, len(keys)+len(txn.rangeDeletes)+1)
+	for _, k := range keys {
+		v := txn.pendingWrites[k]
+		v.Meta |= kv.BitTxn
+		entries = append(entries, &entry{key: util.KeyWithTs([]byte(k), commitTs), value: v})
+	}
+	for _, rt := range txn.rangeDeletes {
+		entries = append(entries, &entry{
+			key:   util.KeyWithTs(rt.Start, commitTs),
+			value: kv.Value{Meta: kv.BitRangeDelete | kv.BitTxn, Value: rt.End},
+		})
+	}
+	entries = append(entries, &entry{
+		key:   util.KeyWithTs(txnKey, commitTs),
+		value: kv.Value{Meta: kv.BitFinTxn, Value: []byte(strconv.FormatUint(commitTs, 10))},
+	})
+
+	req, err := txn.db.sendToWriteCh(entries)
+	orc.writeChLock.Unlock()
+	if err != nil {
+		// Nothing was written.
+		orc.doneCommit(commitTs)
+		return err
+	}
+	// Other commits can join the group written with this one while we wait.
+	if err := req.Wait(); err != nil {
+		orc.fail(err)
+		return err
+	}
+	orc.doneCommit(commitTs)
+
+	return nil
+}
+
+// Discard discards a created transaction. This method is very important and must be called. Commit
+// method calls this internally, however, calling this multiple times doesn't cause any issues. So,
+// this can safely be called via a defer right when transaction is created.
+//
+// NOTE: If any operations are run on a discarded transaction, ErrDiscardedTxn is returned.
+func (txn *Txn) Discard() {
+	if txn.discarded { // Avoid a re-run.
+		return
+	}
+	txn.discarded = true
+	txn.db.orc.doneRead(txn)
+}
@@ -0,0 +1,257 @@
+package nyx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crazyfrankie/nyxdb/internal/kv"
+	"github.com/crazyfrankie/nyxdb/internal/util"
+)
+
+func TestTxnSnapshotIsolation(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	defer db.Close()
+
+	require.NoError(t, db.Put([]byte("key"), []byte("v1")))
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+
+	require.NoError(t, db.Put([]byte("key"), []byte("v2")))
+	require.NoError(t, db.Put([]byte("new"), []byte("v")))
+	require.NoError(t, db.Delete([]byte("key")))
+
+	val, err := txn.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(val))
+	_, err = txn.Get([]byte("new"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	require.ErrorIs(t, txn.Set([]byte("key"), nil), ErrReadOnlyTxn)
+
+	_, err = db.Get([]byte("key"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestTxnReadYourWrites(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	defer db.Close()
+	require.NoError(t, db.Put([]byte("a"), []byte("old")))
+
+	txn := db.NewTransaction(true)
+	require.NoError(t, txn.Set([]byte("a"), []byte("new")))
+	require.NoError(t, txn.Set([]byte("b"), []byte("b")))
+	require.NoError(t, txn.Delete([]byte("b")))
+
+	val, err := txn.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, "new", string(val))
+	_, err = txn.Get([]byte("b"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+
+	// Nothing is visible to others before the commit.
+	val, err = db.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, "old", string(val))
+
+	require.NoError(t, txn.Commit())
+	require.Greater(t, txn.CommitTs(), txn.ReadTs())
+	val, err = db.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, "new", string(val))
+
+	_, err = txn.Get([]byte("a"))
+	require.ErrorIs(t, err, ErrDiscardedTxn)
+	require.ErrorIs(t, txn.Commit(), ErrDiscardedTxn)
+}
+
+func TestTxnConflict(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	defer db.Close()
+	require.NoError(t, db.Put([]byte("counter"), []byte("0")))
+
+	txn1 := db.NewTransaction(true)
+	txn2 := db.NewTransaction(true)
+	for _, txn := range []*Txn{txn1, txn2} {
+		_, err := txn.Get([]byte("counter"))
+		require.NoError(t, err)
+		require.NoError(t, txn.Set([]byte("counter"), []byte("1")))
+	}
+	require.NoError(t, txn1.Commit())
+	require.ErrorIs(t, txn2.Commit(), ErrConflict)
+
+	// Blind writes never conflict.
+	txn3 := db.NewTransaction(true)
+	require.NoError(t, db.Put([]byte("counter"), []byte("2")))
+	require.NoError(t, txn3.Set([]byte("counter"), []byte("3")))
+	require.NoError(t, txn3.Commit())
+}
+
+func TestTxnConcurrentIncrements(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	defer db.Close()
+
+	increment := func(txn *Txn) error {
+		var n int
+		val, err := txn.Get([]byte("counter"))
+		if err == nil {
+			_, err = fmt.Sscan(string(val), &n)
+		}
+		if err != nil && err != ErrKeyNotFound {
+			return err
+		}
+		return txn.Set([]byte("counter"), []byte(fmt.Sprint(n+1)))
+	}
+
+	const workers, rounds = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				for {
+					err := db.Update(increment)
+					if err == ErrConflict {
+						continue
+					}
+					require.NoError(t, err)
+					break
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, err := db.Get([]byte("counter"))
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprint(workers*rounds), string(val))
+}
+
+func TestTxnTooBig(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), WithMemTableSize(16<<10))
+	defer db.Close()
+
+	err := db.Update(func(txn *Txn) error {
+		for i := 0; ; i++ {
+			if err := txn.Set([]byte(fmt.Sprintf("key%04d", i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+	})
+	require.ErrorIs(t, err, ErrTxnTooBig)
+}
+
+func TestTxnVersionsSurviveReopen(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	txn := db.NewTransaction(true)
+	require.NoError(t, txn.Set([]byte("key"), []byte("v1")))
+	require.NoError(t, txn.Commit())
+	first := txn.CommitTs()
+	require.NoError(t, db.Close())
+
+	db = openTestDB(t, dir)
+	defer db.Close()
+	txn = db.NewTransaction(true)
+	require.Equal(t, first, txn.ReadTs())
+	require.NoError(t, txn.Set([]byte("key"), []byte("v2")))
+	require.NoError(t, txn.Commit())
+	require.Greater(t, txn.CommitTs(), first)
+
+	val, err := db.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(val))
+}
+
+func TestTxnFailedCommit(t *testing.T) {
+	valueDir := t.TempDir()
+	db := openTestDB(t, t.TempDir(), WithValueDir(valueDir),
+		WithValueThreshold(1<<10), WithValueLogFileSize(1<<20))
+	defer db.Close()
+	require.NoError(t, db.Put([]byte("key"), []byte("old")))
+
+	// The value log can't start a new file once the value fills the current one.
+	require.NoError(t, os.RemoveAll(valueDir))
+	txn := db.NewTransaction(true)
+	require.NoError(t, txn.Set([]byte("key"), []byte("new")))
+	for i := 0; i < 5; i++ {
+		require.NoError(t, txn.Set([]byte(fmt.Sprintf("big%d", i)), bytes.Repeat([]byte("v"), 300<<10)))
+	}
+	require.Error(t, txn.Commit())
+
+	// Reads don't wait for the failed commit, and no commit follows it.
+	val, err := db.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("old"), val)
+	require.ErrorContains(t, db.Put([]byte("other"), []byte("value")), "failed write")
+}
+
+func TestTxnTornCommit(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	require.NoError(t, db.Put([]byte("key"), []byte("old")))
+
+	// The second entry doesn't fit into any memtable, the first one is
+	// written alone.
+	orc := db.orc
+	commitTs, err := orc.newCommitTs(&Txn{readTs: orc.readTs()})
+	require.NoError(t, err)
+	entries := []*entry{
+		{key: util.KeyWithTs([]byte("key"), commitTs), value: kv.Value{Meta: kv.BitTxn, Value: []byte("new")}},
+		{key: util.KeyWithTs([]byte("big"), commitTs), value: kv.Value{Meta: kv.BitTxn, Value: make([]byte, db.arenaSize())}},
+	}
+	db.writeLock.Lock()
+	err = db.writeToMemTable(entries)
+	db.writeLock.Unlock()
+	require.Error(t, err)
+	orc.fail(err)
+
+	// The memtable isn't flushed on close, and the transaction cut short is
+	// dropped from its WAL on the next Open.
+	require.NoError(t, db.Close())
+	db = openTestDB(t, dir)
+	defer db.Close()
+	val, err := db.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("old"), val)
+	require.NoError(t, db.Put([]byte("key"), []byte("newer")))
+}
+
+func TestOracleFail(t *testing.T) {
+	orc := newOracle(10)
+	commit := func() (uint64, error) {
+		return orc.newCommitTs(&Txn{readTs: 10})
+	}
+	done, err := commit()
+	require.NoError(t, err)
+	orc.doneCommit(done)
+	failed, err := commit()
+	require.NoError(t, err)
+	pending, err := commit()
+	require.NoError(t, err)
+
+	readTs := make(chan uint64)
+	go func() { readTs <- orc.readTs() }()
+	select {
+	case <-readTs:
+		t.Fatal("read didn't wait for the pending commits")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The failed commit is never done, the reads stop before it even once the
+	// commits after it are.
+	orc.fail(errors.New("write failed"))
+	require.Equal(t, done, <-readTs)
+	orc.doneCommit(pending)
+	require.Equal(t, done, orc.readTs())
+	require.LessOrEqual(t, orc.discardAtOrBelow(), done)
+	require.Less(t, done, failed)
+	_, err = commit()
+	require.ErrorContains(t, err, "write failed")
+}
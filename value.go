@@ -1,9 +1,574 @@
 package nyx
 
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/crazyfrankie/nyxdb/internal/compress"
+	"github.com/crazyfrankie/nyxdb/internal/kv"
+	"github.com/crazyfrankie/nyxdb/internal/util"
+)
+
 const (
+	VlogFileExt = ".vlog"
+
 	// size of vlog header.
 	// +----------------+------------------+
 	// | keyID(8 bytes) |  baseIV(12 bytes)|
 	// +----------------+------------------+
 	vlogHeaderSize = 20
+
+	// vptrSize is the size of an encoded valuePointer.
+	vptrSize = 12
 )
+
+// valuePointer points to the entry of a value stored in the value log.
+type valuePointer struct {
+	Fid    uint32
+	Len    uint32
+	Offset uint32
+}
+
+// Encode encodes the pointer into a new byte slice.
+func (p valuePointer) Encode() []byte {
+	b := make([]byte, vptrSize)
+	binary.BigEndian.PutUint32(b[0:4], p.Fid)
+	binary.BigEndian.PutUint32(b[4:8], p.Len)
+	binary.BigEndian.PutUint32(b[8:12], p.Offset)
+
+	return b
+}
+
+// Decode decodes the pointer from b, which must be at least vptrSize long.
+func (p *valuePointer) Decode(b []byte) {
+	p.Fid = binary.BigEndian.Uint32(b[0:4])
+	p.Len = binary.BigEndian.Uint32(b[4:8])
+	p.Offset = binary.BigEndian.Uint32(b[8:12])
+}
+
+// valueLog stores the values that are too big to be kept in the LSM tree.
+// Values are appended to the newest file only, older files are read-only.
+// Value log files share the entry format of the WAL, so they are handled by
+// the same type.
+type valueLog struct {
+	dirPath string
+
+	filesLock sync.RWMutex // Guards filesMap, maxFid and filesToBeDeleted.
+	filesMap  map[uint32]*wal
+	maxFid    uint32
+
+	// A file rewritten by GC is deleted only once no reader may still hold
+	// a pointer into it.
+	numActiveReaders atomic.Int32
+	filesToBeDeleted []uint32
+
+	discardStats *discardStats
+	garbageCh    chan struct{} // Allows only one GC at a time.
+
+	opt      *option
+	metrics  *metrics
+	registry *keyRegistry
+
+	// Only used by the writer, which holds DB.writeLock.
+	buf         bytes.Buffer
+	compressBuf []byte
+	valueBuf    []byte
+}
+
+func vlogFilePath(dirPath string, fid uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%06d%s", fid, VlogFileExt))
+}
+
+// open opens all the value log files in ValueDir and finds the end of the
+// newest one, which is where writes continue. The values written are counted
+// in m, new files are encrypted with the latest data key of kr.
+func (vlog *valueLog) open(opt *option, m *metrics, kr *keyRegistry) error {
+	vlog.dirPath = opt.ValueDir
+	vlog.opt = opt
+	vlog.metrics = m
+	vlog.registry = kr
+	vlog.filesMap = make(map[uint32]*wal)
+	vlog.garbageCh = make(chan struct{}, 1)
+
+	var err error
+	if vlog.discardStats, err = initDiscardStats(vlog.dirPath); err != nil {
+		return err
+	}
+
+	fids, err := vlogFids(vlog.dirPath)
+	if err != nil {
+		return err
+	}
+	for _, fid := range fids {
+		lf, err := vlog.openLogFile(fid, os.O_RDWR)
+		if err != nil {
+			vlog.close()
+			return err
+		}
+		vlog.filesMap[fid] = lf
+		vlog.maxFid = fid
+	}
+	if len(fids) == 0 {
+		// The first file is created by the first write that needs it.
+		return nil
+	}
+
+	// Anything after the last valid entry of the newest file was never
+	// referenced from the LSM tree, drop it.
+	last := vlog.filesMap[vlog.maxFid]
+	end, err := last.iterate(func([]byte, kv.Value, valuePointer) error { return nil })
+	if err != nil {
+		vlog.close()
+		return fmt.Errorf("while iterating value log file %d: %w", vlog.maxFid, err)
+	}
+	if err := last.truncate(end); err != nil {
+		vlog.close()
+		return err
+	}
+	if last.sealed {
+		// Writes go on in a new file, with a new base IV.
+		if _, err := vlog.createLogFile(); err != nil {
+			vlog.close()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// vlogFids returns the fids of the value log files in dirPath in ascending order.
+func vlogFids(dirPath string) ([]uint32, error) {
+	files, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open value log dir %q: %w", dirPath, err)
+	}
+	var fids []uint32
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), VlogFileExt) {
+			continue
+		}
+		fsz := len(file.Name())
+		fid, err := strconv.ParseUint(file.Name()[:fsz-len(VlogFileExt)], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse value log file %q: %w", file.Name(), err)
+		}
+		fids = append(fids, uint32(fid))
+	}
+	sort.Slice(fids, func(i, j int) bool { return fids[i] < fids[j] })
+
+	return fids, nil
+}
+
+// openLogFile opens the value log file with the given fid. Files that already
+// exist are mapped at their size, their whole content is readable.
+func (vlog *valueLog) openLogFile(fid uint32, flags int) (*wal, error) {
+	path := vlogFilePath(vlog.dirPath, fid)
+	lf := &wal{
+		path:     path,
+		fid:      fid,
+		writeAt:  vlogHeaderSize,
+		opt:      vlog.opt,
+		registry: vlog.registry,
+	}
+	if err := lf.open(path, flags, 2*int(vlog.opt.ValueLogFileSize)); err != nil {
+		return nil, err
+	}
+
+	return lf, nil
+}
+
+// write appends key and v to the newest value log file and returns a pointer
+// to the entry. The file is rotated once it grows past ValueLogFileSize.
+// Must be called with DB.writeLock held.
+func (vlog *valueLog) write(key []byte, v kv.Value) (valuePointer, error) {
+	vlog.metrics.vlogRawBytes.Add(uint64(len(v.Value)))
+	if vlog.opt.CompressValueLog {
+		v = vlog.compressValue(v)
+	}
+	vlog.metrics.vlogStoredBytes.Add(uint64(len(v.Value)))
+
+	vlog.filesLock.RLock()
+	lf := vlog.filesMap[vlog.maxFid]
+	vlog.filesLock.RUnlock()
+	if lf == nil {
+		var err error
+		if lf, err = vlog.createLogFile(); err != nil {
+			return valuePointer{}, err
+		}
+	}
+
+	offset := lf.writeAt
+	if err := lf.writeEntry(&vlog.buf, key, v); err != nil {
+		return valuePointer{}, fmt.Errorf("while writing to value log file %d: %w", lf.fid, err)
+	}
+	vp := valuePointer{Fid: lf.fid, Len: lf.writeAt - offset, Offset: offset}
+
+	if int64(lf.writeAt) > vlog.opt.ValueLogFileSize {
+		// Seal the full file, the next write starts a new one.
+		if err := lf.sync(); err != nil {
+			return valuePointer{}, fmt.Errorf("while syncing value log file %d: %w", lf.fid, err)
+		}
+		if _, err := vlog.createLogFile(); err != nil {
+			return valuePointer{}, err
+		}
+	}
+
+	return vp, nil
+}
+
+// compressValue returns v with its value compressed and BitCompressed set, or
+// v as is if compression doesn't make it smaller. The returned value is only
+// valid until the next call.
+func (vlog *valueLog) compressValue(v kv.Value) kv.Value {
+	typ := vlog.opt.Compression
+	if typ == compress.None {
+		return v
+	}
+	var err error
+	vlog.compressBuf, err = compress.Encode(typ, vlog.compressBuf, v.Value)
+	if err != nil || len(vlog.compressBuf)+1 >= len(v.Value) {
+		return v
+	}
+	vlog.valueBuf = append(append(vlog.valueBuf[:0], byte(typ)), vlog.compressBuf...)
+	v.Meta |= kv.BitCompressed
+	v.Value = vlog.valueBuf
+	return v
+}
+
+// decodeValue returns a copy of the value of a value log entry, decompressed
+// if it was compressed.
+func decodeValue(v kv.Value) ([]byte, error) {
+	if v.Meta&kv.BitCompressed == 0 {
+		return append([]byte{}, v.Value...), nil
+	}
+	if len(v.Value) == 0 {
+		return nil, errors.New("compressed value without compression type")
+	}
+	typ := compress.Type(v.Value[0])
+	val, err := compress.Decode(typ, nil, v.Value[1:])
+	if err != nil {
+		return nil, fmt.Errorf("while decompressing %s value: %w", typ, err)
+	}
+	return val, nil
+}
+
+// createLogFile creates the file following the newest one and makes it the
+// one written to.
+func (vlog *valueLog) createLogFile() (*wal, error) {
+	lf, err := vlog.openLogFile(vlog.maxFid+1, os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		return nil, err
+	}
+
+	vlog.filesLock.Lock()
+	defer vlog.filesLock.Unlock()
+	vlog.filesMap[lf.fid] = lf
+	vlog.maxFid = lf.fid
+
+	return lf, nil
+}
+
+// read returns a copy of the value vp points to, decrypted and decompressed if needed.
+func (vlog *valueLog) read(vp valuePointer) ([]byte, error) {
+	vlog.filesLock.RLock()
+	defer vlog.filesLock.RUnlock()
+
+	lf, ok := vlog.filesMap[vp.Fid]
+	if !ok {
+		return nil, fmt.Errorf("value log file %d not found", vp.Fid)
+	}
+
+	lf.mu.RLock()
+	defer lf.mu.RUnlock()
+
+	end := uint64(vp.Offset) + uint64(vp.Len)
+	if end > uint64(len(lf.mmapFile.Data)) {
+		return nil, fmt.Errorf("invalid value pointer, offset %d len %d beyond the end of value log file %d",
+			vp.Offset, vp.Len, vp.Fid)
+	}
+	key, v, _, err := decodeEntry(lf.mmapFile.Data[vp.Offset:end])
+	if err != nil {
+		if errors.Is(err, errTruncate) {
+			return nil, fmt.Errorf("corrupt entry at offset %d in value log file %d", vp.Offset, vp.Fid)
+		}
+		return nil, err
+	}
+	if _, v, err = lf.decrypt(key, v, vp.Offset); err != nil {
+		return nil, fmt.Errorf("entry at offset %d in value log file %d: %w", vp.Offset, vp.Fid, err)
+	}
+
+	val, err := decodeValue(v)
+	if err != nil {
+		return nil, fmt.Errorf("entry at offset %d in value log file %d: %w", vp.Offset, vp.Fid, err)
+	}
+
+	return val, nil
+}
+
+// close closes all the value log files, truncating each to its written size.
+func (vlog *valueLog) close() error {
+	vlog.filesLock.Lock()
+	defer vlog.filesLock.Unlock()
+
+	var errs []error
+	for fid, lf := range vlog.filesMap {
+		errs = append(errs, lf.close())
+		delete(vlog.filesMap, fid)
+	}
+	if vlog.discardStats != nil {
+		errs = append(errs, vlog.discardStats.close())
+		vlog.discardStats = nil
+	}
+
+	return errors.Join(errs...)
+}
+
+// sync msyncs the file values are currently written to.
+func (vlog *valueLog) sync() error {
+	vlog.filesLock.RLock()
+	lf := vlog.filesMap[vlog.maxFid]
+	vlog.filesLock.RUnlock()
+	if lf == nil {
+		return nil
+	}
+
+	return lf.sync()
+}
+
+// incrReaders registers a reader that may dereference value pointers.
+func (vlog *valueLog) incrReaders() {
+	vlog.numActiveReaders.Add(1)
+}
+
+// decrReaders unregisters a reader. The last one out deletes the files that
+// were waiting for it.
+func (vlog *valueLog) decrReaders() {
+	if vlog.numActiveReaders.Add(-1) != 0 {
+		return
+	}
+
+	vlog.filesLock.Lock()
+	defer vlog.filesLock.Unlock()
+	if vlog.numActiveReaders.Load() != 0 {
+		return
+	}
+	for _, fid := range vlog.filesToBeDeleted {
+		if err := vlog.deleteLogFile(fid); err != nil {
+			log.Printf("error deleting value log file %d: %v", fid, err)
+		}
+	}
+	vlog.filesToBeDeleted = nil
+}
+
+// removeLogFile deletes the file with fid right away if there are no readers,
+// otherwise the last reader deletes it.
+func (vlog *valueLog) removeLogFile(fid uint32) error {
+	vlog.filesLock.Lock()
+	defer vlog.filesLock.Unlock()
+
+	if vlog.numActiveReaders.Load() == 0 {
+		return vlog.deleteLogFile(fid)
+	}
+	vlog.filesToBeDeleted = append(vlog.filesToBeDeleted, fid)
+
+	return nil
+}
+
+// deleteLogFile deletes the file with fid and its discard stats.
+// Must be called with filesLock held.
+func (vlog *valueLog) deleteLogFile(fid uint32) error {
+	lf, ok := vlog.filesMap[fid]
+	if !ok {
+		return nil
+	}
+	delete(vlog.filesMap, fid)
+	vlog.discardStats.Update(fid, -1)
+
+	return lf.delete()
+}
+
+// updateDiscardStats adds the bytes dropped from the files in stats.
+// Files that no longer exist are ignored.
+func (vlog *valueLog) updateDiscardStats(stats map[uint32]int64) {
+	vlog.filesLock.RLock()
+	defer vlog.filesLock.RUnlock()
+
+	for fid, discard := range stats {
+		if _, ok := vlog.filesMap[fid]; ok {
+			vlog.discardStats.Update(fid, discard)
+		}
+	}
+}
+
+// pickLog returns the sealed file with the most discard bytes, if at least
+// discardRatio of it can be discarded.
+func (vlog *valueLog) pickLog(discardRatio float64) *wal {
+	vlog.filesLock.RLock()
+	defer vlog.filesLock.RUnlock()
+
+	fid, discard := vlog.discardStats.MaxDiscard(func(fid uint32) bool {
+		// The file being written to can't be rewritten, nor can those
+		// already waiting for deletion.
+		if _, ok := vlog.filesMap[fid]; !ok || fid >= vlog.maxFid {
+			return false
+		}
+		for _, d := range vlog.filesToBeDeleted {
+			if d == fid {
+				return false
+			}
+		}
+		return true
+	})
+	if fid == 0 {
+		return nil
+	}
+	lf := vlog.filesMap[fid]
+	if float64(discard) < discardRatio*float64(lf.writeAt) {
+		return nil
+	}
+
+	return lf
+}
+
+// RunValueLogGC triggers a value log garbage collection.
+//
+// It picks the value log file with the most discardable data, as counted by
+// compactions, and rewrites its live entries into the newest file, after
+// which the old file is deleted. A file is only picked if at least
+// discardRatio of it can be discarded. One call rewrites at most one file,
+// it can be called again as long as it returns nil.
+//
+// It returns ErrNoRewrite if no file was rewritten, and ErrRejected if
+// another GC is already running.
+func (d *DB) RunValueLogGC(discardRatio float64) error {
+	if discardRatio >= 1.0 || discardRatio <= 0.0 {
+		return ErrInvalidRequest
+	}
+	if d.isClosed.Load() {
+		return ErrDBClosed
+	}
+
+	select {
+	case d.vlog.garbageCh <- struct{}{}:
+	default:
+		return ErrRejected
+	}
+	defer func() {
+		<-d.vlog.garbageCh
+	}()
+
+	lf := d.vlog.pickLog(discardRatio)
+	if lf == nil {
+		return ErrNoRewrite
+	}
+
+	return d.rewrite(lf)
+}
+
+// rewrite moves the entries of lf that are still referenced by the LSM tree to
+// the newest value log file and deletes lf.
+func (d *DB) rewrite(lf *wal) error {
+	_, err := lf.iterate(func(key []byte, v kv.Value, vp valuePointer) error {
+		if d.isClosed.Load() {
+			return ErrDBClosed
+		}
+		d.writeLock.Lock()
+		defer d.writeLock.Unlock()
+
+		// The entry is live if its version is still kept and points at it.
+		vs, ok, err := d.keptVersion(key)
+		if err != nil {
+			return err
+		}
+		if !ok || vs.Meta&kv.BitValuePointer == 0 {
+			// Deleted, or overwritten by a value stored in the LSM tree.
+			return nil
+		}
+		var cur valuePointer
+		cur.Decode(vs.Value)
+		if cur != vp {
+			// Overwritten by a value stored elsewhere in the value log.
+			return nil
+		}
+		if vs.IsExpired() {
+			// Nobody can read it anymore.
+			return nil
+		}
+
+		// The value is written again under the current compression settings,
+		// as an entry of its own: the transaction it was committed in is over.
+		val, err := decodeValue(v)
+		if err != nil {
+			return err
+		}
+		v.Meta &^= kv.BitCompressed | kv.BitTxn | kv.BitFinTxn
+		v.Value = val
+		req := &request{entries: []*entry{{key: key, value: v}}}
+		d.writeRequestsLocked([]*request{req})
+		return req.Err
+	})
+	if err != nil {
+		return fmt.Errorf("while rewriting value log file %d: %w", lf.fid, err)
+	}
+
+	// The moved entries must be durable before the old copies go away. The
+	// memtables rotated meanwhile hold some of them too, those flushed already
+	// have them in level 0 tables.
+	d.writeLock.Lock()
+	mts, decr := d.getMemTables()
+	err = d.vlog.sync()
+	for _, mt := range mts {
+		err = errors.Join(err, mt.SyncWAL())
+	}
+	decr()
+	d.writeLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return d.vlog.removeLogFile(lf.fid)
+}
+
+// keptVersion returns the version of the user key in key. Versions above the
+// discard timestamp are kept, a running transaction may still read them.
+// Below it, walking down from the newest version, it isn't found if a range
+// tombstone covers it, or a tombstone, an expired version or
+// NumVersionsToKeep versions lie above it: compaction discards it then, and
+// writing it again would put it back above them.
+func (d *DB) keptVersion(key []byte) (kv.Value, bool, error) {
+	userKey, version := util.ParseKey(key), util.ParseTs(key)
+	discardTs := d.orc.discardAtOrBelow()
+	if version > discardTs {
+		vs, err := d.get(key)
+		return vs, err == nil && vs.Version == version, err
+	}
+	if version < d.deletedBelow(userKey, discardTs) {
+		return kv.Value{}, false, nil
+	}
+	ts := discardTs
+	for n := 0; n < d.opt.NumVersionsToKeep; n++ {
+		vs, err := d.get(util.KeyWithTs(userKey, ts))
+		if err != nil {
+			return kv.Value{}, false, err
+		}
+		if vs.Version == version {
+			return vs, true, nil
+		}
+		if vs.Version < version || vs.IsDeletedOrExpired() {
+			return kv.Value{}, false, nil
+		}
+		ts = vs.Version - 1
+	}
+
+	return kv.Value{}, false, nil
+}
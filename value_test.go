@@ -0,0 +1,403 @@
+package nyx
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValuePointerEncodeDecode(t *testing.T) {
+	vp := valuePointer{Fid: 3, Len: 1 << 20, Offset: 12345}
+	var got valuePointer
+	got.Decode(vp.Encode())
+	require.Equal(t, vp, got)
+}
+
+func TestValueLogReadWrite(t *testing.T) {
+	dir := t.TempDir()
+	valueDir := filepath.Join(dir, "vlog")
+	opts := []Option{WithValueDir(valueDir), WithValueThreshold(64)}
+	db := openTestDB(t, dir, opts...)
+
+	const n = 200
+	value := func(i int) []byte {
+		if i%2 == 0 {
+			return []byte(fmt.Sprintf("small%03d", i))
+		}
+		return bytes.Repeat([]byte{byte(i)}, 1<<10)
+	}
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%03d", i)), value(i)))
+	}
+	require.NoError(t, db.Delete([]byte("key001")))
+
+	check := func() {
+		for i := 0; i < n; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+			if i == 1 {
+				require.ErrorIs(t, err, ErrKeyNotFound)
+				continue
+			}
+			require.NoError(t, err)
+			require.Equal(t, value(i), val)
+		}
+	}
+	check()
+
+	// Only the big values went to the value log.
+	fi, err := os.Stat(vlogFilePath(valueDir, 1))
+	require.NoError(t, err)
+	require.NotZero(t, fi.Size())
+	require.NoError(t, db.Close())
+	fi, err = os.Stat(vlogFilePath(valueDir, 1))
+	require.NoError(t, err)
+	require.Greater(t, fi.Size(), int64(n/2<<10))
+	require.Less(t, fi.Size(), int64(n/2*(1<<10+64)))
+
+	// The pointers now live in a level 0 table.
+	db = openTestDB(t, dir, opts...)
+	check()
+	require.NoError(t, db.Put([]byte("key999"), value(999)))
+	require.NoError(t, db.Close())
+
+	db = openTestDB(t, dir, opts...)
+	defer db.Close()
+	check()
+	val, err := db.Get([]byte("key999"))
+	require.NoError(t, err)
+	require.Equal(t, value(999), val)
+}
+
+func TestValueLogRotate(t *testing.T) {
+	dir := t.TempDir()
+	opts := []Option{WithValueThreshold(1 << 10), WithValueLogFileSize(1 << 20)}
+	db := openTestDB(t, dir, opts...)
+
+	const n = 40
+	value := func(i int) []byte {
+		return bytes.Repeat([]byte{byte(i)}, 64<<10)
+	}
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%02d", i)), value(i)))
+	}
+	check := func() {
+		for i := 0; i < n; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key%02d", i)))
+			require.NoError(t, err)
+			require.Equal(t, value(i), val)
+		}
+	}
+	check()
+	require.Equal(t, uint32(3), db.vlog.maxFid)
+	require.NoError(t, db.Close())
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+VlogFileExt))
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+
+	db = openTestDB(t, dir, opts...)
+	defer db.Close()
+	check()
+	require.Equal(t, uint32(3), db.vlog.maxFid)
+}
+
+func TestValueLogTruncatesTornTail(t *testing.T) {
+	dir := t.TempDir()
+	opts := []Option{WithValueThreshold(64)}
+	db := openTestDB(t, dir, opts...)
+	require.NoError(t, db.Put([]byte("key"), bytes.Repeat([]byte("v"), 128)))
+	end := db.vlog.filesMap[1].writeAt
+	require.NoError(t, db.Close())
+
+	// Append garbage that looks like the start of an entry.
+	path := vlogFilePath(dir, 1)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 3, 200, 1, 'k'})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	db = openTestDB(t, dir, opts...)
+	defer db.Close()
+	require.Equal(t, end, db.vlog.filesMap[1].writeAt)
+	val, err := db.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, bytes.Repeat([]byte("v"), 128), val)
+}
+
+func TestEncryptedValueLogTornTail(t *testing.T) {
+	dir := t.TempDir()
+	opts := []Option{WithValueThreshold(64), WithEncryptionKey(bytes.Repeat([]byte("k"), 32))}
+	db := openTestDB(t, dir, opts...)
+	require.NoError(t, db.Put([]byte("key"), bytes.Repeat([]byte("v"), 128)))
+	require.NoError(t, db.Close())
+
+	// A cleanly closed file is written on.
+	db = openTestDB(t, dir, opts...)
+	require.Equal(t, uint32(1), db.vlog.maxFid)
+	require.NoError(t, db.Close())
+
+	path := vlogFilePath(dir, 1)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 3, 200, 1, 'k'})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// The offsets of the garbage aren't encrypted again, writes go on in a
+	// new file.
+	db = openTestDB(t, dir, opts...)
+	require.Equal(t, uint32(2), db.vlog.maxFid)
+	require.True(t, db.vlog.filesMap[1].sealed)
+	require.NoError(t, db.Put([]byte("other"), bytes.Repeat([]byte("o"), 128)))
+	require.NoError(t, db.Close())
+
+	db = openTestDB(t, dir, opts...)
+	defer db.Close()
+	val, err := db.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, bytes.Repeat([]byte("v"), 128), val)
+	val, err = db.Get([]byte("other"))
+	require.NoError(t, err)
+	require.Equal(t, bytes.Repeat([]byte("o"), 128), val)
+}
+
+func TestDiscardStats(t *testing.T) {
+	dir := t.TempDir()
+	ds, err := initDiscardStats(dir)
+	require.NoError(t, err)
+
+	require.Equal(t, int64(100), ds.Update(3, 100))
+	require.Equal(t, int64(50), ds.Update(1, 50))
+	require.Equal(t, int64(120), ds.Update(3, 20))
+	require.Equal(t, int64(120), ds.Update(3, 0))
+	require.Equal(t, int64(0), ds.Update(2, 0))
+
+	all := func(uint32) bool { return true }
+	fid, discard := ds.MaxDiscard(all)
+	require.Equal(t, uint32(3), fid)
+	require.Equal(t, int64(120), discard)
+	fid, discard = ds.MaxDiscard(func(fid uint32) bool { return fid != 3 })
+	require.Equal(t, uint32(1), fid)
+	require.Equal(t, int64(50), discard)
+
+	require.Equal(t, int64(0), ds.Update(1, -1))
+	require.NoError(t, ds.close())
+
+	ds, err = initDiscardStats(dir)
+	require.NoError(t, err)
+	defer ds.close()
+	require.Equal(t, int64(120), ds.Update(3, 0))
+	require.Equal(t, int64(0), ds.Update(1, 0))
+}
+
+func TestValueLogGC(t *testing.T) {
+	dir := t.TempDir()
+	opts := []Option{
+		WithValueThreshold(1 << 10),
+		WithValueLogFileSize(1 << 20),
+		WithNumLevelZeroTables(2),
+	}
+	db := openTestDB(t, dir, opts...)
+	require.ErrorIs(t, db.RunValueLogGC(1), ErrInvalidRequest)
+
+	const n = 40
+	value := func(i, round int) []byte {
+		return bytes.Repeat([]byte{byte(i), byte(round)}, 32<<10)
+	}
+	latest := make([]int, n)
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%02d", i)), value(i, 0)))
+	}
+	require.ErrorIs(t, db.RunValueLogGC(0.5), ErrNoRewrite)
+	require.NoError(t, db.Close())
+
+	// Overwrite most of the values in the first file, the old pointers are
+	// dropped once both level 0 tables are compacted together.
+	db = openTestDB(t, dir, opts...)
+	for i := 0; i < 12; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%02d", i)), value(i, 1)))
+		latest[i] = 1
+	}
+	require.NoError(t, db.Close())
+
+	db = openTestDB(t, dir, opts...)
+	waitForCompaction(t, db)
+	require.Eventually(t, func() bool {
+		return db.vlog.discardStats.Update(1, 0) >= 12<<16
+	}, 10*time.Second, 10*time.Millisecond)
+
+	check := func(db *DB) {
+		for i := 0; i < n; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key%02d", i)))
+			require.NoError(t, err)
+			require.Equal(t, value(i, latest[i]), val)
+		}
+	}
+	require.NoError(t, db.RunValueLogGC(0.5))
+	require.NoFileExists(t, vlogFilePath(dir, 1))
+	check(db)
+	require.ErrorIs(t, db.RunValueLogGC(0.5), ErrNoRewrite)
+
+	// The moved entries are replayed from the WAL after a crash, along with
+	// the writes that follow them.
+	require.NoError(t, db.Put([]byte("after"), []byte("gc")))
+	crashed := copyDir(t, dir)
+	require.NoError(t, db.Close())
+	for _, dir := range []string{crashed, dir} {
+		db = openTestDB(t, dir, opts...)
+		check(db)
+		val, err := db.Get([]byte("after"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("gc"), val)
+		require.NoError(t, db.Close())
+	}
+}
+
+func TestValueLogGCKeepsDeletes(t *testing.T) {
+	deletes := map[string]func(db *DB) error{
+		"Delete":      func(db *DB) error { return db.Delete([]byte("k")) },
+		"DeleteRange": func(db *DB) error { return db.DeleteRange([]byte("j"), []byte("l")) },
+	}
+	for name, del := range deletes {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := []Option{WithValueThreshold(1 << 10), WithValueLogFileSize(1 << 20)}
+			db := openTestDB(t, dir, opts...)
+			require.NoError(t, db.Put([]byte("k"), bytes.Repeat([]byte("v"), 2<<10)))
+			// Fill the first file, so the next one takes the moved entries.
+			for i := 0; i < 17; i++ {
+				require.NoError(t, db.Put([]byte(fmt.Sprintf("other%02d", i)), bytes.Repeat([]byte{byte(i)}, 64<<10)))
+			}
+			require.NoError(t, db.Close())
+
+			// The value of k goes to level 2, its deletion to level 1.
+			db = openTestDB(t, dir, opts...)
+			require.NoError(t, db.lc.doCompact(0, compactionPriority{level: 0}))
+			require.NoError(t, db.lc.doCompact(0, compactionPriority{level: 1}))
+			require.NoError(t, del(db))
+			require.NoError(t, db.Close())
+
+			db = openTestDB(t, dir, opts...)
+			defer db.Close()
+			require.NoError(t, db.lc.doCompact(0, compactionPriority{level: 0}))
+			require.NotEmpty(t, levelLayout(db)[1])
+			require.NotEmpty(t, levelLayout(db)[2])
+			require.Greater(t, db.vlog.maxFid, uint32(1))
+
+			// The deleted value isn't moved above the deletion, which is
+			// dropped along with it on the next compaction.
+			require.NoError(t, db.rewrite(db.vlog.filesMap[1]))
+			require.NoError(t, db.lc.doCompact(0, compactionPriority{level: 1}))
+			_, err := db.Get([]byte("k"))
+			require.ErrorIs(t, err, ErrKeyNotFound)
+		})
+	}
+}
+
+func TestValueLogGCKeepsSnapshotVersions(t *testing.T) {
+	opts := []Option{WithValueThreshold(1 << 10), WithValueLogFileSize(1 << 20)}
+	db := openTestDB(t, t.TempDir(), opts...)
+	defer db.Close()
+
+	old := bytes.Repeat([]byte("v"), 2<<10)
+	require.NoError(t, db.Put([]byte("k"), old))
+	// Fill the first file, so the next one takes the moved entries.
+	for i := 0; i < 17; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("other%02d", i)), bytes.Repeat([]byte{byte(i)}, 64<<10)))
+	}
+	require.Greater(t, db.vlog.maxFid, uint32(1))
+
+	snap, err := db.Snapshot()
+	require.NoError(t, err)
+	defer snap.Release()
+	require.NoError(t, db.Put([]byte("k"), bytes.Repeat([]byte("w"), 2<<10)))
+
+	// The snapshot still reads the overwritten value, so it's moved as well.
+	require.NoError(t, db.rewrite(db.vlog.filesMap[1]))
+	val, err := snap.Get([]byte("k"))
+	require.NoError(t, err)
+	require.Equal(t, old, val)
+}
+
+// copyDir copies the files in dir to a new directory, as they would be found
+// after a crash of the DB writing to them.
+func copyDir(t *testing.T, dir string) string {
+	t.Helper()
+	dst := t.TempDir()
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		if e.IsDir() || e.Name() == lockFile {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dst, e.Name()), data, 0600))
+	}
+	return dst
+}
+
+func TestValueLogGCDropsExpired(t *testing.T) {
+	dir := t.TempDir()
+	opts := []Option{
+		WithValueThreshold(1 << 10),
+		WithValueLogFileSize(1 << 20),
+		WithNumLevelZeroTables(2),
+	}
+	db := openTestDB(t, dir, opts...)
+
+	const n = 40
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%02d", i)) }
+	value := func(i int) []byte { return bytes.Repeat([]byte{byte(i)}, 32<<10) }
+	for i := 0; i < n; i++ {
+		if i < 20 {
+			require.NoError(t, db.SetWithTTL(key(i), value(i), -time.Second))
+			continue
+		}
+		require.NoError(t, db.Put(key(i), value(i)))
+	}
+	require.NoError(t, db.Close())
+
+	// A second level 0 table gets both compacted together, which drops the
+	// expired pointers.
+	db = openTestDB(t, dir, opts...)
+	require.NoError(t, db.Put([]byte("other"), []byte("value")))
+	require.NoError(t, db.Close())
+
+	db = openTestDB(t, dir, opts...)
+	defer db.Close()
+	waitForCompaction(t, db)
+	require.Eventually(t, func() bool {
+		return db.vlog.discardStats.Update(1, 0) >= 20<<15
+	}, 10*time.Second, 10*time.Millisecond)
+
+	head := db.vlog.maxFid
+	headSize := db.vlog.filesMap[head].writeAt
+	require.NoError(t, db.RunValueLogGC(0.3))
+	require.NoFileExists(t, vlogFilePath(dir, 1))
+	for i := 0; i < n; i++ {
+		val, err := db.Get(key(i))
+		if i < 20 {
+			require.ErrorIs(t, err, ErrKeyNotFound)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, value(i), val)
+	}
+
+	// Only the live values of the first file were moved, which are less than
+	// the expired ones.
+	var moved int64
+	for fid := head; fid <= db.vlog.maxFid; fid++ {
+		moved += int64(db.vlog.filesMap[fid].writeAt)
+	}
+	moved -= int64(headSize)
+	require.Positive(t, moved)
+	require.Less(t, moved, int64(20<<15))
+}